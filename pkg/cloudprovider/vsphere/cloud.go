@@ -17,11 +17,14 @@ limitations under the License.
 package vsphere
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 
 	v1 "k8s.io/api/core/v1"
 	klog "k8s.io/klog/v2"
@@ -146,6 +149,8 @@ func (vs *VSphere) Initialize(clientBuilder cloudprovider.ControllerClientBuilde
 
 		// if running secrets, init them
 		connMgr.InitializeSecretLister()
+
+		go refreshCredentialsOnSignal(connMgr)
 	} else {
 		klog.Errorf("Kubernetes Client Init Failed: %v", err)
 	}
@@ -162,6 +167,19 @@ func (vs *VSphere) Initialize(clientBuilder cloudprovider.ControllerClientBuilde
 	}
 }
 
+// refreshCredentialsOnSignal refreshes the credentials of connMgr on SIGHUP, for operators
+// who rotated a Secret out-of-band to have it picked up without waiting for the informer.
+func refreshCredentialsOnSignal(connMgr *cm.ConnectionManager) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		klog.Info("Received SIGHUP, refreshing vCenter credentials")
+		if err := connMgr.RefreshCredentials(context.Background()); err != nil {
+			klog.Errorf("Failed to refresh vCenter credentials: %v", err)
+		}
+	}
+}
+
 func (vs *VSphere) isLoadBalancerSupportEnabled() bool {
 	return vs.loadbalancer != nil
 }
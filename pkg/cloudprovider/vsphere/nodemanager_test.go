@@ -21,6 +21,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -158,7 +159,7 @@ func TestDiscoverNodeByNameWithNamesClash(t *testing.T) {
 		t.Errorf("MiltipleVMFound error expected")
 	}
 
-	if err != vclib.ErrMultipleVMsFound {
+	if !errors.Is(err, vclib.ErrMultipleVMsFound) {
 		t.Errorf("ErrMultipleVMsFound expected, another error occured: %s", err)
 	}
 }
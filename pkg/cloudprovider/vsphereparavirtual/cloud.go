@@ -21,8 +21,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/yaml"
 
@@ -63,6 +67,30 @@ var (
 
 	// podIPPoolType specifies if Pod IP addresses are public or private.
 	podIPPoolType string
+
+	// annotateLBProvider if set to true, Services of type LoadBalancer are annotated with their load balancer provider.
+	annotateLBProvider bool
+
+	// loadBalancerClass is the spec.loadBalancerClass of Services handled besides those without a class.
+	loadBalancerClass string
+
+	// vmServiceNameSuffixLen is the maximum length of the hash suffix of VirtualMachineService names.
+	vmServiceNameSuffixLen int
+
+	// vmServiceNameMaxLen is the maximum length of VirtualMachineService names.
+	vmServiceNameMaxLen int
+
+	// vmServiceAllowedNamespaces is a comma separated list of the namespaces Services may place their VirtualMachineService in.
+	vmServiceAllowedNamespaces string
+
+	// vmServiceAllowedProviders is a comma separated list of the load balancer providers Services may request.
+	vmServiceAllowedProviders string
+
+	// vmServiceCallTimeout is the timeout of each VirtualMachineService request to the supervisor cluster.
+	vmServiceCallTimeout time.Duration
+
+	// selectorMigrationMode if set to true, the worker vm selector of existing VirtualMachineServices is left unchanged.
+	selectorMigrationMode bool
 )
 
 func init() {
@@ -88,7 +116,15 @@ func init() {
 	})
 
 	flag.BoolVar(&vmservice.IsLegacy, "is-legacy-paravirtual", false, "If true, machine label selector will start with capw.vmware.com. By default, it's false, machine label selector will start with capv.vmware.com.")
+	flag.BoolVar(&selectorMigrationMode, "paravirtual-selector-migration-mode", false, "If true, the machine label selector of existing VirtualMachineServices is left unchanged, so that worker VMs still labeled with capw.vmware.com or capv.vmware.com keep receiving traffic while they are migrated. New VirtualMachineServices use the labels chosen by is-legacy-paravirtual.")
 	flag.BoolVar(&vpcModeEnabled, "enable-vpc-mode", false, "If true, routable pod controller will start with VPC mode. It is useful only when route controller is enabled in vsphereparavirtual mode")
+	flag.BoolVar(&annotateLBProvider, "annotate-lb-provider", false, "If true, Services of type LoadBalancer are annotated with the load balancer provider reported by the supervisor cluster.")
+	flag.StringVar(&loadBalancerClass, "load-balancer-class", "", "Services of type LoadBalancer with this spec.loadBalancerClass are handled besides those without a class. Services of other classes are left to other load balancer controllers.")
+	flag.IntVar(&vmServiceNameSuffixLen, "vm-service-name-suffix-length", vmservice.MaxCheckSumLen, "Maximum length of the hash suffix of VirtualMachineService names. A longer suffix lowers the chance of name collisions.")
+	flag.IntVar(&vmServiceNameMaxLen, "vm-service-name-max-length", vmservice.MaxVMServiceNameLen, "Maximum length of VirtualMachineService names, the cluster name and the hash suffix included.")
+	flag.StringVar(&vmServiceAllowedNamespaces, "vm-service-allowed-namespaces", "", "Comma separated list of supervisor namespaces Services may place their VirtualMachineService in with the "+vmservice.AnnotationVMServiceNamespaceKey+" annotation.")
+	flag.StringVar(&vmServiceAllowedProviders, "vm-service-allowed-providers", "", "Comma separated list of load balancer providers Services may request with the "+vmservice.AnnotationVMServiceProviderKey+" annotation.")
+	flag.DurationVar(&vmServiceCallTimeout, "vm-service-call-timeout", vmservice.DefaultCallTimeout, "Timeout of each VirtualMachineService request to the supervisor cluster, 0 to disable.")
 	flag.StringVar(&podIPPoolType, "pod-ip-pool-type", "", "Specify if Pod IP address is Public or Private routable in VPC network. Valid values are Public and Private")
 }
 
@@ -142,7 +178,23 @@ func (cp *VSphereParavirtual) Initialize(clientBuilder cloudprovider.ControllerC
 
 	cp.informMgr.AddNodeListener(cp.nodeAdded, cp.nodeDeleted, nil)
 
-	lb, err := NewLoadBalancer(clusterNS, kcfg, cp.ownerReference)
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	lb, err := NewLoadBalancer(clusterNS, kcfg, cp.ownerReference, LoadBalancerOptions{
+		VMService: vmservice.Options{
+			LoadBalancerClass: loadBalancerClass,
+			NameSuffixLen:     vmServiceNameSuffixLen,
+			MaxNameLen:        vmServiceNameMaxLen,
+			AllowedNamespaces: splitList(vmServiceAllowedNamespaces),
+			AllowedProviders:  splitList(vmServiceAllowedProviders),
+			CallTimeout:       vmServiceCallTimeout,
+			IsLegacy:          vmservice.IsLegacy,
+			MigrationMode:     selectorMigrationMode,
+		},
+		ServiceClient:      client,
+		AnnotateLBProvider: annotateLBProvider,
+		Recorder:           eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: clientName}),
+	})
 	if err != nil {
 		klog.Errorf("Failed to init LoadBalancer: %v", err)
 	}
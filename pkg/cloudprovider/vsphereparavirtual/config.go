@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -158,3 +159,14 @@ func checkPodIPPoolType(vpcModeEnabled bool, podIPPoolType string) error {
 	}
 	return nil
 }
+
+// splitList splits a comma separated list, such as namespaces or providers, dropping empty entries
+func splitList(list string) []string {
+	var result []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
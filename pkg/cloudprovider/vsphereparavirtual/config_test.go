@@ -323,6 +323,29 @@ func TestCheckPodIPPoolType(t *testing.T) {
 	}
 }
 
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces string
+		expected   []string
+	}{
+		{
+			name:       "empty list",
+			namespaces: "",
+			expected:   nil,
+		},
+		{
+			name:       "list with spaces and empty entries",
+			namespaces: "tenant-a, tenant-b,,",
+			expected:   []string{"tenant-a", "tenant-b"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, splitList(test.namespaces), test.name)
+	}
+}
+
 func createTestFile(dir, filename, content string) error {
 	tmpFile, err := os.Create(dir + "/" + filename)
 	if err != nil {
@@ -18,13 +18,20 @@ package vsphereparavirtual
 
 import (
 	"context"
+	"encoding/json"
+	"strings"
+	"time"
 
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/cloud-provider/api"
 	"k8s.io/klog/v2"
 
 	"github.com/pkg/errors"
@@ -33,13 +40,60 @@ import (
 	"k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmservice"
 )
 
+// AnnotationLoadBalancerProviderKey is set on Services of type LoadBalancer to the name of the
+// load balancer provider reported by the supervisor cluster, when enabled with --annotate-lb-provider
+const AnnotationLoadBalancerProviderKey = "vsphere-paravirtual.cloudprovider.vsphere.k8s.io/load-balancer-provider"
+
+// AnnotationVMServiceKey is set on Services of type LoadBalancer to the <namespace>/<name> of their
+// VirtualMachineService, so that it is deleted even when its name can no longer be computed
+const AnnotationVMServiceKey = "vsphere-paravirtual.cloudprovider.vsphere.k8s.io/vm-service"
+
+// EventReasonSessionAffinityUnsupported is the reason of the warning event recorded on Services
+// whose session affinity cannot be applied to their VirtualMachineService
+const EventReasonSessionAffinityUnsupported = "SessionAffinityUnsupported"
+
+// nodePortPendingRetryDelay is how long to wait before reconciling a Service with node ports
+// pending allocation again
+const nodePortPendingRetryDelay = 5 * time.Second
+
+// EventReasonNoPortsDefined is the reason of the warning event recorded on Services of type
+// LoadBalancer without ports, for which no VirtualMachineService is created
+const EventReasonNoPortsDefined = "NoPortsDefined"
+
+// EventReasonInvalidAnnotation is the reason of the warning event recorded on Services of type
+// LoadBalancer with an annotation rejected by the annotation validator, which are not reconciled
+const EventReasonInvalidAnnotation = "InvalidAnnotation"
+
+// EventReasonVMServiceFailed is the reason of the warning event recorded on Services of type
+// LoadBalancer whose VirtualMachineService was rejected by the load balancer provider
+const EventReasonVMServiceFailed = "VirtualMachineServiceFailed"
+
 // loadBalancer implements cloudprovider.LoadBalancer interface
 type loadBalancer struct {
 	vmService vmservice.VMService
+	// serviceClient, when set, is used to annotate Services with their VirtualMachineService
+	serviceClient clientset.Interface
+	// annotateLBProvider is whether Services are also annotated with their load balancer provider
+	annotateLBProvider bool
+	// recorder, when set, records events on Services for settings the load balancer cannot apply
+	recorder record.EventRecorder
 }
 
-// NewLoadBalancer returns an implementation of cloudprovider.LoadBalancer
-func NewLoadBalancer(clusterNS string, kcfg *rest.Config, ownerRef *metav1.OwnerReference) (cloudprovider.LoadBalancer, error) {
+// LoadBalancerOptions configures the load balancer returned by NewLoadBalancer.
+type LoadBalancerOptions struct {
+	// VMService configures the VirtualMachineServices of the Services
+	VMService vmservice.Options
+	// ServiceClient, when set, is used to annotate Services with their VirtualMachineService
+	ServiceClient clientset.Interface
+	// AnnotateLBProvider also annotates Services with their load balancer provider
+	AnnotateLBProvider bool
+	// Recorder, when set, records events on Services for settings the load balancer cannot apply
+	Recorder record.EventRecorder
+}
+
+// NewLoadBalancer returns an implementation of cloudprovider.LoadBalancer managing the
+// VirtualMachineServices of the cluster in clusterNS of the supervisor cluster, as configured by opts.
+func NewLoadBalancer(clusterNS string, kcfg *rest.Config, ownerRef *metav1.OwnerReference, opts LoadBalancerOptions) (cloudprovider.LoadBalancer, error) {
 	klog.V(1).Info("Create load balancer for vsphere paravirtual cloud provider")
 
 	client, err := vmservice.GetVmopClient(kcfg)
@@ -47,9 +101,11 @@ func NewLoadBalancer(clusterNS string, kcfg *rest.Config, ownerRef *metav1.Owner
 		klog.Errorf("failed to create load balancer: %v", err)
 		return nil, err
 	}
-	vmService := vmservice.NewVMService(client, clusterNS, ownerRef)
 	return &loadBalancer{
-		vmService: vmService,
+		vmService:          vmservice.NewVMService(client, clusterNS, ownerRef, opts.VMService),
+		serviceClient:      opts.ServiceClient,
+		annotateLBProvider: opts.AnnotateLBProvider,
+		recorder:           opts.Recorder,
 	}, nil
 }
 
@@ -92,11 +148,28 @@ func (l *loadBalancer) GetLoadBalancerName(ctx context.Context, clusterName stri
 func (l *loadBalancer) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
 	klog.V(1).Infof("Ensure Load Balancer for %s", namespacedName(service))
 
+	l.warnUnsupportedSessionAffinity(service)
 	vmService, err := l.vmService.CreateOrUpdate(ctx, service, clusterName)
 
+	// the VirtualMachineService is recorded as soon as it exists, before it is allocated an IP
+	if vmService != nil {
+		if err := l.annotate(ctx, service, vmService); err != nil {
+			klog.Errorf("failed to annotate %s with its virtual machine service: %v", namespacedName(service), err)
+		}
+	}
+
 	if err != nil {
 		klog.Errorf("failed to ensure virtual machine service for %s: %v", namespacedName(service), err)
-		return nil, err
+		if errors.Is(err, vmservice.ErrNoPortsDefined) && l.recorder != nil {
+			l.recorder.Event(service, v1.EventTypeWarning, EventReasonNoPortsDefined,
+				"Service has no ports defined, its VirtualMachineService is not created")
+		}
+		l.warnInvalidAnnotation(service, err)
+		if errors.Is(err, vmservice.ErrVMServiceFailed) && l.recorder != nil {
+			l.recorder.Eventf(service, v1.EventTypeWarning, EventReasonVMServiceFailed,
+				"VirtualMachineService will not be allocated an IP: %v", err)
+		}
+		return nil, retryIfNodePortPending(err)
 	}
 
 	klog.V(1).Infof("Ensured load balancer for %s with virtual machine service %s", namespacedName(service), vmService.Name)
@@ -123,14 +196,20 @@ func (l *loadBalancer) UpdateLoadBalancer(ctx context.Context, clusterName strin
 		return errors.Errorf("VirtualMachineService not found")
 	}
 
+	l.warnUnsupportedSessionAffinity(service)
 	vmService, err = l.vmService.Update(ctx, service, clusterName, vmService)
 
 	if err != nil {
 		klog.Errorf("failed to update virtual machine service for %s: %v", namespacedName(service), err)
-		return err
+		l.warnInvalidAnnotation(service, err)
+		return retryIfNodePortPending(err)
 	}
 
 	klog.V(1).Infof("updated virtual machine service: %s", vmService.Name)
+
+	if err := l.annotate(ctx, service, vmService); err != nil {
+		klog.Errorf("failed to annotate %s with its virtual machine service: %v", namespacedName(service), err)
+	}
 	return nil
 }
 
@@ -145,8 +224,17 @@ func (l *loadBalancer) UpdateLoadBalancer(ctx context.Context, clusterName strin
 func (l *loadBalancer) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
 	klog.V(1).Infof("Ensure load balancer is deleted %s", namespacedName(service))
 
-	err := l.vmService.Delete(ctx, service, clusterName)
+	var err error
+	if namespace, name, ok := strings.Cut(service.Annotations[AnnotationVMServiceKey], "/"); ok {
+		err = l.vmService.DeleteRecorded(ctx, service, clusterName, namespace, name)
+	} else {
+		err = l.vmService.Delete(ctx, service, clusterName)
+	}
 
+	if errors.Is(err, vmservice.ErrNotOurLoadBalancerClass) {
+		klog.V(1).Infof("load balancer for %s is handled by another controller", namespacedName(service))
+		return nil
+	}
 	if err != nil {
 		if !k8serrors.IsNotFound(err) {
 			klog.Errorf("failed to delete load balancer for %s", namespacedName(service))
@@ -160,6 +248,69 @@ func (l *loadBalancer) EnsureLoadBalancerDeleted(ctx context.Context, clusterNam
 	return nil
 }
 
+// annotate records the namespace and name of vmService on the service and, when annotateLBProvider
+// is set, mirrors its load balancer provider onto the service.
+// It is a no-op unless serviceClient is set and the annotations changed.
+func (l *loadBalancer) annotate(ctx context.Context, service *v1.Service, vmService *vmopv1alpha1.VirtualMachineService) error {
+	if l.serviceClient == nil {
+		return nil
+	}
+	annotations := map[string]string{}
+	if ref := vmService.Namespace + "/" + vmService.Name; vmService.Name != "" && service.Annotations[AnnotationVMServiceKey] != ref {
+		annotations[AnnotationVMServiceKey] = ref
+	}
+	if provider := vmservice.GetLoadBalancerProvider(vmService); l.annotateLBProvider && provider != "" &&
+		service.Annotations[AnnotationLoadBalancerProviderKey] != provider {
+		annotations[AnnotationLoadBalancerProviderKey] = provider
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = l.serviceClient.CoreV1().Services(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// warnUnsupportedSessionAffinity warns that ClientIP session affinity of service is dropped, as
+// VirtualMachineService has no session affinity in the vm-operator API version in use.
+func (l *loadBalancer) warnUnsupportedSessionAffinity(service *v1.Service) {
+	if service.Spec.SessionAffinity != v1.ServiceAffinityClientIP {
+		return
+	}
+	klog.Warningf("session affinity %s of %s is not supported by VirtualMachineService and is ignored", service.Spec.SessionAffinity, namespacedName(service))
+	if l.recorder != nil {
+		l.recorder.Eventf(service, v1.EventTypeWarning, EventReasonSessionAffinityUnsupported,
+			"Session affinity %s is not supported by VirtualMachineService and is ignored", service.Spec.SessionAffinity)
+	}
+}
+
+// warnInvalidAnnotation records a warning event on service if err is an annotation of service
+// rejected by the annotation validator.
+func (l *loadBalancer) warnInvalidAnnotation(service *v1.Service, err error) {
+	if errors.Is(err, vmservice.ErrInvalidAnnotation) && l.recorder != nil {
+		l.recorder.Eventf(service, v1.EventTypeWarning, EventReasonInvalidAnnotation,
+			"Service is not reconciled: %v", err)
+	}
+}
+
+// retryIfNodePortPending turns vmservice.ErrNodePortPending into a RetryError, so that the
+// Service is reconciled again once its node ports are allocated rather than failing with
+// exponential backoff.
+func retryIfNodePortPending(err error) error {
+	if errors.Is(err, vmservice.ErrNodePortPending) {
+		return api.NewRetryError(err.Error(), nodePortPendingRetryDelay)
+	}
+	return err
+}
+
 func toStatus(vmService *vmopv1alpha1.VirtualMachineService) *v1.LoadBalancerStatus {
 
 	if len(vmService.Status.LoadBalancer.Ingress) > 0 {
@@ -29,9 +29,12 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
 	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/cloud-provider/api"
 
 	"k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmservice"
 
@@ -53,13 +56,25 @@ var (
 	}
 )
 
+// testK8sServicePorts returns the ports of the test Services
+func testK8sServicePorts() []v1.ServicePort {
+	return []v1.ServicePort{
+		{
+			Name:     "test-port",
+			Port:     80,
+			NodePort: 30800,
+			Protocol: "TCP",
+		},
+	}
+}
+
 func newTestLoadBalancer() (cloudprovider.LoadBalancer, *dynamicfake.FakeDynamicClient) {
 	scheme := runtime.NewScheme()
 	_ = vmopv1alpha1.AddToScheme(scheme)
 	fc := dynamicfake.NewSimpleDynamicClient(scheme)
 	fcw := vmopclient.NewFakeClientSet(fc)
 
-	vms := vmservice.NewVMService(fcw, testClusterNameSpace, &testOwnerReference)
+	vms := vmservice.NewVMService(fcw, testClusterNameSpace, &testOwnerReference, vmservice.Options{})
 	return &loadBalancer{vmService: vms}, fc
 }
 
@@ -78,7 +93,7 @@ func TestNewLoadBalancer(t *testing.T) {
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			_, err := NewLoadBalancer(testClusterNameSpace, testCase.config, &testOwnerReference)
+			_, err := NewLoadBalancer(testClusterNameSpace, testCase.config, &testOwnerReference, LoadBalancerOptions{})
 			assert.Equal(t, testCase.err, err)
 		})
 	}
@@ -105,6 +120,9 @@ func TestGetLoadBalancer_VMServiceCreated(t *testing.T) {
 			Name:      testK8sServiceName,
 			Namespace: testK8sServiceNameSpace,
 		},
+		Spec: v1.ServiceSpec{
+			Ports: testK8sServicePorts(),
+		},
 	}
 
 	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
@@ -156,23 +174,16 @@ func TestUpdateLoadBalancer(t *testing.T) {
 					Name:      testK8sServiceName,
 					Namespace: testK8sServiceNameSpace,
 				},
+				Spec: v1.ServiceSpec{
+					Ports: testK8sServicePorts(),
+				},
 			}
 
-			// Add the service with no ports
 			_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
 			assert.Equal(t, vmservice.ErrVMServiceIPNotFound, err)
 
-			// Update the service definition to add ports
-			testK8sService.Spec = v1.ServiceSpec{
-				Ports: []v1.ServicePort{
-					{
-						Name:     "test-port",
-						Port:     80,
-						NodePort: 30900,
-						Protocol: "TCP",
-					},
-				},
-			}
+			// Update the service definition to change the node port
+			testK8sService.Spec.Ports[0].NodePort = 30900
 
 			if testCase.expectErr {
 				// Ensure that the client Update call returns an error on update
@@ -197,6 +208,7 @@ func TestEnsureLoadBalancer_VMServiceExternalTrafficPolicyLocal(t *testing.T) {
 			Namespace: testK8sServiceNameSpace,
 		},
 		Spec: v1.ServiceSpec{
+			Ports:                 testK8sServicePorts(),
 			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
 		},
 	}
@@ -253,6 +265,9 @@ func TestEnsureLoadBalancer(t *testing.T) {
 					Name:      testK8sServiceName,
 					Namespace: testK8sServiceNameSpace,
 				},
+				Spec: v1.ServiceSpec{
+					Ports: testK8sServicePorts(),
+				},
 			}
 			fc.PrependReactor("create", "virtualmachineservices", testCase.createFunc)
 
@@ -265,6 +280,121 @@ func TestEnsureLoadBalancer(t *testing.T) {
 	}
 }
 
+func TestEnsureLoadBalancer_InvalidAnnotation(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = vmopv1alpha1.AddToScheme(scheme)
+	fc := dynamicfake.NewSimpleDynamicClient(scheme)
+	transform := func(key string) (string, bool) { return key, true }
+	validator := vmservice.EnumAnnotationValidator(map[string][]string{"lb.example.com/pool-algorithm": {"round-robin"}})
+	vms := vmservice.NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, vmservice.Options{AnnotationTransform: transform, AnnotationValidator: validator})
+	recorder := record.NewFakeRecorder(10)
+	lb := &loadBalancer{vmService: vms, recorder: recorder}
+	testK8sService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        testK8sServiceName,
+			Namespace:   testK8sServiceNameSpace,
+			Annotations: map[string]string{"lb.example.com/pool-algorithm": "random"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: testK8sServicePorts(),
+		},
+	}
+
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.ErrorIs(t, err, vmservice.ErrInvalidAnnotation)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning "+EventReasonInvalidAnnotation)
+
+	_, exists, _ := lb.GetLoadBalancer(context.Background(), testClustername, testK8sService)
+	assert.False(t, exists)
+}
+
+// failedVMService is a VMService whose VirtualMachineServices are rejected by the load balancer provider
+type failedVMService struct {
+	vmservice.VMService
+}
+
+func (f failedVMService) CreateOrUpdate(ctx context.Context, service *v1.Service, clusterName string) (*vmopv1alpha1.VirtualMachineService, error) {
+	return nil, fmt.Errorf("%w: IPPoolExhausted: no IP is left", vmservice.ErrVMServiceFailed)
+}
+
+func TestEnsureLoadBalancer_VMServiceFailed(t *testing.T) {
+	lb, _ := newTestLoadBalancer()
+	recorder := record.NewFakeRecorder(10)
+	lb.(*loadBalancer).recorder = recorder
+	lb.(*loadBalancer).vmService = failedVMService{VMService: lb.(*loadBalancer).vmService}
+	testK8sService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testK8sServiceName,
+			Namespace: testK8sServiceNameSpace,
+		},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: testK8sServicePorts(),
+		},
+	}
+
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.ErrorIs(t, err, vmservice.ErrVMServiceFailed)
+	assert.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning "+EventReasonVMServiceFailed)
+	assert.Contains(t, event, "no IP is left")
+}
+
+func TestEnsureLoadBalancer_NoPorts(t *testing.T) {
+	lb, _ := newTestLoadBalancer()
+	recorder := record.NewFakeRecorder(10)
+	lb.(*loadBalancer).recorder = recorder
+	testK8sService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testK8sServiceName,
+			Namespace: testK8sServiceNameSpace,
+		},
+	}
+
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.Equal(t, vmservice.ErrNoPortsDefined, err)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning "+EventReasonNoPortsDefined)
+
+	_, exists, _ := lb.GetLoadBalancer(context.Background(), testClustername, testK8sService)
+	assert.False(t, exists)
+}
+
+func TestEnsureLoadBalancer_NodePortPending(t *testing.T) {
+	lb, _ := newTestLoadBalancer()
+	testK8sService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testK8sServiceName,
+			Namespace: testK8sServiceNameSpace,
+		},
+		Spec: v1.ServiceSpec{
+			Ports:                 testK8sServicePorts(),
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+			HealthCheckNodePort:   31234,
+		},
+	}
+	// the health check node port is allocated, the data port is not yet
+	testK8sService.Spec.Ports[0].NodePort = 0
+
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	var retryErr *api.RetryError
+	assert.ErrorAs(t, err, &retryErr)
+	assert.Equal(t, nodePortPendingRetryDelay, retryErr.RetryAfter())
+	_, exists, _ := lb.GetLoadBalancer(context.Background(), testClustername, testK8sService)
+	assert.False(t, exists)
+
+	// a later reconcile finds the allocated node port
+	testK8sService.Spec.Ports[0].NodePort = 30800
+	_, err = lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.Equal(t, vmservice.ErrVMServiceIPNotFound, err)
+	_, exists, err = lb.GetLoadBalancer(context.Background(), testClustername, testK8sService)
+	assert.True(t, exists)
+	assert.NoError(t, err)
+}
+
 func TestEnsureLoadBalancer_VMServiceCreatedIPFound(t *testing.T) {
 	lb, fc := newTestLoadBalancer()
 	testK8sService := &v1.Service{
@@ -272,6 +402,9 @@ func TestEnsureLoadBalancer_VMServiceCreatedIPFound(t *testing.T) {
 			Name:      testK8sServiceName,
 			Namespace: testK8sServiceNameSpace,
 		},
+		Spec: v1.ServiceSpec{
+			Ports: testK8sServicePorts(),
+		},
 	}
 	// Ensure that the client Create call returns a VMService with a valid IP
 	fc.PrependReactor("create", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
@@ -319,6 +452,139 @@ func TestEnsureLoadBalancer_VMServiceCreatedIPFound(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestEnsureLoadBalancer_AnnotateProvider(t *testing.T) {
+	testCases := []struct {
+		name                string
+		provider            string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:     "when the supervisor records the provider",
+			provider: "nsx-t",
+			expectedAnnotations: map[string]string{
+				AnnotationLoadBalancerProviderKey: "nsx-t",
+			},
+		},
+		{
+			name:                "when the provider is unknown",
+			provider:            "",
+			expectedAnnotations: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			lb, fc := newTestLoadBalancer()
+			testK8sService := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      testK8sServiceName,
+					Namespace: testK8sServiceNameSpace,
+				},
+				Spec: v1.ServiceSpec{
+					Ports: testK8sServicePorts(),
+				},
+			}
+			serviceClient := fake.NewSimpleClientset(testK8sService)
+			lb.(*loadBalancer).serviceClient = serviceClient
+			lb.(*loadBalancer).annotateLBProvider = true
+
+			fc.PrependReactor("create", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+				vmService := &vmopv1alpha1.VirtualMachineService{
+					Status: vmopv1alpha1.VirtualMachineServiceStatus{
+						LoadBalancer: vmopv1alpha1.LoadBalancerStatus{
+							Ingress: []vmopv1alpha1.LoadBalancerIngress{
+								{
+									IP: "10.10.10.10",
+								},
+							},
+						},
+					},
+				}
+				if testCase.provider != "" {
+					vmService.Annotations = map[string]string{
+						vmservice.AnnotationLoadBalancerProviderKey: testCase.provider,
+					}
+				}
+				unstructuredObj, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(vmService)
+				return true, &unstructured.Unstructured{Object: unstructuredObj}, nil
+			})
+
+			_, ensureErr := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+			assert.NoError(t, ensureErr)
+
+			svc, err := serviceClient.CoreV1().Services(testK8sServiceNameSpace).Get(context.Background(), testK8sServiceName, metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedAnnotations, svc.Annotations)
+		})
+	}
+}
+
+func TestEnsureLoadBalancerDeleted_ByName(t *testing.T) {
+	lb, fc := newTestLoadBalancer()
+	testK8sService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testK8sServiceName,
+			Namespace: testK8sServiceNameSpace,
+		},
+		Spec: v1.ServiceSpec{
+			Ports: testK8sServicePorts(),
+		},
+	}
+	serviceClient := fake.NewSimpleClientset(testK8sService)
+	lb.(*loadBalancer).serviceClient = serviceClient
+
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.Error(t, err)
+
+	svc, err := serviceClient.CoreV1().Services(testK8sServiceNameSpace).Get(context.Background(), testK8sServiceName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	vmServiceName := lb.GetLoadBalancerName(context.Background(), testClustername, testK8sService)
+	assert.Equal(t, testClusterNameSpace+"/"+vmServiceName, svc.Annotations[AnnotationVMServiceKey])
+
+	// the recorded name is deleted even though it can no longer be computed from the cluster name
+	fc.ClearActions()
+	err = lb.EnsureLoadBalancerDeleted(context.Background(), "renamed-cluster", svc)
+	assert.NoError(t, err)
+	var deleted []string
+	for _, action := range fc.Actions() {
+		if deleteAction, ok := action.(clientgotesting.DeleteAction); ok {
+			deleted = append(deleted, deleteAction.GetName())
+		}
+	}
+	assert.Equal(t, []string{vmServiceName}, deleted)
+}
+
+func TestEnsureLoadBalancerDeleted_ForeignAnnotation(t *testing.T) {
+	lb, fc := newTestLoadBalancer()
+	newService := func(name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testK8sServiceNameSpace},
+			Spec:       v1.ServiceSpec{Ports: testK8sServicePorts()},
+		}
+	}
+	foreignService, testK8sService := newService("foreign-service"), newService(testK8sServiceName)
+	lb.(*loadBalancer).serviceClient = fake.NewSimpleClientset(foreignService, testK8sService)
+
+	// the VirtualMachineServices are created, but not allocated an IP
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, foreignService, []*v1.Node{})
+	assert.Error(t, err)
+	_, err = lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.Error(t, err)
+	foreignName := lb.GetLoadBalancerName(context.Background(), testClustername, foreignService)
+	ownName := lb.GetLoadBalancerName(context.Background(), testClustername, testK8sService)
+
+	// the author of the Service points its annotation at the VirtualMachineService of another Service
+	testK8sService.Annotations = map[string]string{AnnotationVMServiceKey: testClusterNameSpace + "/" + foreignName}
+	err = lb.EnsureLoadBalancerDeleted(context.Background(), testClustername, testK8sService)
+	assert.NoError(t, err)
+
+	vmServices := fc.Resource(vmopv1alpha1.SchemeGroupVersion.WithResource("virtualmachineservices")).Namespace(testClusterNameSpace)
+	_, err = vmServices.Get(context.Background(), foreignName, metav1.GetOptions{})
+	assert.NoError(t, err, "the VirtualMachineService of the other Service must not be deleted")
+	_, err = vmServices.Get(context.Background(), ownName, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "the VirtualMachineService of the Service must be deleted instead")
+}
+
 func TestEnsureLoadBalancer_DeleteLB(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -348,6 +614,9 @@ func TestEnsureLoadBalancer_DeleteLB(t *testing.T) {
 					Name:      testK8sServiceName,
 					Namespace: testK8sServiceNameSpace,
 				},
+				Spec: v1.ServiceSpec{
+					Ports: testK8sServicePorts(),
+				},
 			}
 
 			// should pass without error
@@ -363,3 +632,61 @@ func TestEnsureLoadBalancer_DeleteLB(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadBalancer_SessionAffinity(t *testing.T) {
+	lb, _ := newTestLoadBalancer()
+	recorder := record.NewFakeRecorder(10)
+	lb.(*loadBalancer).recorder = recorder
+	testK8sService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testK8sServiceName,
+			Namespace: testK8sServiceNameSpace,
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{
+					Name:     "http",
+					Protocol: "tcp",
+					Port:     80,
+					NodePort: 30800,
+				},
+			},
+			SessionAffinity: v1.ServiceAffinityClientIP,
+		},
+	}
+
+	// The VirtualMachineService is created without affinity, the supervisor has not assigned an IP yet
+	_, err := lb.EnsureLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+	assert.Equal(t, vmservice.ErrVMServiceIPNotFound, err)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, EventReasonSessionAffinityUnsupported)
+
+	testCases := []struct {
+		name           string
+		affinity       v1.ServiceAffinity
+		expectedEvents int
+	}{
+		{
+			name:           "when session affinity is turned off",
+			affinity:       v1.ServiceAffinityNone,
+			expectedEvents: 0,
+		},
+		{
+			name:           "when session affinity is turned on",
+			affinity:       v1.ServiceAffinityClientIP,
+			expectedEvents: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService.Spec.SessionAffinity = testCase.affinity
+			err := lb.UpdateLoadBalancer(context.Background(), testClustername, testK8sService, []*v1.Node{})
+			assert.NoError(t, err)
+			assert.Len(t, recorder.Events, testCase.expectedEvents)
+			for i := 0; i < testCase.expectedEvents; i++ {
+				assert.Contains(t, <-recorder.Events, "Warning "+EventReasonSessionAffinityUnsupported)
+			}
+		})
+	}
+}
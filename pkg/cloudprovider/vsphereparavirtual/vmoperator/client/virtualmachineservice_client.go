@@ -62,6 +62,28 @@ func (v *virtualMachineServices) Update(ctx context.Context, virtualMachineServi
 	return updatedVirtualMachineService, nil
 }
 
+// Apply server-side applies virtualMachineService, whose status is left out as it is
+// not applied through the main resource
+func (v *virtualMachineServices) Apply(ctx context.Context, virtualMachineService *vmopv1alpha1.VirtualMachineService, opts v1.ApplyOptions) (*vmopv1alpha1.VirtualMachineService, error) {
+	unstructuredObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(virtualMachineService)
+	if err != nil {
+		return nil, err
+	}
+	unstructured.RemoveNestedField(unstructuredObj, "status")
+	unstructured.RemoveNestedField(unstructuredObj, "metadata", "creationTimestamp")
+
+	obj, err := v.client.Resource(VirtualMachineServiceGVR).Namespace(v.ns).Apply(ctx, virtualMachineService.Name, &unstructured.Unstructured{Object: unstructuredObj}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedVirtualMachineService := &vmopv1alpha1.VirtualMachineService{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), appliedVirtualMachineService); err != nil {
+		return nil, err
+	}
+	return appliedVirtualMachineService, nil
+}
+
 func (v *virtualMachineServices) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
 	return v.client.Resource(VirtualMachineServiceGVR).Namespace(v.ns).Delete(ctx, name, opts)
 }
@@ -2,12 +2,14 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	vmopv1alpha1 "github.com/vmware-tanzu/vm-operator-api/api/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgotesting "k8s.io/client-go/testing"
 
@@ -150,6 +152,56 @@ func TestVMServiceUpdate(t *testing.T) {
 	}
 }
 
+func TestVMServiceApply(t *testing.T) {
+	testCases := []struct {
+		name        string
+		applyFunc   func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error)
+		expectedErr bool
+	}{
+		{
+			name: "Apply: when everything is ok",
+			applyFunc: func(action clientgotesting.Action) (bool, runtime.Object, error) {
+				obj := &unstructured.Unstructured{}
+				err := json.Unmarshal(action.(clientgotesting.PatchAction).GetPatch(), &obj.Object)
+				return true, obj, err
+			},
+		},
+		{
+			name: "Apply: when apply error",
+			applyFunc: func(action clientgotesting.Action) (bool, runtime.Object, error) {
+				return true, nil, fmt.Errorf("test error")
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			vms, fc := initVMServiceTest()
+			fc.PrependReactor("patch", "*", testCase.applyFunc)
+			virtualMachineService := &vmopv1alpha1.VirtualMachineService{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test-vm",
+				},
+				Spec: vmopv1alpha1.VirtualMachineServiceSpec{
+					Type: "NodePort",
+				},
+			}
+			appliedVM, err := vms.Apply(context.Background(), virtualMachineService, metav1.ApplyOptions{FieldManager: "test"})
+			if testCase.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, virtualMachineService.Spec, appliedVM.Spec)
+
+				patch := fc.Actions()[0].(clientgotesting.PatchAction).GetPatch()
+				assert.NotContains(t, string(patch), "status")
+				assert.NotContains(t, string(patch), "creationTimestamp")
+			}
+		})
+	}
+}
+
 func TestVMServiceDelete(t *testing.T) {
 	testCases := []struct {
 		name                  string
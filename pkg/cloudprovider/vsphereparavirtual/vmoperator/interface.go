@@ -34,6 +34,7 @@ type VirtualMachineInterface interface {
 type VirtualMachineServiceInterface interface {
 	Create(ctx context.Context, virtualMachineService *vmopv1alpha1.VirtualMachineService, opts v1.CreateOptions) (*vmopv1alpha1.VirtualMachineService, error)
 	Update(ctx context.Context, virtualMachineService *vmopv1alpha1.VirtualMachineService, opts v1.UpdateOptions) (*vmopv1alpha1.VirtualMachineService, error)
+	Apply(ctx context.Context, virtualMachineService *vmopv1alpha1.VirtualMachineService, opts v1.ApplyOptions) (*vmopv1alpha1.VirtualMachineService, error)
 	Delete(ctx context.Context, name string, opts v1.DeleteOptions) error
 	Get(ctx context.Context, name string, opts v1.GetOptions) (*vmopv1alpha1.VirtualMachineService, error)
 	List(ctx context.Context, opts v1.ListOptions) (*vmopv1alpha1.VirtualMachineServiceList, error)
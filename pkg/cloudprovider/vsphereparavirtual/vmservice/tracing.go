@@ -0,0 +1,61 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmservice
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+const tracerName = "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmservice"
+
+// startSpan starts a span for a VirtualMachineService operation on behalf of service.
+// The span is a no-op unless a tracer provider is registered with otel.SetTracerProvider.
+func (s *vmService) startSpan(ctx context.Context, operation string, service *v1.Service) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "vmservice."+operation, trace.WithAttributes(
+		attribute.String("vmservice.namespace", s.namespace),
+		attribute.String("vmservice.operation", operation),
+		attribute.String("service", service.Namespace+"/"+service.Name),
+	))
+}
+
+// startNamedSpan starts a span for a VirtualMachineService operation on the VirtualMachineService
+// of the given name, when its Service is not available.
+func (s *vmService) startNamedSpan(ctx context.Context, operation, namespace, vmServiceName string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "vmservice."+operation, trace.WithAttributes(
+		attribute.String("vmservice.namespace", namespace),
+		attribute.String("vmservice.operation", operation),
+		attribute.String("vmservice.name", vmServiceName),
+	))
+}
+
+// endSpan records the result of the operation and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("vmservice.result", "error"))
+	} else {
+		span.SetAttributes(attribute.String("vmservice.result", "success"))
+	}
+	span.End()
+}
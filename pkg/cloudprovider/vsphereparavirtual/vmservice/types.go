@@ -18,9 +18,11 @@ package vmservice
 
 import (
 	"context"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2/klogr"
 
 	"github.com/vmware-tanzu/vm-operator-api/api/v1alpha1"
@@ -35,8 +37,58 @@ type VMService interface {
 	Get(ctx context.Context, service *v1.Service, clusterName string) (*v1alpha1.VirtualMachineService, error)
 	Create(ctx context.Context, service *v1.Service, clusterName string) (*v1alpha1.VirtualMachineService, error)
 	CreateOrUpdate(ctx context.Context, service *v1.Service, clusterName string) (*v1alpha1.VirtualMachineService, error)
+	Apply(ctx context.Context, service *v1.Service, clusterName string) (*v1alpha1.VirtualMachineService, error)
 	Update(ctx context.Context, service *v1.Service, clusterName string, vmService *v1alpha1.VirtualMachineService) (*v1alpha1.VirtualMachineService, error)
 	Delete(ctx context.Context, service *v1.Service, clusterName string) error
+	DeleteByName(ctx context.Context, namespace, vmServiceName string) error
+	DeleteRecorded(ctx context.Context, service *v1.Service, clusterName, namespace, vmServiceName string) error
+	WaitForLoadBalancerIP(ctx context.Context, service *v1.Service, clusterName string, timeout time.Duration) (string, error)
+	ListManaged(ctx context.Context, clusterName string) ([]*v1alpha1.VirtualMachineService, error)
+	DeleteOrphaned(ctx context.Context, clusterName string, liveServices []*v1.Service) error
+}
+
+// Options configures the VMService returned by NewVMService. The zero value handles the Services
+// without a load balancer class, with the default name lengths and no annotation propagation.
+type Options struct {
+	// LoadBalancerClass is the spec.loadBalancerClass of the Services handled besides those
+	// without a class. Services of other classes are left to other load balancer controllers.
+	LoadBalancerClass string
+	// NameSuffixLen is the maximum length of the hash suffix of VirtualMachineService names.
+	// MaxCheckSumLen is used when zero.
+	NameSuffixLen int
+	// MaxNameLen is the maximum length of VirtualMachineService names.
+	// MaxVMServiceNameLen is used when zero.
+	MaxNameLen int
+	// DryRun makes creates, updates and deletes only validated by the supervisor cluster
+	// and not persisted.
+	DryRun bool
+	// AllowedNamespaces are the namespaces Services may place their VirtualMachineService in
+	// with the AnnotationVMServiceNamespaceKey annotation, instead of the cluster namespace.
+	AllowedNamespaces []string
+	// AllowedProviders are the load balancer providers Services may request with the
+	// AnnotationVMServiceProviderKey annotation.
+	AllowedProviders []string
+	// CallTimeout limits each request to the supervisor cluster, unless it is zero.
+	CallTimeout time.Duration
+	// IsLegacy selects the worker vms by the legacy capw labels.
+	IsLegacy bool
+	// MigrationMode leaves the worker vm selector of existing VirtualMachineServices unchanged,
+	// while worker vms are migrated between the capv and the legacy capw labels. A selector
+	// matches all of its labels, so it cannot select vms labeled either way; switching it before
+	// all vms are relabeled would cut the others off. New VirtualMachineServices select the
+	// labels chosen by IsLegacy.
+	MigrationMode bool
+	// Namer, when set, names the VirtualMachineServices instead of the cluster name and hash.
+	Namer Namer
+	// AnnotationTransform, when set, propagates the Service annotations other than the excluded
+	// ones to the VirtualMachineService with the keys it returns. None are propagated otherwise.
+	AnnotationTransform AnnotationTransform
+	// ExcludedAnnotations are Service annotations never propagated, in addition to the built-in
+	// ones. Empty keys are ignored.
+	ExcludedAnnotations []string
+	// AnnotationValidator, when set, validates the propagated annotations. A Service with an
+	// invalid one is not reconciled.
+	AnnotationValidator AnnotationValidator
 }
 
 // vmService takes care of mapping of LB type of service to VM service in supervisor cluster
@@ -44,4 +96,54 @@ type vmService struct {
 	vmClient       vmop.Interface
 	namespace      string
 	ownerReference *metav1.OwnerReference
+	// loadBalancerClass is the spec.loadBalancerClass of the Services handled besides those without a class
+	loadBalancerClass string
+	// nameSuffixLen is the maximum length of the hash suffix of VirtualMachineService names
+	nameSuffixLen int
+	// maxNameLen is the maximum length of VirtualMachineService names
+	maxNameLen int
+	// dryRun is whether mutating requests are sent as dry runs
+	dryRun bool
+	// allowedNamespaces are the namespaces Services may place their VirtualMachineService in
+	allowedNamespaces sets.Set[string]
+	// allowedProviders are the load balancer providers Services may request
+	allowedProviders sets.Set[string]
+	// callTimeout limits each request to the supervisor cluster, unless it is zero
+	callTimeout time.Duration
+	// isLegacy is whether worker vms are selected by the legacy capw labels
+	isLegacy bool
+	// migrationMode is whether the selector of existing VirtualMachineServices is left unchanged
+	migrationMode bool
+	// namer, when set, names the VirtualMachineServices instead of GetVMServiceName
+	namer Namer
+	// annotationTransform, when set, propagates the Service annotations with the keys it returns
+	annotationTransform AnnotationTransform
+	// excludedAnnotations are the Service annotations that are never propagated
+	excludedAnnotations sets.Set[string]
+	// annotationValidator, when set, validates the propagated Service annotations
+	annotationValidator AnnotationValidator
 }
+
+// Namer returns the name of the VirtualMachineService of a Service of the given cluster
+type Namer func(service *v1.Service, clusterName string) string
+
+// AnnotationTransform returns the key a Service annotation is propagated to the
+// VirtualMachineService with, or false to drop the annotation
+type AnnotationTransform func(key string) (string, bool)
+
+// State is the provisioning state of a VirtualMachineService
+type State string
+
+const (
+	// StatePending is the state of a VirtualMachineService not allocated an IP yet
+	StatePending State = "Pending"
+	// StateReady is the state of a VirtualMachineService allocated an IP
+	StateReady State = "Ready"
+	// StateFailed is the state of a VirtualMachineService rejected by the load balancer provider,
+	// which is not allocated an IP however long it is waited for
+	StateFailed State = "Failed"
+)
+
+// AnnotationValidator returns an error if value is not valid for the Service annotation key
+// propagated to the VirtualMachineService. Annotations it does not know must be accepted.
+type AnnotationValidator func(key, value string) error
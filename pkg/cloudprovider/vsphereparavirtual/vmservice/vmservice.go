@@ -21,18 +21,31 @@ import (
 	"crypto/md5" // #nosec
 	"encoding/hex"
 	"fmt"
+	"math"
+	"net"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	rest "k8s.io/client-go/rest"
 
 	vmopv1alpha1 "github.com/vmware-tanzu/vm-operator-api/api/v1alpha1"
 	vmop "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmoperator"
 	vmopclient "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmoperator/client"
+	"k8s.io/cloud-provider-vsphere/pkg/util"
 )
 
 const (
@@ -64,25 +77,84 @@ const (
 	// AnnotationServiceHealthCheckNodePortKey label is used to piggyback vSphere Paravirtual Service's
 	// configuration to the supervisor cluster.
 	AnnotationServiceHealthCheckNodePortKey = "virtualmachineservice.vmoperator.vmware.com/service.healthCheckNodePort"
+	// AnnotationLoadBalancerProviderKey annotation is set by the supervisor cluster to
+	// the name of the load balancer provider that serviced the VirtualMachineService.
+	AnnotationLoadBalancerProviderKey = "virtualmachineservice.vmoperator.vmware.com/loadbalancer.provider"
+	// AnnotationVMServiceNamespaceKey annotation on a Service overrides the namespace of its
+	// VirtualMachineService, which must be one of the allowed namespaces
+	AnnotationVMServiceNamespaceKey = "vmservice.vmware.com/namespace"
+	// AnnotationVMServiceProviderKey annotation on a Service requests a load balancer provider
+	// for its VirtualMachineService, which must be one of the allowed providers
+	AnnotationVMServiceProviderKey = "vmservice.vmware.com/provider"
+	// AnnotationServiceIdleTimeoutKey annotation on a Service requests an idle timeout, in seconds,
+	// for the connections through its load balancer
+	AnnotationServiceIdleTimeoutKey = "vmservice.vmware.com/idle-timeout-seconds"
+	// AnnotationLoadBalancerIdleTimeoutKey annotation is used to piggyback the idle timeout requested by
+	// AnnotationServiceIdleTimeoutKey to the supervisor cluster. It has no VirtualMachineServiceSpec
+	// counterpart, load balancer providers not supporting it ignore it.
+	AnnotationLoadBalancerIdleTimeoutKey = "virtualmachineservice.vmoperator.vmware.com/loadbalancer.idleTimeoutSeconds"
+	// AnnotationPropagatedKeysKey annotation records the comma-separated keys of the annotations
+	// propagated from the Service to its VirtualMachineService, so that they are removed from the
+	// VirtualMachineService once the Service drops them
+	AnnotationPropagatedKeysKey = "vmservice.vmware.com/propagated-annotations"
 
-	// MaxCheckSumLen is the maximum length of vmservice suffix: vsphere paravirtual name length cannot exceed 41 bytes in total, so we need to make sure vmservice suffix is 21 bytes (63 - 41 -1 = 21)
+	// MaxCheckSumLen is the default maximum length of vmservice suffix: vsphere paravirtual name length cannot exceed 41 bytes in total, so we need to make sure vmservice suffix is 21 bytes (63 - 41 -1 = 21)
 	// https://gitlab.eng.vmware.com/core-build/guest-cluster-controller/blob/master/webhooks/validation/tanzukubernetescluster_validator.go#L56
 	MaxCheckSumLen = 21
+	// MaxVMServiceNameLen is the default maximum length of a VirtualMachineService name: <cluster name>-<suffix>
+	MaxVMServiceNameLen = 63
+	// FieldManager is the field manager of the fields applied by Apply
+	FieldManager = "vsphere-paravirtual-cloud-controller-manager"
+	// DefaultCallTimeout is the default timeout of each VirtualMachineService request
+	DefaultCallTimeout = 30 * time.Second
 )
 
 // A list of possible error messages
 var (
-	ErrCreateVMService     = errors.New("failed to create VirtualMachineService")
-	ErrUpdateVMService     = errors.New("failed to update VirtualMachineService")
-	ErrGetVMService        = errors.New("failed to get VirtualMachineService")
-	ErrDeleteVMService     = errors.New("failed to delete VirtualMachineService")
-	ErrVMServiceIPNotFound = errors.New("VirtualMachineService IP not found")
-	ErrNodePortNotFound    = errors.New("NodePort not found")
+	ErrCreateVMService         = errors.New("failed to create VirtualMachineService")
+	ErrUpdateVMService         = errors.New("failed to update VirtualMachineService")
+	ErrApplyVMService          = errors.New("failed to apply VirtualMachineService")
+	ErrUpdateConflict          = errors.New("VirtualMachineService kept being changed during the update")
+	ErrGetVMService            = errors.New("failed to get VirtualMachineService")
+	ErrDeleteVMService         = errors.New("failed to delete VirtualMachineService")
+	ErrVMServiceIPNotFound     = errors.New("VirtualMachineService IP not found")
+	ErrVMServiceFailed         = errors.New("VirtualMachineService was rejected by the load balancer provider")
+	ErrNodePortNotFound        = errors.New("NodePort not found")
+	ErrNodePortPending         = errors.New("NodePort is pending allocation")
+	ErrNamedTargetPort         = errors.New("named targetPort cannot be used without NodePorts")
+	ErrNotOurLoadBalancerClass = errors.New("load balancer class of Service is not handled by this cloud provider")
+	ErrVMServiceNameTooLong    = errors.New("VirtualMachineService name is too long")
+	ErrNoPortsDefined          = errors.New("Service has no ports defined")
+	ErrInvalidExternalIP       = errors.New("invalid external IP")
+	ErrNamespaceNotAllowed     = errors.New("VirtualMachineService namespace is not allowed")
+	ErrNamespaceNotFound       = errors.New("VirtualMachineService namespace not found")
+	ErrProviderNotAllowed      = errors.New("load balancer provider is not allowed")
+	ErrVMServiceNameCollision  = errors.New("VirtualMachineService name is used by another Service")
+	ErrVMServiceTimeout        = errors.New("VirtualMachineService request timed out")
+	ErrInvalidIdleTimeout      = errors.New("idle timeout must be a positive number of seconds")
+	ErrInvalidVMServiceName    = errors.New("VirtualMachineService name is not a valid DNS-1123 label")
+	ErrListVMServices          = errors.New("failed to list VirtualMachineServices")
+	ErrInvalidAnnotation       = errors.New("invalid annotation")
 )
 
+// WaitForLoadBalancerIPBackoff is the backoff between the polls of WaitForLoadBalancerIP
+var WaitForLoadBalancerIPBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    math.MaxInt32,
+	Cap:      10 * time.Second,
+}
+
+// namespacesGVR is the resource of namespaces in the supervisor cluster
+var namespacesGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
 var (
 	// IsLegacy indicates whether legacy paravirtual mode is enabled
 	// Default to false
+	//
+	// Deprecated: set Options.IsLegacy of NewVMService instead, IsLegacy is only its default
+	// in the cloud provider and will be removed in the next release.
 	IsLegacy bool
 )
 
@@ -92,13 +164,94 @@ func GetVmopClient(config *rest.Config) (vmop.Interface, error) {
 	return vmopclient.NewForConfig(config)
 }
 
-// NewVMService creates a vmService object
-func NewVMService(vmClient vmop.Interface, ns string, ownerRef *metav1.OwnerReference) VMService {
+// NewVMService creates a vmService object managing the VirtualMachineServices of the Services
+// of a cluster, placed in ns and owned by ownerRef, as configured by opts.
+func NewVMService(vmClient vmop.Interface, ns string, ownerRef *metav1.OwnerReference, opts Options) VMService {
+	nameSuffixLen := opts.NameSuffixLen
+	if nameSuffixLen <= 0 {
+		nameSuffixLen = MaxCheckSumLen
+	}
+	maxNameLen := opts.MaxNameLen
+	if maxNameLen <= 0 {
+		maxNameLen = MaxVMServiceNameLen
+	}
+	excluded := sets.New(excludedAnnotations...)
+	for _, key := range opts.ExcludedAnnotations {
+		if strings.TrimSpace(key) == "" {
+			log.Info("Ignoring an empty excluded annotation")
+			continue
+		}
+		excluded.Insert(key)
+	}
 	return &vmService{
-		vmClient:       vmClient,
-		namespace:      ns,
-		ownerReference: ownerRef,
+		vmClient:            vmClient,
+		namespace:           ns,
+		ownerReference:      ownerRef,
+		loadBalancerClass:   opts.LoadBalancerClass,
+		nameSuffixLen:       nameSuffixLen,
+		maxNameLen:          maxNameLen,
+		dryRun:              opts.DryRun,
+		allowedNamespaces:   sets.New(opts.AllowedNamespaces...),
+		allowedProviders:    sets.New(opts.AllowedProviders...),
+		callTimeout:         opts.CallTimeout,
+		isLegacy:            opts.IsLegacy,
+		migrationMode:       opts.MigrationMode,
+		namer:               opts.Namer,
+		annotationTransform: opts.AnnotationTransform,
+		excludedAnnotations: excluded,
+		annotationValidator: opts.AnnotationValidator,
+	}
+}
+
+// withCallTimeout calls fn with ctx limited to the call timeout, returning ErrVMServiceTimeout
+// if fn failed because the call timeout expired
+func (s *vmService) withCallTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.callTimeout <= 0 {
+		return fn(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.callTimeout)
+	defer cancel()
+	err := fn(callCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return errors.Wrapf(ErrVMServiceTimeout, "after %s: %v", s.callTimeout, err)
 	}
+	return err
+}
+
+// namespaceFor returns the namespace of the VirtualMachineService of service
+func (s *vmService) namespaceFor(ctx context.Context, service *v1.Service) (string, error) {
+	namespace := service.Annotations[AnnotationVMServiceNamespaceKey]
+	if namespace == "" || namespace == s.namespace {
+		return s.namespace, nil
+	}
+	if !s.allowedNamespaces.Has(namespace) {
+		return "", errors.Wrapf(ErrNamespaceNotAllowed, "%s", namespace)
+	}
+	err := s.withCallTimeout(ctx, func(ctx context.Context) error {
+		_, err := s.vmClient.V1alpha1().Client().Resource(namespacesGVR).Get(ctx, namespace, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", errors.Wrapf(ErrNamespaceNotFound, "%s", namespace)
+		}
+		return "", err
+	}
+	return namespace, nil
+}
+
+// dryRunOption returns the DryRun option of mutating requests
+func (s *vmService) dryRunOption() []string {
+	if s.dryRun {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
+
+// ownsLoadBalancerClass returns whether the load balancer class of service is handled by s
+func (s *vmService) ownsLoadBalancerClass(service *v1.Service) bool {
+	class := service.Spec.LoadBalancerClass
+	return class == nil || *class == s.loadBalancerClass
 }
 
 func (s *vmService) hashString(str string) string {
@@ -111,48 +264,139 @@ func (s *vmService) hashString(str string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// GetVMServiceName returns VirtualMachineService name for a lb type of service
+// GetVMServiceName returns VirtualMachineService name for a lb type of service. The cluster name
+// is part of the hashed suffix, so that Services of the same name in clusters sharing a supervisor
+// namespace do not collide. The namer of s, if any, names it instead.
 func (s *vmService) GetVMServiceName(service *v1.Service, clusterName string) string {
-	suffix := s.hashString(service.Name + "." + service.Namespace)
+	if s.namer != nil {
+		return s.namer(service, clusterName)
+	}
+	return s.vmServiceName(clusterName+"/"+service.Name+"."+service.Namespace, service, clusterName)
+}
+
+// legacyVMServiceName returns the name VirtualMachineServices had before the cluster name was
+// hashed into their suffix
+func (s *vmService) legacyVMServiceName(service *v1.Service, clusterName string) string {
+	return s.vmServiceName(service.Name+"."+service.Namespace, service, clusterName)
+}
+
+// vmServiceName returns the name of the VirtualMachineService of service, suffixed with the
+// hash of hashInput
+func (s *vmService) vmServiceName(hashInput string, service *v1.Service, clusterName string) string {
+	suffix := s.hashString(hashInput)
 	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
 	logger.V(6).Info(fmt.Sprintf("Hash string for VirtualMachinService Name is %s", suffix))
 
-	if len(suffix) > MaxCheckSumLen {
-		suffix = suffix[:MaxCheckSumLen]
+	if len(suffix) > s.nameSuffixLen {
+		suffix = suffix[:s.nameSuffixLen]
 		logger.V(6).Info(fmt.Sprintf("Hash string for VirtualMachinService Name is truncated to %s", suffix))
 	}
 	return clusterName + "-" + suffix
 }
 
-// Get returns the corresponding virtual machine service if it exists
-func (s *vmService) Get(ctx context.Context, service *v1.Service, clusterName string) (*vmopv1alpha1.VirtualMachineService, error) {
+// Get returns the corresponding virtual machine service if it exists. A VirtualMachineService
+// with the legacy name of service is returned when there is none with its current name, so that
+// VirtualMachineServices created by earlier versions keep being used.
+func (s *vmService) Get(ctx context.Context, service *v1.Service, clusterName string) (_ *vmopv1alpha1.VirtualMachineService, err error) {
+	ctx, span := s.startSpan(ctx, "Get", service)
+	defer func() { endSpan(span, err) }()
+
 	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
 	logger.V(2).Info("Attempting to get VirtualMachineService")
 
-	vmService, err := s.vmClient.V1alpha1().VirtualMachineServices(s.namespace).Get(ctx, s.GetVMServiceName(service, clusterName), metav1.GetOptions{})
+	namespace, err := s.namespaceFor(ctx, service)
+	if err != nil {
+		logger.Error(ErrGetVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	vmService, err := s.getByName(ctx, namespace, s.GetVMServiceName(service, clusterName))
+	if err == nil && vmService == nil {
+		vmService, err = s.getLegacy(ctx, namespace, service, clusterName)
+	}
+	if err != nil {
+		logger.Error(ErrGetVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+	if vmService != nil && !belongsTo(vmService, service, clusterName) {
+		err = errors.Wrapf(ErrVMServiceNameCollision, "%s/%s belongs to Service %s/%s of cluster %s", vmService.Namespace, vmService.Name,
+			vmService.Labels[LabelServiceNameSpaceKey], vmService.Labels[LabelServiceNameKey], vmService.Labels[LabelClusterNameKey])
+		logger.Error(ErrGetVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	return vmService, nil
+}
+
+// getByName returns the VirtualMachineService of the given name, or nil if it does not exist
+func (s *vmService) getByName(ctx context.Context, namespace, name string) (*vmopv1alpha1.VirtualMachineService, error) {
+	var vmService *vmopv1alpha1.VirtualMachineService
+	err := s.withCallTimeout(ctx, func(ctx context.Context) (err error) {
+		vmService, err = s.vmClient.V1alpha1().VirtualMachineServices(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			return nil, nil
 		}
-		logger.Error(ErrGetVMService, fmt.Sprintf("%v", err))
 		return nil, err
 	}
+	return vmService, nil
+}
 
+// getLegacy returns the VirtualMachineService of service with its legacy name, or nil if it
+// does not exist or belongs to another Service, e.g. of another cluster. VirtualMachineServices
+// named by a namer never had a legacy name, so there is none to look for then.
+func (s *vmService) getLegacy(ctx context.Context, namespace string, service *v1.Service, clusterName string) (*vmopv1alpha1.VirtualMachineService, error) {
+	if s.namer != nil {
+		return nil, nil
+	}
+	vmService, err := s.getByName(ctx, namespace, s.legacyVMServiceName(service, clusterName))
+	if err != nil || vmService == nil || !belongsTo(vmService, service, clusterName) {
+		return nil, err
+	}
 	return vmService, nil
 }
 
+// belongsTo returns whether the labels of vmService, when set, match service and clusterName
+func belongsTo(vmService *vmopv1alpha1.VirtualMachineService, service *v1.Service, clusterName string) bool {
+	expected := map[string]string{
+		LabelClusterNameKey:      clusterName,
+		LabelServiceNameKey:      service.Name,
+		LabelServiceNameSpaceKey: service.Namespace,
+	}
+	for key, value := range expected {
+		if label, found := vmService.Labels[key]; found && label != value {
+			return false
+		}
+	}
+	return true
+}
+
 // Create creates a vmservice to map to the given lb type of service, it should be called if vmservice not found
-func (s *vmService) Create(ctx context.Context, service *v1.Service, clusterName string) (*vmopv1alpha1.VirtualMachineService, error) {
+func (s *vmService) Create(ctx context.Context, service *v1.Service, clusterName string) (_ *vmopv1alpha1.VirtualMachineService, err error) {
+	ctx, span := s.startSpan(ctx, "Create", service)
+	defer func() { endSpan(span, err) }()
+
 	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
 	logger.V(2).Info("Attempting to create VirtualMachineService")
 
-	vmService, err := s.lbServiceToVMService(service, clusterName)
+	namespace, err := s.namespaceFor(ctx, service)
 	if err != nil {
 		logger.Error(ErrCreateVMService, fmt.Sprintf("%v", err))
 		return nil, err
 	}
 
-	vmService, err = s.vmClient.V1alpha1().VirtualMachineServices(s.namespace).Create(ctx, vmService, metav1.CreateOptions{})
+	vmService, err := s.lbServiceToVMService(service, clusterName, namespace)
+	if err != nil {
+		logger.Error(ErrCreateVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	err = s.withCallTimeout(ctx, func(ctx context.Context) (err error) {
+		vmService, err = s.vmClient.V1alpha1().VirtualMachineServices(namespace).Create(ctx, vmService, metav1.CreateOptions{DryRun: s.dryRunOption()})
+		return err
+	})
 	if err != nil {
 		logger.Error(ErrCreateVMService, fmt.Sprintf("%v", err))
 		return nil, err
@@ -163,11 +407,22 @@ func (s *vmService) Create(ctx context.Context, service *v1.Service, clusterName
 	return vmService, nil
 }
 
-// CreateOrUpdate creates a vmservice to map to the given lb type of service
-func (s *vmService) CreateOrUpdate(ctx context.Context, service *v1.Service, clusterName string) (*vmopv1alpha1.VirtualMachineService, error) {
+// CreateOrUpdate creates a vmservice to map to the given lb type of service.
+// While the VirtualMachineService is not allocated an IP, it is returned along with
+// ErrVMServiceIPNotFound, callers should still inspect it, e.g. to record it on the Service.
+// Once it is rejected by the load balancer provider, ErrVMServiceFailed is returned instead.
+func (s *vmService) CreateOrUpdate(ctx context.Context, service *v1.Service, clusterName string) (_ *vmopv1alpha1.VirtualMachineService, err error) {
+	ctx, span := s.startSpan(ctx, "CreateOrUpdate", service)
+	defer func() { endSpan(span, err) }()
+
 	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
 	logger.V(2).Info("Attempting to create or update a VirtualMachineService")
 
+	if !s.ownsLoadBalancerClass(service) {
+		logger.V(2).Info("Skipping Service of another load balancer class", "loadBalancerClass", *service.Spec.LoadBalancerClass)
+		return nil, ErrNotOurLoadBalancerClass
+	}
+
 	if clusterName == "" {
 		logger.Error(ErrCreateVMService, "cluster name is required to create or update a vm service")
 		return nil, errors.Wrapf(ErrCreateVMService, "cluster name cannot be empty")
@@ -194,94 +449,631 @@ func (s *vmService) CreateOrUpdate(ctx context.Context, service *v1.Service, clu
 		}
 	}
 
-	vmServiceIP := getVMServiceIP(vmService)
-	if vmServiceIP == "" {
+	vmServiceIP, state := getVMServiceState(vmService)
+	switch state {
+	case StateFailed:
+		err = vmServiceFailure(vmService)
+		logger.Error(err, "VirtualMachineService will not be allocated an IP")
+		return vmService, err
+	case StatePending:
+		if s.dryRun {
+			// a VirtualMachineService that is not persisted is never allocated an IP
+			logger.V(2).Info("Dry run, VirtualMachineService IP is not allocated")
+			return vmService, nil
+		}
 		return vmService, ErrVMServiceIPNotFound
 	}
 
-	logger.V(2).Info("VirtualMachineService IP has been found")
+	logger.V(2).Info("VirtualMachineService IP has been found", "ip", vmServiceIP)
 
 	return vmService, err
 }
 
+// Apply server-side applies the vmservice mapping the given lb type of service.
+// Unlike CreateOrUpdate, it leaves merging to the API server, which only changes
+// the fields owned by FieldManager. Like Get, it applies to the VirtualMachineService
+// with the legacy name of service when there is none with its current name
+func (s *vmService) Apply(ctx context.Context, service *v1.Service, clusterName string) (_ *vmopv1alpha1.VirtualMachineService, err error) {
+	ctx, span := s.startSpan(ctx, "Apply", service)
+	defer func() { endSpan(span, err) }()
+
+	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
+	logger.V(2).Info("Attempting to apply VirtualMachineService")
+
+	if !s.ownsLoadBalancerClass(service) {
+		logger.V(2).Info("Skipping Service of another load balancer class", "loadBalancerClass", *service.Spec.LoadBalancerClass)
+		return nil, ErrNotOurLoadBalancerClass
+	}
+
+	if clusterName == "" {
+		logger.Error(ErrApplyVMService, "cluster name is required to apply a vm service")
+		return nil, errors.Wrapf(ErrApplyVMService, "cluster name cannot be empty")
+	}
+
+	namespace, err := s.namespaceFor(ctx, service)
+	if err != nil {
+		logger.Error(ErrApplyVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	vmService, err := s.lbServiceToVMService(service, clusterName, namespace)
+	if err != nil {
+		logger.Error(ErrApplyVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	if s.namer == nil {
+		// applying to the current name would leave a VirtualMachineService with the legacy
+		// name behind, serving the same Service
+		var existing *vmopv1alpha1.VirtualMachineService
+		existing, err = s.getByName(ctx, namespace, vmService.Name)
+		if err == nil && existing == nil {
+			existing, err = s.getLegacy(ctx, namespace, service, clusterName)
+			if existing != nil {
+				vmService.Name = existing.Name
+			}
+		}
+		if err != nil {
+			logger.Error(ErrApplyVMService, fmt.Sprintf("%v", err))
+			return nil, err
+		}
+	}
+
+	err = s.withCallTimeout(ctx, func(ctx context.Context) (err error) {
+		vmService, err = s.vmClient.V1alpha1().VirtualMachineServices(namespace).Apply(ctx, vmService, metav1.ApplyOptions{
+			FieldManager: FieldManager,
+			Force:        true,
+			DryRun:       s.dryRunOption(),
+		})
+		return err
+	})
+	if err != nil {
+		logger.Error(ErrApplyVMService, fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	logger.V(2).Info("Successfully applied VirtualMachineService")
+
+	switch _, state := getVMServiceState(vmService); state {
+	case StateFailed:
+		err = vmServiceFailure(vmService)
+		logger.Error(err, "VirtualMachineService will not be allocated an IP")
+		return vmService, err
+	case StatePending:
+		if s.dryRun {
+			// a VirtualMachineService that is not persisted is never allocated an IP
+			logger.V(2).Info("Dry run, VirtualMachineService IP is not allocated")
+			return vmService, nil
+		}
+		return vmService, ErrVMServiceIPNotFound
+	}
+
+	return vmService, nil
+}
+
+// WaitForLoadBalancerIP polls the VirtualMachineService of service until it is assigned an IP and
+// returns it. ErrVMServiceIPNotFound is returned when no IP is assigned within timeout, the
+// error of ctx when it is done first, and ErrVMServiceFailed as soon as the VirtualMachineService
+// is rejected by the load balancer provider.
+func (s *vmService) WaitForLoadBalancerIP(ctx context.Context, service *v1.Service, clusterName string, timeout time.Duration) (_ string, err error) {
+	ctx, span := s.startSpan(ctx, "WaitForLoadBalancerIP", service)
+	defer func() { endSpan(span, err) }()
+
+	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
+	logger.V(2).Info("Waiting for VirtualMachineService IP", "timeout", timeout)
+
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := WaitForLoadBalancerIPBackoff
+	for {
+		vmService, err := s.Get(pollCtx, service, clusterName)
+		if err != nil && pollCtx.Err() == nil {
+			return "", err
+		}
+		if vmService != nil {
+			switch ip, state := getVMServiceState(vmService); state {
+			case StateReady:
+				logger.V(2).Info("VirtualMachineService IP is assigned", "ip", ip)
+				return ip, nil
+			case StateFailed:
+				return "", vmServiceFailure(vmService)
+			}
+		}
+
+		select {
+		case <-pollCtx.Done():
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			logger.V(2).Info("Timed out waiting for VirtualMachineService IP")
+			return "", ErrVMServiceIPNotFound
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
 // Update updates a vmservice
-func (s *vmService) Update(ctx context.Context, service *v1.Service, clusterName string, vmService *vmopv1alpha1.VirtualMachineService) (*vmopv1alpha1.VirtualMachineService, error) {
+func (s *vmService) Update(ctx context.Context, service *v1.Service, clusterName string, vmService *vmopv1alpha1.VirtualMachineService) (_ *vmopv1alpha1.VirtualMachineService, err error) {
+	ctx, span := s.startSpan(ctx, "Update", service)
+	defer func() { endSpan(span, err) }()
+
 	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
 	logger.V(2).Info("Attempting to update VirtualMachineService")
 
-	// Compare the ports setting in service and vmService, update vmService if needed
-	ports, err := findPorts(service)
+	// When the VirtualMachineService was changed since it was read, the update
+	// conflicts and is retried on the latest VirtualMachineService
+	var namespace string
+	var updatedVMService *vmopv1alpha1.VirtualMachineService
+	attempts := 0
+	err = util.RetryOnError(util.DefaultRetry, apierrors.IsConflict, func() error {
+		attempts++
+		if attempts > 1 {
+			logger.V(2).Info("Update conflicted, retrying on the latest VirtualMachineService")
+			err := s.withCallTimeout(ctx, func(ctx context.Context) (err error) {
+				vmService, err = s.vmClient.V1alpha1().VirtualMachineServices(namespace).Get(ctx, vmService.Name, metav1.GetOptions{})
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		updatedVMService = vmService
+
+		newVMService := vmService.DeepCopy()
+
+		// VMService only has a few fields to be kept in sync, each of them is
+		// reconciled by its own fieldReconciler and all changes are applied in a
+		// single update
+		var needsUpdate bool
+		for _, reconcile := range s.fieldReconcilers() {
+			changed, err := reconcile(service, vmService, newVMService)
+			if err != nil {
+				return err
+			}
+			needsUpdate = needsUpdate || changed
+		}
+		if !needsUpdate {
+			return nil
+		}
+
+		if namespace == "" {
+			var err error
+			if namespace, err = s.namespaceFor(ctx, service); err != nil {
+				return err
+			}
+		}
+		return s.withCallTimeout(ctx, func(ctx context.Context) error {
+			updated, err := s.vmClient.V1alpha1().VirtualMachineServices(namespace).Update(ctx, newVMService, metav1.UpdateOptions{DryRun: s.dryRunOption()})
+			if err != nil {
+				return err
+			}
+			updatedVMService = updated
+			logger.V(2).Info("Successfully updated VirtualMachineService")
+			return nil
+		})
+	})
+	if apierrors.IsConflict(err) {
+		err = errors.Wrapf(ErrUpdateConflict, "giving up after %d attempts: %v", attempts, err)
+	}
 	if err != nil {
 		logger.Error(ErrUpdateVMService, fmt.Sprintf("%v", err))
 		return nil, err
 	}
-	vmServicePorts := vmService.Spec.Ports
 
-	newVMService := vmService.DeepCopy()
+	return updatedVMService, nil
+}
+
+// Delete deletes the vmservice mapped to the given lb type of service
+func (s *vmService) Delete(ctx context.Context, service *v1.Service, clusterName string) (err error) {
+	ctx, span := s.startSpan(ctx, "Delete", service)
+	defer func() { endSpan(span, err) }()
+
+	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
+	logger.V(2).Info("Attempting to delete VirtualMachineService")
+
+	if !s.ownsLoadBalancerClass(service) {
+		logger.V(2).Info("Skipping Service of another load balancer class", "loadBalancerClass", *service.Spec.LoadBalancerClass)
+		return ErrNotOurLoadBalancerClass
+	}
+
+	namespace, err := s.namespaceFor(ctx, service)
+	if err != nil {
+		logger.Error(ErrDeleteVMService, fmt.Sprintf("%v", err))
+		return err
+	}
+
+	name := s.GetVMServiceName(service, clusterName)
+	err = s.withCallTimeout(ctx, func(ctx context.Context) error {
+		return s.vmClient.V1alpha1().VirtualMachineServices(namespace).Delete(ctx, name, metav1.DeleteOptions{DryRun: s.dryRunOption()})
+	})
+	if apierrors.IsNotFound(err) {
+		// the VirtualMachineService may have been created with the legacy name
+		legacy, getErr := s.getLegacy(ctx, namespace, service, clusterName)
+		if getErr != nil {
+			err = getErr
+		} else if legacy != nil {
+			err = s.withCallTimeout(ctx, func(ctx context.Context) error {
+				return s.vmClient.V1alpha1().VirtualMachineServices(namespace).Delete(ctx, legacy.Name, metav1.DeleteOptions{DryRun: s.dryRunOption()})
+			})
+		}
+	}
+	if err != nil {
+		logger.Error(ErrDeleteVMService, fmt.Sprintf("%v", err))
+		return err
+	}
+
+	logger.V(2).Info("Successfully deleted VirtualMachineService")
+	return nil
+}
 
-	if vmService.Spec.LoadBalancerSourceRanges == nil {
-		vmService.Spec.LoadBalancerSourceRanges = []string{}
+// DeleteByName deletes the vmservice of the given name, for callers that recorded it and may
+// no longer compute it from the Service. namespace defaults to the cluster namespace when empty
+// and must otherwise be one of the allowed namespaces
+func (s *vmService) DeleteByName(ctx context.Context, namespace, vmServiceName string) (err error) {
+	if namespace == "" {
+		namespace = s.namespace
 	}
-	if service.Spec.LoadBalancerSourceRanges == nil {
-		service.Spec.LoadBalancerSourceRanges = []string{}
+	ctx, span := s.startNamedSpan(ctx, "DeleteByName", namespace, vmServiceName)
+	defer func() { endSpan(span, err) }()
+
+	logger := log.WithValues("vmServiceName", vmServiceName, "vmServiceNamespace", namespace)
+	logger.V(2).Info("Attempting to delete VirtualMachineService by name")
+
+	if namespace != s.namespace && !s.allowedNamespaces.Has(namespace) {
+		err = errors.Wrapf(ErrNamespaceNotAllowed, "%s", namespace)
+		logger.Error(ErrDeleteVMService, fmt.Sprintf("%v", err))
+		return err
+	}
+
+	err = s.withCallTimeout(ctx, func(ctx context.Context) error {
+		return s.vmClient.V1alpha1().VirtualMachineServices(namespace).Delete(ctx, vmServiceName, metav1.DeleteOptions{DryRun: s.dryRunOption()})
+	})
+	if err != nil {
+		logger.Error(ErrDeleteVMService, fmt.Sprintf("%v", err))
+		return err
+	}
+
+	logger.V(2).Info("Successfully deleted VirtualMachineService")
+	return nil
+}
+
+// DeleteRecorded deletes the VirtualMachineService of the given namespace and name recorded on
+// service, e.g. in an annotation, which may no longer be computed from the Service. Annotations
+// can be edited by the authors of Services, so it is only deleted if it is managed by the cloud
+// provider and labeled with service, and also with clusterName unless it is owned by the owner
+// reference of the cloud provider. Otherwise the recorded name is ignored and the
+// VirtualMachineService of service is deleted as by Delete.
+func (s *vmService) DeleteRecorded(ctx context.Context, service *v1.Service, clusterName, namespace, vmServiceName string) (err error) {
+	if namespace == "" {
+		namespace = s.namespace
 	}
+	ctx, span := s.startSpan(ctx, "DeleteRecorded", service)
+	defer func() { endSpan(span, err) }()
 
-	annotations := getVMServiceAnnotations(vmService, service)
+	logger := log.WithValues("name", service.Name, "namespace", service.Namespace, "vmServiceName", vmServiceName, "vmServiceNamespace", namespace)
+	if !s.ownsLoadBalancerClass(service) {
+		logger.V(2).Info("Skipping Service of another load balancer class", "loadBalancerClass", *service.Spec.LoadBalancerClass)
+		return ErrNotOurLoadBalancerClass
+	}
 
-	// VMService only has a few fields to be kept in sync so we will simply
-	// iterate over them
-	// As more fields are added, we need to consider adopting a patch helper
-	var needsUpdate bool
-	if !reflect.DeepEqual(vmServicePorts, ports) {
-		needsUpdate = true
-		newVMService.Spec.Ports = ports
+	if namespace != s.namespace && !s.allowedNamespaces.Has(namespace) {
+		logger.Info("Ignoring the recorded VirtualMachineService in a namespace that is not allowed")
+		return s.Delete(ctx, service, clusterName)
 	}
-	if vmService.Spec.LoadBalancerIP != service.Spec.LoadBalancerIP {
-		needsUpdate = true
-		newVMService.Spec.LoadBalancerIP = service.Spec.LoadBalancerIP
+	vmService, err := s.getByName(ctx, namespace, vmServiceName)
+	if err != nil {
+		logger.Error(ErrDeleteVMService, fmt.Sprintf("%v", err))
+		return err
 	}
-	if !reflect.DeepEqual(vmService.Spec.LoadBalancerSourceRanges, service.Spec.LoadBalancerSourceRanges) {
-		needsUpdate = true
-		newVMService.Spec.LoadBalancerSourceRanges = service.Spec.LoadBalancerSourceRanges
+	if vmService == nil {
+		return s.Delete(ctx, service, clusterName)
 	}
-	if !reflect.DeepEqual(vmService.Annotations, annotations) {
-		needsUpdate = true
-		newVMService.Annotations = annotations
+	if !s.isManaged(vmService) || vmService.Labels[LabelServiceNameKey] != service.Name || vmService.Labels[LabelServiceNameSpaceKey] != service.Namespace ||
+		(!s.isOwned(vmService) && vmService.Labels[LabelClusterNameKey] != clusterName) {
+		logger.Info("Ignoring the recorded VirtualMachineService, it does not belong to the Service",
+			"vmServiceLabels", vmService.Labels)
+		return s.Delete(ctx, service, clusterName)
 	}
+	return s.DeleteByName(ctx, namespace, vmServiceName)
+}
+
+// ListManaged returns the VirtualMachineServices of the Services of clusterName, in the cluster
+// namespace and the allowed namespaces. Only those labeled with their Service are returned, in
+// the cluster namespace only those that are also owned by the owner reference of the cloud provider.
+func (s *vmService) ListManaged(ctx context.Context, clusterName string) ([]*vmopv1alpha1.VirtualMachineService, error) {
+	logger := log.WithValues("clusterName", clusterName)
+	logger.V(2).Info("Attempting to list managed VirtualMachineServices")
 
-	if needsUpdate {
-		newVMService, err = s.vmClient.V1alpha1().VirtualMachineServices(s.namespace).Update(ctx, newVMService, metav1.UpdateOptions{})
+	selector := labels.Set{LabelClusterNameKey: clusterName}.String()
+	namespaces := append([]string{s.namespace}, sets.List(s.allowedNamespaces.Clone().Delete(s.namespace))...)
+	var managed []*vmopv1alpha1.VirtualMachineService
+	for _, namespace := range namespaces {
+		var list *vmopv1alpha1.VirtualMachineServiceList
+		err := s.withCallTimeout(ctx, func(ctx context.Context) (err error) {
+			list, err = s.vmClient.V1alpha1().VirtualMachineServices(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+			return err
+		})
 		if err != nil {
-			logger.Error(ErrUpdateVMService, fmt.Sprintf("%v", err))
+			err = errors.Wrapf(ErrListVMServices, "in namespace %s: %v", namespace, err)
+			logger.Error(err, "Failed to list managed VirtualMachineServices")
 			return nil, err
 		}
-
-		logger.V(2).Info("Successfully updated VirtualMachineService")
-		return newVMService, nil
+		for i := range list.Items {
+			if s.isManaged(&list.Items[i]) {
+				managed = append(managed, &list.Items[i])
+			}
+		}
 	}
+	return managed, nil
+}
 
-	return vmService, nil
+// isManaged returns whether vmService is labeled with its cluster and Service and, in the
+// cluster namespace, owned by the owner reference of the cloud provider. Owner references
+// cannot cross namespaces, so in the allowed namespaces the labels are all there is to go by.
+func (s *vmService) isManaged(vmService *vmopv1alpha1.VirtualMachineService) bool {
+	if vmService.Labels[LabelClusterNameKey] == "" || vmService.Labels[LabelServiceNameKey] == "" || vmService.Labels[LabelServiceNameSpaceKey] == "" {
+		return false
+	}
+	if vmService.Namespace != s.namespace {
+		return s.allowedNamespaces.Has(vmService.Namespace)
+	}
+	return s.isOwned(vmService)
 }
 
-// Delete deletes the vmservice mapped to the given lb type of service
-func (s *vmService) Delete(ctx context.Context, service *v1.Service, clusterName string) error {
-	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
-	logger.V(2).Info("Attempting to delete VirtualMachineService")
+// isOwned returns whether vmService is owned by the owner reference of the cloud provider
+func (s *vmService) isOwned(vmService *vmopv1alpha1.VirtualMachineService) bool {
+	if s.ownerReference == nil {
+		return false
+	}
+	for _, ref := range vmService.OwnerReferences {
+		if ref.UID == s.ownerReference.UID {
+			return true
+		}
+	}
+	return false
+}
 
-	err := s.vmClient.V1alpha1().VirtualMachineServices(s.namespace).Delete(ctx, s.GetVMServiceName(service, clusterName), metav1.DeleteOptions{})
+// DeleteOrphaned deletes the VirtualMachineServices returned by ListManaged whose Service is
+// not one of liveServices, e.g. because it was deleted while the cloud provider was down.
+// A failure to delete one does not stop the others from being deleted, the first is returned.
+func (s *vmService) DeleteOrphaned(ctx context.Context, clusterName string, liveServices []*v1.Service) error {
+	managed, err := s.ListManaged(ctx, clusterName)
 	if err != nil {
-		logger.Error(ErrDeleteVMService, fmt.Sprintf("%v", err))
 		return err
 	}
 
-	logger.V(2).Info("Successfully deleted VirtualMachineService")
+	live := sets.New[types.NamespacedName]()
+	for _, service := range liveServices {
+		live.Insert(types.NamespacedName{Namespace: service.Namespace, Name: service.Name})
+	}
+	var firstErr error
+	for _, vmService := range managed {
+		owner := types.NamespacedName{Namespace: vmService.Labels[LabelServiceNameSpaceKey], Name: vmService.Labels[LabelServiceNameKey]}
+		if live.Has(owner) {
+			continue
+		}
+		log.Info("Deleting orphaned VirtualMachineService", "vmServiceName", vmService.Name, "vmServiceNamespace", vmService.Namespace, "service", owner.String())
+		if err := s.DeleteByName(ctx, vmService.Namespace, vmService.Name); err != nil && !apierrors.IsNotFound(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fieldReconciler syncs a single field of newVMService, a copy of the
+// existing vmService, with the given service and reports whether it changed
+type fieldReconciler func(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error)
+
+// fieldReconcilers lists the VirtualMachineService fields kept in sync by Update
+func (s *vmService) fieldReconcilers() []fieldReconciler {
+	return []fieldReconciler{
+		reconcilePorts,
+		s.reconcileSelector,
+		reconcileLoadBalancerIP,
+		reconcileLoadBalancerSourceRanges,
+		s.reconcileAnnotations,
+		reconcileExternalIPs,
+		s.reconcileProvider,
+	}
+}
+
+func reconcilePorts(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	ports, err := findPorts(service)
+	if err != nil {
+		return false, err
+	}
+	if portsEqual(vmService.Spec.Ports, ports) {
+		return false, nil
+	}
+	newVMService.Spec.Ports = ports
+	return true, nil
+}
+
+// portsEqual returns whether current and desired hold the same ports, in any order, so that
+// the supervisor reordering the ports does not cause an update. Ports are keyed by name,
+// which is unique among the ports of a Service.
+func portsEqual(current, desired []vmopv1alpha1.VirtualMachineServicePort) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	byName := make(map[string]vmopv1alpha1.VirtualMachineServicePort, len(current))
+	for _, port := range current {
+		byName[port.Name] = port
+	}
+	if len(byName) != len(current) {
+		// duplicate names cannot be matched by name
+		return reflect.DeepEqual(current, desired)
+	}
+	for _, port := range desired {
+		if currentPort, found := byName[port.Name]; !found || currentPort != port {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *vmService) reconcileSelector(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	clusterName := vmService.Labels[LabelClusterNameKey]
+	if clusterName == "" {
+		// the selector cannot be computed without the cluster name label
+		return false, nil
+	}
+	if s.migrationMode && len(vmService.Spec.Selector) != 0 {
+		// the worker vms may not all carry the labels of the new selector yet
+		return false, nil
+	}
+	selector := nodeSelector(clusterName, s.isLegacy)
+	if reflect.DeepEqual(vmService.Spec.Selector, selector) {
+		return false, nil
+	}
+	newVMService.Spec.Selector = selector
+	return true, nil
+}
+
+func reconcileLoadBalancerIP(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	if vmService.Spec.LoadBalancerIP == service.Spec.LoadBalancerIP {
+		return false, nil
+	}
+	newVMService.Spec.LoadBalancerIP = service.Spec.LoadBalancerIP
+	return true, nil
+}
+
+func reconcileLoadBalancerSourceRanges(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	// nil and empty source ranges are equivalent
+	current := vmService.Spec.LoadBalancerSourceRanges
+	if current == nil {
+		current = []string{}
+	}
+	desired := service.Spec.LoadBalancerSourceRanges
+	if desired == nil {
+		desired = []string{}
+	}
+	if reflect.DeepEqual(current, desired) {
+		return false, nil
+	}
+	newVMService.Spec.LoadBalancerSourceRanges = desired
+	return true, nil
+}
+
+// managedAnnotationKeys lists the VirtualMachineService annotations owned by the cloud provider.
+// Other annotations, such as those added by the supervisor cluster, are left untouched.
+var managedAnnotationKeys = []string{
+	AnnotationServiceExternalTrafficPolicyKey,
+	AnnotationServiceHealthCheckNodePortKey,
+	AnnotationLoadBalancerIdleTimeoutKey,
+	AnnotationPropagatedKeysKey,
+}
+
+// excludedAnnotations lists the Service annotations that are never propagated to the
+// VirtualMachineService, because the cloud provider handles them itself.
+// Options.ExcludedAnnotations add to them, but never remove any.
+var excludedAnnotations = []string{
+	v1.LastAppliedConfigAnnotation,
+	AnnotationServiceExternalTrafficPolicyKey,
+	AnnotationServiceHealthCheckNodePortKey,
+	AnnotationVMServiceNamespaceKey,
+	AnnotationVMServiceProviderKey,
+	AnnotationServiceIdleTimeoutKey,
+}
+
+// reconcileAnnotations reconciles the managed annotations and those propagated from service,
+// including the previously propagated ones service dropped since.
+func (s *vmService) reconcileAnnotations(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	desired, err := s.vmServiceAnnotations(service)
+	if err != nil {
+		return false, err
+	}
+	keys := sets.New(managedAnnotationKeys...)
+	if previous := vmService.Annotations[AnnotationPropagatedKeysKey]; previous != "" {
+		keys.Insert(strings.Split(previous, ",")...)
+	}
+	for key := range desired {
+		keys.Insert(key)
+	}
+	var changed bool
+	for _, key := range sets.List(keys) {
+		current, exists := vmService.Annotations[key]
+		value, wanted := desired[key]
+		switch {
+		case wanted && (!exists || current != value):
+			if newVMService.Annotations == nil {
+				newVMService.Annotations = make(map[string]string)
+			}
+			newVMService.Annotations[key] = value
+			changed = true
+		case !wanted && exists:
+			delete(newVMService.Annotations, key)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// reconcileExternalIPs validates the externalIPs of service. They have no VirtualMachineServiceSpec
+// counterpart in this vm-operator API version and are skipped, so it never reports a change.
+func reconcileExternalIPs(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	return false, checkExternalIPs(service)
+}
+
+// reconcileProvider validates the load balancer provider requested by service. It has no
+// VirtualMachineServiceSpec counterpart in this vm-operator API version and is skipped, so it
+// never reports a change.
+func (s *vmService) reconcileProvider(service *v1.Service, vmService, newVMService *vmopv1alpha1.VirtualMachineService) (bool, error) {
+	return false, s.checkProvider(service)
+}
+
+// checkProvider returns ErrProviderNotAllowed if the load balancer provider requested by service
+// is not one of the allowed providers, and logs that allowed providers are skipped.
+func (s *vmService) checkProvider(service *v1.Service) error {
+	provider, found := service.Annotations[AnnotationVMServiceProviderKey]
+	if !found {
+		return nil
+	}
+	if !s.allowedProviders.Has(provider) {
+		return errors.Wrapf(ErrProviderNotAllowed, "%q", provider)
+	}
+	log.WithValues("name", service.Name, "namespace", service.Namespace).V(2).Info(
+		"Skipping load balancer provider, it is not supported by the VirtualMachineService API version", "provider", provider)
+	return nil
+}
+
+// checkExternalIPs returns ErrInvalidExternalIP if an externalIP of service cannot be parsed,
+// and logs that valid externalIPs are skipped.
+func checkExternalIPs(service *v1.Service) error {
+	if len(service.Spec.ExternalIPs) == 0 {
+		return nil
+	}
+	for _, ip := range service.Spec.ExternalIPs {
+		if net.ParseIP(ip) == nil {
+			return errors.Wrapf(ErrInvalidExternalIP, "%q", ip)
+		}
+	}
+	log.WithValues("name", service.Name, "namespace", service.Namespace).Info(
+		"Skipping externalIPs, they are not supported by the VirtualMachineService API version", "externalIPs", service.Spec.ExternalIPs)
 	return nil
 }
 
+// findPorts maps the ports of service to VirtualMachineService ports targeting their node port
+// on the worker vms. The Service targetPort, whether numeric, named or unset, is never used:
+// kube-proxy forwards the node port to the targetPort of each endpoint, which resolves named
+// target ports per endpoint. Every port thus needs a node port, and its protocol, TCP, UDP or
+// SCTP, is passed on as is.
+// Services with allocateLoadBalancerNodePorts disabled have no node ports, their ports target
+// the numeric targetPort, or the port when unset, on the worker vms instead.
 func findPorts(service *v1.Service) ([]vmopv1alpha1.VirtualMachineServicePort, error) {
+	if len(service.Spec.Ports) == 0 {
+		return nil, ErrNoPortsDefined
+	}
+	if nodePortsDisabled(service) {
+		return findTargetPorts(service)
+	}
 	var ports []vmopv1alpha1.VirtualMachineServicePort
 	for _, port := range service.Spec.Ports {
 		if port.NodePort == 0 {
+			if nodePortPending(service) {
+				return nil, errors.Wrapf(ErrNodePortPending, fmt.Sprintf("port %s", port.Name))
+			}
 			return nil, errors.Wrapf(ErrNodePortNotFound, fmt.Sprintf("port %s", port.Name))
 		}
 		ports = append(ports, vmopv1alpha1.VirtualMachineServicePort{
@@ -294,31 +1086,72 @@ func findPorts(service *v1.Service) ([]vmopv1alpha1.VirtualMachineServicePort, e
 	return ports, nil
 }
 
-func (s *vmService) lbServiceToVMService(service *v1.Service, clusterName string) (*vmopv1alpha1.VirtualMachineService, error) {
+// nodePortsDisabled returns whether service opted out of node ports with allocateLoadBalancerNodePorts
+func nodePortsDisabled(service *v1.Service) bool {
+	return service.Spec.AllocateLoadBalancerNodePorts != nil && !*service.Spec.AllocateLoadBalancerNodePorts
+}
+
+// findTargetPorts maps the ports of service to VirtualMachineService ports targeting their
+// targetPort on the worker vms, for Services without node ports. Named target ports are resolved
+// per endpoint by kube-proxy and cannot be targeted on the worker vms.
+func findTargetPorts(service *v1.Service) ([]vmopv1alpha1.VirtualMachineServicePort, error) {
+	var ports []vmopv1alpha1.VirtualMachineServicePort
+	for _, port := range service.Spec.Ports {
+		targetPort := port.Port
+		switch {
+		case port.TargetPort.Type == intstr.String && port.TargetPort.StrVal != "":
+			return nil, errors.Wrapf(ErrNamedTargetPort, "port %s targets %q", port.Name, port.TargetPort.StrVal)
+		case port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal != 0:
+			targetPort = port.TargetPort.IntVal
+		}
+		ports = append(ports, vmopv1alpha1.VirtualMachineServicePort{
+			Name:       port.Name,
+			Port:       port.Port,
+			TargetPort: targetPort,
+			Protocol:   string(port.Protocol),
+		})
+	}
+	return ports, nil
+}
+
+// nodePortPending returns whether the missing node ports of service are still being allocated,
+// which is the case for a Service with Local externalTrafficPolicy that already has its
+// healthCheckNodePort allocated.
+func nodePortPending(service *v1.Service) bool {
+	return service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal &&
+		service.Spec.HealthCheckNodePort != 0
+}
+
+func (s *vmService) lbServiceToVMService(service *v1.Service, clusterName, namespace string) (*vmopv1alpha1.VirtualMachineService, error) {
+	name := s.GetVMServiceName(service, clusterName)
+	if len(name) > s.maxNameLen {
+		return nil, errors.Wrapf(ErrVMServiceNameTooLong, "%s exceeds %d characters", name, s.maxNameLen)
+	}
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return nil, errors.Wrapf(ErrInvalidVMServiceName, "%q: %s", name, strings.Join(errs, ", "))
+	}
 	ports, err := findPorts(service)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkExternalIPs(service); err != nil {
+		return nil, err
+	}
+	if err := s.checkProvider(service); err != nil {
+		return nil, err
+	}
 	vmServiceSpec := vmopv1alpha1.VirtualMachineServiceSpec{
-		Type:  vmopv1alpha1.VirtualMachineServiceTypeLoadBalancer,
-		Ports: ports,
-		Selector: map[string]string{
-			ClusterSelectorKey: clusterName,
-			NodeSelectorKey:    NodeRole,
-		},
+		Type:     vmopv1alpha1.VirtualMachineServiceTypeLoadBalancer,
+		Ports:    ports,
+		Selector: nodeSelector(clusterName, s.isLegacy),
 		// When service has spec.loadBalancerIP specified, pass it to the
 		// corresponding VirtualMachineService
 		LoadBalancerIP: service.Spec.LoadBalancerIP,
 		// When service has spec.LoadBalancerSourceRanges specified,
 		// pass it to the corresponding VirtualMachineService
 		LoadBalancerSourceRanges: service.Spec.LoadBalancerSourceRanges,
-	}
-
-	if IsLegacy {
-		vmServiceSpec.Selector = map[string]string{
-			LegacyClusterSelectorKey: clusterName,
-			LegacyNodeSelectorKey:    NodeRole,
-		}
+		// spec.sessionAffinity has no VirtualMachineServiceSpec counterpart
+		// in this vm-operator API version, the load balancer warns about it
 	}
 
 	label := map[string]string{
@@ -334,23 +1167,120 @@ func (s *vmService) lbServiceToVMService(service *v1.Service, clusterName string
 		},
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: label,
-			Name:   s.GetVMServiceName(service, clusterName),
-			OwnerReferences: []metav1.OwnerReference{
-				*s.ownerReference,
-			},
+			Name:   name,
 		},
 		Spec: vmServiceSpec,
 	}
+	// Owner references cannot cross namespaces, VirtualMachineServices in other
+	// namespaces than the cluster's are not garbage collected with it
+	if namespace == s.namespace {
+		vmService.OwnerReferences = []metav1.OwnerReference{
+			*s.ownerReference,
+		}
+	}
 
-	if annotations := getVMServiceAnnotations(vmService, service); len(annotations) != 0 {
+	annotations, err := s.vmServiceAnnotations(service)
+	if err != nil {
+		return nil, err
+	}
+	if len(annotations) != 0 {
 		vmService.Annotations = annotations
 	}
 
 	return vmService, nil
 }
 
-func getVMServiceAnnotations(vmService *vmopv1alpha1.VirtualMachineService, service *v1.Service) map[string]string {
-	var annotations map[string]string
+// nodeSelector returns the selector of the worker vms of the cluster: the capv labels, or the
+// legacy capw labels if isLegacy is set
+func nodeSelector(clusterName string, isLegacy bool) map[string]string {
+	if isLegacy {
+		return map[string]string{
+			LegacyClusterSelectorKey: clusterName,
+			LegacyNodeSelectorKey:    NodeRole,
+		}
+	}
+	return map[string]string{
+		ClusterSelectorKey: clusterName,
+		NodeSelectorKey:    NodeRole,
+	}
+}
+
+// vmServiceAnnotations returns the managed annotations of the VirtualMachineService of service
+// and those propagated from service, which are recorded in AnnotationPropagatedKeysKey.
+func (s *vmService) vmServiceAnnotations(service *v1.Service) (map[string]string, error) {
+	annotations, err := getVMServiceAnnotations(service)
+	if err != nil {
+		return nil, err
+	}
+	propagated, err := s.propagatedAnnotations(service)
+	if err != nil {
+		return nil, err
+	}
+	if len(propagated) == 0 {
+		return annotations, nil
+	}
+	for key, value := range propagated {
+		annotations[key] = value
+	}
+	annotations[AnnotationPropagatedKeysKey] = strings.Join(sets.List(sets.KeySet(propagated)), ",")
+	return annotations, nil
+}
+
+// propagatedAnnotations returns the annotations of service other than the excluded ones with
+// the keys returned by the annotation transform, leaving out those it drops. None are propagated
+// without an annotation transform. It returns ErrInvalidAnnotation if the annotation validator
+// rejects one of them.
+func (s *vmService) propagatedAnnotations(service *v1.Service) (map[string]string, error) {
+	if s.annotationTransform == nil {
+		return nil, nil
+	}
+	logger := log.WithValues("name", service.Name, "namespace", service.Namespace)
+	managed := sets.New(managedAnnotationKeys...).Insert(AnnotationLoadBalancerProviderKey)
+	propagated := make(map[string]string)
+	// sorted, so that the first invalid annotation is reported consistently
+	for _, key := range sets.List(sets.KeySet(service.Annotations)) {
+		value := service.Annotations[key]
+		if s.excludedAnnotations.Has(key) {
+			continue
+		}
+		newKey, keep := s.annotationTransform(key)
+		if !keep || newKey == "" {
+			continue
+		}
+		if managed.Has(newKey) {
+			logger.V(2).Info("Not propagating annotation over a managed VirtualMachineService annotation", "annotation", key, "key", newKey)
+			continue
+		}
+		if s.annotationValidator != nil {
+			if err := s.annotationValidator(key, value); err != nil {
+				return nil, errors.Wrapf(ErrInvalidAnnotation, "%s=%q: %v", key, value, err)
+			}
+		}
+		propagated[newKey] = value
+	}
+	return propagated, nil
+}
+
+// EnumAnnotationValidator returns an AnnotationValidator accepting the values of the annotations
+// in allowedValues among those listed for their key. Other annotations are not validated.
+func EnumAnnotationValidator(allowedValues map[string][]string) AnnotationValidator {
+	allowed := make(map[string]sets.Set[string], len(allowedValues))
+	for key, values := range allowedValues {
+		allowed[key] = sets.New(values...)
+	}
+	return func(key, value string) error {
+		values, known := allowed[key]
+		if !known || values.Has(value) {
+			return nil
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(sets.List(values), ", "))
+	}
+}
+
+// getVMServiceAnnotations returns the managed annotations of the VirtualMachineService of service,
+// or ErrInvalidIdleTimeout if its idle timeout annotation is not a positive integer.
+func getVMServiceAnnotations(service *v1.Service) (map[string]string, error) {
+	annotations := make(map[string]string)
 	// When ExternalTrafficPolicy is set to Local in the Service, add its
 	// value and the healthCheckNodePort to VirtualMachineService
 	// labels
@@ -358,11 +1288,66 @@ func getVMServiceAnnotations(vmService *vmopv1alpha1.VirtualMachineService, serv
 	// the default value, also there will be no HealthCheckNodePort
 	// allocated in that case
 	if service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
-		annotations = make(map[string]string)
 		annotations[AnnotationServiceExternalTrafficPolicyKey] = string(service.Spec.ExternalTrafficPolicy)
 		annotations[AnnotationServiceHealthCheckNodePortKey] = strconv.Itoa(int(service.Spec.HealthCheckNodePort))
 	}
-	return annotations
+	if value, found := service.Annotations[AnnotationServiceIdleTimeoutKey]; found {
+		seconds, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || seconds <= 0 {
+			return nil, errors.Wrapf(ErrInvalidIdleTimeout, "%q", value)
+		}
+		annotations[AnnotationLoadBalancerIdleTimeoutKey] = strconv.FormatInt(seconds, 10)
+	}
+	return annotations, nil
+}
+
+// GetLoadBalancerProvider returns the name of the load balancer provider that
+// serviced the VirtualMachineService, or an empty string if it is not known.
+func GetLoadBalancerProvider(vmService *vmopv1alpha1.VirtualMachineService) string {
+	return vmService.Annotations[AnnotationLoadBalancerProviderKey]
+}
+
+// getVMServiceState returns the IP of vmService and its provisioning state. A VirtualMachineService
+// allocated an IP is Ready. One that is not is Failed if its status reports a failed Ready
+// condition, see failedCondition, and Pending otherwise.
+func getVMServiceState(vmService *vmopv1alpha1.VirtualMachineService) (string, State) {
+	if ip := getVMServiceIP(vmService); ip != "" {
+		return ip, StateReady
+	}
+	if _, failed := failedCondition(&vmService.Status); failed {
+		return "", StateFailed
+	}
+	return "", StatePending
+}
+
+// vmServiceFailure returns ErrVMServiceFailed with the reason and message of the failed
+// condition of vmService
+func vmServiceFailure(vmService *vmopv1alpha1.VirtualMachineService) error {
+	message, _ := failedCondition(&vmService.Status)
+	return errors.Wrapf(ErrVMServiceFailed, "%s/%s: %s", vmService.Namespace, vmService.Name, message)
+}
+
+// failedCondition returns the reason and message of the Ready condition of status, a pointer to
+// a VirtualMachineServiceStatus, if it is False with severity Error. The conditions are read from
+// the unstructured status, as the VirtualMachineServiceStatus of the vm-operator API version in
+// use has none. A status without conditions is never failed.
+func failedCondition(status interface{}) (string, bool) {
+	unstructuredStatus, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return "", false
+	}
+	conditions, _ := unstructuredStatus["conditions"].([]interface{})
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		field := func(key string) string {
+			value, _ := condition[key].(string)
+			return value
+		}
+		if field("type") == "Ready" && field("status") == string(metav1.ConditionFalse) && field("severity") == "Error" {
+			return fmt.Sprintf("%s: %s", field("reason"), field("message")), true
+		}
+	}
+	return "", false
 }
 
 func getVMServiceIP(vmService *vmopv1alpha1.VirtualMachineService) string {
@@ -18,25 +18,40 @@ package vmservice
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	vmopv1alpha1 "github.com/vmware-tanzu/vm-operator-api/api/v1alpha1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/api/node/v1alpha1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	rest "k8s.io/client-go/rest"
 	clientgotesting "k8s.io/client-go/testing"
 
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 
+	vmop "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmoperator"
 	vmopclient "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphereparavirtual/vmoperator/client"
+	"k8s.io/cloud-provider-vsphere/pkg/util"
 )
 
 var (
@@ -79,7 +94,7 @@ func initTest() (*v1.Service, VMService, *dynamicfake.FakeDynamicClient) {
 	scheme := runtime.NewScheme()
 	_ = vmopv1alpha1.AddToScheme(scheme)
 	fc := dynamicfake.NewSimpleDynamicClient(scheme)
-	vms = NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference)
+	vms = NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{})
 	return testK8sService, vms, fc
 }
 
@@ -102,7 +117,7 @@ func TestNewVMService(t *testing.T) {
 			assert.NoError(t, err)
 			assert.NotEqual(t, client, nil)
 
-			realVms := NewVMService(client, testClusterNameSpace, &testOwnerReference)
+			realVms := NewVMService(client, testClusterNameSpace, &testOwnerReference, Options{})
 			assert.NotEqual(t, realVms, nil)
 		})
 	}
@@ -117,11 +132,97 @@ func TestGetVMServiceName(t *testing.T) {
 		},
 	}
 	name := vms.GetVMServiceName(k8sService, testClustername)
-	hashStr := vms.(*vmService).hashString(testK8sServiceName + "." + testK8sServiceNameSpace)
+	hashStr := vms.(*vmService).hashString(testClustername + "/" + testK8sServiceName + "." + testK8sServiceNameSpace)
 	expectedName := testClustername + "-" + hashStr[:MaxCheckSumLen]
 	assert.Equal(t, name, expectedName)
 }
 
+func TestGetVMService_CrossClusterCollision(t *testing.T) {
+	testK8sService, vms, _ := initTest()
+	const otherClusterName = "other-cluster"
+	client := vms.(*vmService).vmClient.V1alpha1().VirtualMachineServices(testClusterNameSpace)
+
+	// a cluster sharing the supervisor namespace has a Service of the same name
+	otherVMService, err := vms.Create(context.Background(), testK8sService, otherClusterName)
+	assert.NoError(t, err)
+	assert.NotEqual(t, vms.GetVMServiceName(testK8sService, otherClusterName), vms.GetVMServiceName(testK8sService, testClustername))
+	vmService, err := vms.Get(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+	assert.Nil(t, vmService)
+
+	// its VirtualMachineService is never mistaken for ours
+	colliding := otherVMService.DeepCopy()
+	colliding.Name = vms.GetVMServiceName(testK8sService, testClustername)
+	colliding.ResourceVersion = ""
+	_, err = client.Create(context.Background(), colliding, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	vmService, err = vms.Get(context.Background(), testK8sService, testClustername)
+	assert.ErrorIs(t, err, ErrVMServiceNameCollision)
+	assert.Nil(t, vmService)
+}
+
+func TestVMService_LegacyName(t *testing.T) {
+	testCases := []struct {
+		name        string
+		clusterName string
+		expectFound bool
+	}{
+		{
+			name:        "when the legacy VMService belongs to the Service",
+			clusterName: testClustername,
+			expectFound: true,
+		},
+		{
+			name:        "when the legacy VMService belongs to another cluster",
+			clusterName: "other-cluster",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, fc := initTest()
+			client := vms.(*vmService).vmClient.V1alpha1().VirtualMachineServices(testClusterNameSpace)
+
+			// a VirtualMachineService created before the cluster name was hashed into its name
+			legacy, err := vms.(*vmService).lbServiceToVMService(testK8sService, testCase.clusterName, testClusterNameSpace)
+			assert.NoError(t, err)
+			legacy.Name = vms.(*vmService).legacyVMServiceName(testK8sService, testClustername)
+			_, err = client.Create(context.Background(), legacy, metav1.CreateOptions{})
+			assert.NoError(t, err)
+
+			vmService, err := vms.Get(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			if !testCase.expectFound {
+				assert.Nil(t, vmService)
+				err = vms.Delete(context.Background(), testK8sService, testClustername)
+				assert.True(t, apierrors.IsNotFound(err))
+				_, err = client.Get(context.Background(), legacy.Name, metav1.GetOptions{})
+				assert.NoError(t, err)
+				return
+			}
+			if assert.NotNil(t, vmService) {
+				assert.Equal(t, legacy.Name, vmService.Name)
+			}
+
+			var applied string
+			fc.PrependReactor("patch", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+				patch := action.(clientgotesting.PatchAction)
+				applied = patch.GetName()
+				obj := &unstructured.Unstructured{}
+				return true, obj, json.Unmarshal(patch.GetPatch(), &obj.Object)
+			})
+			_, err = vms.Apply(context.Background(), testK8sService, testClustername)
+			assert.ErrorIs(t, err, ErrVMServiceIPNotFound)
+			assert.Equal(t, legacy.Name, applied)
+
+			err = vms.Delete(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			_, err = client.Get(context.Background(), legacy.Name, metav1.GetOptions{})
+			assert.True(t, apierrors.IsNotFound(err))
+		})
+	}
+}
+
 func TestGetVMService_ReturnNil(t *testing.T) {
 	_, vms, _ := initTest()
 	k8sService := &v1.Service{
@@ -137,15 +238,9 @@ func TestGetVMService_ReturnNil(t *testing.T) {
 
 func TestGetVMService(t *testing.T) {
 	testK8sService, vms, _ := initTest()
-	k8sService := &v1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      testK8sServiceName,
-			Namespace: testK8sServiceNameSpace,
-		},
-	}
 	// create a fake VMService
-	createdVMService, _ := vms.Create(context.Background(), k8sService, testClustername)
-	vmService, err := vms.Get(context.Background(), k8sService, testClustername)
+	createdVMService, _ := vms.Create(context.Background(), testK8sService, testClustername)
+	vmService, err := vms.Get(context.Background(), testK8sService, testClustername)
 	assert.NoError(t, err)
 	assert.Equal(t, (*vmService).Spec, (*createdVMService).Spec)
 
@@ -173,8 +268,143 @@ func TestCreateVMService(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCreateVMService_NameLength(t *testing.T) {
+	testCases := []struct {
+		name          string
+		clusterName   string
+		nameSuffixLen int
+		maxNameLen    int
+		expectedErr   error
+	}{
+		{
+			name:        "default suffix with a cluster name at the length limit",
+			clusterName: strings.Repeat("c", MaxVMServiceNameLen-1-MaxCheckSumLen),
+		},
+		{
+			name:        "default suffix with a cluster name over the length limit",
+			clusterName: strings.Repeat("c", MaxVMServiceNameLen-MaxCheckSumLen),
+			expectedErr: ErrVMServiceNameTooLong,
+		},
+		{
+			name:          "longer suffix with a cluster name at the length limit",
+			clusterName:   strings.Repeat("c", MaxVMServiceNameLen-1-32),
+			nameSuffixLen: 32,
+		},
+		{
+			name:          "longer suffix with a cluster name over the length limit",
+			clusterName:   strings.Repeat("c", MaxVMServiceNameLen-32),
+			nameSuffixLen: 32,
+			expectedErr:   ErrVMServiceNameTooLong,
+		},
+		{
+			name:        "shorter name budget",
+			clusterName: strings.Repeat("c", 20),
+			maxNameLen:  41,
+			expectedErr: ErrVMServiceNameTooLong,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{NameSuffixLen: testCase.nameSuffixLen, MaxNameLen: testCase.maxNameLen})
+
+			vmService, err := vms.Create(context.Background(), testK8sService, testCase.clusterName)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			suffixLen := testCase.nameSuffixLen
+			if suffixLen == 0 {
+				suffixLen = MaxCheckSumLen
+			}
+			assert.Len(t, vmService.Name, len(testCase.clusterName)+1+suffixLen)
+		})
+	}
+}
+
+func TestCreateVMService_Namer(t *testing.T) {
+	testCases := []struct {
+		name         string
+		namer        Namer
+		expectedName string
+		expectedErr  error
+	}{
+		{
+			name: "custom name",
+			namer: func(service *v1.Service, clusterName string) string {
+				return "lb-" + clusterName + "-" + service.Name
+			},
+			expectedName: "lb-" + testClustername + "-" + testK8sServiceName,
+		},
+		{
+			name: "name that is not a DNS-1123 label",
+			namer: func(service *v1.Service, clusterName string) string {
+				return clusterName + "/" + service.Name
+			},
+			expectedErr: ErrInvalidVMServiceName,
+		},
+		{
+			name: "name over the length limit",
+			namer: func(service *v1.Service, clusterName string) string {
+				return strings.Repeat("n", MaxVMServiceNameLen+1)
+			},
+			expectedErr: ErrVMServiceNameTooLong,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{Namer: testCase.namer})
+
+			vmService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedName, vmService.Name)
+			assert.Equal(t, testCase.expectedName, vms.GetVMServiceName(testK8sService, testClustername))
+
+			vmService, err = vms.Get(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			if assert.NotNil(t, vmService) {
+				assert.Equal(t, testCase.expectedName, vmService.Name)
+			}
+		})
+	}
+}
+
+func TestVMService_NamerSkipsLegacyName(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	client := vms.(*vmService).vmClient.V1alpha1().VirtualMachineServices(testClusterNameSpace)
+
+	legacy, err := vms.(*vmService).lbServiceToVMService(testK8sService, testClustername, testClusterNameSpace)
+	assert.NoError(t, err)
+	legacy.Name = vms.(*vmService).legacyVMServiceName(testK8sService, testClustername)
+	_, err = client.Create(context.Background(), legacy, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	named := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{
+		Namer: func(service *v1.Service, clusterName string) string {
+			return "lb-" + clusterName + "-" + service.Name
+		},
+	})
+	vmService, err := named.Get(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+	assert.Nil(t, vmService)
+
+	err = named.Delete(context.Background(), testK8sService, testClustername)
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = client.Get(context.Background(), legacy.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
 func TestCreateVMServiceWithLegacySelector(t *testing.T) {
-	testK8sService, vms, _ := initTest()
+	testK8sService, _, fc := initTest()
+	vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{IsLegacy: true})
 	ports, _ := findPorts(testK8sService)
 	expectedSpec := vmopv1alpha1.VirtualMachineServiceSpec{
 		Type:  vmopv1alpha1.VirtualMachineServiceTypeLoadBalancer,
@@ -185,14 +415,129 @@ func TestCreateVMServiceWithLegacySelector(t *testing.T) {
 		},
 	}
 
-	IsLegacy = true
 	vmServiceObj, err := vms.Create(context.Background(), testK8sService, testClustername)
 	assert.NoError(t, err)
 	assert.Equal(t, (*vmServiceObj).Spec, expectedSpec)
 
 	err = vms.Delete(context.Background(), testK8sService, testClustername)
 	assert.NoError(t, err)
-	IsLegacy = false
+}
+
+func TestCreateVMService_LegacyPerInstance(t *testing.T) {
+	testCases := []struct {
+		name             string
+		isLegacy         bool
+		expectedSelector map[string]string
+	}{
+		{
+			name: "when the instance is not legacy",
+			expectedSelector: map[string]string{
+				ClusterSelectorKey: testClustername,
+				NodeSelectorKey:    NodeRole,
+			},
+		},
+		{
+			name:     "when the instance is legacy",
+			isLegacy: true,
+			expectedSelector: map[string]string{
+				LegacyClusterSelectorKey: testClustername,
+				LegacyNodeSelectorKey:    NodeRole,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		// initTest sets the shared vms, so it is not called from the parallel tests
+		testK8sService, _, fc := initTest()
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{IsLegacy: testCase.isLegacy})
+
+			for i := 0; i < 10; i++ {
+				vmServiceObj, err := vms.Create(context.Background(), testK8sService, testClustername)
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.expectedSelector, vmServiceObj.Spec.Selector)
+				assert.NoError(t, vms.Delete(context.Background(), testK8sService, testClustername))
+			}
+		})
+	}
+}
+
+func TestCreateVMService_MigrationMode(t *testing.T) {
+	testCases := []struct {
+		name             string
+		isLegacy         bool
+		expectedSelector map[string]string
+	}{
+		{
+			name: "when legacy mode is not set",
+			expectedSelector: map[string]string{
+				ClusterSelectorKey: testClustername,
+				NodeSelectorKey:    NodeRole,
+			},
+		},
+		{
+			name:     "when legacy mode is set",
+			isLegacy: true,
+			expectedSelector: map[string]string{
+				LegacyClusterSelectorKey: testClustername,
+				LegacyNodeSelectorKey:    NodeRole,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{IsLegacy: testCase.isLegacy, MigrationMode: true})
+			vmServiceObj, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedSelector, vmServiceObj.Spec.Selector)
+		})
+	}
+}
+
+func TestUpdateVMService_MigrationMode(t *testing.T) {
+	legacySelector := map[string]string{
+		LegacyClusterSelectorKey: testClustername,
+		LegacyNodeSelectorKey:    NodeRole,
+	}
+
+	testCases := []struct {
+		name             string
+		migrationMode    bool
+		expectedSelector map[string]string
+	}{
+		{
+			name:          "when migration mode is not set",
+			migrationMode: false,
+			expectedSelector: map[string]string{
+				ClusterSelectorKey: testClustername,
+				NodeSelectorKey:    NodeRole,
+			},
+		},
+		{
+			name:             "when migration mode is set",
+			migrationMode:    true,
+			expectedSelector: legacySelector,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			legacyVMS := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{IsLegacy: true})
+			vmServiceObj, err := legacyVMS.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			assert.Equal(t, legacySelector, vmServiceObj.Spec.Selector)
+
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{MigrationMode: testCase.migrationMode})
+			updatedVMServiceObj, err := vms.Update(context.Background(), testK8sService, testClustername, vmServiceObj)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedSelector, updatedVMServiceObj.Spec.Selector)
+		})
+	}
 }
 
 func TestCreateVMService_ZeroNodeport(t *testing.T) {
@@ -221,6 +566,167 @@ func TestCreateVMService_ZeroNodeport(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFindPorts_TargetPorts(t *testing.T) {
+	testCases := []struct {
+		name       string
+		targetPort intstr.IntOrString
+		protocol   v1.Protocol
+	}{
+		{
+			name:       "when the target port is numeric",
+			targetPort: intstr.FromInt(8080),
+			protocol:   v1.ProtocolTCP,
+		},
+		{
+			name:       "when the target port is named",
+			targetPort: intstr.FromString("http"),
+			protocol:   v1.ProtocolTCP,
+		},
+		{
+			name:     "when the target port defaults to the port",
+			protocol: v1.ProtocolUDP,
+		},
+		{
+			name:       "when the protocol is SCTP",
+			targetPort: intstr.FromString("sctp"),
+			protocol:   v1.ProtocolSCTP,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			service := &v1.Service{
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{
+							Name:       "port",
+							Protocol:   testCase.protocol,
+							Port:       80,
+							TargetPort: testCase.targetPort,
+							NodePort:   30800,
+						},
+					},
+				},
+			}
+
+			ports, err := findPorts(service)
+			assert.NoError(t, err)
+			assert.Equal(t, []vmopv1alpha1.VirtualMachineServicePort{
+				{
+					Name:       "port",
+					Protocol:   string(testCase.protocol),
+					Port:       80,
+					TargetPort: 30800,
+				},
+			}, ports)
+		})
+	}
+}
+
+func TestFindPorts_NodePortsDisabled(t *testing.T) {
+	enabled, disabled := true, false
+	testCases := []struct {
+		name               string
+		allocateNodePorts  *bool
+		targetPort         intstr.IntOrString
+		nodePort           int32
+		expectedTargetPort int32
+		expectedErr        error
+	}{
+		{
+			name:               "when node ports are disabled and the target port is numeric",
+			allocateNodePorts:  &disabled,
+			targetPort:         intstr.FromInt(8080),
+			expectedTargetPort: 8080,
+		},
+		{
+			name:               "when node ports are disabled and the target port defaults to the port",
+			allocateNodePorts:  &disabled,
+			expectedTargetPort: 80,
+		},
+		{
+			name:              "when node ports are disabled and the target port is named",
+			allocateNodePorts: &disabled,
+			targetPort:        intstr.FromString("http"),
+			expectedErr:       ErrNamedTargetPort,
+		},
+		{
+			name:               "when node ports are disabled but a node port is allocated",
+			allocateNodePorts:  &disabled,
+			targetPort:         intstr.FromInt(8080),
+			nodePort:           30800,
+			expectedTargetPort: 8080,
+		},
+		{
+			name:               "when node ports are enabled",
+			allocateNodePorts:  &enabled,
+			targetPort:         intstr.FromInt(8080),
+			nodePort:           30800,
+			expectedTargetPort: 30800,
+		},
+		{
+			name:              "when node ports are enabled but not allocated",
+			allocateNodePorts: &enabled,
+			targetPort:        intstr.FromInt(8080),
+			expectedErr:       ErrNodePortNotFound,
+		},
+		{
+			name:        "when node ports default to enabled but are not allocated",
+			targetPort:  intstr.FromInt(8080),
+			expectedErr: ErrNodePortNotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			service := &v1.Service{
+				Spec: v1.ServiceSpec{
+					AllocateLoadBalancerNodePorts: testCase.allocateNodePorts,
+					Ports: []v1.ServicePort{
+						{
+							Name:       "port",
+							Protocol:   v1.ProtocolTCP,
+							Port:       80,
+							TargetPort: testCase.targetPort,
+							NodePort:   testCase.nodePort,
+						},
+					},
+				},
+			}
+
+			ports, err := findPorts(service)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []vmopv1alpha1.VirtualMachineServicePort{
+				{
+					Name:       "port",
+					Protocol:   string(v1.ProtocolTCP),
+					Port:       80,
+					TargetPort: testCase.expectedTargetPort,
+				},
+			}, ports)
+		})
+	}
+}
+
+func TestCreateVMService_NodePortPending(t *testing.T) {
+	testK8sService, vms, _ := initTest()
+	testK8sService.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	testK8sService.Spec.HealthCheckNodePort = 31234
+	testK8sService.Spec.Ports[0].NodePort = 0
+
+	_, err := vms.Create(context.Background(), testK8sService, testClustername)
+	assert.ErrorIs(t, err, ErrNodePortPending)
+	assert.NotErrorIs(t, err, ErrNodePortNotFound)
+
+	testK8sService.Spec.Ports[0].NodePort = 30800
+	_, err = vms.Create(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+}
+
 func TestCreateDuplicateVMService(t *testing.T) {
 	testK8sService, vms, _ := initTest()
 	vmServiceObj, err := vms.Create(context.Background(), testK8sService, testClustername)
@@ -367,13 +873,8 @@ func TestCreateOrUpdateVMService(t *testing.T) {
 		expectedErr string
 	}{
 		{
-			name: "when VMService does not exist",
-			k8sService: &v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      testK8sServiceName,
-					Namespace: testK8sServiceNameSpace,
-				},
-			},
+			name:        "when VMService does not exist",
+			k8sService:  testK8sService,
 			clustername: testClustername,
 			expectedErr: ErrVMServiceIPNotFound.Error(),
 		},
@@ -394,49 +895,295 @@ func TestCreateOrUpdateVMService(t *testing.T) {
 	}
 }
 
-func TestCreateOrUpdateVMService_RedefineGetFunc(t *testing.T) {
+func TestCreateOrUpdateVMService_IPPendingReturnsVMService(t *testing.T) {
+	testK8sService, vms, _ := initTest()
+
+	// created
+	vmService, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
+	assert.ErrorIs(t, err, ErrVMServiceIPNotFound)
+	if assert.NotNil(t, vmService) {
+		assert.Equal(t, vms.GetVMServiceName(testK8sService, testClustername), vmService.Name)
+	}
+
+	// updated
+	testK8sService.Spec.LoadBalancerIP = "10.10.10.10"
+	vmService, err = vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
+	assert.ErrorIs(t, err, ErrVMServiceIPNotFound)
+	if assert.NotNil(t, vmService) {
+		assert.Equal(t, "10.10.10.10", vmService.Spec.LoadBalancerIP)
+	}
+}
+
+func TestGetVMServiceState(t *testing.T) {
 	testCases := []struct {
-		name        string
-		getFunc     func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error)
-		expectedErr error
+		name          string
+		ingress       []vmopv1alpha1.LoadBalancerIngress
+		expectedIP    string
+		expectedState State
 	}{
 		{
-			name: "failed to create VirtualMachineService",
-			getFunc: func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
-				return true, nil, fmt.Errorf("failed to get VirtualMachineService")
-			},
-			expectedErr: ErrGetVMService,
+			name:          "no ingress",
+			expectedState: StatePending,
 		},
 		{
-			name: "when VMService does not exist",
-			getFunc: func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
-				return true, nil, apierrors.NewNotFound(v1alpha1.Resource("virtualmachineservice"), testClustername)
-			},
-			expectedErr: ErrVMServiceIPNotFound,
+			name:          "ingress without IP",
+			ingress:       []vmopv1alpha1.LoadBalancerIngress{{Hostname: "lb.example.com"}},
+			expectedState: StatePending,
+		},
+		{
+			name:          "ingress with IP",
+			ingress:       []vmopv1alpha1.LoadBalancerIngress{{IP: fakeLBIP}},
+			expectedIP:    fakeLBIP,
+			expectedState: StateReady,
 		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			testK8sService, vms, fc := initTest()
-			// Redefine Get in the client to return an error
-			fc.PrependReactor("get", "virtualmachineservices", testCase.getFunc)
-			_, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
-			assert.Equal(t, testCase.expectedErr.Error(), err.Error())
+			vmService := &vmopv1alpha1.VirtualMachineService{}
+			vmService.Status.LoadBalancer.Ingress = testCase.ingress
+			ip, state := getVMServiceState(vmService)
+			assert.Equal(t, testCase.expectedIP, ip)
+			assert.Equal(t, testCase.expectedState, state)
 		})
 	}
 }
 
-func TestCreateOrUpdateVMService_RedefineCreateFunc(t *testing.T) {
-	testK8sService, vms, fc := initTest()
-	// Redefine Create in the client to return an error
-	fc.PrependReactor("create", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+// testCondition stands in for the conditions of the VirtualMachineServiceStatus of vm-operator
+// API versions that have them
+type testCondition struct {
+	Type     string `json:"type"`
+	Status   string `json:"status"`
+	Severity string `json:"severity,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+func TestFailedCondition(t *testing.T) {
+	type statusWithConditions struct {
+		Conditions []testCondition `json:"conditions,omitempty"`
+	}
+	type statusWithMetaConditions struct {
+		Conditions []metav1.Condition `json:"conditions,omitempty"`
+	}
+
+	testCases := []struct {
+		name            string
+		status          interface{}
+		expectedFailed  bool
+		expectedMessage string
+	}{
+		{
+			name:   "status without conditions",
+			status: &vmopv1alpha1.VirtualMachineServiceStatus{},
+		},
+		{
+			name:   "no conditions",
+			status: &statusWithConditions{},
+		},
+		{
+			name:   "provisioning",
+			status: &statusWithConditions{Conditions: []testCondition{{Type: "Ready", Status: "False", Severity: "Info", Reason: "Provisioning"}}},
+		},
+		{
+			name:   "ready",
+			status: &statusWithConditions{Conditions: []testCondition{{Type: "Ready", Status: "True"}}},
+		},
+		{
+			name: "rejected",
+			status: &statusWithConditions{Conditions: []testCondition{
+				{Type: "ProviderReady", Status: "True"},
+				{Type: "Ready", Status: "False", Severity: "Error", Reason: "IPPoolExhausted", Message: "no IP is left"},
+			}},
+			expectedFailed:  true,
+			expectedMessage: "IPPoolExhausted: no IP is left",
+		},
+		{
+			name:   "conditions without severity",
+			status: &statusWithMetaConditions{Conditions: []metav1.Condition{{Type: "Ready", Status: metav1.ConditionFalse, Reason: "Provisioning"}}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			message, failed := failedCondition(testCase.status)
+			assert.Equal(t, testCase.expectedFailed, failed)
+			assert.Equal(t, testCase.expectedMessage, message)
+		})
+	}
+}
+
+func TestVMServiceFailure(t *testing.T) {
+	vmService := &vmopv1alpha1.VirtualMachineService{ObjectMeta: metav1.ObjectMeta{Name: "vm-service", Namespace: testClusterNameSpace}}
+	err := vmServiceFailure(vmService)
+	assert.ErrorIs(t, err, ErrVMServiceFailed)
+	assert.Contains(t, err.Error(), testClusterNameSpace+"/vm-service")
+}
+
+func TestWaitForLoadBalancerIP(t *testing.T) {
+	defer func(backoff wait.Backoff) { WaitForLoadBalancerIPBackoff = backoff }(WaitForLoadBalancerIPBackoff)
+	WaitForLoadBalancerIPBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: math.MaxInt32}
+
+	testCases := []struct {
+		name        string
+		ipAfter     int
+		timeout     time.Duration
+		cancel      bool
+		expectedIP  string
+		expectedErr error
+	}{
+		{
+			name:       "IP appears after a couple of polls",
+			ipAfter:    3,
+			timeout:    time.Minute,
+			expectedIP: fakeLBIP,
+		},
+		{
+			name:        "IP never appears",
+			timeout:     50 * time.Millisecond,
+			expectedErr: ErrVMServiceIPNotFound,
+		},
+		{
+			name:        "context is canceled",
+			timeout:     time.Minute,
+			cancel:      true,
+			expectedErr: context.Canceled,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, fc := initTest()
+			_, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+
+			polls := 0
+			fc.PrependReactor("get", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+				polls++
+				if testCase.ipAfter == 0 || polls < testCase.ipAfter {
+					return false, nil, nil
+				}
+				getAction := action.(clientgotesting.GetAction)
+				obj, err := fc.Tracker().Get(getAction.GetResource(), getAction.GetNamespace(), getAction.GetName())
+				if err != nil {
+					return true, nil, err
+				}
+				u := obj.(*unstructured.Unstructured).DeepCopy()
+				_ = unstructured.SetNestedSlice(u.Object, []interface{}{map[string]interface{}{"ip": fakeLBIP}}, "status", "loadBalancer", "ingress")
+				return true, u, nil
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if testCase.cancel {
+				cancel()
+			}
+
+			ip, err := vms.WaitForLoadBalancerIP(ctx, testK8sService, testClustername, testCase.timeout)
+			assert.ErrorIs(t, err, testCase.expectedErr)
+			assert.Equal(t, testCase.expectedIP, ip)
+			if testCase.ipAfter > 0 {
+				assert.Equal(t, testCase.ipAfter, polls)
+			}
+		})
+	}
+}
+
+func TestCreateOrUpdateVMService_NoPorts(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	testK8sService.Spec.Ports = nil
+	fc.ClearActions()
+
+	vmService, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
+	assert.Equal(t, ErrNoPortsDefined, err)
+	assert.Nil(t, vmService)
+	for _, action := range fc.Actions() {
+		assert.NotEqual(t, "create", action.GetVerb())
+	}
+}
+
+func TestCreateOrUpdateVMService_RedefineGetFunc(t *testing.T) {
+	testCases := []struct {
+		name        string
+		getFunc     func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error)
+		expectedErr error
+	}{
+		{
+			name: "failed to create VirtualMachineService",
+			getFunc: func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+				return true, nil, fmt.Errorf("failed to get VirtualMachineService")
+			},
+			expectedErr: ErrGetVMService,
+		},
+		{
+			name: "when VMService does not exist",
+			getFunc: func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+				return true, nil, apierrors.NewNotFound(v1alpha1.Resource("virtualmachineservice"), testClustername)
+			},
+			expectedErr: ErrVMServiceIPNotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, fc := initTest()
+			// Redefine Get in the client to return an error
+			fc.PrependReactor("get", "virtualmachineservices", testCase.getFunc)
+			_, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
+			assert.Equal(t, testCase.expectedErr.Error(), err.Error())
+		})
+	}
+}
+
+func TestCreateOrUpdateVMService_RedefineCreateFunc(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	// Redefine Create in the client to return an error
+	fc.PrependReactor("create", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
 		return true, nil, fmt.Errorf("failed to create VirtualMachineService")
 	})
 	_, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
 	assert.Equal(t, ErrCreateVMService.Error(), err.Error())
 }
 
+func TestApplyVMService(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	testK8sService.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	testK8sService.Spec.HealthCheckNodePort = 30012
+
+	var patch clientgotesting.PatchAction
+	fc.PrependReactor("patch", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+		patch = action.(clientgotesting.PatchAction)
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(patch.GetPatch(), &obj.Object); err != nil {
+			return true, nil, err
+		}
+		_ = unstructured.SetNestedSlice(obj.Object, []interface{}{map[string]interface{}{"ip": fakeLBIP}}, "status", "loadBalancer", "ingress")
+		return true, obj, nil
+	})
+
+	vmService, err := vms.Apply(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+	assert.Equal(t, fakeLBIP, getVMServiceIP(vmService))
+
+	assert.Equal(t, types.ApplyPatchType, patch.GetPatchType())
+	assert.Equal(t, testClusterNameSpace, patch.GetNamespace())
+	assert.Equal(t, vms.GetVMServiceName(testK8sService, testClustername), patch.GetName())
+
+	applied := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(patch.GetPatch(), &applied))
+	assert.ElementsMatch(t, []string{"apiVersion", "kind", "metadata", "spec"}, keys(applied))
+	assert.ElementsMatch(t, []string{"name", "labels", "annotations", "ownerReferences"}, keys(applied["metadata"].(map[string]interface{})))
+	assert.ElementsMatch(t, []string{AnnotationServiceExternalTrafficPolicyKey, AnnotationServiceHealthCheckNodePortKey}, keys(applied["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})))
+}
+
+func keys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 func TestVMService_AlreadyExists(t *testing.T) {
 	testK8sService, vms, _ := initTest()
 	oldK8sService := &v1.Service{
@@ -514,6 +1261,135 @@ func TestUpdateVMService_NodePortChanges(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUpdateVMService_PortsReordered(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	testK8sService.Spec.Ports = append(testK8sService.Spec.Ports, v1.ServicePort{
+		Name:     "https",
+		Protocol: "tcp",
+		Port:     443,
+		NodePort: 30443,
+	})
+	createdVMService, err := vms.Create(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+
+	// the supervisor normalizes the order of the ports
+	reordered := createdVMService.DeepCopy()
+	ports := reordered.Spec.Ports
+	ports[0], ports[1] = ports[1], ports[0]
+
+	fc.ClearActions()
+	vmServiceObj, err := vms.Update(context.Background(), testK8sService, testClustername, reordered)
+	assert.NoError(t, err)
+	assert.Empty(t, fc.Actions())
+	assert.Equal(t, reordered, vmServiceObj)
+
+	// a changed port is still updated
+	testK8sService.Spec.Ports[1].NodePort = 30444
+	vmServiceObj, err = vms.Update(context.Background(), testK8sService, testClustername, reordered)
+	assert.NoError(t, err)
+	assert.Len(t, fc.Actions(), 1)
+	expectedPorts, _ := findPorts(testK8sService)
+	assert.Equal(t, expectedPorts, vmServiceObj.Spec.Ports)
+}
+
+func TestPortsEqual(t *testing.T) {
+	http := vmopv1alpha1.VirtualMachineServicePort{Name: "http", Protocol: "TCP", Port: 80, TargetPort: 30800}
+	https := vmopv1alpha1.VirtualMachineServicePort{Name: "https", Protocol: "TCP", Port: 443, TargetPort: 30443}
+	httpUDP := http
+	httpUDP.Protocol = "UDP"
+
+	testCases := []struct {
+		name     string
+		current  []vmopv1alpha1.VirtualMachineServicePort
+		desired  []vmopv1alpha1.VirtualMachineServicePort
+		expected bool
+	}{
+		{
+			name:     "when the ports are in the same order",
+			current:  []vmopv1alpha1.VirtualMachineServicePort{http, https},
+			desired:  []vmopv1alpha1.VirtualMachineServicePort{http, https},
+			expected: true,
+		},
+		{
+			name:     "when the ports are reordered",
+			current:  []vmopv1alpha1.VirtualMachineServicePort{https, http},
+			desired:  []vmopv1alpha1.VirtualMachineServicePort{http, https},
+			expected: true,
+		},
+		{
+			name:    "when a port is added",
+			current: []vmopv1alpha1.VirtualMachineServicePort{http},
+			desired: []vmopv1alpha1.VirtualMachineServicePort{http, https},
+		},
+		{
+			name:    "when the protocol of a port changes",
+			current: []vmopv1alpha1.VirtualMachineServicePort{https, http},
+			desired: []vmopv1alpha1.VirtualMachineServicePort{httpUDP, https},
+		},
+		{
+			name:    "when the names are duplicated",
+			current: []vmopv1alpha1.VirtualMachineServicePort{http, http},
+			desired: []vmopv1alpha1.VirtualMachineServicePort{http, httpUDP},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, portsEqual(testCase.current, testCase.desired))
+		})
+	}
+}
+
+func TestUpdateVMService_Conflict(t *testing.T) {
+	testCases := []struct {
+		name            string
+		conflicts       int
+		expectedErr     error
+		expectedUpdates int
+	}{
+		{
+			name:            "when the first update conflicts",
+			conflicts:       1,
+			expectedUpdates: 2,
+		},
+		{
+			name:            "when every update conflicts",
+			conflicts:       util.DefaultRetry.Steps,
+			expectedErr:     ErrUpdateConflict,
+			expectedUpdates: util.DefaultRetry.Steps,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, fc := initTest()
+			oldK8sService := testK8sService.DeepCopy()
+			oldK8sService.Spec.Ports[0].NodePort = 30500
+			createdVMService, err := vms.Create(context.Background(), oldK8sService, testClustername)
+			assert.NoError(t, err)
+
+			updates := 0
+			fc.PrependReactor("update", "virtualmachineservices", func(action clientgotesting.Action) (handled bool, ret runtime.Object, err error) {
+				updates++
+				if updates <= testCase.conflicts {
+					return true, nil, apierrors.NewConflict(v1alpha1.Resource("virtualmachineservice"), createdVMService.Name, fmt.Errorf("the object has been modified"))
+				}
+				return false, nil, nil
+			})
+
+			vmServiceObj, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+			assert.Equal(t, testCase.expectedUpdates, updates)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				assert.Nil(t, vmServiceObj)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testK8sService.Spec.Ports[0].NodePort, vmServiceObj.Spec.Ports[0].TargetPort)
+		})
+	}
+}
+
 func TestUpdateVMService_LBIPAdded(t *testing.T) {
 	testK8sService, vms, _ := initTest()
 	oldK8sService := testK8sService.DeepCopy()
@@ -674,9 +1550,1030 @@ func TestUpdateVMService_ExternalTrafficPolicyCluster(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestDeleteVMService(t *testing.T) {
-	testK8sService, vms, _ := initTest()
-	_, _ = vms.Create(context.Background(), testK8sService, testClustername)
-	err := vms.Delete(context.Background(), testK8sService, testClustername)
+func TestUpdateVMService_MultipleFieldChanges(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	oldK8sService := testK8sService.DeepCopy()
+	oldK8sService.Spec.Ports[0].NodePort = 30500
+	testK8sService.Spec.LoadBalancerIP = fakeLBIP
+	testK8sService.Spec.LoadBalancerSourceRanges = []string{"1.1.1.0/24"}
+	testK8sService.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	testK8sService.Spec.HealthCheckNodePort = 31234
+	ports, _ := findPorts(testK8sService)
+	expectedSpec := vmopv1alpha1.VirtualMachineServiceSpec{
+		Type:  vmopv1alpha1.VirtualMachineServiceTypeLoadBalancer,
+		Ports: ports,
+		Selector: map[string]string{
+			ClusterSelectorKey: testClustername,
+			NodeSelectorKey:    NodeRole,
+		},
+		LoadBalancerIP:           fakeLBIP,
+		LoadBalancerSourceRanges: []string{"1.1.1.0/24"},
+	}
+	expectedAnnotations := map[string]string{
+		AnnotationServiceExternalTrafficPolicyKey: string(v1.ServiceExternalTrafficPolicyTypeLocal),
+		AnnotationServiceHealthCheckNodePortKey:   "31234",
+	}
+	// create an old VMService
+	createdVMService, _ := vms.Create(context.Background(), oldK8sService, testClustername)
+	fc.ClearActions()
+
+	vmServiceObj, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+	assert.NoError(t, err)
+	assert.Equal(t, (*vmServiceObj).Spec, expectedSpec)
+	assert.Equal(t, (*vmServiceObj).Annotations, expectedAnnotations)
+
+	updates := 0
+	for _, action := range fc.Actions() {
+		if action.GetVerb() == "update" {
+			updates++
+		}
+	}
+	assert.Equal(t, 1, updates)
+
+	err = vms.Delete(context.Background(), testK8sService, testClustername)
 	assert.NoError(t, err)
 }
+
+func TestUpdateVMService_KeepsLoadBalancerProvider(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	createdVMService, _ := vms.Create(context.Background(), testK8sService, testClustername)
+	// the supervisor records the provider that serviced the VMService
+	createdVMService.Annotations = map[string]string{
+		AnnotationLoadBalancerProviderKey: "nsx-t",
+	}
+	fc.ClearActions()
+
+	vmServiceObj, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+	assert.NoError(t, err)
+	assert.Equal(t, "nsx-t", GetLoadBalancerProvider(vmServiceObj))
+	assert.Empty(t, fc.Actions())
+
+	err = vms.Delete(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+}
+
+func TestUpdateVMService_IgnoresSupervisorAnnotations(t *testing.T) {
+	testK8sService, vms, fc := initTest()
+	testK8sService.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	testK8sService.Spec.HealthCheckNodePort = 31234
+	createdVMService, _ := vms.Create(context.Background(), testK8sService, testClustername)
+	// the supervisor adds its own annotations to the VMService
+	supervisorAnnotations := map[string]string{
+		AnnotationLoadBalancerProviderKey:    "nsx-t",
+		"vmoperator.vmware.com/some-setting": "true",
+	}
+	for key, value := range supervisorAnnotations {
+		createdVMService.Annotations[key] = value
+	}
+
+	needsUpdate, err := vms.(*vmService).reconcileAnnotations(testK8sService, createdVMService, createdVMService.DeepCopy())
+	assert.NoError(t, err)
+	assert.False(t, needsUpdate)
+
+	fc.ClearActions()
+	vmServiceObj, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+	assert.NoError(t, err)
+	assert.Empty(t, fc.Actions())
+	assert.Equal(t, createdVMService, vmServiceObj)
+
+	// changes of managed annotations are merged into the supervisor annotations
+	testK8sService.Spec.HealthCheckNodePort = 31235
+	vmServiceObj, err = vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+	assert.NoError(t, err)
+	assert.Equal(t, "31235", vmServiceObj.Annotations[AnnotationServiceHealthCheckNodePortKey])
+	for key, value := range supervisorAnnotations {
+		assert.Equal(t, value, vmServiceObj.Annotations[key])
+	}
+
+	err = vms.Delete(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+}
+
+func TestVMService_ExternalIPs(t *testing.T) {
+	testCases := []struct {
+		name        string
+		externalIPs []string
+		expectedErr error
+	}{
+		{
+			name:        "when externalIPs are set",
+			externalIPs: []string{"10.10.10.10", "fd00::10"},
+		},
+		{
+			name:        "when externalIPs are cleared",
+			externalIPs: nil,
+		},
+		{
+			name:        "when an externalIP is invalid",
+			externalIPs: []string{"10.10.10.10", "10.10.10"},
+			expectedErr: ErrInvalidExternalIP,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, fc := initTest()
+			createdVMService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+
+			// externalIPs are skipped, so they never change the VMService
+			testK8sService.Spec.ExternalIPs = testCase.externalIPs
+			fc.ClearActions()
+			vmService, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, createdVMService, vmService)
+			}
+			assert.Empty(t, fc.Actions())
+
+			err = vms.Delete(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			vmService, err = vms.Create(context.Background(), testK8sService, testClustername)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, createdVMService.Spec, vmService.Spec)
+		})
+	}
+}
+
+func TestVMService_Provider(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expectedErr error
+	}{
+		{
+			name: "when no provider is requested",
+		},
+		{
+			name:        "when an allowed provider is requested",
+			annotations: map[string]string{AnnotationVMServiceProviderKey: "avi"},
+		},
+		{
+			name:        "when a disallowed provider is requested",
+			annotations: map[string]string{AnnotationVMServiceProviderKey: "haproxy"},
+			expectedErr: ErrProviderNotAllowed,
+		},
+		{
+			name:        "when an empty provider is requested",
+			annotations: map[string]string{AnnotationVMServiceProviderKey: ""},
+			expectedErr: ErrProviderNotAllowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{AllowedProviders: []string{"avi", "nsx-t"}})
+			createdVMService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+
+			// the provider is skipped, so it never changes the VMService
+			testK8sService.Annotations = testCase.annotations
+			fc.ClearActions()
+			vmService, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, createdVMService, vmService)
+			}
+			assert.Empty(t, fc.Actions())
+
+			err = vms.Delete(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			vmService, err = vms.Create(context.Background(), testK8sService, testClustername)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, createdVMService.Spec, vmService.Spec)
+		})
+	}
+}
+
+func TestVMService_IdleTimeout(t *testing.T) {
+	testCases := []struct {
+		name                string
+		annotations         map[string]string
+		expectedAnnotations map[string]string
+		expectedErr         error
+	}{
+		{
+			name: "when no idle timeout is requested",
+		},
+		{
+			name:                "when a valid idle timeout is requested",
+			annotations:         map[string]string{AnnotationServiceIdleTimeoutKey: "300"},
+			expectedAnnotations: map[string]string{AnnotationLoadBalancerIdleTimeoutKey: "300"},
+		},
+		{
+			name:                "when the idle timeout has a leading zero",
+			annotations:         map[string]string{AnnotationServiceIdleTimeoutKey: "0600"},
+			expectedAnnotations: map[string]string{AnnotationLoadBalancerIdleTimeoutKey: "600"},
+		},
+		{
+			name:        "when the idle timeout is zero",
+			annotations: map[string]string{AnnotationServiceIdleTimeoutKey: "0"},
+			expectedErr: ErrInvalidIdleTimeout,
+		},
+		{
+			name:        "when the idle timeout is negative",
+			annotations: map[string]string{AnnotationServiceIdleTimeoutKey: "-30"},
+			expectedErr: ErrInvalidIdleTimeout,
+		},
+		{
+			name:        "when the idle timeout is not an integer",
+			annotations: map[string]string{AnnotationServiceIdleTimeoutKey: "5m"},
+			expectedErr: ErrInvalidIdleTimeout,
+		},
+		{
+			name:        "when the idle timeout is empty",
+			annotations: map[string]string{AnnotationServiceIdleTimeoutKey: ""},
+			expectedErr: ErrInvalidIdleTimeout,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, _ := initTest()
+			createdVMService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			assert.Empty(t, createdVMService.Annotations)
+
+			testK8sService.Annotations = testCase.annotations
+			vmService, err := vms.Update(context.Background(), testK8sService, testClustername, createdVMService)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.expectedAnnotations, emptyToNil(vmService.Annotations))
+			}
+
+			err = vms.Delete(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			vmService, err = vms.Create(context.Background(), testK8sService, testClustername)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedAnnotations, emptyToNil(vmService.Annotations))
+
+			// removing the annotation removes the idle timeout
+			testK8sService.Annotations = nil
+			vmService, err = vms.Update(context.Background(), testK8sService, testClustername, vmService)
+			assert.NoError(t, err)
+			assert.Empty(t, vmService.Annotations)
+		})
+	}
+}
+
+func TestVMService_AnnotationTransform(t *testing.T) {
+	serviceAnnotations := map[string]string{
+		"kubernetes.io/pool-algorithm":   "round-robin",
+		"vendor.example.com/persistence": "cookie",
+		"team.example.com/owner":         "platform",
+		v1.LastAppliedConfigAnnotation:   "{}",
+		AnnotationServiceIdleTimeoutKey:  "300",
+	}
+
+	testCases := []struct {
+		name                string
+		transform           AnnotationTransform
+		excluded            []string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name: "without a transform nothing is propagated",
+			expectedAnnotations: map[string]string{
+				AnnotationLoadBalancerIdleTimeoutKey: "300",
+			},
+		},
+		{
+			name:      "passthrough",
+			transform: func(key string) (string, bool) { return key, true },
+			expectedAnnotations: map[string]string{
+				"kubernetes.io/pool-algorithm":       "round-robin",
+				"vendor.example.com/persistence":     "cookie",
+				"team.example.com/owner":             "platform",
+				AnnotationLoadBalancerIdleTimeoutKey: "300",
+				AnnotationPropagatedKeysKey:          "kubernetes.io/pool-algorithm,team.example.com/owner,vendor.example.com/persistence",
+			},
+		},
+		{
+			name: "rename",
+			transform: func(key string) (string, bool) {
+				if key == "vendor.example.com/persistence" {
+					return "lb.example.com/persistence", true
+				}
+				return strings.TrimPrefix(key, "kubernetes.io/"), true
+			},
+			expectedAnnotations: map[string]string{
+				"pool-algorithm":                     "round-robin",
+				"lb.example.com/persistence":         "cookie",
+				"team.example.com/owner":             "platform",
+				AnnotationLoadBalancerIdleTimeoutKey: "300",
+				AnnotationPropagatedKeysKey:          "lb.example.com/persistence,pool-algorithm,team.example.com/owner",
+			},
+		},
+		{
+			name: "drop",
+			transform: func(key string) (string, bool) {
+				return key, !strings.HasPrefix(key, "team.example.com/")
+			},
+			expectedAnnotations: map[string]string{
+				"kubernetes.io/pool-algorithm":       "round-robin",
+				"vendor.example.com/persistence":     "cookie",
+				AnnotationLoadBalancerIdleTimeoutKey: "300",
+				AnnotationPropagatedKeysKey:          "kubernetes.io/pool-algorithm,vendor.example.com/persistence",
+			},
+		},
+		{
+			name:      "custom exclusions add to the built-in ones",
+			transform: func(key string) (string, bool) { return key, true },
+			excluded:  []string{"team.example.com/owner", "", " "},
+			expectedAnnotations: map[string]string{
+				"kubernetes.io/pool-algorithm":       "round-robin",
+				"vendor.example.com/persistence":     "cookie",
+				AnnotationLoadBalancerIdleTimeoutKey: "300",
+				AnnotationPropagatedKeysKey:          "kubernetes.io/pool-algorithm,vendor.example.com/persistence",
+			},
+		},
+		{
+			name: "managed annotations are not overwritten",
+			transform: func(key string) (string, bool) {
+				if key == "team.example.com/owner" {
+					return AnnotationLoadBalancerProviderKey, true
+				}
+				return "", false
+			},
+			expectedAnnotations: map[string]string{
+				AnnotationLoadBalancerIdleTimeoutKey: "300",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{AnnotationTransform: testCase.transform, ExcludedAnnotations: testCase.excluded})
+			testK8sService.Annotations = serviceAnnotations
+
+			vmService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedAnnotations, vmService.Annotations)
+
+			// annotations dropped from the Service are removed from the VirtualMachineService,
+			// while those of the supervisor are kept
+			vmService.Annotations[AnnotationLoadBalancerProviderKey] = "nsx-t"
+			testK8sService.Annotations = nil
+			vmService, err = vms.Update(context.Background(), testK8sService, testClustername, vmService)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{AnnotationLoadBalancerProviderKey: "nsx-t"}, vmService.Annotations)
+		})
+	}
+}
+
+func emptyToNil(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+func TestGetLoadBalancerProvider(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:     "no annotations",
+			expected: "",
+		},
+		{
+			name: "provider annotation set",
+			annotations: map[string]string{
+				AnnotationServiceExternalTrafficPolicyKey: string(v1.ServiceExternalTrafficPolicyTypeLocal),
+				AnnotationLoadBalancerProviderKey:         "avi",
+			},
+			expected: "avi",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			vmService := &vmopv1alpha1.VirtualMachineService{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: testCase.annotations,
+				},
+			}
+			assert.Equal(t, testCase.expected, GetLoadBalancerProvider(vmService))
+		})
+	}
+}
+
+func TestVMService_AnnotationValidator(t *testing.T) {
+	validator := EnumAnnotationValidator(map[string][]string{
+		"lb.example.com/pool-algorithm": {"round-robin", "least-connections"},
+	})
+
+	testCases := []struct {
+		name                string
+		annotations         map[string]string
+		expectedErr         error
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:        "valid value",
+			annotations: map[string]string{"lb.example.com/pool-algorithm": "least-connections"},
+			expectedAnnotations: map[string]string{
+				"lb.example.com/pool-algorithm": "least-connections",
+				AnnotationPropagatedKeysKey:     "lb.example.com/pool-algorithm",
+			},
+		},
+		{
+			name:        "invalid value",
+			annotations: map[string]string{"lb.example.com/pool-algorithm": "random"},
+			expectedErr: ErrInvalidAnnotation,
+		},
+		{
+			name:        "unknown key",
+			annotations: map[string]string{"lb.example.com/persistence": "anything"},
+			expectedAnnotations: map[string]string{
+				"lb.example.com/persistence": "anything",
+				AnnotationPropagatedKeysKey:  "lb.example.com/persistence",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			transform := func(key string) (string, bool) { return key, true }
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{AnnotationTransform: transform, AnnotationValidator: validator})
+			testK8sService.Annotations = testCase.annotations
+
+			vmService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				assert.Contains(t, err.Error(), "must be one of least-connections, round-robin")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedAnnotations, vmService.Annotations)
+		})
+	}
+}
+
+func TestDeleteVMService(t *testing.T) {
+	testK8sService, vms, _ := initTest()
+	_, _ = vms.Create(context.Background(), testK8sService, testClustername)
+	err := vms.Delete(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+}
+
+func TestDeleteVMServiceByName(t *testing.T) {
+	testCases := []struct {
+		name        string
+		namespace   string
+		expectedErr error
+	}{
+		{
+			name:      "when the namespace is the cluster namespace",
+			namespace: testClusterNameSpace,
+		},
+		{
+			name: "when the namespace is empty",
+		},
+		{
+			name:        "when the namespace is not allowed",
+			namespace:   "other-ns",
+			expectedErr: ErrNamespaceNotAllowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, vms, fc := initTest()
+			vmService, err := vms.Create(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+
+			err = vms.DeleteByName(context.Background(), testCase.namespace, vmService.Name)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			_, err = vmopclient.NewFakeClientSet(fc).V1alpha1().VirtualMachineServices(testClusterNameSpace).Get(context.Background(), vmService.Name, metav1.GetOptions{})
+			assert.True(t, apierrors.IsNotFound(err))
+		})
+	}
+}
+
+func TestDeleteRecordedVMService(t *testing.T) {
+	testCases := []struct {
+		name        string
+		recorded    func(own, other *vmopv1alpha1.VirtualMachineService) string
+		clusterName string
+	}{
+		{
+			name:        "when the recorded VirtualMachineService belongs to the Service",
+			recorded:    func(own, _ *vmopv1alpha1.VirtualMachineService) string { return own.Name },
+			clusterName: testClustername,
+		},
+		{
+			name:        "when the cluster was renamed since the recorded VirtualMachineService was created",
+			recorded:    func(own, _ *vmopv1alpha1.VirtualMachineService) string { return own.Name },
+			clusterName: "renamed-cluster",
+		},
+		{
+			name:        "when the recorded VirtualMachineService belongs to another Service",
+			recorded:    func(_, other *vmopv1alpha1.VirtualMachineService) string { return other.Name },
+			clusterName: testClustername,
+		},
+		{
+			name:        "when the recorded VirtualMachineService does not exist",
+			recorded:    func(_, _ *vmopv1alpha1.VirtualMachineService) string { return "missing" },
+			clusterName: testClustername,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := context.Background()
+			testK8sService, vms, fc := initTest()
+			own, err := vms.Create(ctx, testK8sService, testClustername)
+			assert.NoError(t, err)
+			otherService := testK8sService.DeepCopy()
+			otherService.Name = "other-service"
+			other, err := vms.Create(ctx, otherService, testClustername)
+			assert.NoError(t, err)
+
+			err = vms.DeleteRecorded(ctx, testK8sService, testCase.clusterName, "", testCase.recorded(own, other))
+			assert.NoError(t, err)
+
+			client := vmopclient.NewFakeClientSet(fc).V1alpha1().VirtualMachineServices(testClusterNameSpace)
+			_, err = client.Get(ctx, other.Name, metav1.GetOptions{})
+			assert.NoError(t, err)
+			_, err = client.Get(ctx, own.Name, metav1.GetOptions{})
+			assert.True(t, apierrors.IsNotFound(err))
+		})
+	}
+}
+
+func TestDeleteRecordedVMService_Foreign(t *testing.T) {
+	ctx := context.Background()
+	testK8sService, vms, fc := initTest()
+	own, err := vms.Create(ctx, testK8sService, testClustername)
+	assert.NoError(t, err)
+
+	// a VirtualMachineService labeled with the Service, but neither owned by the cloud provider nor of its cluster
+	client := vmopclient.NewFakeClientSet(fc).V1alpha1().VirtualMachineServices(testClusterNameSpace)
+	foreign := own.DeepCopy()
+	foreign.Name = "foreign"
+	foreign.ResourceVersion = ""
+	foreign.OwnerReferences = nil
+	foreign.Labels[LabelClusterNameKey] = "other-cluster"
+	_, err = client.Create(ctx, foreign, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	err = vms.DeleteRecorded(ctx, testK8sService, testClustername, testClusterNameSpace, foreign.Name)
+	assert.NoError(t, err)
+
+	_, err = client.Get(ctx, foreign.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = client.Get(ctx, own.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestDeleteOrphanedVMServices(t *testing.T) {
+	ctx := context.Background()
+	liveService, vms, fc := initTest()
+	live, err := vms.Create(ctx, liveService, testClustername)
+	assert.NoError(t, err)
+
+	orphanService := liveService.DeepCopy()
+	orphanService.Name = "deleted-service"
+	orphan, err := vms.Create(ctx, orphanService, testClustername)
+	assert.NoError(t, err)
+
+	// VirtualMachineServices of the cluster not created by the cloud provider are left alone
+	client := vmopclient.NewFakeClientSet(fc).V1alpha1().VirtualMachineServices(testClusterNameSpace)
+	foreign := orphan.DeepCopy()
+	foreign.Name = "foreign"
+	foreign.ResourceVersion = ""
+	foreign.OwnerReferences = nil
+	_, err = client.Create(ctx, foreign, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	managed, err := vms.ListManaged(ctx, testClustername)
+	assert.NoError(t, err)
+	var names []string
+	for _, vmService := range managed {
+		names = append(names, vmService.Name)
+	}
+	assert.ElementsMatch(t, []string{live.Name, orphan.Name}, names)
+
+	managed, err = vms.ListManaged(ctx, "other-cluster")
+	assert.NoError(t, err)
+	assert.Empty(t, managed)
+
+	err = vms.DeleteOrphaned(ctx, testClustername, []*v1.Service{liveService})
+	assert.NoError(t, err)
+
+	_, err = client.Get(ctx, orphan.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = client.Get(ctx, live.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = client.Get(ctx, foreign.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestDeleteOrphanedVMServices_AllowedNamespace(t *testing.T) {
+	ctx := context.Background()
+	tenantNamespace := "tenant-ns"
+	liveService, _, fc := initTest()
+	namespace := &unstructured.Unstructured{}
+	namespace.SetAPIVersion("v1")
+	namespace.SetKind("Namespace")
+	namespace.SetName(tenantNamespace)
+	assert.NoError(t, fc.Tracker().Add(namespace))
+	vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{AllowedNamespaces: []string{tenantNamespace}})
+
+	liveService.Annotations = map[string]string{AnnotationVMServiceNamespaceKey: tenantNamespace}
+	live, err := vms.Create(ctx, liveService, testClustername)
+	assert.NoError(t, err)
+
+	orphanService := liveService.DeepCopy()
+	orphanService.Name = "deleted-service"
+	orphan, err := vms.Create(ctx, orphanService, testClustername)
+	assert.NoError(t, err)
+	// owner references cannot cross namespaces, the labels identify them as managed
+	assert.Empty(t, orphan.OwnerReferences)
+
+	// VirtualMachineServices of the cluster without the Service labels are left alone
+	client := vmopclient.NewFakeClientSet(fc).V1alpha1().VirtualMachineServices(tenantNamespace)
+	foreign := orphan.DeepCopy()
+	foreign.Name = "foreign"
+	foreign.ResourceVersion = ""
+	delete(foreign.Labels, LabelServiceNameKey)
+	_, err = client.Create(ctx, foreign, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	managed, err := vms.ListManaged(ctx, testClustername)
+	assert.NoError(t, err)
+	var names []string
+	for _, vmService := range managed {
+		names = append(names, vmService.Name)
+	}
+	assert.ElementsMatch(t, []string{live.Name, orphan.Name}, names)
+
+	err = vms.DeleteOrphaned(ctx, testClustername, []*v1.Service{liveService})
+	assert.NoError(t, err)
+
+	_, err = client.Get(ctx, orphan.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = client.Get(ctx, live.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = client.Get(ctx, foreign.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestVMService_LoadBalancerClass(t *testing.T) {
+	ourClass := "vsphere-paravirtual"
+	otherClass := "other-lb-controller"
+
+	testCases := []struct {
+		name              string
+		loadBalancerClass string
+		serviceClass      *string
+		expectedErr       error
+	}{
+		{
+			name:              "Service without class is handled",
+			loadBalancerClass: ourClass,
+			expectedErr:       ErrVMServiceIPNotFound,
+		},
+		{
+			name:              "Service of matching class is handled",
+			loadBalancerClass: ourClass,
+			serviceClass:      &ourClass,
+			expectedErr:       ErrVMServiceIPNotFound,
+		},
+		{
+			name:              "Service of mismatched class is skipped",
+			loadBalancerClass: ourClass,
+			serviceClass:      &otherClass,
+			expectedErr:       ErrNotOurLoadBalancerClass,
+		},
+		{
+			name:         "Service with a class is skipped when no class is configured",
+			serviceClass: &otherClass,
+			expectedErr:  ErrNotOurLoadBalancerClass,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			testK8sService.Spec.LoadBalancerClass = testCase.serviceClass
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{LoadBalancerClass: testCase.loadBalancerClass})
+
+			_, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
+			assert.Equal(t, testCase.expectedErr, err)
+
+			vmService, err := vms.Get(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			if testCase.expectedErr == ErrNotOurLoadBalancerClass {
+				assert.Nil(t, vmService)
+				assert.Equal(t, ErrNotOurLoadBalancerClass, vms.Delete(context.Background(), testK8sService, testClustername))
+				return
+			}
+			assert.NotNil(t, vmService)
+			assert.NoError(t, vms.Delete(context.Background(), testK8sService, testClustername))
+		})
+	}
+}
+
+// dryRunClientSet records the DryRun option of the VirtualMachineService requests it passes on
+type dryRunClientSet struct {
+	vmop.V1alpha1Interface
+	dryRun map[string][]string
+}
+
+func (c *dryRunClientSet) V1alpha1() vmop.V1alpha1Interface {
+	return c
+}
+
+func (c *dryRunClientSet) VirtualMachineServices(namespace string) vmop.VirtualMachineServiceInterface {
+	return &dryRunVMServices{VirtualMachineServiceInterface: c.V1alpha1Interface.VirtualMachineServices(namespace), dryRun: c.dryRun}
+}
+
+type dryRunVMServices struct {
+	vmop.VirtualMachineServiceInterface
+	dryRun map[string][]string
+}
+
+func (c *dryRunVMServices) Create(ctx context.Context, vmService *vmopv1alpha1.VirtualMachineService, opts metav1.CreateOptions) (*vmopv1alpha1.VirtualMachineService, error) {
+	c.dryRun["create"] = opts.DryRun
+	return c.VirtualMachineServiceInterface.Create(ctx, vmService, opts)
+}
+
+func (c *dryRunVMServices) Update(ctx context.Context, vmService *vmopv1alpha1.VirtualMachineService, opts metav1.UpdateOptions) (*vmopv1alpha1.VirtualMachineService, error) {
+	c.dryRun["update"] = opts.DryRun
+	return c.VirtualMachineServiceInterface.Update(ctx, vmService, opts)
+}
+
+func (c *dryRunVMServices) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	c.dryRun["delete"] = opts.DryRun
+	return c.VirtualMachineServiceInterface.Delete(ctx, name, opts)
+}
+
+func TestVMService_DryRun(t *testing.T) {
+	testCases := []struct {
+		name           string
+		dryRun         bool
+		expectedDryRun []string
+		expectedErr    error
+	}{
+		{
+			name:           "when dry run is set",
+			dryRun:         true,
+			expectedDryRun: []string{metav1.DryRunAll},
+		},
+		{
+			name:        "when dry run is not set",
+			expectedErr: ErrVMServiceIPNotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			client := &dryRunClientSet{
+				V1alpha1Interface: vmopclient.NewFakeClientSet(fc).V1alpha1(),
+				dryRun:            make(map[string][]string),
+			}
+			vms := NewVMService(client, testClusterNameSpace, &testOwnerReference, Options{DryRun: testCase.dryRun})
+
+			// a dry run is never allocated an IP
+			vmService, err := vms.CreateOrUpdate(context.Background(), testK8sService, testClustername)
+			assert.Equal(t, testCase.expectedErr, err)
+			assert.NotNil(t, vmService)
+
+			testK8sService.Spec.LoadBalancerIP = fakeLBIP
+			_, err = vms.Update(context.Background(), testK8sService, testClustername, vmService)
+			assert.NoError(t, err)
+
+			err = vms.Delete(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+
+			for _, verb := range []string{"create", "update", "delete"} {
+				assert.Equal(t, testCase.expectedDryRun, client.dryRun[verb], verb)
+			}
+		})
+	}
+}
+
+func TestVMService_NamespaceAnnotation(t *testing.T) {
+	tenantNamespace := "tenant-ns"
+
+	testCases := []struct {
+		name              string
+		namespace         string
+		allowedNamespaces []string
+		expectedNamespace string
+		expectedErr       error
+	}{
+		{
+			name:              "when the annotation is absent",
+			allowedNamespaces: []string{tenantNamespace},
+			expectedNamespace: testClusterNameSpace,
+		},
+		{
+			name:              "when the namespace is overridden",
+			namespace:         tenantNamespace,
+			allowedNamespaces: []string{tenantNamespace},
+			expectedNamespace: tenantNamespace,
+		},
+		{
+			name:        "when the namespace is not allowed",
+			namespace:   tenantNamespace,
+			expectedErr: ErrNamespaceNotAllowed,
+		},
+		{
+			name:              "when the namespace does not exist",
+			namespace:         "missing-ns",
+			allowedNamespaces: []string{tenantNamespace, "missing-ns"},
+			expectedErr:       ErrNamespaceNotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testK8sService, _, fc := initTest()
+			namespace := &unstructured.Unstructured{}
+			namespace.SetAPIVersion("v1")
+			namespace.SetKind("Namespace")
+			namespace.SetName(tenantNamespace)
+			assert.NoError(t, fc.Tracker().Add(namespace))
+			if testCase.namespace != "" {
+				testK8sService.Annotations = map[string]string{AnnotationVMServiceNamespaceKey: testCase.namespace}
+			}
+			vms := NewVMService(vmopclient.NewFakeClientSet(fc), testClusterNameSpace, &testOwnerReference, Options{AllowedNamespaces: testCase.allowedNamespaces})
+
+			_, err := vms.Create(context.Background(), testK8sService, testClustername)
+			if testCase.expectedErr != nil {
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				_, err = vms.Get(context.Background(), testK8sService, testClustername)
+				assert.ErrorIs(t, err, testCase.expectedErr)
+				assert.ErrorIs(t, vms.Delete(context.Background(), testK8sService, testClustername), testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			vmService, err := vms.Get(context.Background(), testK8sService, testClustername)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expectedNamespace, vmService.Namespace)
+			// owner references cannot cross namespaces
+			if testCase.expectedNamespace == testClusterNameSpace {
+				assert.Equal(t, []metav1.OwnerReference{testOwnerReference}, vmService.OwnerReferences)
+			} else {
+				assert.Empty(t, vmService.OwnerReferences)
+			}
+
+			testK8sService.Spec.LoadBalancerIP = fakeLBIP
+			vmService, err = vms.Update(context.Background(), testK8sService, testClustername, vmService)
+			assert.NoError(t, err)
+			assert.Equal(t, fakeLBIP, vmService.Spec.LoadBalancerIP)
+
+			assert.NoError(t, vms.Delete(context.Background(), testK8sService, testClustername))
+		})
+	}
+}
+
+func TestVMServiceTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	testK8sService, vms, _ := initTest()
+	_, err := vms.Create(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+	err = vms.Delete(context.Background(), testK8sService, testClustername)
+	assert.NoError(t, err)
+	// the VirtualMachineService is already gone
+	err = vms.Delete(context.Background(), testK8sService, testClustername)
+	assert.Error(t, err)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 3)
+	expected := []struct {
+		name   string
+		status codes.Code
+	}{
+		{"vmservice.Create", codes.Unset},
+		{"vmservice.Delete", codes.Unset},
+		{"vmservice.Delete", codes.Error},
+	}
+	for i, span := range spans {
+		assert.Equal(t, expected[i].name, span.Name())
+		assert.Equal(t, expected[i].status, span.Status().Code)
+		assert.Contains(t, span.Attributes(), attribute.String("vmservice.namespace", testClusterNameSpace))
+	}
+	assert.Contains(t, spans[2].Attributes(), attribute.String("vmservice.result", "error"))
+}
+
+// blockingClientSet returns VirtualMachineService clients whose requests block until their context is done
+type blockingClientSet struct {
+	vmop.V1alpha1Interface
+}
+
+func (c *blockingClientSet) V1alpha1() vmop.V1alpha1Interface {
+	return c
+}
+
+func (c *blockingClientSet) VirtualMachineServices(namespace string) vmop.VirtualMachineServiceInterface {
+	return &blockingVMServices{}
+}
+
+type blockingVMServices struct {
+	vmop.VirtualMachineServiceInterface
+}
+
+func (c *blockingVMServices) Get(ctx context.Context, name string, opts metav1.GetOptions) (*vmopv1alpha1.VirtualMachineService, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *blockingVMServices) Create(ctx context.Context, vmService *vmopv1alpha1.VirtualMachineService, opts metav1.CreateOptions) (*vmopv1alpha1.VirtualMachineService, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *blockingVMServices) Update(ctx context.Context, vmService *vmopv1alpha1.VirtualMachineService, opts metav1.UpdateOptions) (*vmopv1alpha1.VirtualMachineService, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *blockingVMServices) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestVMService_CallTimeout(t *testing.T) {
+	callTimeout := 50 * time.Millisecond
+
+	testK8sService, _, fc := initTest()
+	vms := NewVMService(&blockingClientSet{V1alpha1Interface: vmopclient.NewFakeClientSet(fc).V1alpha1()}, testClusterNameSpace, &testOwnerReference, Options{CallTimeout: callTimeout})
+	vmService := &vmopv1alpha1.VirtualMachineService{}
+
+	calls := map[string]func(ctx context.Context) error{
+		"get": func(ctx context.Context) error {
+			_, err := vms.Get(ctx, testK8sService, testClustername)
+			return err
+		},
+		"create": func(ctx context.Context) error {
+			_, err := vms.Create(ctx, testK8sService, testClustername)
+			return err
+		},
+		"update": func(ctx context.Context) error {
+			testK8sService.Spec.LoadBalancerIP = fakeLBIP
+			_, err := vms.Update(ctx, testK8sService, testClustername, vmService)
+			return err
+		},
+		"delete": func(ctx context.Context) error {
+			return vms.Delete(ctx, testK8sService, testClustername)
+		},
+	}
+
+	for name, call := range calls {
+		t.Run("when "+name+" times out", func(t *testing.T) {
+			start := time.Now()
+			err := call(context.Background())
+			elapsed := time.Since(start)
+
+			assert.ErrorIs(t, err, ErrVMServiceTimeout)
+			assert.GreaterOrEqual(t, elapsed, callTimeout)
+			assert.Less(t, elapsed, callTimeout+time.Second)
+		})
+
+		t.Run("when the context of "+name+" is done first", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), callTimeout/5)
+			defer cancel()
+
+			err := call(ctx)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.NotErrorIs(t, err, ErrVMServiceTimeout)
+		})
+	}
+}
@@ -18,8 +18,11 @@ package connectionmanager
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 
+	v1 "k8s.io/api/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	listerv1 "k8s.io/client-go/listers/core/v1"
 	klog "k8s.io/klog/v2"
@@ -52,6 +55,10 @@ func NewConnectionManager(cfg *vcfg.Config, informMgr *k8s.InformerManager, clie
 	if informMgr != nil {
 		klog.V(2).Info("Initializing with K8s SecretLister")
 		credMgr := cm.NewCredentialManager(cfg.Global.SecretName, cfg.Global.SecretNamespace, "", informMgr.GetSecretLister())
+		if client != nil {
+			credMgr.SecretGetter = client.CoreV1()
+		}
+		invalidateOnSecretChange(informMgr, credMgr)
 		connMgr.credentialManagers[vcfg.DefaultCredentialManager] = credMgr
 		connMgr.informerManagers[vcfg.DefaultCredentialManager] = informMgr
 
@@ -86,6 +93,7 @@ func generateInstanceMap(cfg *vcfg.Config) map[string]*VSphereInstance {
 			Cfg:  vcConfig,
 		}
 		vsphereInstanceMap[vcConfig.TenantRef] = &vsphereIns
+		vclib.RegisterSessionMetrics(vcConfig.VCenterIP)
 	}
 
 	return vsphereInstanceMap
@@ -123,12 +131,30 @@ func (connMgr *ConnectionManager) createManagersPerTenant(secretName string, sec
 	credMgr := cm.NewCredentialManager(secretName, secretNamespace, secretsDirectory, lister)
 
 	if lister != nil {
+		credMgr.SecretGetter = client.CoreV1()
+		invalidateOnSecretChange(informMgr, credMgr)
 		informMgr.Listen()
 	}
 
 	return credMgr, informMgr
 }
 
+// invalidateOnSecretChange invalidates the negative cache of credMgr when its Secret changes,
+// so that credentials added to the Secret are found within the NegativeCacheTTL.
+func invalidateOnSecretChange(informMgr *k8s.InformerManager, credMgr *cm.CredentialManager) {
+	invalidate := func(obj interface{}) {
+		// Deleted secrets may be tombstones, which invalidate regardless
+		if secret, ok := obj.(*v1.Secret); ok &&
+			(secret.Name != credMgr.SecretName || secret.Namespace != credMgr.SecretNamespace) {
+			return
+		}
+		credMgr.InvalidateNegativeCache()
+	}
+	informMgr.AddSecretListener(invalidate, invalidate, func(oldObj, newObj interface{}) {
+		invalidate(newObj)
+	})
+}
+
 // Connect connects to vCenter with existing credentials
 // If credentials are invalid:
 //  1. It will fetch credentials from credentialManager
@@ -143,26 +169,88 @@ func (connMgr *ConnectionManager) Connect(ctx context.Context, vcInstance *VSphe
 		return nil
 	}
 
-	if !vclib.IsInvalidCredentialsError(err) || connMgr.credentialManagers == nil {
+	missingCredentials := errors.Is(err, vclib.ErrNoAuthMethodConfigured)
+	if !(vclib.IsInvalidCredentialsError(err) || missingCredentials) || connMgr.credentialManagers == nil {
 		klog.Errorf("Cannot connect to vCenter with err: %v", err)
 		return err
 	}
 
-	klog.V(2).Infof("Invalid credentials. Fetching credentials from secrets. vcServer=%s credentialHolder=%s",
-		vcInstance.Cfg.VCenterIP, vcInstance.Cfg.SecretRef)
+	klog.V(2).Infof("Invalid or missing credentials. Fetching credentials from secrets. vcServer=%s credentialHolder=%s missing=%t",
+		vcInstance.Cfg.VCenterIP, vcInstance.Cfg.SecretRef, missingCredentials)
 
 	credMgr := connMgr.credentialManagers[vcInstance.Cfg.SecretRef]
 	if credMgr == nil {
 		klog.Errorf("Unable to find credential manager for vcServer=%s credentialHolder=%s", vcInstance.Cfg.VCenterIP, vcInstance.Cfg.SecretRef)
 		return ErrUnableToFindCredentialManager
 	}
-	credentials, err := credMgr.GetCredential(vcInstance.Cfg.VCenterIP)
+	if err := applyCredential(vcInstance.Conn, credMgr, vcInstance.Cfg.VCenterIP); err != nil {
+		return err
+	}
+	return vcInstance.Conn.Connect(ctx)
+}
+
+// ConnectWithCredentials fetches the credential of server from credMgr, applies it to conn
+// and connects. If the login fails with invalid credentials, e.g. because the secret was
+// rotated in the meantime, the credential is fetched again and the login retried once.
+func ConnectWithCredentials(ctx context.Context, conn *vclib.VSphereConnection, credMgr cm.Interface, server string) error {
+	if credMgr == nil {
+		return ErrUnableToFindCredentialManager
+	}
+	if err := applyCredential(conn, credMgr, server); err != nil {
+		return err
+	}
+	err := conn.Connect(ctx)
+	if err == nil || !vclib.IsInvalidCredentialsError(err) {
+		return err
+	}
+
+	klog.V(2).Infof("Invalid credentials. Fetching credentials again. vcServer=%s", server)
+	if err := applyCredential(conn, credMgr, server); err != nil {
+		return err
+	}
+	return conn.Connect(ctx)
+}
+
+// applyCredential fetches the credential of server from credMgr and applies it to conn.
+// A credential keyed by the ExpectedInstanceUUID of conn takes precedence over one keyed by
+// server. A session manager URL and token are applied for conn to clone the session of the
+// session manager, with the username and password, if any, as a fallback. The client
+// certificate and key of conn are kept, Secrets do not hold them.
+func applyCredential(conn *vclib.VSphereConnection, credMgr cm.Interface, server string) error {
+	credentials, err := credMgr.GetCredentialForInstance(server, conn.ExpectedInstanceUUID)
 	if err != nil {
 		klog.Error("Failed to get credentials from Secret Credential Manager with err:", err)
 		return err
 	}
-	vcInstance.Conn.UpdateCredentials(credentials.User, credentials.Password)
-	return vcInstance.Conn.Connect(ctx)
+	return conn.UpdateAll(vclib.Credentials{
+		Username:            credentials.User,
+		Password:            credentials.Password,
+		SessionManagerURL:   credentials.VCSessionManagerURL,
+		SessionManagerToken: credentials.VCSessionManagerToken,
+	})
+}
+
+// RefreshCredentials re-reads the credentials of all the credential managers right away, e.g.
+// after a Secret was edited out-of-band, and applies them to the connections of the vCenters
+// they hold the credentials of. The errors of both are returned.
+func (connMgr *ConnectionManager) RefreshCredentials(ctx context.Context) error {
+	var errs []error
+	for name, credMgr := range connMgr.credentialManagers {
+		if err := credMgr.Refresh(ctx); err != nil {
+			klog.Errorf("Failed to refresh credentials of %s: %v", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		for _, vcInstance := range connMgr.VsphereInstanceMap {
+			if vcInstance.Cfg.SecretRef != name {
+				continue
+			}
+			if err := applyCredential(vcInstance.Conn, credMgr, vcInstance.Cfg.VCenterIP); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", name, vcInstance.Cfg.VCenterIP, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // Logout closes existing connections to remote vCenter endpoints.
@@ -0,0 +1,282 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connectionmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+
+	vcfg "k8s.io/cloud-provider-vsphere/pkg/common/config"
+	cm "k8s.io/cloud-provider-vsphere/pkg/common/credentialmanager"
+	cmfake "k8s.io/cloud-provider-vsphere/pkg/common/credentialmanager/fake"
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+)
+
+// rotatingSecretLister returns the next of its secrets on every Get, the last one repeatedly.
+type rotatingSecretLister struct {
+	secrets []*v1.Secret
+	gets    int
+}
+
+func (l *rotatingSecretLister) List(selector labels.Selector) ([]*v1.Secret, error) {
+	return l.secrets, nil
+}
+
+func (l *rotatingSecretLister) Secrets(namespace string) listerv1.SecretNamespaceLister {
+	return l
+}
+
+func (l *rotatingSecretLister) Get(name string) (*v1.Secret, error) {
+	secret := l.secrets[len(l.secrets)-1]
+	if l.gets < len(l.secrets) {
+		secret = l.secrets[l.gets]
+	}
+	l.gets++
+	return secret, nil
+}
+
+func TestConnectWithCredentials(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+	server := s.URL.Hostname()
+
+	secret := func(server string, data map[string]string) *v1.Secret {
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "vsphere-creds", Namespace: "kube-system"}}
+		secret.Data = make(map[string][]byte)
+		for key, value := range data {
+			secret.Data[server+"."+key] = []byte(value)
+		}
+		return secret
+	}
+	password := func(password string) *v1.Secret {
+		return secret(server, map[string]string{"username": "user", "password": password})
+	}
+
+	// a session manager handing out clone tickets of a session of user
+	shared := &vclib.VSphereConnection{Hostname: server, Port: s.URL.Port(), Insecure: true, Username: "user", Password: "pass"}
+	if err := shared.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Logout(context.Background())
+	sessionManager := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer session-manager-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ticket, err := session.NewManager(shared.Client).AcquireCloneTicket(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, ticket)
+	}))
+	defer sessionManager.Close()
+
+	tests := []struct {
+		name         string
+		secrets      []*v1.Secret
+		expectedErr  func(error) bool
+		expectedGets int
+		expectedUser string
+	}{
+		{
+			name:         "password credential",
+			secrets:      []*v1.Secret{password("pass")},
+			expectedGets: 1,
+			expectedUser: "user",
+		},
+		{
+			name:         "rotated password is fetched again",
+			secrets:      []*v1.Secret{password("stale"), password("pass")},
+			expectedGets: 2,
+			expectedUser: "user",
+		},
+		{
+			name:         "fetched password is still invalid",
+			secrets:      []*v1.Secret{password("stale"), password("still-stale")},
+			expectedErr:  vclib.IsInvalidCredentialsError,
+			expectedGets: 2,
+		},
+		{
+			name: "session of the session manager is cloned",
+			secrets: []*v1.Secret{secret(server, map[string]string{
+				"vc-session-manager-url":   sessionManager.URL,
+				"vc-session-manager-token": "session-manager-token",
+			})},
+			expectedGets: 1,
+			expectedUser: "user",
+		},
+		{
+			name:         "missing credential",
+			secrets:      []*v1.Secret{secret("other.example.com", map[string]string{"username": "user", "password": "pass"})},
+			expectedErr:  func(err error) bool { return errors.Is(err, cm.ErrCredentialsNotFound) },
+			expectedGets: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i, secret := range test.secrets {
+				secret.ResourceVersion = strconv.Itoa(i + 1)
+			}
+			lister := &rotatingSecretLister{secrets: test.secrets}
+			credMgr := cm.NewCredentialManager("vsphere-creds", "kube-system", "", lister)
+			conn := &vclib.VSphereConnection{
+				Hostname: server,
+				Port:     s.URL.Port(),
+				Insecure: true,
+			}
+
+			err := ConnectWithCredentials(context.Background(), conn, credMgr, server)
+			if test.expectedErr != nil {
+				if !test.expectedErr(err) {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if lister.gets != test.expectedGets {
+				t.Errorf("Expected the secret to be fetched %d times, got %d", test.expectedGets, lister.gets)
+			}
+			if test.expectedUser == "" {
+				return
+			}
+
+			userSession, err := session.NewManager(conn.Client).UserSession(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userSession == nil || userSession.UserName != test.expectedUser {
+				t.Errorf("Expected session of %s, got %v", test.expectedUser, userSession)
+			}
+			conn.Logout(context.Background())
+		})
+	}
+}
+
+func TestConnectWithCredentialsWithoutCredentialManager(t *testing.T) {
+	err := ConnectWithCredentials(context.Background(), &vclib.VSphereConnection{}, nil, "vc.example.com")
+	if !errors.Is(err, ErrUnableToFindCredentialManager) {
+		t.Errorf("Expected %v, got %v", ErrUnableToFindCredentialManager, err)
+	}
+}
+
+func TestApplyCredential(t *testing.T) {
+	conn := &vclib.VSphereConnection{
+		Username:      "old-user",
+		Password:      "old-pass",
+		BearerToken:   "old-token",
+		ClientCertPEM: "cert",
+		ClientKeyPEM:  "key",
+	}
+	credMgr := cmfake.NewFakeCredentialManager(map[string]*cm.Credential{
+		"vc.example.com": {User: "user", Password: "pass"},
+	})
+	if err := applyCredential(conn, credMgr, "vc.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Username != "user" || conn.Password != "pass" || conn.BearerToken != "" {
+		t.Errorf("Expected the credentials of the Secret, got %q, %q, %q", conn.Username, conn.Password, conn.BearerToken)
+	}
+	if conn.ClientCertPEM != "cert" || conn.ClientKeyPEM != "key" {
+		t.Errorf("Expected the client certificate and key to be kept, got %q, %q", conn.ClientCertPEM, conn.ClientKeyPEM)
+	}
+
+	credMgr.SetCredential("vc.example.com", &cm.Credential{
+		VCSessionManagerURL:   "https://vc.example.com/session",
+		VCSessionManagerToken: "token",
+	})
+	if err := applyCredential(conn, credMgr, "vc.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.SessionManagerURL != "https://vc.example.com/session" || conn.SessionManagerToken != "token" || conn.BearerToken != "" {
+		t.Errorf("Expected the session manager URL and token, got %q, %q, bearer token %q",
+			conn.SessionManagerURL, conn.SessionManagerToken, conn.BearerToken)
+	}
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	secret := func(password string) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "vsconf", Namespace: "kube-system", ResourceVersion: "1"},
+			Data: map[string][]byte{
+				"0.0.0.0.username": []byte("user"),
+				"0.0.0.0.password": []byte(password),
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(secret("password"))
+	// the lister never catches up with the Secret edited out-of-band
+	credMgr := cm.NewCredentialManager("vsconf", "kube-system", "", &rotatingSecretLister{secrets: []*v1.Secret{secret("password")}})
+	credMgr.SecretGetter = client.CoreV1()
+	conn := &vclib.VSphereConnection{Hostname: "0.0.0.0", Username: "user", Password: "password"}
+	connMgr := &ConnectionManager{
+		credentialManagers: map[string]*cm.CredentialManager{vcfg.DefaultCredentialManager: credMgr},
+		VsphereInstanceMap: map[string]*VSphereInstance{
+			"0.0.0.0": {Conn: conn, Cfg: &vcfg.VirtualCenterConfig{VCenterIP: "0.0.0.0", SecretRef: vcfg.DefaultCredentialManager}},
+		},
+	}
+	if _, err := credMgr.GetCredential("0.0.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CoreV1().Secrets("kube-system").Update(context.Background(), secret("rotated"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := connMgr.RefreshCredentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	credential, err := credMgr.GetCredential("0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.Password != "rotated" {
+		t.Errorf("Expected the refreshed password, got %q", credential.Password)
+	}
+	if conn.Password != "rotated" {
+		t.Errorf("Expected the refreshed password to be applied to the connection, got %q", conn.Password)
+	}
+
+	if err := client.CoreV1().Secrets("kube-system").Delete(context.Background(), "vsconf", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := connMgr.RefreshCredentials(context.Background()); err == nil {
+		t.Error("Expected the failure to read the Secret to be returned")
+	}
+}
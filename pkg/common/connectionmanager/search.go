@@ -59,7 +59,6 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 	var globalErrMutex = &sync.Mutex{}
 	var queueChannel chan *vmSearch
 	var wg sync.WaitGroup
-	var globalErr *error
 
 	queueChannel = make(chan *vmSearch, QueueSize)
 
@@ -76,11 +75,11 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 	klog.V(2).Info("WhichVCandDCByNodeID nodeID: ", myNodeID)
 
 	vmFound := false
-	globalErr = nil
+	globalErr := vclib.NewMultiError(len(cm.VsphereInstanceMap))
 
-	setGlobalErr := func(err error) {
+	setGlobalErr := func(server string, err error) {
 		globalErrMutex.Lock()
-		globalErr = &err
+		globalErr.Add(server, err)
 		globalErrMutex.Unlock()
 	}
 
@@ -116,7 +115,7 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 
 			if err != nil {
 				klog.Error("WhichVCandDCByNodeID error vc:", err)
-				setGlobalErr(err)
+				setGlobalErr(vsi.Cfg.VCenterIP, err)
 				continue
 			}
 
@@ -124,7 +123,7 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 				datacenterObjs, err = vclib.GetAllDatacenter(ctx, vsi.Conn)
 				if err != nil {
 					klog.Error("WhichVCandDCByNodeID error dc:", err)
-					setGlobalErr(err)
+					setGlobalErr(vsi.Cfg.VCenterIP, err)
 					continue
 				}
 			} else {
@@ -137,7 +136,7 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 					datacenterObj, err := vclib.GetDatacenter(ctx, vsi.Conn, dc)
 					if err != nil {
 						klog.Error("WhichVCandDCByNodeID error dc:", err)
-						setGlobalErr(err)
+						setGlobalErr(vsi.Cfg.VCenterIP, err)
 						continue
 					}
 					datacenterObjs = append(datacenterObjs, datacenterObj)
@@ -181,7 +180,7 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 					klog.Errorf("Error while looking for vm=%s(%s) in vc=%s and datacenter=%s: %v",
 						myNodeID, searchBy, res.vc, res.datacenter.Name(), err)
 					if err != vclib.ErrNoVMFound {
-						setGlobalErr(err)
+						setGlobalErr(res.vc, err)
 					} else {
 						klog.V(2).Infof("Did not find node %s in vc=%s and datacenter=%s",
 							myNodeID, res.vc, res.datacenter.Name())
@@ -221,8 +220,8 @@ func (cm *ConnectionManager) WhichVCandDCByNodeID(ctx context.Context, nodeID st
 	if vmFound {
 		return vmInfo, nil
 	}
-	if globalErr != nil {
-		return nil, *globalErr
+	if err := globalErr.ErrorOrNil(); err != nil {
+		return nil, err
 	}
 
 	klog.V(4).Infof("WhichVCandDCByNodeID: %q vm not found", myNodeID)
@@ -247,16 +246,15 @@ func (cm *ConnectionManager) WhichVCandDCByFCDId(ctx context.Context, fcdID stri
 	var globalErrMutex = &sync.Mutex{}
 	var queueChannel chan *fcdSearch
 	var wg sync.WaitGroup
-	var globalErr *error
 
 	queueChannel = make(chan *fcdSearch, QueueSize)
 
 	fcdFound := false
-	globalErr = nil
+	globalErr := vclib.NewMultiError(len(cm.VsphereInstanceMap))
 
-	setGlobalErr := func(err error) {
+	setGlobalErr := func(server string, err error) {
 		globalErrMutex.Lock()
-		globalErr = &err
+		globalErr.Add(server, err)
 		globalErrMutex.Unlock()
 	}
 
@@ -292,7 +290,7 @@ func (cm *ConnectionManager) WhichVCandDCByFCDId(ctx context.Context, fcdID stri
 
 			if err != nil {
 				klog.Error("WhichVCandDCByFCDId error vc:", err)
-				setGlobalErr(err)
+				setGlobalErr(vsi.Cfg.VCenterIP, err)
 				continue
 			}
 
@@ -300,7 +298,7 @@ func (cm *ConnectionManager) WhichVCandDCByFCDId(ctx context.Context, fcdID stri
 				datacenterObjs, err = vclib.GetAllDatacenter(ctx, vsi.Conn)
 				if err != nil {
 					klog.Error("WhichVCandDCByFCDId error dc:", err)
-					setGlobalErr(err)
+					setGlobalErr(vsi.Cfg.VCenterIP, err)
 					continue
 				}
 			} else {
@@ -313,7 +311,7 @@ func (cm *ConnectionManager) WhichVCandDCByFCDId(ctx context.Context, fcdID stri
 					datacenterObj, err := vclib.GetDatacenter(ctx, vsi.Conn, dc)
 					if err != nil {
 						klog.Error("WhichVCandDCByFCDId error dc:", err)
-						setGlobalErr(err)
+						setGlobalErr(vsi.Cfg.VCenterIP, err)
 						continue
 					}
 					datacenterObjs = append(datacenterObjs, datacenterObj)
@@ -347,7 +345,7 @@ func (cm *ConnectionManager) WhichVCandDCByFCDId(ctx context.Context, fcdID stri
 					klog.Errorf("Error while looking for FCD=%+v in vc=%s and datacenter=%s: %v",
 						fcd, res.vc, res.datacenter.Name(), err)
 					if err != vclib.ErrNoDiskIDFound {
-						setGlobalErr(err)
+						setGlobalErr(res.vc, err)
 					} else {
 						klog.V(2).Infof("Did not find FCD %s in vc=%s and datacenter=%s",
 							fcdID, res.vc, res.datacenter.Name())
@@ -369,8 +367,8 @@ func (cm *ConnectionManager) WhichVCandDCByFCDId(ctx context.Context, fcdID stri
 	if fcdFound {
 		return fcdInfo, nil
 	}
-	if globalErr != nil {
-		return nil, *globalErr
+	if err := globalErr.ErrorOrNil(); err != nil {
+		return nil, err
 	}
 
 	klog.V(4).Infof("WhichVCandDCByFCDId: %q FCD not found", fcdID)
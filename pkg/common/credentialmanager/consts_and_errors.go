@@ -18,12 +18,35 @@ package credentialmanager
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 const (
 	usernamePrefix = "username_"
 	passwordPrefix = "password_"
 	serverPrefix   = "server_"
+
+	usernameSuffix            = "username"
+	passwordSuffix            = "password"
+	sessionManagerURLSuffix   = "vc-session-manager-url"
+	sessionManagerTokenSuffix = "vc-session-manager-token"
+	portSuffix                = "port"
+
+	// structuredCredentialsKey is the Secret key holding a YAML or JSON map of servers to
+	// their credentials, as an alternative to a key per server and credential. It is not named
+	// after the vsphere.conf cloud config, which Secrets may hold next to it.
+	structuredCredentialsKey = "credentials.yaml"
+
+	// periodicReloadJitter is the jitter factor of the StartPeriodicReload interval
+	periodicReloadJitter = 0.1
+
+	// DefaultConsistencyCheckInterval is the default interval of StartConsistencyCheck
+	DefaultConsistencyCheckInterval = 30 * time.Minute
+
+	// DefaultNegativeCacheMaxTTLFactor is the default NegativeCacheMaxTTL, as a multiple of
+	// NegativeCacheTTL
+	DefaultNegativeCacheMaxTTLFactor = 16
 )
 
 // Errors
@@ -39,4 +62,43 @@ var (
 
 	// ErrIncompleteCredentialSet is returned when the credentials do not contain all required values
 	ErrIncompleteCredentialSet = errors.New("Credentials did not have all required values")
+	// ErrInsecureSessionManagerURL is returned when a session manager URL does not use the https scheme.
+	ErrInsecureSessionManagerURL = errors.New("Session manager URL must use https")
+	// ErrInvalidSessionManagerURL is returned when a session manager URL cannot be parsed.
+	ErrInvalidSessionManagerURL = errors.New("Session manager URL is invalid")
+	// ErrPathLikeCredential is returned when a username or password looks like a file path.
+	ErrPathLikeCredential = errors.New("Username/Password looks like a file path")
+	// ErrMixedSecretFormats is returned in strict format mode when a Secret mixes the
+	// <server>.<key> and <key>_<n> formats.
+	ErrMixedSecretFormats = errors.New("Secret mixes the <server>.<key> and <key>_<n> formats")
+	// ErrMalformedStructuredCredentials is returned when the structured credentials key of a
+	// Secret does not hold a valid map of servers to credentials.
+	ErrMalformedStructuredCredentials = errors.New("Secret key " + structuredCredentialsKey + " is not a YAML or JSON map of servers to credentials")
+	// ErrInvalidDatacenterScope is returned when the <server>/<datacenter> scope of a Secret key
+	// has an empty server or datacenter, or a datacenter with surrounding spaces or a slash.
+	ErrInvalidDatacenterScope = errors.New("Secret key has an invalid <server>/<datacenter> scope")
+	// ErrInvalidPort is returned when a port is not a number between 1 and 65535.
+	ErrInvalidPort = errors.New("Port must be a number between 1 and 65535")
 )
+
+// CredentialError is returned when no credentials are found for a vCenter Server. It wraps
+// ErrCredentialsNotFound, and can be extracted with errors.As to tell the servers apart.
+type CredentialError struct {
+	// Server is the vCenter Server the credentials were looked up for.
+	Server string
+	// SecretRef is the <namespace>/<name> of the Secret, or the secrets directory, the credentials
+	// were looked up in, if known.
+	SecretRef string
+}
+
+func (e *CredentialError) Error() string {
+	if e.SecretRef == "" {
+		return fmt.Sprintf("%v for server %s", ErrCredentialsNotFound, e.Server)
+	}
+	return fmt.Sprintf("%v for server %s in %s", ErrCredentialsNotFound, e.Server, e.SecretRef)
+}
+
+// Unwrap returns ErrCredentialsNotFound.
+func (e *CredentialError) Unwrap() error {
+	return ErrCredentialsNotFound
+}
@@ -17,16 +17,31 @@ limitations under the License.
 package credentialmanager
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	yaml "gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	v1 "k8s.io/client-go/listers/core/v1"
 	klog "k8s.io/klog/v2"
 )
 
+var filePathElementRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var instanceUUIDRegexp = regexp.MustCompile(`^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$`)
+
 // NewCredentialManager returns a new CredentialManager object.
 func NewCredentialManager(secretName string, secretNamespace string, secretsDirectory string,
 	secretLister v1.SecretLister) *CredentialManager {
@@ -43,9 +58,187 @@ func NewCredentialManager(secretName string, secretNamespace string, secretsDire
 	}
 }
 
+// NewCredentialManagerWithDefaultPort returns a new CredentialManager object like
+// NewCredentialManager, whose credentials default to defaultPort when they do not set a port.
+// It returns ErrInvalidPort if defaultPort is not a valid port.
+func NewCredentialManagerWithDefaultPort(secretName string, secretNamespace string, secretsDirectory string,
+	secretLister v1.SecretLister, defaultPort string) (*CredentialManager, error) {
+	if err := validatePort(defaultPort); err != nil {
+		return nil, err
+	}
+	credentialManager := NewCredentialManager(secretName, secretNamespace, secretsDirectory, secretLister)
+	credentialManager.DefaultPort = defaultPort
+	return credentialManager, nil
+}
+
+// withDefaultPort sets the Port of credential to DefaultPort if it has none, and returns it.
+func (credentialManager *CredentialManager) withDefaultPort(credential *Credential) *Credential {
+	if credential.Port == "" {
+		credential.Port = credentialManager.DefaultPort
+	}
+	return credential
+}
+
 // GetCredential returns credentials for the given vCenter Server.
-// GetCredential returns error if Secret is not added or SecretDirectory is not set (ie No Creds).
+// GetCredential returns error if Secret is not added or SecretDirectory is not set (ie No Creds),
+// and a CredentialError if there are no credentials for the server.
 func (credentialManager *CredentialManager) GetCredential(server string) (*Credential, error) {
+	if credentialManager.isNegativelyCached(server) {
+		klog.V(4).Infof("credentials not found for server %s, cached", server)
+		return nil, credentialManager.notFound(server)
+	}
+	if err := credentialManager.refresh(); err != nil {
+		return nil, err
+	}
+
+	credential, found := credentialManager.Cache.GetCredential(server)
+	if !found {
+		klog.Errorf("credentials not found for server %s", server)
+		credentialManager.cacheNegatively(server)
+		return nil, credentialManager.notFound(server)
+	}
+	credentialManager.forgetNegative(server)
+	return credentialManager.withDefaultPort(&credential), nil
+}
+
+// notFound returns the CredentialError of server.
+func (credentialManager *CredentialManager) notFound(server string) error {
+	secretRef := credentialManager.SecretsDirectory
+	if credentialManager.SecretName != "" {
+		secretRef = credentialManager.SecretNamespace + "/" + credentialManager.SecretName
+	}
+	return &CredentialError{Server: server, SecretRef: secretRef}
+}
+
+// InvalidateNegativeCache forgets which servers were found to have no credentials, so that
+// GetCredential reads the Secret again for them, e.g. when the Secret changed.
+func (credentialManager *CredentialManager) InvalidateNegativeCache() {
+	credentialManager.negativeCacheLock.Lock()
+	defer credentialManager.negativeCacheLock.Unlock()
+	credentialManager.negativeCache = nil
+}
+
+// isNegativelyCached returns whether server was recently found to have no credentials.
+func (credentialManager *CredentialManager) isNegativelyCached(server string) bool {
+	credentialManager.negativeCacheLock.Lock()
+	defer credentialManager.negativeCacheLock.Unlock()
+	entry, found := credentialManager.negativeCache[server]
+	return found && time.Now().Before(entry.expiry)
+}
+
+// cacheNegatively remembers that server has no credentials for NegativeCacheTTL, or twice as
+// long as the last time if its previous entry expired, up to NegativeCacheMaxTTL. Nothing is
+// cached without a SecretLister, whose informer invalidates the entries.
+func (credentialManager *CredentialManager) cacheNegatively(server string) {
+	if credentialManager.NegativeCacheTTL <= 0 || credentialManager.SecretLister == nil {
+		return
+	}
+	maxTTL := credentialManager.NegativeCacheMaxTTL
+	if maxTTL <= 0 {
+		maxTTL = DefaultNegativeCacheMaxTTLFactor * credentialManager.NegativeCacheTTL
+	}
+
+	credentialManager.negativeCacheLock.Lock()
+	defer credentialManager.negativeCacheLock.Unlock()
+	if credentialManager.negativeCache == nil {
+		credentialManager.negativeCache = make(map[string]negativeCacheEntry)
+	}
+	ttl := credentialManager.NegativeCacheTTL
+	if previous, found := credentialManager.negativeCache[server]; found {
+		ttl = previous.ttl * 2
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	credentialManager.negativeCache[server] = negativeCacheEntry{expiry: time.Now().Add(ttl), ttl: ttl}
+	klog.V(4).Infof("caching that server %s has no credentials for %s", server, ttl)
+}
+
+// forgetNegative forgets the negative cache entry of server, which has credentials.
+func (credentialManager *CredentialManager) forgetNegative(server string) {
+	credentialManager.negativeCacheLock.Lock()
+	defer credentialManager.negativeCacheLock.Unlock()
+	delete(credentialManager.negativeCache, server)
+}
+
+// GetCredentialByInstanceUUID returns the credentials keyed by the given vCenter instance UUID,
+// as reported in ServiceContent.About.InstanceUuid, which is stable across IP or FQDN changes.
+func (credentialManager *CredentialManager) GetCredentialByInstanceUUID(instanceUUID string) (*Credential, error) {
+	if !instanceUUIDRegexp.MatchString(instanceUUID) {
+		return nil, fmt.Errorf("%w for invalid instance UUID %q", ErrCredentialsNotFound, instanceUUID)
+	}
+	return credentialManager.GetCredential(strings.ToLower(instanceUUID))
+}
+
+// GetCredentialForInstance returns the credentials keyed by the given vCenter instance UUID,
+// which take precedence, or else the credentials of the given vCenter Server.
+func (credentialManager *CredentialManager) GetCredentialForInstance(server, instanceUUID string) (*Credential, error) {
+	if instanceUUID != "" {
+		credential, err := credentialManager.GetCredentialByInstanceUUID(instanceUUID)
+		if err == nil || !errors.Is(err, ErrCredentialsNotFound) {
+			return credential, err
+		}
+		klog.V(4).Infof("No credentials for instance UUID %s, falling back to server %s", instanceUUID, server)
+	}
+	return credentialManager.GetCredential(server)
+}
+
+// GetCredentialForDatacenter returns the credentials scoped to the given datacenter of the
+// vCenter Server, keyed <server>/<datacenter>, or else the credentials of the server.
+func (credentialManager *CredentialManager) GetCredentialForDatacenter(server, datacenter string) (*Credential, error) {
+	if datacenter != "" {
+		if err := credentialManager.refresh(); err != nil {
+			return nil, err
+		}
+		if credential, found := credentialManager.Cache.GetCredential(normalizeServer(DatacenterScope(server, datacenter))); found {
+			return credentialManager.withDefaultPort(&credential), nil
+		}
+		klog.V(4).Infof("No credentials for datacenter %s, falling back to server %s", datacenter, server)
+	}
+	return credentialManager.GetCredential(server)
+}
+
+// GetCredentials returns the credentials of all the given vCenter Servers, refreshing them
+// and taking the cache lock only once. Servers without credentials are left out of the map
+// and reported with a CredentialError each.
+func (credentialManager *CredentialManager) GetCredentials(servers []string) (map[string]*Credential, []error) {
+	if err := credentialManager.refresh(); err != nil {
+		return nil, []error{err}
+	}
+
+	credentials, missing := credentialManager.Cache.GetCredentials(servers)
+	for _, credential := range credentials {
+		credentialManager.withDefaultPort(credential)
+	}
+	var errs []error
+	for _, server := range missing {
+		klog.Errorf("credentials not found for server %s", server)
+		errs = append(errs, credentialManager.notFound(server))
+	}
+	return credentials, errs
+}
+
+// GetAllCredentials returns the credentials of all the vCenter Servers found in the Secret
+// or the SecretsDirectory, keyed by server.
+func (credentialManager *CredentialManager) GetAllCredentials() (map[string]*Credential, error) {
+	if err := credentialManager.refresh(); err != nil {
+		return nil, err
+	}
+
+	snapshot := credentialManager.Cache.snapshot()
+	credentials := make(map[string]*Credential, len(snapshot))
+	for server := range snapshot {
+		credential := snapshot[server]
+		credentials[server] = credentialManager.withDefaultPort(&credential)
+	}
+	return credentials, nil
+}
+
+// refresh updates the cached credentials from the Secret or the SecretsDirectory.
+func (credentialManager *CredentialManager) refresh() error {
+	credentialManager.refreshLock.Lock()
+	defer credentialManager.refreshLock.Unlock()
+
 	//get the creds using the K8s listener if it exists
 	if credentialManager.SecretLister != nil {
 		klog.V(4).Info("SecretLister is valid. Retrieving secrets.")
@@ -54,7 +247,7 @@ func (credentialManager *CredentialManager) GetCredential(server string) (*Crede
 			klog.Errorf("updateCredentialsMapK8s failed. err=%s", err)
 			statusErr, ok := err.(*apierrors.StatusError)
 			if (ok && statusErr.ErrStatus.Code != http.StatusNotFound) || !ok {
-				return nil, err
+				return err
 			}
 			// Handle secrets deletion by finding credentials from cache
 			klog.Warningf("secret %q not found in namespace %q", credentialManager.SecretName, credentialManager.SecretNamespace)
@@ -69,13 +262,7 @@ func (credentialManager *CredentialManager) GetCredential(server string) (*Crede
 			klog.Warningf("Failed parsing SecretsDirectory %q: %q", credentialManager.SecretsDirectory, err)
 		}
 	}
-
-	credential, found := credentialManager.Cache.GetCredential(server)
-	if !found {
-		klog.Errorf("credentials not found for server %s", server)
-		return nil, ErrCredentialsNotFound
-	}
-	return &credential, nil
+	return nil
 }
 
 func (credentialManager *CredentialManager) updateCredentialsMapK8s() error {
@@ -92,7 +279,8 @@ func (credentialManager *CredentialManager) updateCredentialsMapK8s() error {
 		return nil
 	}
 	credentialManager.Cache.UpdateSecret(secret)
-	err = credentialManager.Cache.parseSecret()
+	err = credentialManager.Cache.parseSecret(credentialManager.parseOptions())
+	credentialManager.InvalidateNegativeCache()
 	if err != nil {
 		klog.Errorf("parseSecret failed with err=%q", err)
 	}
@@ -134,7 +322,194 @@ func (credentialManager *CredentialManager) updateCredentialsMapFile() error {
 
 	credentialManager.secretsDirectoryParsed = true
 	credentialManager.Cache.UpdateSecretFile(data)
-	return credentialManager.Cache.parseSecret()
+	defer credentialManager.InvalidateNegativeCache()
+	return credentialManager.Cache.parseSecret(credentialManager.parseOptions())
+}
+
+// AddUpdateHandler registers a handler called by StartPeriodicReload when credentials change.
+func (credentialManager *CredentialManager) AddUpdateHandler(handler CredentialUpdateHandler) {
+	credentialManager.handlersLock.Lock()
+	defer credentialManager.handlersLock.Unlock()
+	credentialManager.updateHandlers = append(credentialManager.updateHandlers, handler)
+}
+
+// StartPeriodicReload re-reads the SecretsDirectory, and the Secret if PeriodicReloadSecret
+// is set, every interval with jitter until ctx is done. The update handlers are called
+// when credentials change, e.g. for mounted secret files that no informer watches.
+func (credentialManager *CredentialManager) StartPeriodicReload(ctx context.Context, interval time.Duration) {
+	go wait.JitterUntilWithContext(ctx, func(ctx context.Context) {
+		if err := credentialManager.reload(); err != nil {
+			klog.Warningf("Failed to reload credentials: %v", err)
+		}
+	}, interval, periodicReloadJitter, true)
+}
+
+// Refresh re-reads the Secret and the SecretsDirectory right away and reparses them, even when
+// the Secret did not change according to its resource version, e.g. after the Secret was
+// edited out-of-band. It returns the error of reading or parsing them, and calls the update
+// handlers with the servers whose credentials changed.
+func (credentialManager *CredentialManager) Refresh(ctx context.Context) error {
+	return credentialManager.reloadWith(func() error {
+		var err error
+		if credentialManager.SecretGetter != nil || credentialManager.SecretLister != nil {
+			err = credentialManager.refreshSecret(ctx)
+		}
+		if credentialManager.SecretsDirectory != "" {
+			credentialManager.secretsDirectoryParsed = false
+			if fileErr := credentialManager.updateCredentialsMapFile(); err == nil {
+				err = fileErr
+			}
+		}
+		return err
+	})
+}
+
+// refreshSecret reads the Secret with SecretGetter, or SecretLister if it is not set, and
+// parses it into the cache. Must be called with refreshLock held.
+func (credentialManager *CredentialManager) refreshSecret(ctx context.Context) error {
+	var secret *corev1.Secret
+	var err error
+	if credentialManager.SecretGetter != nil {
+		secret, err = credentialManager.SecretGetter.Secrets(credentialManager.SecretNamespace).Get(ctx, credentialManager.SecretName, metav1.GetOptions{})
+	} else {
+		secret, err = credentialManager.SecretLister.Secrets(credentialManager.SecretNamespace).Get(credentialManager.SecretName)
+	}
+	if err != nil {
+		klog.Warningf("Cannot get secret %s in namespace %s. error: %q", credentialManager.SecretName, credentialManager.SecretNamespace, err)
+		return err
+	}
+	credentialManager.Cache.UpdateSecret(secret)
+	err = credentialManager.Cache.parseSecret(credentialManager.parseOptions())
+	credentialManager.InvalidateNegativeCache()
+	return err
+}
+
+// StartConsistencyCheck reads the Secret with SecretGetter every interval with jitter until ctx
+// is done, and repairs the cached credentials when they differ from those of the Secret in the
+// SecretLister, i.e. when its informer silently drifted from the API server. It does nothing
+// unless VerifyCacheConsistency is set and both SecretGetter and SecretLister are. An interval
+// of zero uses DefaultConsistencyCheckInterval.
+func (credentialManager *CredentialManager) StartConsistencyCheck(ctx context.Context, interval time.Duration) {
+	if !credentialManager.VerifyCacheConsistency || credentialManager.SecretGetter == nil || credentialManager.SecretLister == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultConsistencyCheckInterval
+	}
+	go wait.JitterUntilWithContext(ctx, func(ctx context.Context) {
+		if _, err := credentialManager.checkCacheConsistency(ctx); err != nil {
+			klog.Warningf("Failed to check the consistency of the cached secret %s/%s: %v",
+				credentialManager.SecretNamespace, credentialManager.SecretName, err)
+		}
+	}, interval, periodicReloadJitter, false)
+}
+
+// checkCacheConsistency compares the credentials of the Secret read from the API server with
+// those of the Secret in the SecretLister, and reloads the Secret from the API server when they
+// differ. It returns whether they differed.
+func (credentialManager *CredentialManager) checkCacheConsistency(ctx context.Context) (bool, error) {
+	namespace, name := credentialManager.SecretNamespace, credentialManager.SecretName
+	secret, err := credentialManager.SecretGetter.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	direct := make(map[string]*Credential)
+	if err := parseConfig(secret.Data, direct, credentialManager.parseOptions()); err != nil {
+		return false, err
+	}
+
+	cached := make(map[string]*Credential)
+	cachedVersion := ""
+	cachedSecret, err := credentialManager.SecretLister.Secrets(namespace).Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	if cachedSecret != nil {
+		cachedVersion = cachedSecret.GetResourceVersion()
+		// the cached Secret failing to parse counts as drift
+		_ = parseConfig(cachedSecret.Data, cached, credentialManager.parseOptions())
+	}
+
+	if credentialsEqual(direct, cached) {
+		return false, nil
+	}
+
+	klog.Warningf("Cached secret %s/%s at resource version %q drifted from the API server at resource version %q, reloading it",
+		namespace, name, cachedVersion, secret.GetResourceVersion())
+	secretCacheDrifts.WithLabelValues(namespace, name).Inc()
+	return true, credentialManager.reloadWith(func() error {
+		return credentialManager.refreshSecret(ctx)
+	})
+}
+
+// credentialsEqual returns whether a and b hold the same servers and credentials.
+func credentialsEqual(a, b map[string]*Credential) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for server, credential := range a {
+		other, found := b[server]
+		if !found || *other != *credential {
+			return false
+		}
+	}
+	return true
+}
+
+// reload re-reads the credentials and calls the update handlers with the servers whose
+// credentials changed.
+func (credentialManager *CredentialManager) reload() error {
+	return credentialManager.reloadWith(func() error {
+		var err error
+		if credentialManager.PeriodicReloadSecret && credentialManager.SecretLister != nil {
+			err = credentialManager.updateCredentialsMapK8s()
+		}
+		if credentialManager.SecretsDirectory != "" {
+			credentialManager.secretsDirectoryParsed = false
+			if fileErr := credentialManager.updateCredentialsMapFile(); err == nil {
+				err = fileErr
+			}
+		}
+		return err
+	})
+}
+
+// reloadWith calls update with refreshLock held and then calls the update handlers with the
+// servers whose credentials changed.
+func (credentialManager *CredentialManager) reloadWith(update func() error) error {
+	before := credentialManager.Cache.snapshot()
+
+	credentialManager.refreshLock.Lock()
+	err := update()
+	credentialManager.refreshLock.Unlock()
+
+	after := credentialManager.Cache.snapshot()
+	var changed []string
+	for server, credential := range after {
+		if previous, found := before[server]; !found || previous != credential {
+			changed = append(changed, server)
+		}
+	}
+	if len(changed) == 0 {
+		return err
+	}
+
+	klog.V(2).Infof("Credentials changed for servers %v", changed)
+	credentialManager.handlersLock.Lock()
+	handlers := credentialManager.updateHandlers
+	credentialManager.handlersLock.Unlock()
+	for _, handler := range handlers {
+		handler(changed)
+	}
+	return err
+}
+
+func (credentialManager *CredentialManager) parseOptions() parseOptions {
+	return parseOptions{
+		allowInsecureSessionManagerURL: credentialManager.AllowInsecureSessionManagerURL,
+		pathLikeCredentialCheck:        credentialManager.PathLikeCredentialCheck,
+		strictFormat:                   credentialManager.StrictFormat,
+	}
 }
 
 // GetSecret returns a Kubernetes secret.
@@ -170,7 +545,37 @@ func (cache *SecretCache) GetCredential(server string) (Credential, bool) {
 	return *credential, found
 }
 
-func (cache *SecretCache) parseSecret() error {
+// snapshot returns a copy of the cached credentials.
+func (cache *SecretCache) snapshot() map[string]Credential {
+	cache.cacheLock.Lock()
+	defer cache.cacheLock.Unlock()
+	credentials := make(map[string]Credential, len(cache.VirtualCenter))
+	for server, credential := range cache.VirtualCenter {
+		credentials[server] = *credential
+	}
+	return credentials
+}
+
+// GetCredentials returns the vCenter credentials of the provided vCenters found in the
+// cache, taking the cache lock once, and the vCenters without credentials.
+func (cache *SecretCache) GetCredentials(servers []string) (map[string]*Credential, []string) {
+	cache.cacheLock.Lock()
+	defer cache.cacheLock.Unlock()
+	credentials := make(map[string]*Credential, len(servers))
+	var missing []string
+	for _, server := range servers {
+		credential, found := cache.VirtualCenter[server]
+		if !found {
+			missing = append(missing, server)
+			continue
+		}
+		credentialCopy := *credential
+		credentials[server] = &credentialCopy
+	}
+	return credentials, missing
+}
+
+func (cache *SecretCache) parseSecret(opts parseOptions) error {
 	cache.cacheLock.Lock()
 	defer cache.cacheLock.Unlock()
 
@@ -183,30 +588,66 @@ func (cache *SecretCache) parseSecret() error {
 		data = cache.SecretFile
 	}
 
-	return parseConfig(data, cache.VirtualCenter)
+	return parseConfig(data, cache.VirtualCenter, opts)
 }
 
-// parseConfig returns vCenter ip/fdqn mapping to its credentials viz. Username and Password.
-func parseConfig(data map[string][]byte, config map[string]*Credential) error {
+// parseConfig returns vCenter ip/fdqn mapping to its credentials viz. Username and Password,
+// or the session manager URL and token.
+func parseConfig(data map[string][]byte, config map[string]*Credential, opts parseOptions) error {
 	if len(data) == 0 {
 		return ErrCredentialMissing
 	}
+	if structured, ok := data[structuredCredentialsKey]; ok {
+		if err := parseStructuredConfig(structured, config); err != nil {
+			klog.Errorf("Failed to parse Secret key %s: %v", structuredCredentialsKey, err)
+			return err
+		}
+		// The other keys are parsed as usual, overriding the structured credentials
+		flatData := make(map[string][]byte, len(data)-1)
+		for credentialKey, credentialValue := range data {
+			if credentialKey != structuredCredentialsKey {
+				flatData[credentialKey] = credentialValue
+			}
+		}
+		data = flatData
+	}
 	unknownKeys := map[string][]byte{}
 	for credentialKey, credentialValue := range data {
-		if strings.HasSuffix(credentialKey, "password") {
-			vcServer := strings.Split(credentialKey, ".password")[0]
-			if _, ok := config[vcServer]; !ok {
-				config[vcServer] = &Credential{}
-			}
-			config[vcServer].Password = strings.TrimSuffix(string(credentialValue), "\n")
-		} else if strings.HasSuffix(credentialKey, "username") {
-			vcServer := strings.Split(credentialKey, ".username")[0]
-			if _, ok := config[vcServer]; !ok {
-				config[vcServer] = &Credential{}
-			}
-			config[vcServer].User = strings.TrimSuffix(string(credentialValue), "\n")
-		} else {
+		vcServer, suffix, ok := splitCredentialKey(credentialKey)
+		if !ok {
 			unknownKeys[credentialKey] = credentialValue
+			continue
+		}
+		if err := validateDatacenterScope(vcServer); err != nil {
+			klog.Errorf("Invalid secret key %s: %v", credentialKey, err)
+			return err
+		}
+		vcServer = normalizeServer(vcServer)
+		if _, ok := config[vcServer]; !ok {
+			config[vcServer] = &Credential{}
+		}
+		value := strings.TrimSuffix(string(credentialValue), "\n")
+		switch suffix {
+		case passwordSuffix:
+			config[vcServer].Password = value
+		case usernameSuffix:
+			config[vcServer].User = value
+		case sessionManagerURLSuffix:
+			config[vcServer].VCSessionManagerURL = value
+		case sessionManagerTokenSuffix:
+			config[vcServer].VCSessionManagerToken = value
+		case portSuffix:
+			config[vcServer].Port = value
+		}
+	}
+
+	if opts.strictFormat && len(unknownKeys) < len(data) {
+		for credentialKey := range unknownKeys {
+			if strings.HasPrefix(credentialKey, serverPrefix) || strings.HasPrefix(credentialKey, usernamePrefix) ||
+				strings.HasPrefix(credentialKey, passwordPrefix) {
+				klog.Errorf("Found key %s of the alternative format in a Secret using the <server>.<key> format", credentialKey)
+				return ErrMixedSecretFormats
+			}
 		}
 	}
 
@@ -286,11 +727,179 @@ func parseConfig(data map[string][]byte, config map[string]*Credential) error {
 		return ErrUnknownSecretKey
 	}
 
-	for vcServer, credential := range config {
-		if credential.User == "" || credential.Password == "" {
-			klog.Errorf("Username/Password is missing for server %s", vcServer)
-			return ErrCredentialMissing
+	// Validate all the credentials, so that every invalid one is reported at once
+	servers := make([]string, 0, len(config))
+	for vcServer := range config {
+		servers = append(servers, vcServer)
+	}
+	sort.Strings(servers)
+	var errs []error
+	for _, vcServer := range servers {
+		credential := config[vcServer]
+		err := credential.validate(opts)
+		if opts.pathLikeCredentialCheck != PathLikeCredentialCheckDisabled &&
+			(looksLikeFilePath(credential.User) || looksLikeFilePath(credential.Password)) {
+			if opts.pathLikeCredentialCheck == PathLikeCredentialCheckStrict {
+				err = errors.Join(err, ErrPathLikeCredential)
+			} else {
+				klog.Warningf("Username/Password for server %s looks like a file path, is the Secret misconfigured?", vcServer)
+			}
+		}
+		if err != nil {
+			klog.Errorf("Invalid credentials for server %s: %v", vcServer, err)
+			errs = append(errs, fmt.Errorf("server %s: %w", vcServer, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// structuredCredential is a credential in the structured credentials key of a Secret, with
+// the same keys as the <server>.<key> format.
+type structuredCredential struct {
+	User                  string `yaml:"username"`
+	Password              string `yaml:"password"`
+	VCSessionManagerURL   string `yaml:"vc-session-manager-url"`
+	VCSessionManagerToken string `yaml:"vc-session-manager-token"`
+	Port                  string `yaml:"port"`
+}
+
+// parseStructuredConfig adds the credentials of the YAML or JSON map of servers to
+// credentials in data to config.
+func parseStructuredConfig(data []byte, config map[string]*Credential) error {
+	var structured map[string]*structuredCredential
+	if err := yaml.UnmarshalStrict(data, &structured); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedStructuredCredentials, err)
+	}
+	if len(structured) == 0 {
+		return fmt.Errorf("%w: no servers found", ErrMalformedStructuredCredentials)
+	}
+	for vcServer, credential := range structured {
+		if vcServer == "" || credential == nil {
+			return fmt.Errorf("%w: server %q has no credentials", ErrMalformedStructuredCredentials, vcServer)
+		}
+		if err := validateDatacenterScope(vcServer); err != nil {
+			return err
+		}
+		config[normalizeServer(vcServer)] = &Credential{
+			User:                  credential.User,
+			Password:              credential.Password,
+			VCSessionManagerURL:   credential.VCSessionManagerURL,
+			VCSessionManagerToken: credential.VCSessionManagerToken,
+			Port:                  credential.Port,
+		}
+	}
+	return nil
+}
+
+// normalizeServer returns the key of the credentials of vcServer, which may be scoped to a
+// datacenter. Instance UUIDs are looked up case-insensitively.
+func normalizeServer(vcServer string) string {
+	if server, datacenter, scoped := strings.Cut(vcServer, "/"); scoped {
+		return DatacenterScope(normalizeServer(server), datacenter)
+	}
+	if instanceUUIDRegexp.MatchString(vcServer) {
+		return strings.ToLower(vcServer)
+	}
+	return vcServer
+}
+
+// DatacenterScope returns the key of the credentials scoped to the given datacenter of the
+// vCenter Server, see GetCredentialForDatacenter.
+func DatacenterScope(server, datacenter string) string {
+	return server + "/" + datacenter
+}
+
+// validateDatacenterScope checks the datacenter scope of vcServer, if any.
+func validateDatacenterScope(vcServer string) error {
+	server, datacenter, scoped := strings.Cut(vcServer, "/")
+	if !scoped {
+		return nil
+	}
+	if server == "" || datacenter == "" || strings.TrimSpace(datacenter) != datacenter || strings.Contains(datacenter, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidDatacenterScope, vcServer)
+	}
+	return nil
+}
+
+// Validate checks that the credential has a username and password or a session manager URL
+// and token, that the session manager URL is a valid https URL, and that the port, if any, is
+// valid. All problems found are returned joined, so that they can be fixed at once.
+func (credential *Credential) Validate() error {
+	return credential.validate(parseOptions{})
+}
+
+// validate implements Validate, honoring the session manager URL option of opts.
+func (credential *Credential) validate(opts parseOptions) error {
+	var errs []error
+	hasPassword := credential.User != "" && credential.Password != ""
+	hasSessionManager := credential.VCSessionManagerURL != "" && credential.VCSessionManagerToken != ""
+	if !hasPassword && !hasSessionManager {
+		errs = append(errs, ErrCredentialMissing)
+	}
+	if credential.VCSessionManagerURL != "" {
+		if err := validateSessionManagerURL(credential.VCSessionManagerURL, opts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if credential.Port != "" {
+		if err := validatePort(credential.Port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validatePort checks that port is a number between 1 and 65535.
+func validatePort(port string) error {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%w: %q", ErrInvalidPort, port)
+	}
+	return nil
+}
+
+// splitCredentialKey splits a <server>.<suffix> secret key into the server and one of the
+// known suffixes. Only the suffix is trimmed from the right, so that servers may be FQDNs
+// with any number of dots.
+func splitCredentialKey(credentialKey string) (server, suffix string, ok bool) {
+	for _, suffix := range []string{usernameSuffix, passwordSuffix, sessionManagerURLSuffix, sessionManagerTokenSuffix, portSuffix} {
+		if server, found := strings.CutSuffix(credentialKey, "."+suffix); found && server != "" {
+			return server, suffix, true
+		}
+	}
+	return "", "", false
+}
+
+// looksLikeFilePath returns true if value is an absolute path of at least two
+// elements made only of characters commonly found in file names, e.g. /etc/vsphere/password.
+func looksLikeFilePath(value string) bool {
+	if !strings.HasPrefix(value, "/") {
+		return false
+	}
+	elements := strings.Split(strings.TrimPrefix(value, "/"), "/")
+	if len(elements) < 2 {
+		return false
+	}
+	for _, element := range elements {
+		if !filePathElementRegexp.MatchString(element) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateSessionManagerURL checks that the session manager URL parses and uses https.
+// A non-https scheme is only logged when insecure session manager URLs are allowed.
+func validateSessionManagerURL(sessionManagerURL string, opts parseOptions) error {
+	u, err := neturl.Parse(sessionManagerURL)
+	if err != nil || u.Host == "" {
+		return ErrInvalidSessionManagerURL
+	}
+	if !strings.EqualFold(u.Scheme, "https") {
+		if opts.allowInsecureSessionManagerURL {
+			klog.Warningf("Session manager URL %q does not use https", sessionManagerURL)
+			return nil
 		}
+		return ErrInsecureSessionManagerURL
 	}
 	return nil
 }
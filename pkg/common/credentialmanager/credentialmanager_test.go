@@ -17,9 +17,16 @@ limitations under the License.
 package credentialmanager
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -254,7 +261,7 @@ func TestSecretCredentialManagerK8s_GetCredential(t *testing.T) {
 				expected := test.expectedValues[ntest].(GetCredentialsTest)
 				credential, err := secretCredentialManager.GetCredential(expected.server)
 				t.Logf("Retrieving credentials for server %s", expected.server)
-				if err != expected.err {
+				if !errors.Is(err, expected.err) {
 					t.Fatalf("Fail to get credentials with error: %v", err)
 				}
 				if expected.err == nil {
@@ -278,6 +285,315 @@ func TestSecretCredentialManagerK8s_GetCredential(t *testing.T) {
 	}
 }
 
+func TestSecretCredentialManagerK8s_GetCredentials(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vsconf",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			"0.0.0.0.username": []byte("user"),
+			"0.0.0.0.password": []byte("password"),
+			"0.0.1.1.username": []byte("user1"),
+			"0.0.1.1.password": []byte("password1"),
+		},
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("Failed to add secret to internal cache: %v", err)
+	}
+	credentialManager := NewCredentialManager(secret.Name, secret.Namespace, "", secretInformer.Lister())
+
+	credentials, errs := credentialManager.GetCredentials([]string{"0.0.0.0", "1.1.1.1", "0.0.1.1", "2.2.2.2"})
+
+	expected := map[string]*Credential{
+		"0.0.0.0": {User: "user", Password: "password"},
+		"0.0.1.1": {User: "user1", Password: "password1"},
+	}
+	if !reflect.DeepEqual(expected, credentials) {
+		t.Errorf("Expected credentials %v, got %v", expected, credentials)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected an error for each unknown server, got %v", errs)
+	}
+	for i, server := range []string{"1.1.1.1", "2.2.2.2"} {
+		if !errors.Is(errs[i], ErrCredentialsNotFound) || !strings.Contains(errs[i].Error(), server) {
+			t.Errorf("Expected credentials of %s not to be found, got %v", server, errs[i])
+		}
+	}
+
+	all, err := credentialManager.GetAllCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, all) {
+		t.Errorf("Expected all credentials %v, got %v", expected, all)
+	}
+}
+
+func TestSecretCredentialManagerK8s_CredentialError(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vsconf",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			"0.0.0.0.username": []byte("user"),
+			"0.0.0.0.password": []byte("password"),
+		},
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("Failed to add secret to internal cache: %v", err)
+	}
+	credentialManager := NewCredentialManager(secret.Name, secret.Namespace, "", secretInformer.Lister())
+	credentialManager.NegativeCacheTTL = time.Minute
+
+	// the negatively cached lookup returns the same error
+	for i := 0; i < 2; i++ {
+		_, err := credentialManager.GetCredential("1.1.1.1")
+		if !errors.Is(err, ErrCredentialsNotFound) {
+			t.Fatalf("Expected %v, got %v", ErrCredentialsNotFound, err)
+		}
+		var credentialErr *CredentialError
+		if !errors.As(err, &credentialErr) {
+			t.Fatalf("Expected a CredentialError, got %T", err)
+		}
+		if credentialErr.Server != "1.1.1.1" || credentialErr.SecretRef != "kube-system/vsconf" {
+			t.Errorf("Expected the server 1.1.1.1 and secret kube-system/vsconf, got %+v", credentialErr)
+		}
+	}
+
+	_, errs := credentialManager.GetCredentials([]string{"0.0.0.0", "2.2.2.2"})
+	var credentialErr *CredentialError
+	if len(errs) != 1 || !errors.As(errs[0], &credentialErr) || credentialErr.Server != "2.2.2.2" {
+		t.Errorf("Expected a CredentialError for 2.2.2.2, got %v", errs)
+	}
+}
+
+func TestSecretCredentialManagerK8s_DefaultPort(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vsconf",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			"0.0.0.0.username": []byte("user"),
+			"0.0.0.0.password": []byte("password"),
+			"1.1.1.1.username": []byte("user"),
+			"1.1.1.1.password": []byte("password"),
+			"1.1.1.1.port":     []byte("8443"),
+		},
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("Failed to add secret to internal cache: %v", err)
+	}
+
+	for _, defaultPort := range []string{"", "https", "0", "65536"} {
+		if _, err := NewCredentialManagerWithDefaultPort(secret.Name, secret.Namespace, "", secretInformer.Lister(), defaultPort); !errors.Is(err, ErrInvalidPort) {
+			t.Errorf("Expected %v for default port %q, got %v", ErrInvalidPort, defaultPort, err)
+		}
+	}
+
+	credentialManager, err := NewCredentialManagerWithDefaultPort(secret.Name, secret.Namespace, "", secretInformer.Lister(), "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		server       string
+		expectedPort string
+	}{
+		{server: "0.0.0.0", expectedPort: "443"},
+		{server: "1.1.1.1", expectedPort: "8443"},
+	}
+	for _, test := range tests {
+		credential, err := credentialManager.GetCredential(test.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credential.Port != test.expectedPort {
+			t.Errorf("Expected port %s for server %s, got %q", test.expectedPort, test.server, credential.Port)
+		}
+	}
+
+	// the default is not cached, so that it is not mistaken for a port of the Secret
+	credentialManager.DefaultPort = ""
+	credential, err := credentialManager.GetCredential("0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.Port != "" {
+		t.Errorf("Expected no port without a default, got %q", credential.Port)
+	}
+}
+
+func TestSecretCredentialManagerK8s_GetCredentialByInstanceUUID(t *testing.T) {
+	const (
+		instanceUUID        = "42375390-71f9-43a3-a770-56803bcd7baa"
+		unknownInstanceUUID = "00000000-71f9-43a3-a770-56803bcd7baa"
+	)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vsconf",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			"0.0.0.0.username":         []byte("ip-user"),
+			"0.0.0.0.password":         []byte("ip-password"),
+			instanceUUID + ".username": []byte("uuid-user"),
+			instanceUUID + ".password": []byte("uuid-password"),
+			"vc.example.com.username":  []byte("fqdn-user"),
+			"vc.example.com.password":  []byte("fqdn-password"),
+		},
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("Failed to add secret to internal cache: %v", err)
+	}
+	credentialManager := NewCredentialManager(secret.Name, secret.Namespace, "", secretInformer.Lister())
+
+	tests := []struct {
+		name          string
+		get           func() (*Credential, error)
+		expectedUser  string
+		expectedError error
+	}{
+		{
+			name:         "by instance UUID",
+			get:          func() (*Credential, error) { return credentialManager.GetCredentialByInstanceUUID(instanceUUID) },
+			expectedUser: "uuid-user",
+		},
+		{
+			name: "by upper case instance UUID",
+			get: func() (*Credential, error) {
+				return credentialManager.GetCredentialByInstanceUUID(strings.ToUpper(instanceUUID))
+			},
+			expectedUser: "uuid-user",
+		},
+		{
+			name:          "by invalid instance UUID",
+			get:           func() (*Credential, error) { return credentialManager.GetCredentialByInstanceUUID("0.0.0.0") },
+			expectedError: ErrCredentialsNotFound,
+		},
+		{
+			name: "by unknown instance UUID",
+			get: func() (*Credential, error) {
+				return credentialManager.GetCredentialByInstanceUUID(unknownInstanceUUID)
+			},
+			expectedError: ErrCredentialsNotFound,
+		},
+		{
+			name: "instance UUID takes precedence over server",
+			get: func() (*Credential, error) {
+				return credentialManager.GetCredentialForInstance("0.0.0.0", instanceUUID)
+			},
+			expectedUser: "uuid-user",
+		},
+		{
+			name: "server without credentials for the instance UUID",
+			get: func() (*Credential, error) {
+				return credentialManager.GetCredentialForInstance("vc.example.com", unknownInstanceUUID)
+			},
+			expectedUser: "fqdn-user",
+		},
+		{
+			name:         "server without instance UUID",
+			get:          func() (*Credential, error) { return credentialManager.GetCredentialForInstance("0.0.0.0", "") },
+			expectedUser: "ip-user",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credential, err := test.get()
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("Expected error %v, got %v", test.expectedError, err)
+			}
+			if err == nil && credential.User != test.expectedUser {
+				t.Errorf("Expected user %s, got %s", test.expectedUser, credential.User)
+			}
+		})
+	}
+}
+
+func TestSecretCredentialManagerK8s_GetCredentialForDatacenter(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vsconf",
+			Namespace: "kube-system",
+		},
+		Data: map[string][]byte{
+			"vc.example.com.username":       []byte("server-user"),
+			"vc.example.com.password":       []byte("server-password"),
+			"vc.example.com/dc-a.username":  []byte("dc-a-user"),
+			"vc.example.com/dc-a.password":  []byte("dc-a-password"),
+			"vc2.example.com/dc-b.username": []byte("dc-b-user"),
+			"vc2.example.com/dc-b.password": []byte("dc-b-password"),
+		},
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("Failed to add secret to internal cache: %v", err)
+	}
+	credentialManager := NewCredentialManager(secret.Name, secret.Namespace, "", secretInformer.Lister())
+
+	tests := []struct {
+		name          string
+		server        string
+		datacenter    string
+		expectedUser  string
+		expectedError error
+	}{
+		{
+			name:         "server only",
+			server:       "vc.example.com",
+			expectedUser: "server-user",
+		},
+		{
+			name:         "server and datacenter",
+			server:       "vc.example.com",
+			datacenter:   "dc-a",
+			expectedUser: "dc-a-user",
+		},
+		{
+			name:         "datacenter without credentials falls back to the server",
+			server:       "vc.example.com",
+			datacenter:   "dc-b",
+			expectedUser: "server-user",
+		},
+		{
+			name:         "datacenter credentials without server credentials",
+			server:       "vc2.example.com",
+			datacenter:   "dc-b",
+			expectedUser: "dc-b-user",
+		},
+		{
+			name:          "neither datacenter nor server credentials",
+			server:        "vc2.example.com",
+			datacenter:    "dc-a",
+			expectedError: ErrCredentialsNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credential, err := credentialManager.GetCredentialForDatacenter(test.server, test.datacenter)
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("Expected error %v, got %v", test.expectedError, err)
+			}
+			if err == nil && credential.User != test.expectedUser {
+				t.Errorf("Expected user %s, got %s", test.expectedUser, credential.User)
+			}
+		})
+	}
+}
+
 func TestParseSecretConfig(t *testing.T) {
 	var (
 		testUsername = "Admin"
@@ -319,6 +635,47 @@ func TestParseSecretConfig(t *testing.T) {
 			},
 			expectedError: nil,
 		},
+		{
+			testName: "Valid username and password of a multi-dot FQDN server",
+			data: map[string][]byte{
+				"vc01.corp.local.username": []byte(testUsername),
+				"vc01.corp.local.password": []byte(testPassword),
+			},
+			config: map[string]*Credential{
+				"vc01.corp.local": {
+					User:     testUsername,
+					Password: testPassword,
+				},
+			},
+			expectedError: nil,
+		},
+		{
+			testName: "Valid credentials of an FQDN server containing a key suffix",
+			data: map[string][]byte{
+				"username.password.corp.local.username":                 []byte(testUsername),
+				"username.password.corp.local.password":                 []byte(testPassword),
+				"username.password.corp.local.vc-session-manager-url":   []byte("https://sm.corp.local"),
+				"username.password.corp.local.vc-session-manager-token": []byte("token"),
+			},
+			config: map[string]*Credential{
+				"username.password.corp.local": {
+					User:                  testUsername,
+					Password:              testPassword,
+					VCSessionManagerURL:   "https://sm.corp.local",
+					VCSessionManagerToken: "token",
+				},
+			},
+			expectedError: nil,
+		},
+		{
+			testName: "Password key without a dot before the suffix",
+			data: map[string][]byte{
+				"vc01.corp.local.username": []byte(testUsername),
+				"vc01.corp.localpassword":  []byte(testPassword),
+			},
+			config:        nil,
+			expectedError: ErrUnknownSecretKey,
+		},
 		{
 			testName: "Invalid username key with valid password key",
 			data: map[string][]byte{
@@ -426,6 +783,20 @@ func TestParseSecretConfig(t *testing.T) {
 			},
 			expectedError: ErrUnknownSecretKey,
 		},
+		{
+			testName: "Instance UUID keyed secret",
+			data: map[string][]byte{
+				"42375390-71F9-43A3-A770-56803BCD7BAA.username": []byte(testUsername),
+				"42375390-71F9-43A3-A770-56803BCD7BAA.password": []byte(testPassword),
+			},
+			config: map[string]*Credential{
+				"42375390-71f9-43a3-a770-56803bcd7baa": {
+					User:     testUsername,
+					Password: testPassword,
+				},
+			},
+			expectedError: nil,
+		},
 		{
 			testName: "Mixing legacy and Alternative IPv6 compatible secret",
 			data: map[string][]byte{
@@ -478,9 +849,9 @@ func TestParseSecretConfig(t *testing.T) {
 	}
 
 	for _, testcase := range testcases {
-		err := parseConfig(testcase.data, resultConfig)
+		err := parseConfig(testcase.data, resultConfig, parseOptions{})
 		t.Logf("Executing Testcase: %s", testcase.testName)
-		if err != testcase.expectedError {
+		if !errors.Is(err, testcase.expectedError) {
 			t.Fatalf("Parsing Secret failed for data %+v: %s", testcase.data, err)
 		}
 		if testcase.config != nil && !reflect.DeepEqual(testcase.config, resultConfig) {
@@ -490,3 +861,904 @@ func TestParseSecretConfig(t *testing.T) {
 		cleanupResultConfig(resultConfig)
 	}
 }
+
+func TestCredentialValidate(t *testing.T) {
+	const sessionManagerURL = "https://session-manager.local/session"
+	tests := []struct {
+		name           string
+		credential     Credential
+		expectedErrors []error
+	}{
+		{
+			name:       "username and password",
+			credential: Credential{User: "Admin", Password: "Password"},
+		},
+		{
+			name:       "session manager URL and token",
+			credential: Credential{VCSessionManagerURL: sessionManagerURL, VCSessionManagerToken: "token"},
+		},
+		{
+			name:           "empty credential",
+			expectedErrors: []error{ErrCredentialMissing},
+		},
+		{
+			name:           "username without password",
+			credential:     Credential{User: "Admin"},
+			expectedErrors: []error{ErrCredentialMissing},
+		},
+		{
+			name:           "password without username",
+			credential:     Credential{Password: "Password"},
+			expectedErrors: []error{ErrCredentialMissing},
+		},
+		{
+			name:           "session manager URL without token",
+			credential:     Credential{VCSessionManagerURL: sessionManagerURL},
+			expectedErrors: []error{ErrCredentialMissing},
+		},
+		{
+			name:           "session manager token without URL",
+			credential:     Credential{VCSessionManagerToken: "token"},
+			expectedErrors: []error{ErrCredentialMissing},
+		},
+		{
+			name:           "http session manager URL",
+			credential:     Credential{VCSessionManagerURL: "http://session-manager.local/session", VCSessionManagerToken: "token"},
+			expectedErrors: []error{ErrInsecureSessionManagerURL},
+		},
+		{
+			name:           "malformed session manager URL",
+			credential:     Credential{VCSessionManagerURL: "session-manager.local", VCSessionManagerToken: "token"},
+			expectedErrors: []error{ErrInvalidSessionManagerURL},
+		},
+		{
+			name:       "username, password and port",
+			credential: Credential{User: "Admin", Password: "Password", Port: "8443"},
+		},
+		{
+			name:           "invalid port",
+			credential:     Credential{User: "Admin", Password: "Password", Port: "https"},
+			expectedErrors: []error{ErrInvalidPort},
+		},
+		{
+			name:           "http session manager URL without token",
+			credential:     Credential{VCSessionManagerURL: "http://session-manager.local/session"},
+			expectedErrors: []error{ErrCredentialMissing, ErrInsecureSessionManagerURL},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.credential.Validate()
+			if len(test.expectedErrors) == 0 && err != nil {
+				t.Fatalf("Expected credential to be valid, got %v", err)
+			}
+			for _, expected := range test.expectedErrors {
+				if !errors.Is(err, expected) {
+					t.Errorf("Expected error %v, got %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSecretConfig_AggregatesErrors(t *testing.T) {
+	data := map[string][]byte{
+		"10.20.30.40.username":                 []byte("Admin"),
+		"10.20.30.41.password":                 []byte("Password"),
+		"10.20.30.42.username":                 []byte("Admin"),
+		"10.20.30.42.password":                 []byte("Password"),
+		"10.20.30.43.vc-session-manager-url":   []byte("http://session-manager.local/session"),
+		"10.20.30.43.vc-session-manager-token": []byte("token"),
+	}
+
+	err := parseConfig(data, make(map[string]*Credential), parseOptions{})
+	for _, expected := range []error{ErrCredentialMissing, ErrInsecureSessionManagerURL} {
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected error %v, got %v", expected, err)
+		}
+	}
+	for _, server := range []string{"10.20.30.40", "10.20.30.41", "10.20.30.43"} {
+		if err == nil || !strings.Contains(err.Error(), "server "+server+":") {
+			t.Errorf("Expected an error for server %s, got %v", server, err)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "10.20.30.42") {
+		t.Errorf("Expected no error for the valid server, got %v", err)
+	}
+}
+
+func TestParseSecretConfig_SessionManagerURL(t *testing.T) {
+	var (
+		testIP    = "10.20.30.40"
+		testToken = "token"
+	)
+	var testcases = []struct {
+		testName      string
+		url           string
+		allowInsecure bool
+		expectedError error
+	}{
+		{
+			testName: "https session manager URL",
+			url:      "https://session-manager.local/session",
+		},
+		{
+			testName:      "http session manager URL",
+			url:           "http://session-manager.local/session",
+			expectedError: ErrInsecureSessionManagerURL,
+		},
+		{
+			testName:      "http session manager URL with insecure allowed",
+			url:           "http://session-manager.local/session",
+			allowInsecure: true,
+		},
+		{
+			testName:      "malformed session manager URL",
+			url:           "https://%zz/session",
+			expectedError: ErrInvalidSessionManagerURL,
+		},
+		{
+			testName:      "malformed session manager URL with insecure allowed",
+			url:           "session-manager.local",
+			allowInsecure: true,
+			expectedError: ErrInvalidSessionManagerURL,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Logf("Executing Testcase: %s", testcase.testName)
+		data := map[string][]byte{
+			testIP + "." + sessionManagerURLSuffix:   []byte(testcase.url),
+			testIP + "." + sessionManagerTokenSuffix: []byte(testToken),
+		}
+		resultConfig := make(map[string]*Credential)
+		err := parseConfig(data, resultConfig, parseOptions{allowInsecureSessionManagerURL: testcase.allowInsecure})
+		if !errors.Is(err, testcase.expectedError) {
+			t.Fatalf("Parsing Secret failed for data %+v: %v", data, err)
+		}
+		if err == nil {
+			expected := &Credential{
+				VCSessionManagerURL:   testcase.url,
+				VCSessionManagerToken: testToken,
+			}
+			if !reflect.DeepEqual(resultConfig[testIP], expected) {
+				t.Fatalf("Expected credential %+v, got %+v", expected, resultConfig[testIP])
+			}
+		}
+	}
+}
+
+func TestParseSecretConfig_StrictFormat(t *testing.T) {
+	mixed := map[string][]byte{
+		"10.20.30.40.username": []byte("Admin"),
+		"10.20.30.40.password": []byte("Password"),
+		"username_0":           []byte("Adminalt"),
+		"password_0":           []byte("Passwordalt"),
+		"server_0":             []byte("fd01::1"),
+	}
+	var testcases = []struct {
+		testName      string
+		data          map[string][]byte
+		strictFormat  bool
+		expectedError error
+	}{
+		{
+			testName: "mixed formats with strict format off",
+			data:     mixed,
+		},
+		{
+			testName:      "mixed formats with strict format on",
+			data:          mixed,
+			strictFormat:  true,
+			expectedError: ErrMixedSecretFormats,
+		},
+		{
+			testName: "legacy format with a stray alternative key with strict format on",
+			data: map[string][]byte{
+				"10.20.30.40.username": []byte("Admin"),
+				"10.20.30.40.password": []byte("Password"),
+				"server_2":             []byte("fd01::2"),
+			},
+			strictFormat:  true,
+			expectedError: ErrMixedSecretFormats,
+		},
+		{
+			testName: "legacy format with strict format on",
+			data: map[string][]byte{
+				"10.20.30.40.username": []byte("Admin"),
+				"10.20.30.40.password": []byte("Password"),
+			},
+			strictFormat: true,
+		},
+		{
+			testName: "alternative format with strict format on",
+			data: map[string][]byte{
+				"username_0": []byte("Admin"),
+				"password_0": []byte("Password"),
+				"server_0":   []byte("fd01::1"),
+			},
+			strictFormat: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Logf("Executing Testcase: %s", testcase.testName)
+		err := parseConfig(testcase.data, make(map[string]*Credential), parseOptions{strictFormat: testcase.strictFormat})
+		if !errors.Is(err, testcase.expectedError) {
+			t.Fatalf("Parsing Secret failed for data %+v: %v", testcase.data, err)
+		}
+	}
+}
+
+func TestParseSecretConfig_StructuredCredentials(t *testing.T) {
+	var testcases = []struct {
+		testName       string
+		data           map[string][]byte
+		expectedConfig map[string]*Credential
+		expectedError  error
+	}{
+		{
+			testName: "YAML map of servers",
+			data: map[string][]byte{
+				"credentials.yaml": []byte(`
+10.20.30.40:
+  username: Admin
+  password: Password
+vc.example.com:
+  vc-session-manager-url: https://session-manager.local/session
+  vc-session-manager-token: token
+`),
+			},
+			expectedConfig: map[string]*Credential{
+				"10.20.30.40":    {User: "Admin", Password: "Password"},
+				"vc.example.com": {VCSessionManagerURL: "https://session-manager.local/session", VCSessionManagerToken: "token"},
+			},
+		},
+		{
+			testName: "JSON map of servers",
+			data: map[string][]byte{
+				"credentials.yaml": []byte(`{"fd01::1": {"username": "Admin", "password": "Password"}}`),
+			},
+			expectedConfig: map[string]*Credential{
+				"fd01::1": {User: "Admin", Password: "Password"},
+			},
+		},
+		{
+			testName: "structured and flat keys",
+			data: map[string][]byte{
+				"credentials.yaml":     []byte("10.20.30.40:\n  username: Admin\n  password: Password\n"),
+				"10.20.30.40.password": []byte("Override"),
+				"10.20.30.41.username": []byte("Admin1"),
+				"10.20.30.41.password": []byte("Password1"),
+			},
+			expectedConfig: map[string]*Credential{
+				"10.20.30.40": {User: "Admin", Password: "Override"},
+				"10.20.30.41": {User: "Admin1", Password: "Password1"},
+			},
+		},
+		{
+			testName: "malformed YAML",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("10.20.30.40:\n  username: Admin\n password: Password\n"),
+			},
+			expectedError: ErrMalformedStructuredCredentials,
+		},
+		{
+			testName: "unknown credential key",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("10.20.30.40:\n  user: Admin\n  password: Password\n"),
+			},
+			expectedError: ErrMalformedStructuredCredentials,
+		},
+		{
+			testName: "list instead of map",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("- username: Admin\n  password: Password\n"),
+			},
+			expectedError: ErrMalformedStructuredCredentials,
+		},
+		{
+			testName: "server without credentials",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("10.20.30.40:\n"),
+			},
+			expectedError: ErrMalformedStructuredCredentials,
+		},
+		{
+			testName: "incomplete credentials",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("10.20.30.40:\n  username: Admin\n"),
+			},
+			expectedError: ErrCredentialMissing,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Logf("Executing Testcase: %s", testcase.testName)
+		config := make(map[string]*Credential)
+		err := parseConfig(testcase.data, config, parseOptions{})
+		if !errors.Is(err, testcase.expectedError) {
+			t.Fatalf("Parsing Secret failed for data %+v: %v", testcase.data, err)
+		}
+		if testcase.expectedConfig != nil && !reflect.DeepEqual(testcase.expectedConfig, config) {
+			t.Errorf("Expected credentials %+v, got %+v", testcase.expectedConfig, config)
+		}
+	}
+}
+
+func TestParseSecretConfig_DatacenterScope(t *testing.T) {
+	var testcases = []struct {
+		testName       string
+		data           map[string][]byte
+		expectedConfig map[string]*Credential
+		expectedError  error
+	}{
+		{
+			testName: "server and datacenter keys",
+			data: map[string][]byte{
+				"vc.example.com.username":      []byte("Admin"),
+				"vc.example.com.password":      []byte("Password"),
+				"vc.example.com/dc-a.username": []byte("AdminA"),
+				"vc.example.com/dc-a.password": []byte("PasswordA"),
+			},
+			expectedConfig: map[string]*Credential{
+				"vc.example.com":      {User: "Admin", Password: "Password"},
+				"vc.example.com/dc-a": {User: "AdminA", Password: "PasswordA"},
+			},
+		},
+		{
+			testName: "upper case instance UUID and datacenter",
+			data: map[string][]byte{
+				"42375390-71F9-43A3-A770-56803BCD7BAA/DC-A.username": []byte("Admin"),
+				"42375390-71F9-43A3-A770-56803BCD7BAA/DC-A.password": []byte("Password"),
+			},
+			expectedConfig: map[string]*Credential{
+				"42375390-71f9-43a3-a770-56803bcd7baa/DC-A": {User: "Admin", Password: "Password"},
+			},
+		},
+		{
+			testName: "structured datacenter key",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("vc.example.com/dc-a:\n  username: Admin\n  password: Password\n"),
+			},
+			expectedConfig: map[string]*Credential{
+				"vc.example.com/dc-a": {User: "Admin", Password: "Password"},
+			},
+		},
+		{
+			testName: "empty datacenter",
+			data: map[string][]byte{
+				"vc.example.com/.username": []byte("Admin"),
+				"vc.example.com/.password": []byte("Password"),
+			},
+			expectedError: ErrInvalidDatacenterScope,
+		},
+		{
+			testName: "empty server",
+			data: map[string][]byte{
+				"/dc-a.username": []byte("Admin"),
+				"/dc-a.password": []byte("Password"),
+			},
+			expectedError: ErrInvalidDatacenterScope,
+		},
+		{
+			testName: "nested datacenter",
+			data: map[string][]byte{
+				"vc.example.com/dc-a/dc-b.username": []byte("Admin"),
+				"vc.example.com/dc-a/dc-b.password": []byte("Password"),
+			},
+			expectedError: ErrInvalidDatacenterScope,
+		},
+		{
+			testName: "structured datacenter with surrounding spaces",
+			data: map[string][]byte{
+				"credentials.yaml": []byte("\"vc.example.com/ dc-a\":\n  username: Admin\n  password: Password\n"),
+			},
+			expectedError: ErrInvalidDatacenterScope,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Logf("Executing Testcase: %s", testcase.testName)
+		config := make(map[string]*Credential)
+		err := parseConfig(testcase.data, config, parseOptions{})
+		if !errors.Is(err, testcase.expectedError) {
+			t.Fatalf("Parsing Secret failed for data %+v: %v", testcase.data, err)
+		}
+		if testcase.expectedConfig != nil && !reflect.DeepEqual(testcase.expectedConfig, config) {
+			t.Errorf("Expected credentials %+v, got %+v", testcase.expectedConfig, config)
+		}
+	}
+}
+
+func TestParseSecretConfig_PathLikeCredential(t *testing.T) {
+	var testcases = []struct {
+		testName      string
+		password      string
+		check         PathLikeCredentialCheck
+		expectedError error
+	}{
+		{
+			testName: "path-like password with check disabled",
+			password: "/etc/vsphere/password",
+			check:    PathLikeCredentialCheckDisabled,
+		},
+		{
+			testName: "path-like password in warn mode",
+			password: "/etc/vsphere/password",
+			check:    PathLikeCredentialCheckWarn,
+		},
+		{
+			testName:      "path-like password in strict mode",
+			password:      "/etc/vsphere/password",
+			check:         PathLikeCredentialCheckStrict,
+			expectedError: ErrPathLikeCredential,
+		},
+		{
+			testName: "password with slashes in strict mode",
+			password: "/pa$$/w0rd!",
+			check:    PathLikeCredentialCheckStrict,
+		},
+		{
+			testName: "relative password with slashes in strict mode",
+			password: "pass/word",
+			check:    PathLikeCredentialCheckStrict,
+		},
+		{
+			testName: "single element password in strict mode",
+			password: "/password",
+			check:    PathLikeCredentialCheckStrict,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Logf("Executing Testcase: %s", testcase.testName)
+		data := map[string][]byte{
+			"10.20.30.40.username": []byte("Admin"),
+			"10.20.30.40.password": []byte(testcase.password),
+		}
+		err := parseConfig(data, make(map[string]*Credential), parseOptions{pathLikeCredentialCheck: testcase.check})
+		if !errors.Is(err, testcase.expectedError) {
+			t.Fatalf("Parsing Secret failed for data %+v: %v", data, err)
+		}
+	}
+}
+
+func TestCredentialManager_NegativeCache(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	updateSecret := func(resourceVersion string, servers ...string) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "vsconf",
+				Namespace:       "kube-system",
+				ResourceVersion: resourceVersion,
+			},
+			Data: make(map[string][]byte),
+		}
+		for _, server := range servers {
+			secret.Data[server+".username"] = []byte("user")
+			secret.Data[server+".password"] = []byte("password")
+		}
+		if err := secretInformer.Informer().GetIndexer().Update(secret); err != nil {
+			t.Fatalf("Failed to update secret in internal cache: %v", err)
+		}
+	}
+	updateSecret("1", "0.0.0.0")
+	credentialManager := NewCredentialManager("vsconf", "kube-system", "", secretInformer.Lister())
+	credentialManager.NegativeCacheTTL = time.Hour
+	expectFound := func(server string, expectedFound bool) {
+		t.Helper()
+		_, err := credentialManager.GetCredential(server)
+		if expectedFound && err != nil {
+			t.Errorf("Expected credentials of %s to be found, got %v", server, err)
+		} else if !expectedFound && !errors.Is(err, ErrCredentialsNotFound) {
+			t.Errorf("Expected credentials of %s not to be found, got %v", server, err)
+		}
+	}
+
+	expectFound("1.1.1.1", false)
+	updateSecret("2", "0.0.0.0", "1.1.1.1")
+	expectFound("1.1.1.1", false)
+	credentialManager.InvalidateNegativeCache()
+	expectFound("1.1.1.1", true)
+
+	// The negative entries are invalidated when the Secret is reloaded for another lookup
+	expectFound("2.2.2.2", false)
+	updateSecret("3", "0.0.0.0", "1.1.1.1", "2.2.2.2")
+	expectFound("0.0.0.0", true)
+	expectFound("2.2.2.2", true)
+
+	// The negative entries expire after the TTL
+	credentialManager.NegativeCacheTTL = 10 * time.Millisecond
+	expectFound("3.3.3.3", false)
+	updateSecret("4", "0.0.0.0", "1.1.1.1", "2.2.2.2", "3.3.3.3")
+	time.Sleep(20 * time.Millisecond)
+	expectFound("3.3.3.3", true)
+
+	// Nothing is cached when disabled
+	credentialManager.NegativeCacheTTL = 0
+	expectFound("4.4.4.4", false)
+	updateSecret("5", "0.0.0.0", "1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4")
+	expectFound("4.4.4.4", true)
+}
+
+func TestCredentialManager_NegativeCacheBackoff(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vsconf", Namespace: "kube-system", ResourceVersion: "1"},
+		Data: map[string][]byte{
+			"0.0.0.0.username": []byte("user"),
+			"0.0.0.0.password": []byte("password"),
+		},
+	}
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	secretInformer := informerFactory.Core().V1().Secrets()
+	if err := secretInformer.Informer().GetIndexer().Add(secret); err != nil {
+		t.Fatalf("Failed to add secret to internal cache: %v", err)
+	}
+	credentialManager := NewCredentialManager(secret.Name, secret.Namespace, "", secretInformer.Lister())
+	credentialManager.NegativeCacheTTL = time.Minute
+	credentialManager.NegativeCacheMaxTTL = 3 * time.Minute
+
+	// the TTL doubles with every lookup of the server after its entry expired, up to the maximum
+	for _, expectedTTL := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if _, err := credentialManager.GetCredential("1.1.1.1"); !errors.Is(err, ErrCredentialsNotFound) {
+			t.Fatalf("Expected %v, got %v", ErrCredentialsNotFound, err)
+		}
+		entry := credentialManager.negativeCache["1.1.1.1"]
+		if entry.ttl != expectedTTL {
+			t.Errorf("Expected a TTL of %s, got %s", expectedTTL, entry.ttl)
+		}
+		entry.expiry = time.Now().Add(-time.Second)
+		credentialManager.negativeCache["1.1.1.1"] = entry
+	}
+
+	// the entry is forgotten once the server is found, so that the TTL starts over
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	secret.Data["1.1.1.1.username"] = []byte("user")
+	secret.Data["1.1.1.1.password"] = []byte("password")
+	if err := secretInformer.Informer().GetIndexer().Update(secret); err != nil {
+		t.Fatalf("Failed to update secret in internal cache: %v", err)
+	}
+	if _, err := credentialManager.GetCredential("1.1.1.1"); err != nil {
+		t.Fatalf("Expected credentials of 1.1.1.1 to be found, got %v", err)
+	}
+	if _, found := credentialManager.negativeCache["1.1.1.1"]; found {
+		t.Error("Expected the negative cache entry of 1.1.1.1 to be forgotten")
+	}
+}
+
+func TestCredentialManager_NegativeCacheSecretsDirectory(t *testing.T) {
+	writeCredentials := func(dir, server string) {
+		t.Helper()
+		for key, value := range map[string]string{server + ".username": "user", server + ".password": "password"} {
+			if err := os.WriteFile(filepath.Join(dir, key), []byte(value), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// nothing invalidates the entries of a SecretsDirectory without a Secret informer
+	dir := t.TempDir()
+	writeCredentials(dir, "0.0.0.0")
+	credentialManager := NewCredentialManager("", "", dir, nil)
+	credentialManager.NegativeCacheTTL = time.Hour
+	if _, err := credentialManager.GetCredential("1.1.1.1"); !errors.Is(err, ErrCredentialsNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrCredentialsNotFound, err)
+	}
+	if len(credentialManager.negativeCache) != 0 {
+		t.Errorf("Expected nothing to be negatively cached, got %v", credentialManager.negativeCache)
+	}
+	writeCredentials(dir, "1.1.1.1")
+	if err := credentialManager.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := credentialManager.GetCredential("1.1.1.1"); err != nil {
+		t.Errorf("Expected credentials of 1.1.1.1 to be found, got %v", err)
+	}
+
+	// with a Secret informer, the entries are invalidated when the SecretsDirectory is reloaded
+	dir = t.TempDir()
+	writeCredentials(dir, "0.0.0.0")
+	informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	credentialManager = NewCredentialManager("vsconf", "kube-system", dir, informerFactory.Core().V1().Secrets().Lister())
+	credentialManager.NegativeCacheTTL = time.Hour
+	if _, err := credentialManager.GetCredential("1.1.1.1"); !errors.Is(err, ErrCredentialsNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrCredentialsNotFound, err)
+	}
+	if !credentialManager.isNegativelyCached("1.1.1.1") {
+		t.Fatal("Expected 1.1.1.1 to be negatively cached")
+	}
+	writeCredentials(dir, "1.1.1.1")
+	if err := credentialManager.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := credentialManager.GetCredential("1.1.1.1"); err != nil {
+		t.Errorf("Expected credentials of 1.1.1.1 to be found, got %v", err)
+	}
+}
+
+func TestCredentialManager_Refresh(t *testing.T) {
+	secret := func(password string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "vsconf",
+				Namespace:       "kube-system",
+				ResourceVersion: "1",
+			},
+			Data: map[string][]byte{
+				"0.0.0.0.username": []byte("user"),
+				"0.0.0.0.password": []byte(password),
+			},
+		}
+	}
+	expectPassword := func(t *testing.T, credentialManager *CredentialManager, expected string) {
+		t.Helper()
+		credential, err := credentialManager.GetCredential("0.0.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credential.Password != expected {
+			t.Errorf("Expected password %q, got %q", expected, credential.Password)
+		}
+	}
+
+	t.Run("from the API server", func(t *testing.T) {
+		client := fake.NewSimpleClientset(secret("password"))
+		informerFactory := informers.NewSharedInformerFactory(client, 0)
+		indexer := informerFactory.Core().V1().Secrets().Informer().GetIndexer()
+		if err := indexer.Add(secret("password")); err != nil {
+			t.Fatal(err)
+		}
+		credentialManager := NewCredentialManager("vsconf", "kube-system", "", informerFactory.Core().V1().Secrets().Lister())
+		credentialManager.SecretGetter = client.CoreV1()
+		expectPassword(t, credentialManager, "password")
+
+		updates := make(chan []string, 1)
+		credentialManager.AddUpdateHandler(func(servers []string) { updates <- servers })
+
+		// The Secret is edited out-of-band, the informer has not caught up
+		if _, err := client.CoreV1().Secrets("kube-system").Update(context.Background(), secret("rotated"), metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		expectPassword(t, credentialManager, "password")
+		if err := credentialManager.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		expectPassword(t, credentialManager, "rotated")
+		select {
+		case servers := <-updates:
+			if !reflect.DeepEqual(servers, []string{"0.0.0.0"}) {
+				t.Errorf("Expected update of 0.0.0.0, got %v", servers)
+			}
+		default:
+			t.Error("Expected the update handlers to be called")
+		}
+
+		// Parse errors are returned
+		invalid := secret("rotated")
+		invalid.Data["0.0.0.0.unknown"] = []byte("value")
+		if _, err := client.CoreV1().Secrets("kube-system").Update(context.Background(), invalid, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := credentialManager.Refresh(context.Background()); !errors.Is(err, ErrUnknownSecretKey) {
+			t.Errorf("Expected Refresh to return the parse error, got %v", err)
+		}
+	})
+
+	t.Run("from the lister with the same resource version", func(t *testing.T) {
+		informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+		indexer := informerFactory.Core().V1().Secrets().Informer().GetIndexer()
+		if err := indexer.Add(secret("password")); err != nil {
+			t.Fatal(err)
+		}
+		credentialManager := NewCredentialManager("vsconf", "kube-system", "", informerFactory.Core().V1().Secrets().Lister())
+		expectPassword(t, credentialManager, "password")
+
+		if err := indexer.Update(secret("rotated")); err != nil {
+			t.Fatal(err)
+		}
+		expectPassword(t, credentialManager, "password")
+		if err := credentialManager.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		expectPassword(t, credentialManager, "rotated")
+	})
+}
+
+func TestCredentialManager_CheckCacheConsistency(t *testing.T) {
+	secret := func(resourceVersion, password string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "vsconf",
+				Namespace:       "kube-system",
+				ResourceVersion: resourceVersion,
+			},
+			Data: map[string][]byte{
+				"0.0.0.0.username": []byte("user"),
+				"0.0.0.0.password": []byte(password),
+			},
+		}
+	}
+
+	tests := []struct {
+		name             string
+		direct           *corev1.Secret
+		cached           *corev1.Secret
+		expectDrift      bool
+		expectedPassword string
+	}{
+		{
+			name:             "consistent",
+			direct:           secret("1", "password"),
+			cached:           secret("1", "password"),
+			expectedPassword: "password",
+		},
+		{
+			name:             "newer resource version with the same credentials",
+			direct:           secret("2", "password"),
+			cached:           secret("1", "password"),
+			expectedPassword: "password",
+		},
+		{
+			name:             "drifted",
+			direct:           secret("2", "rotated"),
+			cached:           secret("1", "password"),
+			expectDrift:      true,
+			expectedPassword: "rotated",
+		},
+		{
+			name:             "missing from the lister",
+			direct:           secret("2", "rotated"),
+			expectDrift:      true,
+			expectedPassword: "rotated",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.direct)
+			informerFactory := informers.NewSharedInformerFactory(client, 0)
+			if test.cached != nil {
+				if err := informerFactory.Core().V1().Secrets().Informer().GetIndexer().Add(test.cached); err != nil {
+					t.Fatal(err)
+				}
+			}
+			credentialManager := NewCredentialManager("vsconf", "kube-system", "", informerFactory.Core().V1().Secrets().Lister())
+			credentialManager.SecretGetter = client.CoreV1()
+			if test.cached != nil {
+				if _, err := credentialManager.GetCredential("0.0.0.0"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			drifts := testutil.ToFloat64(secretCacheDrifts.WithLabelValues("kube-system", "vsconf"))
+
+			drifted, err := credentialManager.checkCacheConsistency(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if drifted != test.expectDrift {
+				t.Errorf("Expected drift %t, got %t", test.expectDrift, drifted)
+			}
+			if test.expectDrift {
+				drifts++
+			}
+			if actual := testutil.ToFloat64(secretCacheDrifts.WithLabelValues("kube-system", "vsconf")); actual != drifts {
+				t.Errorf("Expected %v drifts to be counted, got %v", drifts, actual)
+			}
+			credential, found := credentialManager.Cache.GetCredential("0.0.0.0")
+			if !found || credential.Password != test.expectedPassword {
+				t.Errorf("Expected cached password %q, got %q (found %t)", test.expectedPassword, credential.Password, found)
+			}
+		})
+	}
+}
+
+func TestCredentialManager_StartPeriodicReload(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	secret := func(resourceVersion, password string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "vsconf",
+				Namespace:       "kube-system",
+				ResourceVersion: resourceVersion,
+			},
+			Data: map[string][]byte{
+				"0.0.0.0.username": []byte("user"),
+				"0.0.0.0.password": []byte(password),
+			},
+		}
+	}
+	writeSecretFiles := func(t *testing.T, dir, password string) {
+		for name, value := range map[string]string{"0.0.0.0.username": "user", "0.0.0.0.password": password} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name                 string
+		periodicReloadSecret bool
+		useSecretsDirectory  bool
+		expectReload         bool
+	}{
+		{
+			name:                "secrets directory is reloaded",
+			useSecretsDirectory: true,
+			expectReload:        true,
+		},
+		{
+			name: "secret is left to the informer by default",
+		},
+		{
+			name:                 "secret is reloaded when enabled",
+			periodicReloadSecret: true,
+			expectReload:         true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var credentialManager *CredentialManager
+			var rotate func()
+			if test.useSecretsDirectory {
+				dir := t.TempDir()
+				writeSecretFiles(t, dir, "password")
+				credentialManager = NewCredentialManager("", "", dir, nil)
+				rotate = func() { writeSecretFiles(t, dir, "rotated") }
+			} else {
+				informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+				indexer := informerFactory.Core().V1().Secrets().Informer().GetIndexer()
+				if err := indexer.Add(secret("1", "password")); err != nil {
+					t.Fatal(err)
+				}
+				credentialManager = NewCredentialManager("vsconf", "kube-system", "", informerFactory.Core().V1().Secrets().Lister())
+				rotate = func() {
+					if err := indexer.Update(secret("2", "rotated")); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+			credentialManager.PeriodicReloadSecret = test.periodicReloadSecret
+			if _, err := credentialManager.GetCredential("0.0.0.0"); err != nil {
+				t.Fatal(err)
+			}
+
+			updates := make(chan []string, 10)
+			credentialManager.AddUpdateHandler(func(servers []string) { updates <- servers })
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			credentialManager.StartPeriodicReload(ctx, interval)
+
+			time.Sleep(5 * interval)
+			select {
+			case servers := <-updates:
+				t.Fatalf("Expected no update before the credentials changed, got %v", servers)
+			default:
+			}
+
+			rotate()
+			select {
+			case servers := <-updates:
+				if !test.expectReload {
+					t.Fatalf("Expected no update, got %v", servers)
+				}
+				if !reflect.DeepEqual(servers, []string{"0.0.0.0"}) {
+					t.Errorf("Expected update of 0.0.0.0, got %v", servers)
+				}
+				credential, found := credentialManager.Cache.GetCredential("0.0.0.0")
+				if !found || credential.Password != "rotated" {
+					t.Errorf("Expected the rotated password to be cached, got %+v", credential)
+				}
+			case <-time.After(50 * interval):
+				if test.expectReload {
+					t.Fatal("Expected an update after the credentials changed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides an in-memory credentialmanager.Interface for tests of code that
+// depends on vCenter credentials, without a Secret informer.
+package fake
+
+import (
+	"strings"
+	"sync"
+
+	cm "k8s.io/cloud-provider-vsphere/pkg/common/credentialmanager"
+)
+
+// CredentialManager is an in-memory credentialmanager.Interface.
+type CredentialManager struct {
+	lock        sync.Mutex
+	credentials map[string]*cm.Credential
+}
+
+var _ cm.Interface = &CredentialManager{}
+
+// NewFakeCredentialManager returns a CredentialManager returning copies of the given
+// credentials, keyed by vCenter Server or instance UUID.
+func NewFakeCredentialManager(credentials map[string]*cm.Credential) *CredentialManager {
+	fake := &CredentialManager{credentials: make(map[string]*cm.Credential, len(credentials))}
+	for server, credential := range credentials {
+		fake.SetCredential(server, credential)
+	}
+	return fake
+}
+
+// SetCredential sets the credentials of the given vCenter Server or instance UUID,
+// or removes them if credential is nil.
+func (fake *CredentialManager) SetCredential(server string, credential *cm.Credential) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if credential == nil {
+		delete(fake.credentials, server)
+		return
+	}
+	credentialCopy := *credential
+	fake.credentials[server] = &credentialCopy
+}
+
+// GetCredential returns the credentials of the given vCenter Server.
+func (fake *CredentialManager) GetCredential(server string) (*cm.Credential, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	credential, found := fake.credentials[server]
+	if !found {
+		return nil, &cm.CredentialError{Server: server}
+	}
+	credentialCopy := *credential
+	return &credentialCopy, nil
+}
+
+// GetCredentialByInstanceUUID returns the credentials keyed by the given vCenter instance UUID.
+func (fake *CredentialManager) GetCredentialByInstanceUUID(instanceUUID string) (*cm.Credential, error) {
+	return fake.GetCredential(strings.ToLower(instanceUUID))
+}
+
+// GetCredentialForInstance returns the credentials keyed by the given vCenter instance UUID,
+// or else the credentials of the given vCenter Server.
+func (fake *CredentialManager) GetCredentialForInstance(server, instanceUUID string) (*cm.Credential, error) {
+	if instanceUUID != "" {
+		if credential, err := fake.GetCredentialByInstanceUUID(instanceUUID); err == nil {
+			return credential, nil
+		}
+	}
+	return fake.GetCredential(server)
+}
+
+// GetCredentialForDatacenter returns the credentials set for cm.DatacenterScope(server, datacenter),
+// or else the credentials of the given vCenter Server.
+func (fake *CredentialManager) GetCredentialForDatacenter(server, datacenter string) (*cm.Credential, error) {
+	if datacenter != "" {
+		if credential, err := fake.GetCredential(cm.DatacenterScope(server, datacenter)); err == nil {
+			return credential, nil
+		}
+	}
+	return fake.GetCredential(server)
+}
+
+// GetCredentials returns the credentials of all the given vCenter Servers, and an
+// CredentialError for each server without credentials.
+func (fake *CredentialManager) GetCredentials(servers []string) (map[string]*cm.Credential, []error) {
+	credentials := make(map[string]*cm.Credential, len(servers))
+	var errs []error
+	for _, server := range servers {
+		credential, err := fake.GetCredential(server)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		credentials[server] = credential
+	}
+	return credentials, errs
+}
+
+// GetAllCredentials returns the credentials of all the known vCenter Servers.
+func (fake *CredentialManager) GetAllCredentials() (map[string]*cm.Credential, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	credentials := make(map[string]*cm.Credential, len(fake.credentials))
+	for server, credential := range fake.credentials {
+		credentialCopy := *credential
+		credentials[server] = &credentialCopy
+	}
+	return credentials, nil
+}
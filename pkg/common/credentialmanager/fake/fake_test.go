@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	cm "k8s.io/cloud-provider-vsphere/pkg/common/credentialmanager"
+)
+
+func TestFakeCredentialManager(t *testing.T) {
+	const instanceUUID = "1f8e9a5c-3b2d-4c6e-8f7a-9b0c1d2e3f4a"
+	credentials := map[string]*cm.Credential{
+		"vc1.example.com":     {User: "user1", Password: "pass1"},
+		"vc2.example.com":     {User: "user2", Password: "pass2"},
+		instanceUUID:          {User: "uuid-user", Password: "uuid-pass"},
+		"vc1.example.com/dc1": {User: "dc-user", Password: "dc-pass"},
+	}
+	var credMgr cm.Interface = NewFakeCredentialManager(credentials)
+
+	credential, err := credMgr.GetCredential("vc1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *credential != *credentials["vc1.example.com"] {
+		t.Errorf("Expected %+v, got %+v", credentials["vc1.example.com"], credential)
+	}
+	credential.Password = "modified"
+	if credential, _ := credMgr.GetCredential("vc1.example.com"); credential.Password != "pass1" {
+		t.Error("Expected the returned credential to be a copy")
+	}
+
+	if _, err := credMgr.GetCredential("vc3.example.com"); !errors.Is(err, cm.ErrCredentialsNotFound) {
+		t.Errorf("Expected %v, got %v", cm.ErrCredentialsNotFound, err)
+	}
+
+	credential, err = credMgr.GetCredentialForInstance("vc1.example.com", "1F8E9A5C-3B2D-4C6E-8F7A-9B0C1D2E3F4A")
+	if err != nil || credential.User != "uuid-user" {
+		t.Errorf("Expected the credential of the instance UUID, got %+v, %v", credential, err)
+	}
+	credential, err = credMgr.GetCredentialForInstance("vc2.example.com", "00000000-0000-0000-0000-000000000000")
+	if err != nil || credential.User != "user2" {
+		t.Errorf("Expected the credential of the server, got %+v, %v", credential, err)
+	}
+
+	credential, err = credMgr.GetCredentialForDatacenter("vc1.example.com", "dc1")
+	if err != nil || credential.User != "dc-user" {
+		t.Errorf("Expected the credential of the datacenter, got %+v, %v", credential, err)
+	}
+	credential, err = credMgr.GetCredentialForDatacenter("vc1.example.com", "dc2")
+	if err != nil || credential.User != "user1" {
+		t.Errorf("Expected the credential of the server, got %+v, %v", credential, err)
+	}
+
+	found, errs := credMgr.GetCredentials([]string{"vc1.example.com", "vc3.example.com"})
+	if len(found) != 1 || found["vc1.example.com"] == nil {
+		t.Errorf("Expected the credential of vc1.example.com only, got %+v", found)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], cm.ErrCredentialsNotFound) {
+		t.Errorf("Expected one %v error, got %v", cm.ErrCredentialsNotFound, errs)
+	}
+
+	all, err := credMgr.GetAllCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, credentials) {
+		t.Errorf("Expected %+v, got %+v", credentials, all)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentialmanager
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// secretCacheDrifts counts the Secrets found drifted from the API server by StartConsistencyCheck
+var secretCacheDrifts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudprovider_vsphere_credential_secret_cache_drifts_total",
+		Help: "Number of times the cached credential Secret was found to differ from the API server",
+	},
+	[]string{"namespace", "name"},
+)
+
+var registerMetricsOnce sync.Once
+
+// RegisterMetrics registers the credential manager metrics. It can be called more than once.
+func RegisterMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(secretCacheDrifts)
+	})
+}
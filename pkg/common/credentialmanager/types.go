@@ -18,8 +18,10 @@ package credentialmanager
 
 import (
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	clientv1 "k8s.io/client-go/listers/core/v1"
 )
 
@@ -34,17 +36,111 @@ type SecretCache struct {
 // Credential is a vCenter credential that is retrieved or stored in a
 // Kubernetes secret.
 type Credential struct {
-	User     string `gcfg:"user"`
-	Password string `gcfg:"password"`
+	User                  string `gcfg:"user"`
+	Password              string `gcfg:"password"`
+	VCSessionManagerURL   string `gcfg:"vc-session-manager-url"`
+	VCSessionManagerToken string `gcfg:"vc-session-manager-token"`
+	// Port is the port of the vCenter Server, or the DefaultPort of the CredentialManager
+	// when the credentials do not set one.
+	Port string `gcfg:"port"`
 }
 
+// Interface is implemented by CredentialManager, and by the in-memory fake in the fake
+// package for tests of code that depends on vCenter credentials.
+type Interface interface {
+	// GetCredential returns the credentials of the given vCenter Server.
+	GetCredential(server string) (*Credential, error)
+	// GetCredentialByInstanceUUID returns the credentials keyed by the given vCenter instance UUID.
+	GetCredentialByInstanceUUID(instanceUUID string) (*Credential, error)
+	// GetCredentialForInstance returns the credentials keyed by the given vCenter instance UUID,
+	// or else the credentials of the given vCenter Server.
+	GetCredentialForInstance(server, instanceUUID string) (*Credential, error)
+	// GetCredentialForDatacenter returns the credentials scoped to the given datacenter of the
+	// vCenter Server, or else the credentials of the server.
+	GetCredentialForDatacenter(server, datacenter string) (*Credential, error)
+	// GetCredentials returns the credentials of all the given vCenter Servers.
+	GetCredentials(servers []string) (map[string]*Credential, []error)
+	// GetAllCredentials returns the credentials of all the known vCenter Servers.
+	GetAllCredentials() (map[string]*Credential, error)
+}
+
+var _ Interface = &CredentialManager{}
+
 // CredentialManager is used to manage vCenter credentials stored as
 // Kubernetes secrets.
 type CredentialManager struct {
-	SecretName             string
-	SecretNamespace        string
-	SecretLister           clientv1.SecretLister
+	SecretName      string
+	SecretNamespace string
+	SecretLister    clientv1.SecretLister
+	// SecretGetter, when set, is used by Refresh to read the Secret from the API server
+	// rather than from SecretLister, whose informer may lag behind.
+	SecretGetter           corev1client.SecretsGetter
 	SecretsDirectory       string
 	secretsDirectoryParsed bool // internal placeholder to identify we parsed the SecretsDirectory
 	Cache                  *SecretCache
+	// AllowInsecureSessionManagerURL only logs a warning, instead of failing,
+	// when a vc-session-manager-url does not use https. Meant for test environments.
+	AllowInsecureSessionManagerURL bool
+	// PathLikeCredentialCheck controls how usernames/passwords that look like
+	// absolute file paths are reported.
+	PathLikeCredentialCheck PathLikeCredentialCheck
+	// StrictFormat rejects Secrets that mix the <server>.<key> and the alternative
+	// <key>_<n> formats, in which a typo in a key goes unnoticed more easily.
+	StrictFormat bool
+	// PeriodicReloadSecret makes StartPeriodicReload also reload the Secret, which is
+	// otherwise left to the informer.
+	PeriodicReloadSecret bool
+	// NegativeCacheTTL, when set, is how long GetCredential remembers that a server has no
+	// credentials, returning ErrCredentialsNotFound without reading the Secret again. The TTL
+	// doubles every time the server is found to have no credentials again, up to
+	// NegativeCacheMaxTTL. The entries are invalidated when the credentials are reloaded or
+	// InvalidateNegativeCache is called, e.g. on Secret informer events. It only applies with
+	// a SecretLister, as nothing invalidates the entries for the SecretsDirectory alone.
+	NegativeCacheTTL time.Duration
+	// NegativeCacheMaxTTL bounds the TTL of the negative cache entries, and defaults to
+	// DefaultNegativeCacheMaxTTLFactor times NegativeCacheTTL.
+	NegativeCacheMaxTTL time.Duration
+	// VerifyCacheConsistency enables StartConsistencyCheck, which periodically compares the
+	// Secret in SecretLister with the Secret read through SecretGetter.
+	VerifyCacheConsistency bool
+	// DefaultPort, when set, is the Port of the credentials returned for servers whose
+	// credentials do not set one. See NewCredentialManagerWithDefaultPort.
+	DefaultPort string
+	// refreshLock serializes reading the Secret and the SecretsDirectory
+	refreshLock    sync.Mutex
+	handlersLock   sync.Mutex
+	updateHandlers []CredentialUpdateHandler
+	// negativeCache maps the servers without credentials to their entry, which is kept after
+	// it expired to double its TTL if the server is still not found
+	negativeCacheLock sync.Mutex
+	negativeCache     map[string]negativeCacheEntry
+}
+
+// negativeCacheEntry remembers that a server has no credentials until expiry
+type negativeCacheEntry struct {
+	expiry time.Time
+	ttl    time.Duration
+}
+
+// CredentialUpdateHandler is called with the vCenter servers whose credentials changed.
+type CredentialUpdateHandler func(servers []string)
+
+// PathLikeCredentialCheck controls the check for credential values that look
+// like file paths, a common sign of a misconfigured Secret.
+type PathLikeCredentialCheck int
+
+const (
+	// PathLikeCredentialCheckDisabled does not check credential values.
+	PathLikeCredentialCheckDisabled PathLikeCredentialCheck = iota
+	// PathLikeCredentialCheckWarn logs a warning for path-like credential values.
+	PathLikeCredentialCheckWarn
+	// PathLikeCredentialCheckStrict rejects path-like credential values.
+	PathLikeCredentialCheckStrict
+)
+
+// parseOptions controls the validation applied when parsing secret data.
+type parseOptions struct {
+	allowInsecureSessionManagerURL bool
+	pathLikeCredentialCheck        PathLikeCredentialCheck
+	strictFormat                   bool
 }
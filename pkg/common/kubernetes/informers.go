@@ -95,6 +95,15 @@ func (im *InformerManager) GetSecretInformer() informerv1.SecretInformer {
 	return im.secretInformer
 }
 
+// AddSecretListener hooks up add, update, delete callbacks for secrets
+func (im *InformerManager) AddSecretListener(add, remove func(obj interface{}), update func(oldObj, newObj interface{})) {
+	im.GetSecretInformer().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    add,
+		UpdateFunc: update,
+		DeleteFunc: remove,
+	})
+}
+
 // AddNodeListener hooks up add, update, delete callbacks
 func (im *InformerManager) AddNodeListener(add, remove func(obj interface{}), update func(oldObj, newObj interface{})) {
 	if im.nodeInformer == nil {
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// circuitState is the state of a circuitBreaker, as recorded in the circuit breaker metric.
+type circuitState int
+
+const (
+	// circuitClosed lets all round trips through.
+	circuitClosed circuitState = iota
+	// circuitOpen fails all round trips fast until the cooldown is over.
+	circuitOpen
+	// circuitHalfOpen lets a single round trip through to probe vCenter.
+	circuitHalfOpen
+)
+
+// circuitBreaker fails round trips fast after consecutive failures, so that a persistently
+// failing vCenter does not make every call wait for its timeout.
+type circuitBreaker struct {
+	server    string
+	threshold int
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// circuitBreakerRoundTripper guards the round trips of roundTripper with breaker.
+type circuitBreakerRoundTripper struct {
+	roundTripper soap.RoundTripper
+	breaker      *circuitBreaker
+}
+
+// newCircuitBreakerRoundTripper wraps rt with the circuit breaker of the connection, which is
+// shared by all its clients. rt is returned as is when CircuitBreakerThreshold is not set.
+func (connection *VSphereConnection) newCircuitBreakerRoundTripper(rt soap.RoundTripper) soap.RoundTripper {
+	if connection.CircuitBreakerThreshold <= 0 {
+		return rt
+	}
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	if connection.breaker == nil {
+		cooldown := connection.CircuitBreakerCooldown
+		if cooldown == 0 {
+			cooldown = DefaultCircuitBreakerCooldown
+		}
+		connection.breaker = &circuitBreaker{
+			server:    connection.Hostname,
+			threshold: connection.CircuitBreakerThreshold,
+			cooldown:  cooldown,
+		}
+		recordCircuitBreakerState(connection.Hostname, circuitClosed)
+	}
+	return &circuitBreakerRoundTripper{roundTripper: rt, breaker: connection.breaker}
+}
+
+// RoundTrip implements soap.RoundTripper.
+func (r *circuitBreakerRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	if err := r.breaker.allow(); err != nil {
+		return err
+	}
+	err := r.roundTripper.RoundTrip(ctx, req, res)
+	r.breaker.record(err)
+	return err
+}
+
+// allow returns ErrCircuitOpen if the round trip must fail fast, and otherwise moves an open
+// breaker whose cooldown is over to half-open, letting the round trip through as the probe.
+func (b *circuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if remaining := b.cooldown - time.Since(b.openedAt); remaining > 0 {
+			return fmt.Errorf("%w: server %s, retrying in %s", ErrCircuitOpen, b.server, remaining.Round(time.Millisecond))
+		}
+		logger.V(2).Info("Circuit breaker cooldown is over, probing vCenter", "server", b.server)
+		b.setState(circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		return fmt.Errorf("%w: server %s, probing", ErrCircuitOpen, b.server)
+	}
+	return nil
+}
+
+// record updates the breaker with the result of a round trip.
+func (b *circuitBreaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if errors.Is(err, context.Canceled) {
+		// Let the next round trip probe instead
+		if b.state == circuitHalfOpen {
+			b.setState(circuitOpen)
+		}
+		return
+	}
+	if !isCircuitFailure(err) {
+		if b.state != circuitClosed {
+			logger.Info("vCenter recovered, closing circuit breaker", "server", b.server)
+		}
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			logger.Error(err, "Opening circuit breaker after consecutive failures", "server", b.server, "failures", b.failures, "cooldown", b.cooldown)
+		}
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+// setState sets the state of the breaker and records it. Must be called with lock held.
+func (b *circuitBreaker) setState(state circuitState) {
+	if b.state != state {
+		b.state = state
+		recordCircuitBreakerState(b.server, state)
+	}
+}
+
+// isCircuitFailure returns whether err counts as a failure of vCenter. Faults returned by
+// vCenter show it is responding, and round trips cancelled by the caller say nothing about it.
+func isCircuitFailure(err error) bool {
+	return err != nil && !soap.IsSoapFault(err) && !soap.IsVimFault(err) && !errors.Is(err, context.Canceled)
+}
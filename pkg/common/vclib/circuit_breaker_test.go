@@ -0,0 +1,102 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestCircuitBreakerRoundTripper(t *testing.T) {
+	const server = "circuit-breaker.example.com"
+	RegisterSessionMetrics(server)
+	const cooldown = 50 * time.Millisecond
+	connection := &VSphereConnection{
+		Hostname:                server,
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerCooldown:  cooldown,
+	}
+	rt := &failingRoundTripper{failures: 4, err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	breaker := connection.newCircuitBreakerRoundTripper(rt)
+	ctx := context.Background()
+
+	expect := func(step string, expectedErr error, expectedCalls int, expectedState circuitState) {
+		t.Helper()
+		err := breaker.RoundTrip(ctx, nil, nil)
+		if expectedErr == nil && err != nil {
+			t.Errorf("%s: unexpected error: %v", step, err)
+		} else if expectedErr != nil && !errors.Is(err, expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", step, expectedErr, err)
+		}
+		if rt.calls != expectedCalls {
+			t.Errorf("%s: expected %d round trips, got %d", step, expectedCalls, rt.calls)
+		}
+		if state := testutil.ToFloat64(vsphereCircuitBreakerState.WithLabelValues(server)); state != float64(expectedState) {
+			t.Errorf("%s: expected circuit breaker state %d, got %v", step, expectedState, state)
+		}
+	}
+
+	expect("first failure", rt.err, 1, circuitClosed)
+	expect("second failure", rt.err, 2, circuitClosed)
+	expect("threshold reached", rt.err, 3, circuitOpen)
+
+	start := time.Now()
+	expect("open circuit fails fast", ErrCircuitOpen, 3, circuitOpen)
+	if elapsed := time.Since(start); elapsed > cooldown {
+		t.Errorf("Expected the open circuit to fail fast, took %s", elapsed)
+	}
+
+	time.Sleep(cooldown)
+	expect("failed probe opens the circuit again", rt.err, 4, circuitOpen)
+	expect("reopened circuit fails fast", ErrCircuitOpen, 4, circuitOpen)
+
+	time.Sleep(cooldown)
+	expect("successful probe closes the circuit", nil, 5, circuitClosed)
+	expect("closed circuit", nil, 6, circuitClosed)
+
+	// The breaker is shared by the connection's clients
+	if other := connection.newCircuitBreakerRoundTripper(rt); other.(*circuitBreakerRoundTripper).breaker != connection.breaker {
+		t.Error("Expected the clients of the connection to share the circuit breaker")
+	}
+}
+
+func TestCircuitBreakerIgnoresFaults(t *testing.T) {
+	connection := &VSphereConnection{CircuitBreakerThreshold: 1}
+	fault := soap.WrapVimFault(&types.NotFound{})
+	rt := &failingRoundTripper{failures: 2, err: fault}
+	breaker := connection.newCircuitBreakerRoundTripper(rt)
+
+	for i := 0; i < 2; i++ {
+		if err := breaker.RoundTrip(context.Background(), nil, nil); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected vCenter faults not to open the circuit, got %v", err)
+		}
+	}
+	if rt.calls != 2 {
+		t.Errorf("Expected 2 round trips, got %d", rt.calls)
+	}
+
+	if wrapped := (&VSphereConnection{}).newCircuitBreakerRoundTripper(rt); wrapped != soap.RoundTripper(rt) {
+		t.Error("Expected no circuit breaker without a threshold")
+	}
+}
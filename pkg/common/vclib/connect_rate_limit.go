@@ -0,0 +1,60 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	connectLimitersLock sync.Mutex
+	// connectLimiters are the token buckets of new clients by vCenter. Guarded by connectLimitersLock.
+	connectLimiters = make(map[string]*rate.Limiter)
+)
+
+// allowConnect reports whether ConnectRateLimit allows a new client to server right away. The
+// token bucket of a server is shared by all the connections to it, and follows the settings
+// of the last connection consulting it. It does not wait for a token, as new clients are
+// created with clientLock held.
+func (connection *VSphereConnection) allowConnect(server string) bool {
+	if connection.ConnectRateLimit <= 0 {
+		return true
+	}
+	limit := rate.Limit(connection.ConnectRateLimit)
+	burst := connection.ConnectBurst
+	if burst < 1 {
+		burst = 1
+	}
+
+	connectLimitersLock.Lock()
+	limiter, found := connectLimiters[server]
+	if !found {
+		limiter = rate.NewLimiter(limit, burst)
+		connectLimiters[server] = limiter
+	} else {
+		if limiter.Limit() != limit {
+			limiter.SetLimit(limit)
+		}
+		if limiter.Burst() != burst {
+			limiter.SetBurst(burst)
+		}
+	}
+	connectLimitersLock.Unlock()
+	return limiter.Allow()
+}
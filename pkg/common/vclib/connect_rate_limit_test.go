@@ -0,0 +1,95 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+)
+
+func TestConnectRateLimit(t *testing.T) {
+	const (
+		burst = 2
+		rate  = 1
+	)
+	s := newTestVCSim(t)
+	newConnection := func() *vclib.VSphereConnection {
+		return &vclib.VSphereConnection{
+			Hostname:         s.URL.Hostname(),
+			Port:             s.URL.Port(),
+			Insecure:         true,
+			Username:         "user",
+			Password:         "pass",
+			ConnectRateLimit: rate,
+			ConnectBurst:     burst,
+		}
+	}
+	ctx := context.Background()
+
+	// A burst of connections to the same vCenter beyond the limit is throttled
+	connections := make([]*vclib.VSphereConnection, 2*burst)
+	errs := make([]error, len(connections))
+	var wg sync.WaitGroup
+	for i := range connections {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			connections[i] = newConnection()
+			errs[i] = connections[i].Connect(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	var connected, limited int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			connected++
+			connections[i].Logout(ctx)
+		case errors.Is(err, vclib.ErrRateLimited):
+			limited++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if connected != burst || limited != len(connections)-burst {
+		t.Errorf("Expected %d connections and %d rate limited, got %d and %d", burst, len(connections)-burst, connected, limited)
+	}
+
+	// A token is available again after 1/rate
+	time.Sleep(time.Second/rate + 100*time.Millisecond)
+	connection := newConnection()
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatalf("Expected the connection to be allowed after the limit refilled, got %v", err)
+	}
+	connection.Logout(ctx)
+
+	// Connections without a limit are not throttled
+	for i := 0; i < 2*burst; i++ {
+		connection := newConnection()
+		connection.ConnectRateLimit = 0
+		if err := connection.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		connection.Logout(ctx)
+	}
+}
@@ -19,52 +19,469 @@ package vclib
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"net"
 	neturl "net/url"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/session/keepalive"
 	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/soap"
-	klog "k8s.io/klog/v2"
+	"golang.org/x/net/proxy"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/version"
 )
 
 const (
 	userAgentName = "k8s-cloud-provider-vsphere"
+
+	// DefaultPort is the vCenter port used when VSphereConnection.Port is blank.
+	DefaultPort = "443"
+
+	// DefaultTokenRenewalMargin is how long before SAML token expiry Connect re-issues the token.
+	DefaultTokenRenewalMargin = time.Minute
+
+	// DefaultCircuitBreakerCooldown is how long the circuit breaker stays open when
+	// VSphereConnection.CircuitBreakerCooldown is zero.
+	DefaultCircuitBreakerCooldown = 30 * time.Second
+
+	// DefaultCredentialsLockTimeout is how long UpdateCredentials waits for the credentials
+	// lock when VSphereConnection.CredentialsLockTimeout is zero.
+	DefaultCredentialsLockTimeout = 30 * time.Second
+)
+
+// SRVResolver looks up DNS SRV records, as net.Resolver does.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// CredentialsProvider returns the current username and password for a connection.
+type CredentialsProvider func(ctx context.Context) (username string, password string, err error)
+
+// Credentials are the credentials of a session opened by WithCredentials, or the credentials
+// of a connection replaced by UpdateAll.
+type Credentials struct {
+	Username string
+	Password string
+	// ClientCertPEM and ClientKeyPEM, when set, log in with a SAML token issued for the certificate
+	ClientCertPEM string
+	ClientKeyPEM  string
+	// BearerToken, when set, is exchanged for a session with SessionManager.LoginByToken
+	BearerToken string
+	// SessionManagerURL and SessionManagerToken, when set, clone the session of a session manager
+	SessionManagerURL   string
+	SessionManagerToken string
+}
+
+// TokenProvider returns a bearer token for a connection, e.g. from an external identity provider.
+type TokenProvider func(ctx context.Context) (token string, err error)
+
+// AuthPreference controls which auth method login tries first when a connection has both a
+// bearer token, e.g. of the session manager, and a client certificate or password.
+type AuthPreference int
+
+const (
+	// AuthPreferenceSessionManagerFirst logs in with the bearer token, falling back to the
+	// client certificate or password if it fails.
+	AuthPreferenceSessionManagerFirst AuthPreference = iota
+	// AuthPreferencePasswordFirst logs in with the client certificate or password, falling back
+	// to the bearer token if it fails.
+	AuthPreferencePasswordFirst
 )
 
 // VSphereConnection contains information for connecting to vCenter
 type VSphereConnection struct {
-	Client            *vim25.Client
-	Username          string
-	Password          string
-	Hostname          string
-	Port              string
-	CACert            string
-	Thumbprint        string
-	Insecure          bool
-	RoundTripperCount uint
-	credentialsLock   sync.Mutex
+	Client   *vim25.Client
+	Username string
+	Password string
+	// ClientCertPEM and ClientKeyPEM are the PEM encoded certificate and private key used to
+	// login with a SAML token. When empty, a PEM encoded Username and Password are used instead.
+	ClientCertPEM string
+	ClientKeyPEM  string
+	// ClientTLSCert and ClientTLSKey are the PEM encoded certificate and private key presented
+	// in the TLS handshake, e.g. to a proxy in front of vCenter requiring mutual TLS. Unlike
+	// ClientCertPEM and ClientKeyPEM, they are not used to login.
+	ClientTLSCert string
+	ClientTLSKey  string
+	Hostname      string
+	Port          string
+	// ServerName, when set, is the name the certificate of vCenter is verified for, e.g. its
+	// FQDN while Hostname is its IP address, and the host its thumbprint is registered for in
+	// addition to the dialed host.
+	ServerName string
+	// URL, when set, is the full URL of the vCenter SDK endpoint, e.g. for a vCenter behind a
+	// path-based reverse proxy, and is used verbatim instead of Hostname and Port. Hostname
+	// then only identifies the server in logs and metrics.
+	URL string
+	// UseSRVLookup, when set and Port is blank, makes NewClient look up the host and port of
+	// vCenter in the _vsphere._tcp.<Hostname> SRV record, falling back to Hostname and
+	// DefaultPort when there is none. Hostname then still identifies the server in logs,
+	// metrics and shared sessions.
+	UseSRVLookup bool
+	// Resolver looks up the SRV record when UseSRVLookup is set. net.DefaultResolver is used when nil.
+	Resolver SRVResolver
+	// CACert is the inline PEM or the paths, optionally prefixed with file://, of the CA
+	// certificates trusted in addition to Thumbprint.
+	CACert     string
+	Thumbprint string
+	Insecure   bool
+	// LearnThumbprintOnFirstConnect, when set and Thumbprint is blank, makes NewClient record
+	// the thumbprint of vCenter's certificate on the first successful connect, e.g. while
+	// Insecure is set, and verify the certificate against it from then on, Insecure
+	// notwithstanding. The learned thumbprint is logged for operators to configure.
+	LearnThumbprintOnFirstConnect bool
+	RoundTripperCount             uint
+	// ConnectTimeout, when set, limits the TCP connection and TLS handshake of ProbeTLS, and
+	// the connections to the SOCKS5 proxy.
+	ConnectTimeout time.Duration
+	// ConnectDeadline, when set, limits each Connect and ClientOrConnect as a whole, waiting
+	// for other connects, retries and login included.
+	ConnectDeadline time.Duration
+	// SOCKS5ProxyURL, when set, is the socks5:// URL of a SOCKS5 proxy to connect to vCenter
+	// through. A username and password in the URL are used to authenticate with the proxy.
+	SOCKS5ProxyURL string
+	// UserAgent, when set, replaces the default user agent identifying the connection's
+	// sessions in vCenter. The build version is appended to it.
+	UserAgent string
+	// RetryInitialDelay is the delay before the first retry of a failed round trip.
+	RetryInitialDelay time.Duration
+	// RetryMaxDelay caps the delay between round trip retries. The delay is not capped when zero.
+	RetryMaxDelay time.Duration
+	// RetryMultiplier scales the delay after each round trip retry. The delay is constant when zero.
+	RetryMultiplier float64
+	// CircuitBreakerThreshold, when set, is the number of consecutive failed round trips,
+	// after retries, after which round trips fail fast with ErrCircuitOpen for
+	// CircuitBreakerCooldown. A single round trip is then let through to probe vCenter.
+	// Faults returned by vCenter are not failures.
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long the circuit breaker stays open.
+	// DefaultCircuitBreakerCooldown is used when zero.
+	CircuitBreakerCooldown time.Duration
+	// ConnectRateLimit, when set, is the number of new clients per second allowed to the vCenter,
+	// shared by all the connections to it, so that a reconcile storm does not flood it with logins.
+	// New clients beyond it fail with ErrRateLimited.
+	ConnectRateLimit float64
+	// ConnectBurst is the number of new clients allowed at once by ConnectRateLimit, at least 1.
+	ConnectBurst int
+	// RetryableFault, when set, reports whether a failed round trip should also be retried for
+	// errors other than temporary network errors, such as transient vCenter faults.
+	RetryableFault func(err error) bool
+	// CredentialsProvider, when set, is asked for fresh credentials when login fails with
+	// invalid credentials, e.g. after the secret holding them was rotated. Login is then
+	// retried once with the returned credentials.
+	CredentialsProvider CredentialsProvider
+	// BearerToken, when set, is exchanged for a session with SessionManager.LoginByToken and
+	// takes precedence over the client certificate and password, unless AuthPreference says otherwise.
+	BearerToken string
+	// TokenProvider, when set, is asked for a bearer token when BearerToken is empty and
+	// again when vCenter rejects the token, after which login is retried once.
+	TokenProvider TokenProvider
+	// SessionManagerURL, when set, is the URL of a session manager sharing a vCenter session
+	// among its clients. Login asks it for a clone ticket of that session with the bearer token
+	// SessionManagerToken, and clones the session instead of logging in one of its own. If that
+	// fails, login falls back to the other credentials of the connection, if any.
+	SessionManagerURL string
+	// SessionManagerToken is the bearer token SessionManagerURL is requested with.
+	SessionManagerToken string
+	// AuthPreference is the auth method tried first when both a bearer token or TokenProvider and
+	// a client certificate or password are configured. The other is tried if it fails.
+	AuthPreference AuthPreference
+	// TokenLifetime is the lifetime requested for SAML tokens. The STS default is used when zero.
+	TokenLifetime time.Duration
+	// TokenRenewalMargin is how long before SAML token expiry the token is re-issued.
+	// DefaultTokenRenewalMargin is used when zero.
+	TokenRenewalMargin time.Duration
+	// ExpectedInstanceUUID, when set, must match the instance UUID reported by vCenter.
+	ExpectedInstanceUUID string
+	// KeepAliveInterval, when set, keeps the session alive by checking it at this
+	// interval and logging in again if it is no longer valid.
+	KeepAliveInterval time.Duration
+	// SessionCheckInterval, when set, makes StartSessionValidation check the session at this
+	// interval and connect again when vCenter dropped it, see Healthy. It is zero by default.
+	SessionCheckInterval time.Duration
+	// ShareSession, when set, makes the connection reuse the authenticated client of other
+	// connections with ShareSession set to the same server and Username, instead of logging
+	// in a session of its own. The session is only logged out by the last of them to Logout.
+	ShareSession bool
+	// StaleSessionAge, when set, makes the first Connect terminate the sessions left behind
+	// by earlier connections, see TerminateStaleSessions. A failure to do so is only logged.
+	StaleSessionAge time.Duration
+	// RegisterMissingExtension makes EnsureExtensionRegistered register the extension
+	// when it is not registered yet, instead of failing.
+	RegisterMissingExtension bool
+	// DebugSOAP logs the SOAP request and response bodies at verbosity 8, with credentials
+	// redacted, to diagnose unexpected vCenter behavior.
+	DebugSOAP bool
+	// CredentialsLockTimeout is how long UpdateCredentials and UpdateBearerToken wait for the
+	// credentials lock before giving up. DefaultCredentialsLockTimeout is used when zero.
+	CredentialsLockTimeout time.Duration
+	// Datacenter is the path of the datacenter returned by GetDatacenter.
+	Datacenter      string
+	credentialsLock timeoutMutex
+	signer          *sts.Signer
+	keepAlive       *keepalive.HandlerSOAP
+	datacenter      *Datacenter
+	// restClient is the client returned by RESTClient, logged in while restClientOwner is the
+	// SOAP client. Guarded by clientLock.
+	restClient      *rest.Client
+	restClientOwner *vim25.Client
+	// staleSessionsTerminated is whether connect terminated the stale sessions
+	staleSessionsTerminated bool
+	// shared is the session the connection holds a reference to when ShareSession is set
+	shared *sharedSession
+	// breaker is the circuit breaker of the connection's clients, kept across new clients
+	breaker *circuitBreaker
+	// sessionActive is whether the session of Client is counted as active in the session metrics
+	sessionActive atomic.Bool
+	// lastConnected is when the connection last logged in successfully. Guarded by credentialsLock.
+	lastConnected time.Time
+	// lastError is the error of the last attempt to log in, nil if it succeeded. Guarded by credentialsLock.
+	lastError error
+	// serverVersion is the version of vCenter as of the last connect. Guarded by credentialsLock.
+	serverVersion ServerVersion
+	// learnedThumbprint is the thumbprint learned when LearnThumbprintOnFirstConnect is set
+	learnedThumbprint atomic.Pointer[string]
+	// healthy is whether the session was valid as of the last login or session check
+	healthy atomic.Bool
+}
+
+// ServerVersion is the version of vCenter, as reported in ServiceContent.About.
+type ServerVersion struct {
+	// Version is the product version, e.g. 8.0.2
+	Version string
+	// Build is the build number, e.g. 22385739
+	Build string
+	// APIVersion is the version of the vSphere API, e.g. 8.0.2.0
+	APIVersion string
+	// FullName is the product name with its version and build,
+	// e.g. VMware vCenter Server 8.0.2 build-22385739
+	FullName string
+}
+
+// timeoutMutex is a mutex whose locking can time out. The zero value is an unlocked mutex.
+type timeoutMutex struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (m *timeoutMutex) init() {
+	m.once.Do(func() { m.ch = make(chan struct{}, 1) })
+}
+
+// Lock locks m, waiting as long as it takes.
+func (m *timeoutMutex) Lock() {
+	m.init()
+	m.ch <- struct{}{}
+}
+
+// lockTimeout locks m, or returns false if it is still locked after timeout.
+func (m *timeoutMutex) lockTimeout(timeout time.Duration) bool {
+	m.init()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// lockContext locks m, or returns the error of ctx if it is done first.
+func (m *timeoutMutex) lockContext(ctx context.Context) error {
+	m.init()
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks m, which must be locked.
+func (m *timeoutMutex) Unlock() {
+	m.init()
+	select {
+	case <-m.ch:
+	default:
+		panic("vclib: unlock of unlocked timeoutMutex")
+	}
+}
+
+// sessionKey identifies the sessions that connections with ShareSession set can share.
+type sessionKey struct {
+	server   string
+	username string
+}
+
+// sharedSession is a client shared by connections with ShareSession set.
+type sharedSession struct {
+	key    sessionKey
+	client *vim25.Client
+	// owner is the connection that created client, whose keep-alive and session metrics track it
+	owner *VSphereConnection
+	// refs is the number of connections holding the session
+	refs int
 }
 
 var (
-	clientLock sync.Mutex
+	// clientLock serializes the connects of all connections. Connect and ClientOrConnect stop
+	// waiting for it when their context is done.
+	clientLock timeoutMutex
+	// rootCAPools caches the CA certificate pools of CACert values
+	rootCAPools = newRootCAPoolCache(maxRootCAPools)
+	// sharedSessions are the sessions of connections with ShareSession set. Guarded by clientLock.
+	sharedSessions = make(map[sessionKey]*sharedSession)
 )
 
 // Connect makes connection to vCenter and sets VSphereConnection.Client.
 // If connection.Client is already set, it obtains the existing user session.
 // if user session is not valid, connection.Client will be set to the new client.
-func (connection *VSphereConnection) Connect(ctx context.Context) error {
-	var err error
-	clientLock.Lock()
+func (connection *VSphereConnection) Connect(ctx context.Context) (err error) {
+	ctx, span := connection.startSpan(ctx, "Connect")
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := connection.withConnectDeadline(ctx)
+	defer cancel()
+	defer func() { recordConnectAttempt(connection.Hostname, err) }()
+
+	if err = connection.lockClient(ctx); err != nil {
+		return err
+	}
 	defer clientLock.Unlock()
+	return connection.connect(ctx)
+}
+
+// ClientOrConnect ensures connection has a valid session, like Connect, and returns its client.
+// The client is read under the same lock, so callers should prefer it over reading
+// connection.Client after Connect.
+func (connection *VSphereConnection) ClientOrConnect(ctx context.Context) (_ *vim25.Client, err error) {
+	ctx, span := connection.startSpan(ctx, "ClientOrConnect")
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := connection.withConnectDeadline(ctx)
+	defer cancel()
+	defer func() { recordConnectAttempt(connection.Hostname, err) }()
+
+	if err = connection.lockClient(ctx); err != nil {
+		return nil, err
+	}
+	defer clientLock.Unlock()
+	if err = connection.connect(ctx); err != nil {
+		return nil, err
+	}
+	return connection.Client, nil
+}
+
+// lockClient locks clientLock, or returns an error wrapping the error of ctx if it is done
+// while other connects hold it.
+func (connection *VSphereConnection) lockClient(ctx context.Context) error {
+	if err := clientLock.lockContext(ctx); err != nil {
+		return fmt.Errorf("waiting for other connects to server %s: %w", connection.Hostname, err)
+	}
+	return nil
+}
+
+// withConnectDeadline limits ctx to ConnectDeadline, unless it is zero.
+func (connection *VSphereConnection) withConnectDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if connection.ConnectDeadline <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, connection.ConnectDeadline)
+}
+
+// connect implements Connect. Must be called with clientLock held.
+func (connection *VSphereConnection) connect(ctx context.Context) error {
+	var err error
+	if connection.ShareSession {
+		err = connection.connectShared(ctx)
+	} else {
+		err = connection.connectClient(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	connection.setServerVersion(connection.Client)
+
+	if connection.StaleSessionAge > 0 && !connection.staleSessionsTerminated {
+		connection.staleSessionsTerminated = true
+		if err := connection.terminateStaleSessions(ctx, connection.Client, connection.StaleSessionAge); err != nil {
+			loggerFor(ctx).Error(err, "Failed to terminate stale sessions", "server", connection.Hostname)
+		}
+	}
+	return nil
+}
+
+// connectShared implements connect for connections with ShareSession set, reusing the
+// session of other connections to the same server and user. Must be called with clientLock held.
+func (connection *VSphereConnection) connectShared(ctx context.Context) error {
+	s := connection.shared
+	if s == nil {
+		key, err := connection.sessionKey()
+		if err != nil {
+			return err
+		}
+		if s = sharedSessions[key]; s == nil {
+			s = &sharedSession{key: key}
+		}
+	}
+	// Pick up the client of the session, which another connection may have replaced
+	if s.client != nil && connection.Client != s.client {
+		connection.Client = s.client
+		connection.datacenter = nil
+	}
+
+	if err := connection.connectClient(ctx); err != nil {
+		return err
+	}
+	if connection.Client != s.client {
+		if s.owner != nil && s.owner != connection {
+			s.owner.stopKeepAlive()
+			if s.owner.sessionActive.Swap(false) {
+				recordSessionExpired(connection.Hostname)
+			}
+		}
+		s.client = connection.Client
+		s.owner = connection
+	}
+	if connection.shared == nil {
+		s.refs++
+		sharedSessions[s.key] = s
+		connection.shared = s
+	}
+	return nil
+}
 
+// sessionKey returns the key of the session shared by connections with ShareSession set.
+func (connection *VSphereConnection) sessionKey() (sessionKey, error) {
+	u, err := connection.serverURL()
+	if err != nil {
+		return sessionKey{}, err
+	}
+	server := hostPort(u) + u.Path
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	return sessionKey{server: server, username: connection.Username}, nil
+}
+
+// connectClient checks the session of connection.Client and replaces the client if the
+// session is not valid. Must be called with clientLock held.
+func (connection *VSphereConnection) connectClient(ctx context.Context) (err error) {
 	if connection.Client == nil {
+		connection.datacenter = nil
 		connection.Client, err = connection.NewClient(ctx)
 		if err != nil {
-			klog.Errorf("Failed to create govmomi client. err: %+v", err)
+			loggerFor(ctx).Error(err, "Failed to create govmomi client", "server", connection.Hostname)
 			return err
 		}
 		return nil
@@ -72,133 +489,1055 @@ func (connection *VSphereConnection) Connect(ctx context.Context) error {
 	m := session.NewManager(connection.Client)
 	userSession, err := m.UserSession(ctx)
 	if err != nil {
-		klog.Errorf("Error while obtaining user session. err: %+v", err)
+		loggerFor(ctx).Error(err, "Failed to obtain user session", "server", connection.Hostname)
 		return err
 	}
 	if userSession != nil {
-		return nil
+		if !connection.tokenNeedsRenewal() {
+			recordConnect(connection.Hostname, true)
+			return nil
+		}
+		loggerFor(ctx).V(2).Info("SAML token is about to expire, renewing", "server", connection.Hostname)
+		if err = connection.renewToken(ctx); err == nil {
+			recordConnect(connection.Hostname, true)
+			return nil
+		}
+		loggerFor(ctx).Error(err, "Failed to renew SAML token", "server", connection.Hostname)
 	}
-	klog.Warning("Creating new client session since the existing session is not valid or not authenticated")
+	loggerFor(ctx).Info("Creating new client session since the existing session is not valid or not authenticated", "server", connection.Hostname)
 
+	connection.stopKeepAlive()
+	if connection.sessionActive.Swap(false) {
+		recordSessionExpired(connection.Hostname)
+	}
+	connection.datacenter = nil
 	connection.Client, err = connection.NewClient(ctx)
 	if err != nil {
-		klog.Errorf("Failed to create govmomi client. err: %+v", err)
+		loggerFor(ctx).Error(err, "Failed to create govmomi client", "server", connection.Hostname)
 		return err
 	}
 	return nil
 }
 
+// GetDatacenter connects if needed and returns the datacenter configured in
+// connection.Datacenter. The datacenter is looked up once and cached until
+// a new client is created. clientLock is not held while it is looked up, so that the
+// lookup does not hold up the connects of other connections.
+func (connection *VSphereConnection) GetDatacenter(ctx context.Context) (*Datacenter, error) {
+	if connection.Datacenter == "" {
+		return nil, ErrNoDatacenterConfigured
+	}
+	client, err := connection.ClientOrConnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientLock.Lock()
+	dc := connection.datacenter
+	clientLock.Unlock()
+	if dc != nil {
+		return dc, nil
+	}
+
+	datacenter, err := find.NewFinder(client, false).Datacenter(ctx, connection.Datacenter)
+	if err != nil {
+		loggerFor(ctx).Error(err, "Failed to find the datacenter", "server", connection.Hostname, "datacenter", connection.Datacenter)
+		return nil, err
+	}
+	dc = &Datacenter{datacenter}
+
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	// the client may have been replaced during the lookup, which resets the cache
+	if connection.Client != client {
+		return dc, nil
+	}
+	if connection.datacenter == nil {
+		connection.datacenter = dc
+	}
+	return connection.datacenter, nil
+}
+
+// ConnectWithRetry calls Connect, retrying failed attempts with the given
+// exponential backoff (and jitter) until it succeeds, the backoff steps are
+// exhausted or ctx is done. Invalid credentials are not retried since
+// repeating the login would only risk locking out the account, nor are
+// missing ones.
+func (connection *VSphereConnection) ConnectWithRetry(ctx context.Context, backoff wait.Backoff) error {
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		lastErr = connection.Connect(ctx)
+		if lastErr == nil {
+			return true, nil
+		}
+		if IsInvalidCredentialsError(lastErr) || errors.Is(lastErr, ErrNoAuthMethodConfigured) {
+			return false, lastErr
+		}
+		loggerFor(ctx).Info("Failed to connect to vCenter, will retry", "server", connection.Hostname, "err", lastErr)
+		return false, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
 // Signer returns an sts.Signer for use with SAML token auth if connection is configured for such.
 // Returns nil if username/password auth is configured for the connection.
 func (connection *VSphereConnection) Signer(ctx context.Context, client *vim25.Client) (*sts.Signer, error) {
-	// TODO: Add separate fields for certificate and private-key.
-	// For now we can leave the config structs and validation as-is and
-	// decide to use LoginByToken if the username value is PEM encoded.
-	b, _ := pem.Decode([]byte(connection.Username))
-	if b == nil {
+	connection.credentialsLock.Lock()
+	certPEM, keyPEM := connection.clientCertificate()
+	connection.credentialsLock.Unlock()
+	return connection.issueSigner(ctx, client, certPEM, keyPEM)
+}
+
+// clientCertificate returns the PEM encoded certificate and private key for SAML token auth,
+// preferring ClientCertPEM and ClientKeyPEM. For connections configured before those fields
+// existed, a PEM encoded Username and Password are used as the certificate and private key.
+// Must be called with credentialsLock held.
+func (connection *VSphereConnection) clientCertificate() (string, string) {
+	if connection.ClientCertPEM != "" {
+		return connection.ClientCertPEM, connection.ClientKeyPEM
+	}
+	if b, _ := pem.Decode([]byte(connection.Username)); b != nil {
+		return connection.Username, connection.Password
+	}
+	return "", ""
+}
+
+// issueSigner issues a SAML token for the given PEM encoded certificate and private key.
+// Returns nil if no certificate is given.
+func (connection *VSphereConnection) issueSigner(ctx context.Context, client *vim25.Client, certPEM, keyPEM string) (*sts.Signer, error) {
+	if certPEM == "" {
 		return nil, nil
 	}
 
-	cert, err := tls.X509KeyPair([]byte(connection.Username), []byte(connection.Password))
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
 	if err != nil {
-		klog.Errorf("Failed to load X509 key pair. err: %+v", err)
+		loggerFor(ctx).Error(err, "Failed to load X509 key pair", "server", connection.Hostname)
 		return nil, err
 	}
 
 	tokens, err := sts.NewClient(ctx, client)
 	if err != nil {
-		klog.Errorf("Failed to create STS client. err: %+v", err)
+		loggerFor(ctx).Error(err, "Failed to create STS client", "server", connection.Hostname)
 		return nil, err
 	}
 
 	req := sts.TokenRequest{
 		Certificate: &cert,
 		Delegatable: true,
+		Lifetime:    connection.TokenLifetime,
 	}
 
 	signer, err := tokens.Issue(ctx, req)
 	if err != nil {
-		klog.Errorf("Failed to issue SAML token. err: %+v", err)
+		loggerFor(ctx).Error(err, "Failed to issue SAML token", "server", connection.Hostname)
 		return nil, err
 	}
 
 	return signer, nil
 }
 
-// login calls SessionManager.LoginByToken if certificate and private key are configured,
-// otherwise calls SessionManager.Login with user and password.
-func (connection *VSphereConnection) login(ctx context.Context, client *vim25.Client) error {
-	m := session.NewManager(client)
+// RenewToken re-issues the SAML token and logs in with it on the existing client,
+// avoiding a full client teardown. It is a no-op for username/password connections.
+func (connection *VSphereConnection) RenewToken(ctx context.Context) error {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+
+	if connection.Client == nil || connection.TokenExpiry().IsZero() {
+		return nil
+	}
+	return connection.renewToken(ctx)
+}
+
+// TokenExpiry returns when the SAML token of the current session expires.
+// The zero time is returned if the session was not created with a SAML token.
+func (connection *VSphereConnection) TokenExpiry() time.Time {
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	if connection.signer == nil {
+		return time.Time{}
+	}
+	return connection.signer.Lifetime.Expires
+}
+
+func (connection *VSphereConnection) tokenNeedsRenewal() bool {
+	expires := connection.TokenExpiry()
+	if expires.IsZero() {
+		return false
+	}
+	margin := connection.TokenRenewalMargin
+	if margin == 0 {
+		margin = DefaultTokenRenewalMargin
+	}
+	return time.Now().Add(margin).After(expires)
+}
+
+// renewToken replaces the token based session of connection.Client with a new one.
+func (connection *VSphereConnection) renewToken(ctx context.Context) (err error) {
+	defer func() { connection.recordLoginResult(err) }()
+
+	m := session.NewManager(connection.Client)
+	if err := m.Logout(ctx); err != nil {
+		loggerFor(ctx).Info("Failed to logout session before renewing SAML token", "server", connection.Hostname, "err", err)
+	}
+	return connection.login(ctx, connection.Client)
+}
+
+// recordLoginResult records the time of a successful login, or the error of a failed one.
+func (connection *VSphereConnection) recordLoginResult(err error) {
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	connection.lastError = err
+	connection.healthy.Store(err == nil)
+	if err == nil {
+		connection.lastConnected = time.Now()
+	}
+}
+
+// LastConnectedTime returns when the connection last logged in to vCenter successfully,
+// or the zero time if it never did.
+func (connection *VSphereConnection) LastConnectedTime() time.Time {
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	return connection.lastConnected
+}
+
+// LastError returns the error of the last attempt to create a client and log in to
+// vCenter, or nil if it succeeded.
+func (connection *VSphereConnection) LastError() error {
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	return connection.lastError
+}
+
+// ServerVersion returns the version of vCenter as of the last successful Connect, refreshed on
+// every connect so that it follows vCenter upgrades, or the zero value before the first one.
+func (connection *VSphereConnection) ServerVersion() ServerVersion {
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	return connection.serverVersion
+}
+
+// setServerVersion records the version of vCenter reported by client.
+func (connection *VSphereConnection) setServerVersion(client *vim25.Client) {
+	about := client.ServiceContent.About
 	connection.credentialsLock.Lock()
 	defer connection.credentialsLock.Unlock()
+	connection.serverVersion = ServerVersion{
+		Version:    about.Version,
+		Build:      about.Build,
+		APIVersion: about.ApiVersion,
+		FullName:   about.FullName,
+	}
+}
+
+// login calls SessionManager.LoginByToken if a bearer token or certificate and private key
+// are configured, otherwise calls SessionManager.Login with user and password.
+// If the TokenProvider fails to provide a bearer token, e.g. because the external session
+// manager issuing it is down, or the bearer token is not accepted and cannot be refreshed,
+// login falls back to the certificate or password when configured. With AuthPreferencePasswordFirst,
+// the certificate or password is tried first instead, falling back to the bearer token.
+// All network calls use ctx, and credentialsLock is not held while they are in flight
+// so that a slow or cancelled login does not block UpdateCredentials.
+func (connection *VSphereConnection) login(ctx context.Context, client *vim25.Client) (err error) {
+	ctx, span := connection.startSpan(ctx, "login")
+	defer func() { endSpan(span, err) }()
+
+	m := session.NewManager(client)
+	connection.credentialsLock.Lock()
+	username, password := connection.Username, connection.Password
+	certPEM, keyPEM := connection.clientCertificate()
+	token := connection.BearerToken
+	sessionManagerURL, sessionManagerToken := connection.SessionManagerURL, connection.SessionManagerToken
+	connection.signer = nil
+	connection.credentialsLock.Unlock()
+
+	hasPassword := password != "" || (certPEM != "" && keyPEM != "")
+	hasToken := token != "" || connection.TokenProvider != nil
+	if sessionManagerURL != "" {
+		err = connection.cloneSession(ctx, m, sessionManagerURL, sessionManagerToken)
+		if err == nil || ctx.Err() != nil || (!hasPassword && !hasToken) {
+			return err
+		}
+		loggerFor(ctx).Info("Session manager clone failed, falling back to the other credentials", "server", connection.Hostname, "err", err)
+	}
+	if connection.AuthPreference == AuthPreferencePasswordFirst && hasPassword && hasToken {
+		err = connection.loginWithPassword(ctx, m, client, username, password, certPEM, keyPEM)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		loggerFor(ctx).Info("Certificate or password login failed, falling back to bearer token login", "server", connection.Hostname, "err", err)
+		if token == "" {
+			if token, err = connection.refreshBearerToken(ctx); err != nil {
+				return err
+			}
+		}
+		if err = connection.loginWithToken(ctx, m, client, token); err == nil {
+			loggerFor(ctx).Info("Logged in with the fallback bearer token", "server", connection.Hostname)
+		}
+		return err
+	}
+
+	canFallBack := func(err error) bool {
+		if ctx.Err() != nil || !hasPassword {
+			return false
+		}
+		loggerFor(ctx).Info("Bearer token login failed, falling back to certificate or password login", "server", connection.Hostname, "err", err)
+		return true
+	}
+	fellBack := false
+	if token == "" && connection.TokenProvider != nil {
+		if token, err = connection.refreshBearerToken(ctx); err != nil {
+			if !canFallBack(err) {
+				return err
+			}
+			fellBack = true
+		}
+	}
+	if token != "" {
+		err = connection.loginWithToken(ctx, m, client, token)
+		// A rejected token is refreshed by loginWithCredentialsRefresh instead
+		refreshable := connection.TokenProvider != nil && IsInvalidCredentialsError(err)
+		if err == nil || refreshable || !canFallBack(err) {
+			return err
+		}
+		fellBack = true
+	}
 
-	signer, err := connection.Signer(ctx, client)
+	err = connection.loginWithPassword(ctx, m, client, username, password, certPEM, keyPEM)
+	if err == nil && fellBack {
+		loggerFor(ctx).Info("Logged in with the fallback certificate or password", "server", connection.Hostname)
+	}
+	return err
+}
+
+// loginWithToken calls SessionManager.LoginByToken with the bearer token.
+func (connection *VSphereConnection) loginWithToken(ctx context.Context, m *session.Manager, client *vim25.Client, token string) error {
+	loggerFor(ctx).V(3).Info("SessionManager.LoginByToken with bearer token", "server", connection.Hostname)
+	header := soap.Header{Security: &sts.Signer{Token: token}}
+	return m.LoginByToken(client.WithHeader(ctx, header))
+}
+
+// loginWithPassword calls SessionManager.LoginByToken with a SAML token issued for the certificate
+// and private key if configured, otherwise calls SessionManager.Login with user and password.
+func (connection *VSphereConnection) loginWithPassword(ctx context.Context, m *session.Manager, client *vim25.Client, username, password, certPEM, keyPEM string) error {
+	signer, err := connection.issueSigner(ctx, client, certPEM, keyPEM)
 	if err != nil {
 		return err
 	}
 
 	if signer == nil {
-		klog.V(3).Infof("SessionManager.Login with username %q", connection.Username)
-		return m.Login(ctx, neturl.UserPassword(connection.Username, connection.Password))
+		if password == "" {
+			// Fail before vCenter rejects the login with an opaque fault
+			return fmt.Errorf("%w for server %s", ErrNoAuthMethodConfigured, connection.Hostname)
+		}
+		loggerFor(ctx).V(3).Info("SessionManager.Login", "server", connection.Hostname, "username", username)
+		return m.Login(ctx, neturl.UserPassword(username, password))
 	}
 
-	klog.V(3).Infof("SessionManager.LoginByToken with certificate %q", connection.Username)
+	loggerFor(ctx).V(3).Info("SessionManager.LoginByToken with client certificate", "server", connection.Hostname)
 
 	header := soap.Header{Security: signer}
 
-	return m.LoginByToken(client.WithHeader(ctx, header))
+	if err := m.LoginByToken(client.WithHeader(ctx, header)); err != nil {
+		return err
+	}
+	connection.credentialsLock.Lock()
+	connection.signer = signer
+	connection.credentialsLock.Unlock()
+	return nil
+}
+
+// refreshBearerToken asks the TokenProvider for a bearer token and stores it in BearerToken.
+func (connection *VSphereConnection) refreshBearerToken(ctx context.Context) (string, error) {
+	token, err := connection.TokenProvider(ctx)
+	if err != nil {
+		loggerFor(ctx).Error(err, "Failed to get bearer token", "server", connection.Hostname)
+		return "", err
+	}
+	connection.credentialsLock.Lock()
+	connection.BearerToken = token
+	connection.credentialsLock.Unlock()
+	return token, nil
+}
+
+// loginWithCredentialsRefresh calls login and, if it fails with invalid credentials, retries
+// once with a new bearer token from the TokenProvider, or with the credentials returned by
+// the CredentialsProvider for connections not using bearer tokens. Missing credentials are
+// refreshed the same way.
+func (connection *VSphereConnection) loginWithCredentialsRefresh(ctx context.Context, client *vim25.Client) error {
+	err := connection.login(ctx, client)
+	if err == nil || !(IsInvalidCredentialsError(err) || errors.Is(err, ErrNoAuthMethodConfigured)) {
+		return err
+	}
+
+	if connection.TokenProvider != nil {
+		loggerFor(ctx).V(2).Info("Bearer token rejected, refreshing token", "server", connection.Hostname)
+		if _, refreshErr := connection.refreshBearerToken(ctx); refreshErr != nil {
+			return err
+		}
+		return connection.login(ctx, client)
+	}
+
+	if connection.CredentialsProvider == nil {
+		return err
+	}
+
+	loggerFor(ctx).V(2).Info("Invalid credentials, refreshing credentials", "server", connection.Hostname)
+	username, password, refreshErr := connection.CredentialsProvider(ctx)
+	if refreshErr != nil {
+		loggerFor(ctx).Error(refreshErr, "Failed to refresh credentials", "server", connection.Hostname)
+		return err
+	}
+	connection.credentialsLock.Lock()
+	connection.Username = username
+	connection.Password = password
+	connection.credentialsLock.Unlock()
+	return connection.login(ctx, client)
 }
 
-// Logout calls SessionManager.Logout for the given connection.
+// Logout calls SessionManager.Logout for the given connection, and logs out its REST client.
+// A session shared with other connections is only logged out by the last of them.
 func (connection *VSphereConnection) Logout(ctx context.Context) {
+	connection.logoutREST(ctx)
+	connection.healthy.Store(false)
+
+	owner := connection
+	if connection.ShareSession {
+		clientLock.Lock()
+		defer clientLock.Unlock()
+		if s := connection.shared; s != nil {
+			connection.shared = nil
+			connection.datacenter = nil
+			if s.refs--; s.refs > 0 {
+				loggerFor(ctx).V(3).Info("Session is still shared, not logging out", "server", connection.Hostname, "refs", s.refs)
+				connection.Client = nil
+				return
+			}
+			delete(sharedSessions, s.key)
+			connection.Client, owner = s.client, s.owner
+		}
+	}
+
 	m := session.NewManager(connection.Client)
 	if err := m.Logout(ctx); err != nil {
-		klog.Errorf("Logout failed: %s", err)
+		loggerFor(ctx).Error(err, "Logout failed", "server", connection.Hostname)
+	} else if owner.sessionActive.Swap(false) {
+		recordSessionClosed(connection.Hostname)
+	}
+	owner.stopKeepAlive()
+}
+
+// TestLogin logs in to vCenter with the credentials of the connection and logs out right away,
+// e.g. to validate credentials before using them. The client and session of the connection are
+// left untouched. The error can be classified with IsInvalidCredentialsError and
+// IsNoPermissionError.
+func (connection *VSphereConnection) TestLogin(ctx context.Context) error {
+	probe := connection.Clone()
+	probe.Thumbprint = connection.thumbprint()
+	probe.KeepAliveInterval = 0
+
+	client, err := probe.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	probe.Client = client
+	probe.Logout(ctx)
+	return nil
+}
+
+// StartSessionValidation checks the session of the connection every SessionCheckInterval until
+// ctx is done, and connects again when the session was dropped by vCenter in between calls,
+// rather than waiting for the next operation to fail. The outcome is reported by Healthy.
+// It does nothing unless SessionCheckInterval is set.
+func (connection *VSphereConnection) StartSessionValidation(ctx context.Context) {
+	if connection.SessionCheckInterval <= 0 {
+		return
+	}
+	go wait.UntilWithContext(ctx, connection.validateSession, connection.SessionCheckInterval)
+}
+
+// validateSession checks the session of the connection, if it is connected, and connects
+// again if the session is no longer valid.
+func (connection *VSphereConnection) validateSession(ctx context.Context) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if connection.Client == nil {
+		return
+	}
+	userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+	if err == nil && userSession != nil {
+		connection.healthy.Store(true)
+		return
+	}
+	connection.healthy.Store(false)
+	loggerFor(ctx).Info("Session was dropped, connecting again", "server", connection.Hostname)
+	if err := connection.connect(ctx); err != nil {
+		loggerFor(ctx).Error(err, "Failed to connect again after the session was dropped", "server", connection.Hostname)
+		return
+	}
+	connection.healthy.Store(true)
+}
+
+// Healthy returns whether the session of the connection was valid as of the last login, or
+// the last check of StartSessionValidation. It is false before the first login and after Logout.
+func (connection *VSphereConnection) Healthy() bool {
+	return connection.healthy.Load()
+}
+
+// WithCredentials opens a session with cred instead of the credentials of the connection, e.g. to
+// run a single operation as another user, and returns its client along with a cleanup function
+// that logs the session out. The client and session of the connection are left untouched.
+func (connection *VSphereConnection) WithCredentials(ctx context.Context, cred Credentials) (*vim25.Client, func(), error) {
+	override := connection.Clone()
+	override.Thumbprint = connection.thumbprint()
+	override.Username, override.Password = cred.Username, cred.Password
+	override.ClientCertPEM, override.ClientKeyPEM = cred.ClientCertPEM, cred.ClientKeyPEM
+	override.BearerToken = cred.BearerToken
+	override.SessionManagerURL, override.SessionManagerToken = cred.SessionManagerURL, cred.SessionManagerToken
+	override.CredentialsProvider = nil
+	override.TokenProvider = nil
+	override.KeepAliveInterval = 0
+
+	client, err := override.NewClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	override.Client = client
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() { override.Logout(context.Background()) })
 	}
+	return client, cleanup, nil
 }
 
+// startKeepAlive wraps the client's RoundTripper with a keep-alive handler, which
+// starts on login and stops on logout.
+func (connection *VSphereConnection) startKeepAlive(client *vim25.Client) {
+	// The keep-alive checks and logs in again through the unwrapped RoundTripper
+	rt := client.RoundTripper
+	c := *client
+	send := func() error {
+		ctx := context.Background()
+		userSession, err := session.NewManager(&c).UserSession(ctx)
+		if err == nil && userSession != nil {
+			return nil
+		}
+		logger.Info("Session is no longer valid, logging in again", "server", connection.Hostname)
+		return connection.login(ctx, &c)
+	}
+	connection.keepAlive = keepalive.NewHandlerSOAP(rt, connection.KeepAliveInterval, send)
+	client.RoundTripper = connection.keepAlive
+}
+
+func (connection *VSphereConnection) stopKeepAlive() {
+	if connection.keepAlive != nil {
+		connection.keepAlive.Stop()
+		connection.keepAlive = nil
+	}
+}
+
+// TLSPolicy controls how NewClientWithTLSPolicy verifies the certificate of vCenter.
+type TLSPolicy int
+
+const (
+	// TLSPolicyStrict trusts the certificate if it is signed by CACert or the system roots,
+	// or if it matches Thumbprint. Insecure is ignored.
+	TLSPolicyStrict TLSPolicy = iota
+	// TLSPolicyThumbprintOnly only trusts the certificate if it matches Thumbprint.
+	TLSPolicyThumbprintOnly
+	// TLSPolicyInsecureFallbackWithWarning verifies the certificate like TLSPolicyStrict, but
+	// connects without verification if the certificate is not trusted, e.g. while migrating
+	// to a new CA. Every fallback is logged as an error and counted in the session metrics.
+	TLSPolicyInsecureFallbackWithWarning
+)
+
 // NewClient creates a new govmomi client for the VSphereConnection obj
 func (connection *VSphereConnection) NewClient(ctx context.Context) (*vim25.Client, error) {
-	url, err := soap.ParseURL(net.JoinHostPort(connection.Hostname, connection.Port))
+	return connection.newClient(ctx, connection.Insecure, false)
+}
+
+// NewClientWithTLSPolicy creates a new govmomi client like NewClient, verifying the certificate
+// of vCenter according to policy instead of Insecure.
+func (connection *VSphereConnection) NewClientWithTLSPolicy(ctx context.Context, policy TLSPolicy) (*vim25.Client, error) {
+	switch policy {
+	case TLSPolicyStrict:
+		return connection.newClient(ctx, false, false)
+	case TLSPolicyThumbprintOnly:
+		if connection.Thumbprint == "" {
+			return nil, fmt.Errorf("%w: thumbprint is empty", ErrInvalidConnectionConfig)
+		}
+		return connection.newClient(ctx, false, true)
+	case TLSPolicyInsecureFallbackWithWarning:
+		client, err := connection.newClient(ctx, false, false)
+		if err == nil || !isCertificateVerificationError(err) {
+			return client, err
+		}
+		loggerFor(ctx).Error(err, "The vCenter certificate is not trusted, FALLING BACK TO AN INSECURE CONNECTION. "+
+			"Configure the CA certificate or thumbprint of vCenter, the fallback is only meant for migrations", "server", connection.Hostname)
+		recordInsecureFallback(connection.Hostname)
+		return connection.newClient(ctx, true, false)
+	}
+	return nil, fmt.Errorf("%w: unknown TLS policy %d", ErrInvalidConnectionConfig, policy)
+}
+
+// isCertificateVerificationError returns true if err is caused by a certificate that is not
+// trusted or does not match the thumbprint.
+func isCertificateVerificationError(err error) bool {
+	// The soap client does not wrap a thumbprint mismatch in a typed error
+	return soap.IsCertificateUntrusted(err) || errors.Is(err, ErrThumbprintMismatch) ||
+		strings.Contains(err.Error(), "thumbprint does not match")
+}
+
+// newClient implements NewClient. The certificate is verified unless insecure is set, and
+// only matched against Thumbprint if thumbprintOnly is set.
+func (connection *VSphereConnection) newClient(ctx context.Context, insecure, thumbprintOnly bool) (_ *vim25.Client, err error) {
+	ctx, span := connection.startSpan(ctx, "NewClient")
+	defer func() { endSpan(span, err) }()
+	defer func() { connection.recordLoginResult(err) }()
+
+	u, err := connection.endpointURL(ctx)
+	if err != nil {
+		loggerFor(ctx).Error(err, "Invalid connection config", "server", connection.Hostname, "port", connection.Port)
+		return nil, err
+	}
+	host := hostPort(u)
+	if !connection.allowConnect(host) {
+		loggerFor(ctx).Info("Too many new clients, rate limited", "server", connection.Hostname, "rate", connection.ConnectRateLimit, "burst", connection.ConnectBurst)
+		return nil, fmt.Errorf("%w: %s", ErrRateLimited, host)
+	}
+
+	thumbprint := connection.thumbprint()
+	learning := connection.LearnThumbprintOnFirstConnect && thumbprint == ""
+	if thumbprint != "" && connection.Thumbprint == "" {
+		// Enforce the learned thumbprint
+		insecure = false
+	}
+
+	sc := soap.NewClient(u, insecure)
+	sc.UserAgent = connection.userAgent()
+
+	var peerThumbprint atomic.Pointer[string]
+	if learning {
+		transport := sc.DefaultTransport()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) > 0 {
+				learned := soap.ThumbprintSHA1(state.PeerCertificates[0])
+				peerThumbprint.Store(&learned)
+			}
+			return nil
+		}
+	}
+
+	cert, err := connection.clientTLSCertificate()
 	if err != nil {
-		klog.Errorf("Failed to parse URL: %s. err: %+v", url, err)
+		loggerFor(ctx).Error(err, "Invalid connection config", "server", connection.Hostname)
 		return nil, err
 	}
 
-	sc := soap.NewClient(url, connection.Insecure)
+	// The soap client's own thumbprint fallback redials without the client certificate
+	if connection.SOCKS5ProxyURL != "" || cert != nil {
+		dialer, err := connection.dialer()
+		if err != nil {
+			loggerFor(ctx).Error(err, "Invalid connection config", "server", connection.Hostname)
+			return nil, err
+		}
+		// The soap client dials TLS connections itself, bypassing DialContext
+		transport := sc.DefaultTransport()
+		transport.DialContext = dialer.DialContext
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			config := &tls.Config{}
+			if transport.TLSClientConfig != nil {
+				config = transport.TLSClientConfig.Clone()
+			}
+			if config.ServerName == "" {
+				config.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			return connection.dialTLS(ctx, dialer, addr, config)
+		}
+	}
 
-	if ca := connection.CACert; ca != "" {
-		if err := sc.SetRootCAs(ca); err != nil {
+	if connection.CACert != "" {
+		pool, err := connection.rootCAs()
+		if err != nil {
 			return nil, err
 		}
+		sc.DefaultTransport().TLSClientConfig.RootCAs = pool
+	}
+	if cert != nil {
+		sc.SetCertificate(*cert)
+	}
+	if thumbprintOnly {
+		// No certificate is signed by an empty pool, leaving the verification to the thumbprint
+		transport := sc.DefaultTransport()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
 	}
 
-	tpHost := connection.Hostname + ":" + connection.Port
-	sc.SetThumbprint(tpHost, connection.Thumbprint)
+	if connection.ServerName != "" {
+		transport := sc.DefaultTransport()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = connection.ServerName
+	}
+
+	sc.SetThumbprint(host, thumbprint)
+	if connection.ServerName != "" {
+		_, port, _ := net.SplitHostPort(host)
+		sc.SetThumbprint(net.JoinHostPort(connection.ServerName, port), thumbprint)
+	}
 
 	client, err := vim25.NewClient(ctx, sc)
 	if err != nil {
-		klog.Errorf("Failed to create new client. err: %+v", err)
+		loggerFor(ctx).Error(err, "Failed to create new client", "server", connection.Hostname)
 		return nil, err
 	}
-	client.UserAgent = userAgentName
-	err = connection.login(ctx, client)
+	client.RoundTripper = connection.newDebugRoundTripper(client.RoundTripper)
+
+	// Verify the instance before sending any credentials to it
+	if expected := connection.ExpectedInstanceUUID; expected != "" {
+		if actual := client.ServiceContent.About.InstanceUuid; !strings.EqualFold(actual, expected) {
+			loggerFor(ctx).Error(ErrUnexpectedVCenter, "Unexpected vCenter instance", "server", connection.Hostname, "instanceUUID", actual, "expectedInstanceUUID", expected)
+			return nil, fmt.Errorf("%w: got %q, expected %q", ErrUnexpectedVCenter, actual, expected)
+		}
+	}
+
+	if connection.KeepAliveInterval > 0 {
+		connection.startKeepAlive(client)
+	}
+
+	err = connection.loginWithCredentialsRefresh(ctx, client)
 	if err != nil {
+		loggerFor(ctx).Error(err, "Failed to login", "server", connection.Hostname)
+		connection.stopKeepAlive()
 		return nil, err
 	}
 
-	if connection.RoundTripperCount == 0 {
-		connection.RoundTripperCount = RoundTripperDefaultCount
+	if learned := peerThumbprint.Load(); learned != nil && connection.learnedThumbprint.CompareAndSwap(nil, learned) {
+		loggerFor(ctx).Info("Learned the vCenter thumbprint, configure it to keep verifying it after restarts", "server", connection.Hostname, "thumbprint", *learned)
 	}
-	client.RoundTripper = vim25.Retry(client.RoundTripper, vim25.TemporaryNetworkError(int(connection.RoundTripperCount)))
+
+	client.RoundTripper = connection.newCircuitBreakerRoundTripper(connection.newRetryRoundTripper(client.RoundTripper))
+	connection.sessionActive.Store(true)
+	recordSessionCreated(connection.Hostname)
+	recordConnect(connection.Hostname, false)
 	return client, nil
 }
 
-// UpdateCredentials updates username and password.
-// Note: Updated username and password will be used when there is no session active
-func (connection *VSphereConnection) UpdateCredentials(username string, password string) {
-	connection.credentialsLock.Lock()
+// thumbprint returns Thumbprint, or the learned thumbprint if it is blank.
+func (connection *VSphereConnection) thumbprint() string {
+	if connection.Thumbprint == "" && connection.LearnThumbprintOnFirstConnect {
+		if learned := connection.learnedThumbprint.Load(); learned != nil {
+			return *learned
+		}
+	}
+	return connection.Thumbprint
+}
+
+// ProbeTLS only performs the TLS handshake with vCenter, without logging in, and returns the
+// SHA-1 thumbprint of its certificate, e.g. for an operator to copy into the config.
+// The certificate is verified as by NewClient: it is trusted when Insecure is set, when it is
+// signed by CACert or the system roots, or when it matches Thumbprint.
+func (connection *VSphereConnection) ProbeTLS(ctx context.Context) (thumbprint string, err error) {
+	ctx, span := connection.startSpan(ctx, "ProbeTLS")
+	defer func() { endSpan(span, err) }()
+
+	u, err := connection.endpointURL(ctx)
+	if err != nil {
+		return "", err
+	}
+	host := hostPort(u)
+
+	config := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: connection.Insecure, // #nosec G402 the operator opted out of verification
+	}
+	if connection.ServerName != "" {
+		config.ServerName = connection.ServerName
+	}
+	if connection.CACert != "" {
+		if config.RootCAs, err = connection.rootCAs(); err != nil {
+			return "", err
+		}
+	}
+	if cert, err := connection.clientTLSCertificate(); err != nil {
+		return "", err
+	} else if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	dialer, err := connection.dialer()
+	if err != nil {
+		return "", err
+	}
+	if connection.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connection.ConnectTimeout)
+		defer cancel()
+	}
+	conn, err := connection.dialTLS(ctx, dialer, host, config)
+	if err != nil {
+		loggerFor(ctx).Error(err, "TLS probe failed", "server", connection.Hostname)
+		return "", err
+	}
+	defer conn.Close()
+	return soap.ThumbprintSHA1(conn.ConnectionState().PeerCertificates[0]), nil
+}
+
+// clientTLSCertificate returns the certificate of ClientTLSCert and ClientTLSKey, or nil if
+// they are not set.
+func (connection *VSphereConnection) clientTLSCertificate() (*tls.Certificate, error) {
+	if connection.ClientTLSCert == "" && connection.ClientTLSKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(connection.ClientTLSCert), []byte(connection.ClientTLSKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid TLS client certificate: %v", ErrInvalidConnectionConfig, err)
+	}
+	return &cert, nil
+}
+
+// dialTLS connects to host with dialer and performs the TLS handshake with config.
+// Like the soap client, an otherwise untrusted certificate is trusted if it matches Thumbprint.
+func (connection *VSphereConnection) dialTLS(ctx context.Context, dialer proxy.ContextDialer, host string, config *tls.Config) (*tls.Conn, error) {
+	thumbprint := connection.thumbprint()
+	conn, err := handshake(ctx, dialer, host, config)
+	if err == nil || thumbprint == "" || !soap.IsCertificateUntrusted(err) {
+		return conn, err
+	}
+
+	config = config.Clone()
+	config.InsecureSkipVerify = true // #nosec G402 verified by thumbprint below
+	if conn, err = handshake(ctx, dialer, host, config); err != nil {
+		return nil, err
+	}
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if thumbprint != soap.ThumbprintSHA1(cert) && thumbprint != soap.ThumbprintSHA256(cert) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: got %s", ErrThumbprintMismatch, soap.ThumbprintSHA1(cert))
+	}
+	return conn, nil
+}
+
+// handshake connects to host with dialer and performs the TLS handshake with config.
+func handshake(ctx context.Context, dialer proxy.ContextDialer, host string, config *tls.Config) (*tls.Conn, error) {
+	rawConn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialer returns the dialer connecting to vCenter, through the SOCKS5 proxy if one is configured.
+func (connection *VSphereConnection) dialer() (proxy.ContextDialer, error) {
+	if connection.SOCKS5ProxyURL != "" {
+		return connection.socks5Dialer()
+	}
+	return &net.Dialer{Timeout: connection.ConnectTimeout}, nil
+}
+
+// socks5Dialer returns a dialer connecting through the SOCKS5 proxy at SOCKS5ProxyURL.
+func (connection *VSphereConnection) socks5Dialer() (proxy.ContextDialer, error) {
+	u, err := neturl.Parse(connection.SOCKS5ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid SOCKS5 proxy URL", ErrInvalidConnectionConfig)
+	}
+	if (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+		return nil, fmt.Errorf("%w: invalid SOCKS5 proxy URL %q", ErrInvalidConnectionConfig, u.Redacted())
+	}
+	dialer, err := proxy.FromURL(u, &net.Dialer{Timeout: connection.ConnectTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConnectionConfig, err)
+	}
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// serverURL validates URL, or Hostname and Port, and returns the URL of the vCenter SDK
+// endpoint to connect to.
+func (connection *VSphereConnection) serverURL() (*neturl.URL, error) {
+	if connection.URL == "" {
+		host, err := connection.serverAddress()
+		if err != nil {
+			return nil, err
+		}
+		return soap.ParseURL(host)
+	}
+
+	u, err := soap.ParseURL(connection.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid URL: %v", ErrInvalidConnectionConfig, err)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: URL %q must be an https URL with a host", ErrInvalidConnectionConfig, u.Redacted())
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidConnectionConfig, port)
+		}
+	}
+	return u, nil
+}
+
+// endpointURL returns the URL of the vCenter SDK endpoint to connect to, as serverURL, with
+// the host and port looked up in the SRV record of Hostname when UseSRVLookup is set.
+func (connection *VSphereConnection) endpointURL(ctx context.Context) (*neturl.URL, error) {
+	u, err := connection.serverURL()
+	if err != nil || !connection.UseSRVLookup || connection.URL != "" || connection.Port != "" {
+		return u, err
+	}
+
+	resolver := connection.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, addrs, err := resolver.LookupSRV(ctx, "vsphere", "tcp", connection.Hostname)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound || err == nil && len(addrs) == 0 {
+		loggerFor(ctx).V(4).Info("No SRV record found, using the default port", "server", connection.Hostname)
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the SRV record of %s: %w", connection.Hostname, err)
+	}
+	// Records are sorted by priority and randomized by weight
+	target := strings.TrimSuffix(addrs[0].Target, ".")
+	u.Host = net.JoinHostPort(target, strconv.Itoa(int(addrs[0].Port)))
+	loggerFor(ctx).V(4).Info("Found SRV record", "server", connection.Hostname, "host", u.Host)
+	return u, nil
+}
+
+// hostPort returns the host:port of u, using DefaultPort when u has no port.
+func hostPort(u *neturl.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	return u.Host
+}
+
+// serverAddress validates Hostname and Port and returns the host:port to connect to,
+// using DefaultPort when Port is blank.
+func (connection *VSphereConnection) serverAddress() (string, error) {
+	if connection.Hostname == "" {
+		return "", fmt.Errorf("%w: hostname is empty", ErrInvalidConnectionConfig)
+	}
+	port := connection.Port
+	if port == "" {
+		port = DefaultPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("%w: invalid port %q", ErrInvalidConnectionConfig, port)
+	}
+	return net.JoinHostPort(connection.Hostname, port), nil
+}
+
+// userAgent returns the user agent of the connection's client, suffixed with the build version.
+func (connection *VSphereConnection) userAgent() string {
+	return connection.userAgentName() + "/" + version.Get().GitVersion
+}
+
+// userAgentName returns the user agent of the connection's client without the build version.
+func (connection *VSphereConnection) userAgentName() string {
+	if connection.UserAgent != "" {
+		return connection.UserAgent
+	}
+	return userAgentName
+}
+
+// UpdateCredentials updates username, password and the client certificate and private key.
+// Note: Updated credentials will be used when there is no session active
+// If the credentials lock is not acquired within CredentialsLockTimeout, the credentials are
+// left unchanged and an error wrapping ErrCredentialsLockTimeout is returned, so that the
+// caller can retry rather than block.
+func (connection *VSphereConnection) UpdateCredentials(username, password, clientCertPEM, clientKeyPEM string) error {
+	if err := connection.lockCredentials(); err != nil {
+		return err
+	}
 	defer connection.credentialsLock.Unlock()
 	connection.Username = username
 	connection.Password = password
+	connection.ClientCertPEM = clientCertPEM
+	connection.ClientKeyPEM = clientKeyPEM
+	return nil
+}
+
+// UpdateBearerToken updates the bearer token, which takes precedence over the other credentials
+// when not empty. Like UpdateCredentials, the token is used when there is no session active,
+// and it is left unchanged with an error returned if the credentials lock is not acquired
+// within CredentialsLockTimeout.
+func (connection *VSphereConnection) UpdateBearerToken(token string) error {
+	if err := connection.lockCredentials(); err != nil {
+		return err
+	}
+	defer connection.credentialsLock.Unlock()
+	connection.BearerToken = token
+	return nil
+}
+
+// UpdateAll replaces the username, password, bearer token and session manager of the connection under a single
+// acquisition of the credentials lock, so that a concurrent login sees either the old or the new
+// credentials, never a mix. The client certificate and private key are only replaced when
+// credentials sets both, as callers such as a Secret may not hold them. Like UpdateCredentials,
+// an error wrapping ErrCredentialsLockTimeout is returned when the lock is not acquired.
+func (connection *VSphereConnection) UpdateAll(credentials Credentials) error {
+	if err := connection.lockCredentials(); err != nil {
+		return err
+	}
+	defer connection.credentialsLock.Unlock()
+	connection.Username = credentials.Username
+	connection.Password = credentials.Password
+	connection.BearerToken = credentials.BearerToken
+	connection.SessionManagerURL = credentials.SessionManagerURL
+	connection.SessionManagerToken = credentials.SessionManagerToken
+	if credentials.ClientCertPEM != "" && credentials.ClientKeyPEM != "" {
+		connection.ClientCertPEM = credentials.ClientCertPEM
+		connection.ClientKeyPEM = credentials.ClientKeyPEM
+	}
+	return nil
+}
+
+// lockCredentials locks credentialsLock, or returns an error wrapping ErrCredentialsLockTimeout
+// if it is still locked after CredentialsLockTimeout.
+func (connection *VSphereConnection) lockCredentials() error {
+	timeout := connection.CredentialsLockTimeout
+	if timeout == 0 {
+		timeout = DefaultCredentialsLockTimeout
+	}
+	if !connection.credentialsLock.lockTimeout(timeout) {
+		return fmt.Errorf("%w: server %s, after %v", ErrCredentialsLockTimeout, connection.Hostname, timeout)
+	}
+	return nil
+}
+
+// Clone returns a connection to the same vCenter with the same settings and credentials, but
+// without its client, so that the clone logs in a session of its own. ShareSession is cleared
+// for the same reason.
+func (connection *VSphereConnection) Clone() *VSphereConnection {
+	connection.credentialsLock.Lock()
+	defer connection.credentialsLock.Unlock()
+	// The exported settings and credentials are copied as they are. The struct is not copied as
+	// a whole, its locks and atomics must not be copied, so the unexported session state, e.g.
+	// the signer, keep-alive and circuit breaker, starts out empty.
+	clone := &VSphereConnection{}
+	src, dst := reflect.ValueOf(connection).Elem(), reflect.ValueOf(clone).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	clone.Client = nil
+	clone.ShareSession = false
+	return clone
 }
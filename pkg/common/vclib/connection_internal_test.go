@@ -0,0 +1,294 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+func TestUpdateCredentials_LockTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	connection := &VSphereConnection{
+		Username:               "old-user",
+		Password:               "old-pass",
+		BearerToken:            "old-token",
+		CredentialsLockTimeout: timeout,
+	}
+
+	// Login only holds the lock between network calls, so hold it directly as a stuck holder would
+	connection.credentialsLock.Lock()
+	done := make(chan time.Duration)
+	var credentialsErr, tokenErr error
+	go func() {
+		start := time.Now()
+		credentialsErr = connection.UpdateCredentials("new-user", "new-pass", "", "")
+		tokenErr = connection.UpdateBearerToken("new-token")
+		done <- time.Since(start)
+	}()
+	select {
+	case elapsed := <-done:
+		if elapsed < 2*timeout {
+			t.Errorf("Expected both updates to wait for the timeout, returned after %v", elapsed)
+		}
+		if !errors.Is(credentialsErr, ErrCredentialsLockTimeout) || !errors.Is(tokenErr, ErrCredentialsLockTimeout) {
+			t.Errorf("Expected both updates to return %v, got %v and %v", ErrCredentialsLockTimeout, credentialsErr, tokenErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the updates to time out")
+	}
+	connection.credentialsLock.Unlock()
+	if connection.Username != "old-user" || connection.Password != "old-pass" || connection.BearerToken != "old-token" {
+		t.Errorf("Expected the timed out updates to be dropped, got %q, %q, %q",
+			connection.Username, connection.Password, connection.BearerToken)
+	}
+
+	if err := connection.UpdateCredentials("new-user", "new-pass", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.UpdateBearerToken("new-token"); err != nil {
+		t.Fatal(err)
+	}
+	if connection.Username != "new-user" || connection.Password != "new-pass" || connection.BearerToken != "new-token" {
+		t.Errorf("Expected the credentials to be updated once unlocked, got %q, %q, %q",
+			connection.Username, connection.Password, connection.BearerToken)
+	}
+}
+
+func TestUpdateAll(t *testing.T) {
+	connection := &VSphereConnection{
+		Username:      "old-user",
+		Password:      "old-pass",
+		BearerToken:   "old-token",
+		ClientCertPEM: "old-cert",
+		ClientKeyPEM:  "old-key",
+	}
+
+	if err := connection.UpdateAll(Credentials{Username: "new-user", Password: "new-pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if connection.Username != "new-user" || connection.Password != "new-pass" || connection.BearerToken != "" {
+		t.Errorf("Expected the credentials to be replaced, got %q, %q, %q",
+			connection.Username, connection.Password, connection.BearerToken)
+	}
+	if connection.ClientCertPEM != "old-cert" || connection.ClientKeyPEM != "old-key" {
+		t.Errorf("Expected the client certificate and key to be kept, got %q, %q",
+			connection.ClientCertPEM, connection.ClientKeyPEM)
+	}
+
+	if err := connection.UpdateAll(Credentials{BearerToken: "new-token", ClientCertPEM: "new-cert", ClientKeyPEM: "new-key"}); err != nil {
+		t.Fatal(err)
+	}
+	if connection.BearerToken != "new-token" || connection.ClientCertPEM != "new-cert" || connection.ClientKeyPEM != "new-key" {
+		t.Errorf("Expected the token, client certificate and key to be replaced, got %q, %q, %q",
+			connection.BearerToken, connection.ClientCertPEM, connection.ClientKeyPEM)
+	}
+
+	connection.CredentialsLockTimeout = 10 * time.Millisecond
+	connection.credentialsLock.Lock()
+	err := connection.UpdateAll(Credentials{Username: "other-user"})
+	connection.credentialsLock.Unlock()
+	if !errors.Is(err, ErrCredentialsLockTimeout) {
+		t.Errorf("Expected %v, got %v", ErrCredentialsLockTimeout, err)
+	}
+	if connection.Username != "" {
+		t.Errorf("Expected the timed out update to leave the credentials unchanged, got %q", connection.Username)
+	}
+}
+
+func TestConnect_ConnectDeadlineWaitingForOtherConnects(t *testing.T) {
+	const deadline = 50 * time.Millisecond
+	connection := &VSphereConnection{Hostname: "vc.example.com", ConnectDeadline: deadline}
+
+	// another connect holding the lock
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	start := time.Now()
+	err := connection.Connect(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*deadline {
+		t.Errorf("Expected Connect to stop waiting at the deadline, returned after %v", elapsed)
+	}
+	if _, err := connection.ClientOrConnect(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestTimeoutMutex(t *testing.T) {
+	var m timeoutMutex
+	if !m.lockTimeout(time.Millisecond) {
+		t.Fatal("Expected the zero value to be unlocked")
+	}
+	if m.lockTimeout(10 * time.Millisecond) {
+		t.Fatal("Expected locking a locked mutex to time out")
+	}
+	m.Unlock()
+	m.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.lockContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected locking a locked mutex to stop at the deadline, got %v", err)
+	}
+	m.Unlock()
+	if err := m.lockContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.Unlock()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected unlocking an unlocked mutex to panic")
+		}
+	}()
+	m.Unlock()
+}
+
+// lockProbe records whether clientLock was held during each round trip
+type lockProbe struct {
+	soap.RoundTripper
+	held []bool
+}
+
+func (p *lockProbe) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	locked := clientLock.lockTimeout(time.Millisecond)
+	if locked {
+		clientLock.Unlock()
+	}
+	p.held = append(p.held, !locked)
+	return p.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+func TestGetDatacenter_LookupWithoutClientLock(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	ctx := context.Background()
+	connection := &VSphereConnection{
+		Hostname:   s.URL.Hostname(),
+		Port:       s.URL.Port(),
+		Insecure:   true,
+		Username:   "user",
+		Password:   "pass",
+		Datacenter: "DC0",
+	}
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Logout(ctx)
+	probe := &lockProbe{RoundTripper: connection.Client.RoundTripper}
+	connection.Client.RoundTripper = probe
+
+	if _, err := connection.GetDatacenter(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(probe.held) == 0 || probe.held[len(probe.held)-1] {
+		t.Errorf("Expected the datacenter to be looked up without holding clientLock, held during round trips: %v", probe.held)
+	}
+}
+
+// cloneResetFields are the exported fields Clone deliberately does not copy
+var cloneResetFields = map[string]bool{"Client": true, "ShareSession": true}
+
+// nonZeroValue returns a non-zero value of typ for TestClone_CopiesAllSettings
+func nonZeroValue(t *testing.T, name string, typ reflect.Type) reflect.Value {
+	v := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.String:
+		v.SetString(name)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(7)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(7)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Ptr:
+		v.Set(reflect.New(typ.Elem()))
+	case reflect.Func:
+		v.Set(reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+			results := make([]reflect.Value, typ.NumOut())
+			for i := range results {
+				results[i] = reflect.Zero(typ.Out(i))
+			}
+			return results
+		}))
+	case reflect.Interface:
+		if !reflect.TypeOf(net.DefaultResolver).Implements(typ) {
+			t.Fatalf("No test value for field %s of type %s, add one to nonZeroValue", name, typ)
+		}
+		v.Set(reflect.ValueOf(net.DefaultResolver))
+	default:
+		t.Fatalf("No test value for field %s of type %s, add one to nonZeroValue", name, typ)
+	}
+	return v
+}
+
+func TestClone_CopiesAllSettings(t *testing.T) {
+	connection := &VSphereConnection{}
+	src := reflect.ValueOf(connection).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		if field.IsExported() {
+			src.Field(i).Set(nonZeroValue(t, field.Name, field.Type))
+		}
+	}
+	// session state, which is not cloned
+	connection.signer = &sts.Signer{}
+	connection.datacenter = &Datacenter{}
+	connection.staleSessionsTerminated = true
+	connection.lastError = errors.New("login failed")
+	connection.lastConnected = time.Now()
+	connection.breaker = &circuitBreaker{}
+	connection.healthy.Store(true)
+	connection.sessionActive.Store(true)
+
+	clone := connection.Clone()
+	dst := reflect.ValueOf(clone).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		switch {
+		case !field.IsExported() || cloneResetFields[field.Name]:
+			if !dst.Field(i).IsZero() {
+				t.Errorf("Expected %s not to be cloned", field.Name)
+			}
+		case field.Type.Kind() == reflect.Func:
+			if dst.Field(i).Pointer() != src.Field(i).Pointer() {
+				t.Errorf("Expected %s to be cloned", field.Name)
+			}
+		case !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()):
+			t.Errorf("Expected %s to be cloned, got %v instead of %v", field.Name, dst.Field(i), src.Field(i))
+		}
+	}
+}
@@ -18,18 +18,49 @@ package vclib_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-logr/logr/funcr"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	_ "github.com/vmware/govmomi/lookup/simulator"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	_ "github.com/vmware/govmomi/sts/simulator"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/version"
+	"k8s.io/klog/v2/klogr"
 
 	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
 	"k8s.io/cloud-provider-vsphere/pkg/common/vclib/fixtures"
@@ -100,6 +131,62 @@ func TestWithValidCaCert(t *testing.T) {
 	verifyConnectionWasMade()
 }
 
+func TestWithInlineCaCert(t *testing.T) {
+	handler, verifyConnectionWasMade := getRequestVerifier(t)
+
+	server, _ := createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, handler)
+	server.StartTLS()
+	u := mustParseUrl(t, server.URL)
+
+	caCertPEM, err := os.ReadFile(fixtures.CaCertPath)
+	if err != nil {
+		t.Fatalf("Could not read ca cert from file")
+	}
+	connection := &vclib.VSphereConnection{
+		Hostname: u.Hostname(),
+		Port:     u.Port(),
+		CACert:   string(caCertPEM),
+	}
+
+	// Ignoring error here, because we only care about the TLS connection
+	connection.NewClient(context.Background())
+
+	verifyConnectionWasMade()
+}
+
+func TestWithFileURLCaCert(t *testing.T) {
+	handler, verifyConnectionWasMade := getRequestVerifier(t)
+
+	server, _ := createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, handler)
+	server.StartTLS()
+	u := mustParseUrl(t, server.URL)
+
+	connection := &vclib.VSphereConnection{
+		Hostname: u.Hostname(),
+		Port:     u.Port(),
+		CACert:   "file://" + fixtures.CaCertPath,
+	}
+
+	// Ignoring error here, because we only care about the TLS connection
+	connection.NewClient(context.Background())
+
+	verifyConnectionWasMade()
+}
+
+func TestWithInvalidInlineCaCert(t *testing.T) {
+	connection := &vclib.VSphereConnection{
+		Hostname: "should-not-matter",
+		Port:     "27015", // doesn't matter, but has to be a valid port
+		CACert:   "-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n",
+	}
+
+	_, err := connection.NewClient(context.Background())
+
+	if msg := err.Error(); !strings.Contains(msg, "invalid certificate") {
+		t.Fatalf("Expected invalid certificate error, got '%s'", msg)
+	}
+}
+
 func TestWithVerificationWithWrongThumbprint(t *testing.T) {
 	handler, _ := getRequestVerifier(t)
 
@@ -157,6 +244,309 @@ func TestWithValidThumbprint(t *testing.T) {
 	verifyConnectionWasMade()
 }
 
+func TestLearnThumbprintOnFirstConnect(t *testing.T) {
+	s := newTestVCSim(t)
+
+	// A simulator serving another certificate, as after a certificate change
+	serverCert, err := tls.LoadX509KeyPair(fixtures.ServerCertPath, fixtures.ServerKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	changed := model.Service.NewServer()
+	defer changed.Close()
+
+	connection := &vclib.VSphereConnection{
+		Hostname:                      s.URL.Hostname(),
+		Port:                          s.URL.Port(),
+		Username:                      "user",
+		Password:                      "pass",
+		Insecure:                      true,
+		LearnThumbprintOnFirstConnect: true,
+	}
+	ctx := context.Background()
+
+	var logged []string
+	vclib.SetLogger(funcr.New(func(prefix, args string) { logged = append(logged, args) }, funcr.Options{}))
+	defer vclib.SetLogger(klogr.New().WithName("vclib"))
+
+	client, err := connection.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = session.NewManager(client).Logout(ctx)
+
+	thumbprint, err := connection.ProbeTLS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := strings.Join(logged, "\n"); !strings.Contains(output, "Learned the vCenter thumbprint") || !strings.Contains(output, thumbprint) {
+		t.Errorf("Expected the learned thumbprint %s to be logged, got: %v", thumbprint, logged)
+	}
+
+	// The learned thumbprint is enforced although Insecure is set
+	client, err = connection.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("Expected the certificate matching the learned thumbprint to be trusted: %v", err)
+	}
+	_ = session.NewManager(client).Logout(ctx)
+
+	connection.Hostname = changed.URL.Hostname()
+	connection.Port = changed.URL.Port()
+	if _, err := connection.NewClient(ctx); err == nil || !strings.Contains(err.Error(), "thumbprint does not match") {
+		t.Errorf("Expected the changed certificate to fail verification, got: %v", err)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	const fqdn = "vcenter.example.com"
+	cert, certPEM := newTestCertificate(t, fqdn)
+
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	tests := []struct {
+		name       string
+		serverName string
+		caCert     string
+		thumbprint string
+		expectErr  bool
+	}{
+		{
+			name:      "IP without server name",
+			caCert:    certPEM,
+			expectErr: true,
+		},
+		{
+			name:       "IP with server name",
+			serverName: fqdn,
+			caCert:     certPEM,
+		},
+		{
+			name:       "IP with another server name",
+			serverName: "other.example.com",
+			caCert:     certPEM,
+			expectErr:  true,
+		},
+		{
+			name:       "IP with server name and thumbprint",
+			serverName: fqdn,
+			thumbprint: soap.ThumbprintSHA1(cert.Leaf),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := &vclib.VSphereConnection{
+				Hostname:   s.URL.Hostname(),
+				Port:       s.URL.Port(),
+				ServerName: test.serverName,
+				CACert:     test.caCert,
+				Thumbprint: test.thumbprint,
+				Username:   "user",
+				Password:   "pass",
+			}
+
+			client, err := connection.NewClient(context.Background())
+			if test.expectErr {
+				if err == nil {
+					t.Error("Expected the certificate verification to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = session.NewManager(client).Logout(context.Background())
+		})
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for dnsName only, and its PEM encoding.
+func newTestCertificate(t *testing.T, dnsName string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, string(certPEM)
+}
+
+func TestNewClientWithTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name             string
+		policy           vclib.TLSPolicy
+		caCert           string
+		thumbprint       string
+		insecure         bool
+		expectConnection bool
+		expectFallback   bool
+		expectConfigErr  bool
+	}{
+		{
+			name:       "strict ignores insecure",
+			policy:     vclib.TLSPolicyStrict,
+			thumbprint: "obviously wrong",
+			insecure:   true,
+		},
+		{
+			name:             "strict trusts the CA certificate",
+			policy:           vclib.TLSPolicyStrict,
+			caCert:           fixtures.CaCertPath,
+			expectConnection: true,
+		},
+		{
+			name:            "thumbprint only requires a thumbprint",
+			policy:          vclib.TLSPolicyThumbprintOnly,
+			caCert:          fixtures.CaCertPath,
+			expectConfigErr: true,
+		},
+		{
+			name:       "thumbprint only ignores the CA certificate",
+			policy:     vclib.TLSPolicyThumbprintOnly,
+			caCert:     fixtures.CaCertPath,
+			thumbprint: "obviously wrong",
+		},
+		{
+			name:             "thumbprint only trusts the thumbprint",
+			policy:           vclib.TLSPolicyThumbprintOnly,
+			thumbprint:       "valid",
+			expectConnection: true,
+		},
+		{
+			name:             "insecure fallback on a mismatched certificate",
+			policy:           vclib.TLSPolicyInsecureFallbackWithWarning,
+			thumbprint:       "obviously wrong",
+			expectConnection: true,
+			expectFallback:   true,
+		},
+		{
+			name:             "no insecure fallback on a trusted certificate",
+			policy:           vclib.TLSPolicyInsecureFallbackWithWarning,
+			caCert:           fixtures.CaCertPath,
+			expectConnection: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotRequest atomic.Bool
+			handler := func(w http.ResponseWriter, r *http.Request) { gotRequest.Store(true) }
+			server, thumbprint := createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, handler)
+			server.StartTLS()
+			defer server.Close()
+			u := mustParseUrl(t, server.URL)
+			fallbacks := insecureFallbacks(t, u.Hostname())
+
+			connection := &vclib.VSphereConnection{
+				Hostname:   u.Hostname(),
+				Port:       u.Port(),
+				CACert:     test.caCert,
+				Thumbprint: test.thumbprint,
+				Insecure:   test.insecure,
+			}
+			if test.thumbprint == "valid" {
+				connection.Thumbprint = thumbprint
+			}
+
+			// Ignoring other errors here, because we only care about the TLS connection
+			_, err := connection.NewClientWithTLSPolicy(context.Background(), test.policy)
+			if errors.Is(err, vclib.ErrInvalidConnectionConfig) != test.expectConfigErr {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if gotRequest.Load() != test.expectConnection {
+				t.Errorf("Expected TLS connection to be established: %t, got error: %v", test.expectConnection, err)
+			}
+			expectedFallbacks := 0.0
+			if test.expectFallback {
+				expectedFallbacks = 1
+			}
+			if got := insecureFallbacks(t, u.Hostname()) - fallbacks; got != expectedFallbacks {
+				t.Errorf("Expected %v insecure fallbacks to be recorded, got %v", expectedFallbacks, got)
+			}
+		})
+	}
+}
+
+// insecureFallbacks returns the insecure fallbacks metric for server.
+func insecureFallbacks(t *testing.T, server string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "cloudprovider_vsphere_tls_insecure_fallbacks_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "server" && label.GetValue() == server {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestWithValidThumbprintIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+
+	handler, verifyConnectionWasMade := getRequestVerifier(t)
+
+	server, thumbprint :=
+		createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.StartTLS()
+	u := mustParseUrl(t, server.URL)
+
+	// The thumbprint is only found when registered under "[::1]:port"
+	connection := &vclib.VSphereConnection{
+		Hostname:   u.Hostname(),
+		Port:       u.Port(),
+		Thumbprint: thumbprint,
+	}
+
+	// Ignoring error here, because we only care about the TLS connection
+	connection.NewClient(context.Background())
+
+	verifyConnectionWasMade()
+}
+
 func TestWithInvalidCaCertPath(t *testing.T) {
 	connection := &vclib.VSphereConnection{
 		Hostname: "should-not-matter",
@@ -184,6 +574,2113 @@ func TestInvalidCaCert(t *testing.T) {
 	}
 }
 
+func TestProbeTLS(t *testing.T) {
+	handler, _ := getRequestVerifier(t)
+	server, sha256Thumbprint := createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, handler)
+	server.StartTLS()
+	defer server.Close()
+	u := mustParseUrl(t, server.URL)
+
+	cert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha1Thumbprint := soap.ThumbprintSHA1(cert)
+
+	testCases := []struct {
+		name        string
+		connection  *vclib.VSphereConnection
+		expectedErr error
+		untrusted   bool
+	}{
+		{
+			name:       "when the certificate is signed by CACert",
+			connection: &vclib.VSphereConnection{CACert: fixtures.CaCertPath},
+		},
+		{
+			name:       "when the connection is insecure",
+			connection: &vclib.VSphereConnection{Insecure: true},
+		},
+		{
+			name:       "when the SHA-256 thumbprint matches",
+			connection: &vclib.VSphereConnection{Thumbprint: sha256Thumbprint},
+		},
+		{
+			name:       "when the SHA-1 thumbprint matches",
+			connection: &vclib.VSphereConnection{Thumbprint: sha1Thumbprint},
+		},
+		{
+			name:        "when the thumbprint does not match",
+			connection:  &vclib.VSphereConnection{Thumbprint: "obviously wrong"},
+			expectedErr: vclib.ErrThumbprintMismatch,
+		},
+		{
+			name:       "when the certificate is not trusted",
+			connection: &vclib.VSphereConnection{},
+			untrusted:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			connection := testCase.connection
+			connection.Hostname = u.Hostname()
+			connection.Port = u.Port()
+			connection.ConnectTimeout = 5 * time.Second
+
+			thumbprint, err := connection.ProbeTLS(context.Background())
+			switch {
+			case testCase.expectedErr != nil:
+				if !errors.Is(err, testCase.expectedErr) {
+					t.Fatalf("Expected %v, got %v", testCase.expectedErr, err)
+				}
+			case testCase.untrusted:
+				if !soap.IsCertificateUntrusted(err) {
+					t.Fatalf("Expected an untrusted certificate error, got %v", err)
+				}
+			case err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			case thumbprint != sha1Thumbprint:
+				t.Fatalf("Expected thumbprint %s, got %s", sha1Thumbprint, thumbprint)
+			}
+		})
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	// fail the first couple of requests before handing over to the simulator
+	failures := int32(2)
+	flaky := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "vCenter unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	u := mustParseUrl(t, flaky.URL)
+
+	backoff := wait.Backoff{Duration: 10 * time.Millisecond, Factor: 2, Jitter: 0.1, Steps: 5}
+
+	t.Run("retry then succeed", func(t *testing.T) {
+		connection := &vclib.VSphereConnection{
+			Hostname: u.Hostname(),
+			Port:     u.Port(),
+			Insecure: true,
+			Username: "user",
+			Password: "pass",
+		}
+		if err := connection.ConnectWithRetry(context.Background(), backoff); err != nil {
+			t.Fatalf("Expected connect to succeed after retries, got: %v", err)
+		}
+		if connection.Client == nil {
+			t.Fatal("Expected client to be set")
+		}
+		if atomic.LoadInt32(&failures) >= 0 {
+			t.Fatal("Expected failed attempts to be retried")
+		}
+	})
+
+	t.Run("fail fast on invalid credentials", func(t *testing.T) {
+		connection := &vclib.VSphereConnection{
+			Hostname: u.Hostname(),
+			Port:     u.Port(),
+			Insecure: true,
+			Username: "user",
+			Password: "wrong",
+		}
+		slow := wait.Backoff{Duration: time.Minute, Factor: 2, Steps: 5}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		err := connection.ConnectWithRetry(ctx, slow)
+		if !vclib.IsInvalidCredentialsError(err) {
+			t.Fatalf("Expected invalid credentials error, got: %v", err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Expected invalid credentials not to be retried")
+		}
+	})
+}
+
+func TestConnectRenewsToken(t *testing.T) {
+	s := newTestVCSim(t)
+
+	cert, err := os.ReadFile(fixtures.ServerCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile(fixtures.ServerKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: string(cert),
+		Password: string(key),
+	}
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expires := connection.TokenExpiry()
+	if expires.IsZero() {
+		t.Fatal("Expected SAML token expiry to be recorded")
+	}
+
+	// the simulated STS issues tokens valid for 5 minutes, far from the default margin
+	time.Sleep(10 * time.Millisecond)
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !connection.TokenExpiry().Equal(expires) {
+		t.Fatal("Expected SAML token not to be renewed")
+	}
+
+	connection.TokenRenewalMargin = 10 * time.Minute
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !connection.TokenExpiry().After(expires) {
+		t.Fatalf("Expected SAML token to be renewed, expiry %s is not after %s", connection.TokenExpiry(), expires)
+	}
+}
+
+func TestConnectWithExpectedInstanceUUID(t *testing.T) {
+	s := newTestVCSim(t)
+
+	newConnection := func(instanceUUID string) *vclib.VSphereConnection {
+		return &vclib.VSphereConnection{
+			Hostname:             s.URL.Hostname(),
+			Port:                 s.URL.Port(),
+			Insecure:             true,
+			Username:             "user",
+			Password:             "pass",
+			ExpectedInstanceUUID: instanceUUID,
+		}
+	}
+
+	connection := newConnection("")
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	instanceUUID := connection.Client.ServiceContent.About.InstanceUuid
+
+	if err := newConnection(strings.ToUpper(instanceUUID)).Connect(context.Background()); err != nil {
+		t.Fatalf("Expected matching instance UUID to connect, got: %v", err)
+	}
+
+	err := newConnection("2c4cb7d4-7a41-4a4c-9a27-1b1f0e4f5e0d").Connect(context.Background())
+	if !errors.Is(err, vclib.ErrUnexpectedVCenter) {
+		t.Fatalf("Expected ErrUnexpectedVCenter, got: %v", err)
+	}
+}
+
+func TestConnectWithKeepAlive(t *testing.T) {
+	idleTimeout := simulator.SessionIdleTimeout
+	simulator.SessionIdleTimeout = 250 * time.Millisecond
+	defer func() { simulator.SessionIdleTimeout = idleTimeout }()
+
+	s := newTestVCSim(t)
+	connection := &vclib.VSphereConnection{
+		Hostname:          s.URL.Hostname(),
+		Port:              s.URL.Port(),
+		Insecure:          true,
+		Username:          "user",
+		Password:          "pass",
+		KeepAliveInterval: 50 * time.Millisecond,
+	}
+	ctx := context.Background()
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m := session.NewManager(connection.Client)
+
+	time.Sleep(4 * simulator.SessionIdleTimeout)
+	userSession, err := m.UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userSession == nil {
+		t.Fatal("Expected session to be kept alive past the idle timeout")
+	}
+
+	// The keep-alive must not log in again after Logout
+	connection.Logout(ctx)
+	time.Sleep(4 * simulator.SessionIdleTimeout)
+	userSession, err = m.UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userSession != nil {
+		t.Fatal("Expected no session after Logout")
+	}
+}
+
+func TestWithCredentials(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Logout(ctx)
+	client := connection.Client
+	primary, err := session.NewManager(client).UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := connection.WithCredentials(ctx, vclib.Credentials{}); err == nil {
+		t.Error("Expected WithCredentials to fail without credentials")
+	}
+
+	overrideClient, cleanup, err := connection.WithCredentials(ctx, vclib.Credentials{Username: "service-account", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := session.NewManager(overrideClient)
+	override, err := m.UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if override.UserName != "service-account" {
+		t.Errorf("Expected a session of service-account, got one of %s", override.UserName)
+	}
+	if override.Key == primary.Key {
+		t.Error("Expected a session other than the one of the connection")
+	}
+
+	cleanup()
+	cleanup()
+	if userSession, err := m.UserSession(ctx); err != nil || userSession != nil {
+		t.Errorf("Expected the session to be logged out by the cleanup: %v", err)
+	}
+
+	if connection.Client != client {
+		t.Error("Expected the client of the connection to be left untouched")
+	}
+	userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userSession == nil || userSession.Key != primary.Key || userSession.UserName != "user" {
+		t.Errorf("Expected the session of the connection to be left untouched, got: %+v", userSession)
+	}
+}
+
+func TestStartSessionValidation(t *testing.T) {
+	s := newTestVCSim(t)
+	connection := &vclib.VSphereConnection{
+		Hostname:             s.URL.Hostname(),
+		Port:                 s.URL.Port(),
+		Insecure:             true,
+		Username:             "user",
+		Password:             "pass",
+		SessionCheckInterval: 50 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if connection.Healthy() {
+		t.Fatal("Expected the connection not to be healthy before connecting")
+	}
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !connection.Healthy() {
+		t.Fatal("Expected the connection to be healthy after connecting")
+	}
+	connected := connection.LastConnectedTime()
+	client := connection.Client
+	connection.StartSessionValidation(ctx)
+
+	// Drop the session behind the back of the connection
+	if err := session.NewManager(client).Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return connection.LastConnectedTime().After(connected) && connection.Healthy(), nil
+	})
+	if err != nil {
+		t.Fatal("Expected the connection to connect again after the session was dropped")
+	}
+
+	// Dropped again, without credentials to connect again
+	client, err = connection.ClientOrConnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection.UpdateCredentials("", "", "", "")
+	if err := session.NewManager(client).Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return !connection.Healthy(), nil
+	})
+	if err != nil {
+		t.Fatal("Expected the connection not to be healthy after failing to connect again")
+	}
+}
+
+func TestConnectionGetDatacenter(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	if _, err := connection.GetDatacenter(ctx); !errors.Is(err, vclib.ErrNoDatacenterConfigured) {
+		t.Fatalf("Expected ErrNoDatacenterConfigured, got: %v", err)
+	}
+
+	connection.Datacenter = vclib.TestDefaultDatacenter
+	dc, err := connection.GetDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dc.Name() != vclib.TestDefaultDatacenter {
+		t.Errorf("Expected datacenter %q, got %q", vclib.TestDefaultDatacenter, dc.Name())
+	}
+
+	cached, err := connection.GetDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != dc {
+		t.Error("Expected the datacenter to be cached")
+	}
+
+	// A new client invalidates the cached datacenter
+	connection.Logout(ctx)
+	renewed, err := connection.GetDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == dc {
+		t.Error("Expected the datacenter to be looked up again after reconnecting")
+	}
+}
+
+func TestConnectRefreshesCredentials(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		password  string
+		expectErr bool
+	}{
+		{
+			name:     "refreshed credentials succeed",
+			password: "pass",
+		},
+		{
+			name:      "refreshed credentials are still invalid",
+			password:  "still-stale",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			refreshes := 0
+			connection := &vclib.VSphereConnection{
+				Hostname: s.URL.Hostname(),
+				Port:     s.URL.Port(),
+				Insecure: true,
+				Username: "user",
+				Password: "stale",
+				CredentialsProvider: func(ctx context.Context) (string, string, error) {
+					refreshes++
+					return "user", test.password, nil
+				},
+			}
+
+			err := connection.Connect(context.Background())
+			if test.expectErr {
+				if !vclib.IsInvalidCredentialsError(err) {
+					t.Errorf("Expected invalid credentials error, got: %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Expected connect to succeed with refreshed credentials, got: %v", err)
+			}
+			if refreshes != 1 {
+				t.Errorf("Expected credentials to be refreshed once, got %d", refreshes)
+			}
+		})
+	}
+}
+
+// bearerToken returns a SAML bearer token for the given subject, as accepted by the simulator.
+func TestConnectRecordsLastConnected(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	if !connection.LastConnectedTime().IsZero() || connection.LastError() != nil {
+		t.Fatal("Expected no connect to be recorded before Connect")
+	}
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := connection.LastConnectedTime()
+	if first.IsZero() || connection.LastError() != nil {
+		t.Fatalf("Expected a successful connect to be recorded, got %v, %v", first, connection.LastError())
+	}
+
+	// Reconnect with a new session
+	connection.Logout(ctx)
+	time.Sleep(10 * time.Millisecond)
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	second := connection.LastConnectedTime()
+	if !second.After(first) {
+		t.Errorf("Expected the last connected time to advance after reconnecting, got %v then %v", first, second)
+	}
+
+	// An existing session does not log in again
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if connection.LastConnectedTime() != second {
+		t.Error("Expected the last connected time not to change without a new login")
+	}
+
+	connection.Logout(ctx)
+	connection.UpdateCredentials("user", "wrong", "", "")
+	if err := connection.Connect(ctx); err == nil {
+		t.Fatal("Expected Connect to fail with invalid credentials")
+	}
+	if err := connection.LastError(); !vclib.IsInvalidCredentialsError(err) {
+		t.Errorf("Expected the invalid credentials error to be recorded, got %v", err)
+	}
+	if connection.LastConnectedTime() != second {
+		t.Error("Expected the last connected time not to change on failure")
+	}
+}
+
+func bearerToken(subject string) string {
+	return fmt.Sprintf(`<saml2:Assertion xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion" ID="_%s">`+
+		`<saml2:Subject><saml2:NameID>%s</saml2:NameID></saml2:Subject></saml2:Assertion>`, subject, subject)
+}
+
+func TestConnectWithBearerToken(t *testing.T) {
+	s := newTestVCSim(t)
+
+	// an assertion without a subject is rejected by the simulator with InvalidLogin
+	expiredToken := `<saml2:Assertion xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion" ID="_expired"></saml2:Assertion>`
+
+	tests := []struct {
+		name              string
+		bearerToken       string
+		tokens            []string
+		expectErr         bool
+		expectedProviders int
+		expectedUser      string
+	}{
+		{
+			name:         "bearer token takes precedence over password",
+			bearerToken:  bearerToken("static@vsphere.local"),
+			expectedUser: "static@vsphere.local",
+		},
+		{
+			name:              "token provider is asked for a token",
+			tokens:            []string{bearerToken("provided@vsphere.local")},
+			expectedProviders: 1,
+			expectedUser:      "provided@vsphere.local",
+		},
+		{
+			name:              "rejected token is refreshed",
+			bearerToken:       expiredToken,
+			tokens:            []string{bearerToken("refreshed@vsphere.local")},
+			expectedProviders: 1,
+			expectedUser:      "refreshed@vsphere.local",
+		},
+		{
+			name:              "refreshed token is still rejected",
+			tokens:            []string{expiredToken, expiredToken},
+			expectErr:         true,
+			expectedProviders: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			providers := 0
+			connection := &vclib.VSphereConnection{
+				Hostname:    s.URL.Hostname(),
+				Port:        s.URL.Port(),
+				Insecure:    true,
+				Username:    "user",
+				Password:    "wrong",
+				BearerToken: test.bearerToken,
+			}
+			if len(test.tokens) > 0 {
+				connection.TokenProvider = func(ctx context.Context) (string, error) {
+					token := test.tokens[providers]
+					providers++
+					return token, nil
+				}
+			}
+
+			err := connection.Connect(ctx)
+			if providers != test.expectedProviders {
+				t.Errorf("Expected token provider to be called %d times, got %d", test.expectedProviders, providers)
+			}
+			if test.expectErr {
+				if !vclib.IsInvalidCredentialsError(err) {
+					t.Errorf("Expected invalid credentials error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected connect to succeed with bearer token, got: %v", err)
+			}
+
+			userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userSession.UserName != test.expectedUser {
+				t.Errorf("Expected session of %q, got %q", test.expectedUser, userSession.UserName)
+			}
+		})
+	}
+}
+
+func TestConnectFallsBackFromBearerToken(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	// an assertion without a subject is rejected by the simulator with InvalidLogin
+	expiredToken := `<saml2:Assertion xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion" ID="_expired"></saml2:Assertion>`
+	errSessionManagerDown := errors.New("session manager unavailable")
+
+	tests := []struct {
+		name         string
+		bearerToken  string
+		providerErr  error
+		password     string
+		expectedErr  func(error) bool
+		expectedUser string
+	}{
+		{
+			name:         "token provider failure falls back to password",
+			providerErr:  errSessionManagerDown,
+			password:     "pass",
+			expectedUser: "user",
+		},
+		{
+			name:        "token provider failure without password",
+			providerErr: errSessionManagerDown,
+			expectedErr: func(err error) bool { return errors.Is(err, errSessionManagerDown) },
+		},
+		{
+			name:         "rejected static token falls back to password",
+			bearerToken:  expiredToken,
+			password:     "pass",
+			expectedUser: "user",
+		},
+		{
+			name:        "rejected static token falls back to invalid password",
+			bearerToken: expiredToken,
+			password:    "wrong",
+			expectedErr: vclib.IsInvalidCredentialsError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			connection := &vclib.VSphereConnection{
+				Hostname:    s.URL.Hostname(),
+				Port:        s.URL.Port(),
+				Insecure:    true,
+				Username:    "user",
+				Password:    test.password,
+				BearerToken: test.bearerToken,
+			}
+			if test.providerErr != nil {
+				connection.TokenProvider = func(ctx context.Context) (string, error) {
+					return "", test.providerErr
+				}
+			}
+
+			err := connection.Connect(ctx)
+			if test.expectedErr != nil {
+				if !test.expectedErr(err) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected connect to fall back to the password, got: %v", err)
+			}
+			defer connection.Logout(ctx)
+
+			userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userSession.UserName != test.expectedUser {
+				t.Errorf("Expected session of %q, got %q", test.expectedUser, userSession.UserName)
+			}
+		})
+	}
+}
+
+func TestRESTClient(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+
+	rc, err := connection.RESTClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := tags.NewManager(rc)
+	if _, err := m.CreateCategory(ctx, &tags.Category{Name: "k8s-zone", Cardinality: "SINGLE"}); err != nil {
+		t.Fatal(err)
+	}
+	categories, err := m.GetCategories(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != 1 || categories[0].Name != "k8s-zone" {
+		t.Errorf("Expected the created category, got %v", categories)
+	}
+
+	cached, err := connection.RESTClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != rc {
+		t.Error("Expected the REST client to be cached")
+	}
+	if restSession, err := rc.Session(ctx); err != nil || restSession == nil {
+		t.Fatalf("Expected a REST session, got %v (%v)", restSession, err)
+	}
+
+	connection.Logout(ctx)
+	if restSession, err := rc.Session(ctx); err != nil || restSession != nil {
+		t.Errorf("Expected the REST session to be logged out, got %v (%v)", restSession, err)
+	}
+}
+
+func TestTestLogin(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		password  string
+		connected bool
+		expectErr bool
+	}{
+		{
+			name:     "valid credentials",
+			password: "pass",
+		},
+		{
+			name:      "valid credentials of a connected connection",
+			password:  "pass",
+			connected: true,
+		},
+		{
+			name:      "invalid credentials",
+			password:  "wrong",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			connection := &vclib.VSphereConnection{
+				Hostname: s.URL.Hostname(),
+				Port:     s.URL.Port(),
+				Insecure: true,
+				Username: "user",
+				Password: "pass",
+			}
+			if test.connected {
+				if err := connection.Connect(ctx); err != nil {
+					t.Fatal(err)
+				}
+				defer connection.Logout(ctx)
+			}
+			client := connection.Client
+			connection.UpdateCredentials("user", test.password, "", "")
+
+			err := connection.TestLogin(ctx)
+			if test.expectErr {
+				if !vclib.IsInvalidCredentialsError(err) {
+					t.Errorf("Expected invalid credentials error, got: %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Expected the login to succeed, got: %v", err)
+			}
+
+			if connection.Client != client {
+				t.Error("Expected the client of the connection to be left untouched")
+			}
+			if test.connected {
+				if userSession, err := session.NewManager(connection.Client).UserSession(ctx); err != nil || userSession == nil {
+					t.Errorf("Expected the session of the connection to be left untouched: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectAuthPreference(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	// an assertion without a subject is rejected by the simulator with InvalidLogin
+	expiredToken := `<saml2:Assertion xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion" ID="_expired"></saml2:Assertion>`
+
+	tests := []struct {
+		name         string
+		preference   vclib.AuthPreference
+		bearerToken  string
+		password     string
+		expectErr    bool
+		expectedUser string
+	}{
+		{
+			name:         "session manager first prefers the token",
+			preference:   vclib.AuthPreferenceSessionManagerFirst,
+			bearerToken:  bearerToken("token@vsphere.local"),
+			password:     "pass",
+			expectedUser: "token@vsphere.local",
+		},
+		{
+			name:         "session manager first falls back to the password",
+			preference:   vclib.AuthPreferenceSessionManagerFirst,
+			bearerToken:  expiredToken,
+			password:     "pass",
+			expectedUser: "user",
+		},
+		{
+			name:         "password first prefers the password",
+			preference:   vclib.AuthPreferencePasswordFirst,
+			bearerToken:  bearerToken("token@vsphere.local"),
+			password:     "pass",
+			expectedUser: "user",
+		},
+		{
+			name:         "password first falls back to the token",
+			preference:   vclib.AuthPreferencePasswordFirst,
+			bearerToken:  bearerToken("token@vsphere.local"),
+			password:     "wrong",
+			expectedUser: "token@vsphere.local",
+		},
+		{
+			name:        "password first with both failing",
+			preference:  vclib.AuthPreferencePasswordFirst,
+			bearerToken: expiredToken,
+			password:    "wrong",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			connection := &vclib.VSphereConnection{
+				Hostname:       s.URL.Hostname(),
+				Port:           s.URL.Port(),
+				Insecure:       true,
+				Username:       "user",
+				Password:       test.password,
+				BearerToken:    test.bearerToken,
+				AuthPreference: test.preference,
+			}
+
+			err := connection.Connect(ctx)
+			if test.expectErr {
+				if !vclib.IsInvalidCredentialsError(err) {
+					t.Errorf("Expected invalid credentials error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Logout(ctx)
+
+			userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userSession.UserName != test.expectedUser {
+				t.Errorf("Expected session of %q, got %q", test.expectedUser, userSession.UserName)
+			}
+		})
+	}
+}
+
+func TestConnectWithSessionManager(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	ctx := context.Background()
+	// the session shared by the session manager
+	shared := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	if err := shared.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Logout(ctx)
+
+	var down atomic.Bool
+	sessionManager := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer session-manager-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ticket, err := session.NewManager(shared.Client).AcquireCloneTicket(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, ticket)
+	}))
+	defer sessionManager.Close()
+
+	tests := []struct {
+		name        string
+		token       string
+		down        bool
+		password    string
+		expectedErr error
+	}{
+		{
+			name:  "clones the session of the session manager",
+			token: "session-manager-token",
+		},
+		{
+			name:     "session manager failure falls back to password",
+			token:    "session-manager-token",
+			down:     true,
+			password: "pass",
+		},
+		{
+			name:        "session manager failure without password",
+			token:       "session-manager-token",
+			down:        true,
+			expectedErr: vclib.ErrSessionManager,
+		},
+		{
+			name:        "rejected session manager token",
+			token:       "wrong-token",
+			expectedErr: vclib.ErrSessionManager,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			down.Store(test.down)
+			connection := &vclib.VSphereConnection{
+				Hostname:            s.URL.Hostname(),
+				Port:                s.URL.Port(),
+				Insecure:            true,
+				Username:            "user",
+				Password:            test.password,
+				SessionManagerURL:   sessionManager.URL,
+				SessionManagerToken: test.token,
+			}
+
+			err := connection.Connect(ctx)
+			if test.expectedErr != nil {
+				if !errors.Is(err, test.expectedErr) {
+					t.Errorf("Expected %v, got: %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Logout(ctx)
+
+			userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userSession == nil || userSession.UserName != "user" {
+				t.Errorf("Expected a session of user, got %+v", userSession)
+			}
+		})
+	}
+}
+
+func TestConnectWithoutAuthMethod(t *testing.T) {
+	s := newTestVCSim(t)
+
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+	}
+	err := connection.Connect(context.Background())
+	if !errors.Is(err, vclib.ErrNoAuthMethodConfigured) {
+		t.Fatalf("Expected ErrNoAuthMethodConfigured, got %v", err)
+	}
+	if !strings.Contains(err.Error(), s.URL.Hostname()) {
+		t.Errorf("Expected the error to name server %s, got %v", s.URL.Hostname(), err)
+	}
+	if vclib.IsInvalidCredentialsError(err) {
+		t.Errorf("Expected the error not to be handled as invalid credentials, got %v", err)
+	}
+	if category := vclib.ClassifyError(err); category != vclib.ErrorCategoryNoCredentials {
+		t.Errorf("Expected category %s, got %s", vclib.ErrorCategoryNoCredentials, category)
+	}
+	if connection.Client != nil {
+		t.Error("Expected no client without an authentication method")
+	}
+}
+
+func TestConnectUserAgent(t *testing.T) {
+	s := newTestVCSim(t)
+
+	tests := []struct {
+		name              string
+		userAgent         string
+		expectedUserAgent string
+	}{
+		{
+			name:              "default user agent",
+			expectedUserAgent: "k8s-cloud-provider-vsphere/" + version.Get().GitVersion,
+		},
+		{
+			name:              "user agent override",
+			userAgent:         "ccm-cluster-a",
+			expectedUserAgent: "ccm-cluster-a/" + version.Get().GitVersion,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			connection := &vclib.VSphereConnection{
+				Hostname:  s.URL.Hostname(),
+				Port:      s.URL.Port(),
+				Insecure:  true,
+				Username:  "user",
+				Password:  "pass",
+				UserAgent: test.userAgent,
+			}
+			if err := connection.Connect(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Logout(ctx)
+
+			if connection.Client.UserAgent != test.expectedUserAgent {
+				t.Errorf("Expected client user agent %q, got %q", test.expectedUserAgent, connection.Client.UserAgent)
+			}
+			userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userSession.UserAgent != test.expectedUserAgent {
+				t.Errorf("Expected session user agent %q, got %q", test.expectedUserAgent, userSession.UserAgent)
+			}
+		})
+	}
+}
+
+func TestConnectWithURL(t *testing.T) {
+	s := newTestVCSim(t)
+
+	// A reverse proxy exposing vCenter at /vcenter/sdk, with a certificate of its own
+	var paths []string
+	var pathsLock sync.Mutex
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			pathsLock.Lock()
+			paths = append(paths, r.In.URL.Path)
+			pathsLock.Unlock()
+			r.SetURL(&url.URL{Scheme: s.URL.Scheme, Host: s.URL.Host})
+			r.Out.URL.Path = strings.TrimPrefix(r.In.URL.Path, "/vcenter")
+		},
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, // #nosec G402 vcsim certificate
+	}
+	gateway, thumbprint := createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, reverseProxy.ServeHTTP)
+	gateway.StartTLS()
+	defer gateway.Close()
+
+	connection := &vclib.VSphereConnection{
+		URL:        gateway.URL + "/vcenter/sdk",
+		Thumbprint: thumbprint,
+		Username:   "user",
+		Password:   "pass",
+	}
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Logout(context.Background())
+
+	if got := connection.Client.URL().Path; got != "/vcenter/sdk" {
+		t.Errorf("Expected the client to use the path of URL, got %q", got)
+	}
+	pathsLock.Lock()
+	defer pathsLock.Unlock()
+	if len(paths) == 0 {
+		t.Fatal("Expected requests through the reverse proxy")
+	}
+	for _, path := range paths {
+		if path != "/vcenter/sdk" {
+			t.Errorf("Expected requests to /vcenter/sdk, got %q", path)
+		}
+	}
+
+	if probed, err := connection.ProbeTLS(context.Background()); err != nil {
+		t.Error(err)
+	} else if probed == "" {
+		t.Error("Expected the thumbprint of the reverse proxy")
+	}
+}
+
+func TestConnectWithClientTLSCertificate(t *testing.T) {
+	s := newTestVCSim(t)
+	cert, err := os.ReadFile(fixtures.ServerCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile(fixtures.ServerKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := os.ReadFile(fixtures.CaCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caCert)
+
+	// A reverse proxy in front of vCenter requiring a client certificate signed by the CA
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&url.URL{Scheme: s.URL.Scheme, Host: s.URL.Host})
+		},
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, // #nosec G402 vcsim certificate
+	}
+	gateway, thumbprint := createTestServer(t, fixtures.CaCertPath, fixtures.ServerCertPath, fixtures.ServerKeyPath, reverseProxy.ServeHTTP)
+	gateway.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	gateway.TLS.ClientCAs = clientCAs
+	gateway.StartTLS()
+	defer gateway.Close()
+	u := mustParseUrl(t, gateway.URL)
+
+	tests := []struct {
+		name            string
+		clientTLSCert   string
+		clientTLSKey    string
+		expectConnected bool
+		expectConfigErr bool
+	}{
+		{
+			name:            "with a client certificate",
+			clientTLSCert:   string(cert),
+			clientTLSKey:    string(key),
+			expectConnected: true,
+		},
+		{
+			name: "without a client certificate",
+		},
+		{
+			name:            "with a certificate but no key",
+			clientTLSCert:   string(cert),
+			expectConfigErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := &vclib.VSphereConnection{
+				Hostname:       u.Hostname(),
+				Port:           u.Port(),
+				Thumbprint:     thumbprint,
+				Username:       "user",
+				Password:       "pass",
+				ClientTLSCert:  test.clientTLSCert,
+				ClientTLSKey:   test.clientTLSKey,
+				ConnectTimeout: time.Second,
+			}
+			err := connection.Connect(context.Background())
+			if test.expectConnected {
+				if err != nil {
+					t.Fatal(err)
+				}
+				connection.Logout(context.Background())
+			} else if err == nil {
+				t.Fatal("Expected Connect to fail")
+			}
+			if errors.Is(err, vclib.ErrInvalidConnectionConfig) != test.expectConfigErr {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			// A missing client certificate is only rejected after the TLS 1.3 handshake
+			// completed on the client, so only the probe with a certificate is checked.
+			if test.expectConnected {
+				if _, err := connection.ProbeTLS(context.Background()); err != nil {
+					t.Errorf("Expected the TLS probe to present the client certificate, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	s := newTestVCSim(t)
+	connection := &vclib.VSphereConnection{
+		Hostname:       s.URL.Hostname(),
+		Port:           s.URL.Port(),
+		Insecure:       true,
+		Username:       "user",
+		Password:       "pass",
+		ConnectTimeout: 5 * time.Second,
+	}
+	ctx := context.Background()
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Logout(ctx)
+	original, err := session.NewManager(connection.Client).UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 4
+	clones := make([]*vclib.VSphereConnection, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			clones[i] = connection.Clone()
+			errs[i] = clones[i].Connect(ctx)
+		}(i)
+		go func() {
+			defer wg.Done()
+			connection.UpdateCredentials("user", "pass", "", "")
+		}()
+	}
+	wg.Wait()
+
+	sessions := map[string]bool{original.Key: true}
+	for i, clone := range clones {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		defer clone.Logout(ctx)
+		if clone.Hostname != connection.Hostname || clone.Port != connection.Port || !clone.Insecure ||
+			clone.Username != "user" || clone.ConnectTimeout != connection.ConnectTimeout {
+			t.Errorf("Expected the clone to have the settings of the connection, got %+v", clone)
+		}
+		if clone.Client == connection.Client {
+			t.Error("Expected the clone to have a client of its own")
+		}
+		userSession, err := session.NewManager(clone.Client).UserSession(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessions[userSession.Key] {
+			t.Errorf("Expected the clone to log in a session of its own, got %s again", userSession.Key)
+		}
+		sessions[userSession.Key] = true
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	s := newTestVCSim(t)
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	if version := connection.ServerVersion(); version != (vclib.ServerVersion{}) {
+		t.Errorf("Expected no version before connecting, got %+v", version)
+	}
+
+	ctx := context.Background()
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	about := connection.Client.ServiceContent.About
+	expected := vclib.ServerVersion{Version: about.Version, Build: about.Build, APIVersion: about.ApiVersion, FullName: about.FullName}
+	if version := connection.ServerVersion(); version.Version == "" || version != expected {
+		t.Errorf("Expected version %+v, got %+v", expected, version)
+	}
+	connection.Logout(ctx)
+
+	// An upgraded vCenter is picked up on reconnect
+	model := simulator.VPX()
+	model.ServiceContent.About.Version = "8.0.2"
+	model.ServiceContent.About.Build = "22385739"
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	defer model.Remove()
+	model.Service.TLS = new(tls.Config)
+	upgraded := model.Service.NewServer()
+	defer upgraded.Close()
+	connection.Hostname, connection.Port = upgraded.URL.Hostname(), upgraded.URL.Port()
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Logout(ctx)
+	if version := connection.ServerVersion(); version.Version != "8.0.2" || version.Build != "22385739" {
+		t.Errorf("Expected the version of the upgraded vCenter, got %+v", version)
+	}
+}
+
+// stubSRVResolver returns its records, or err, for _vsphere._tcp lookups.
+type stubSRVResolver struct {
+	records []*net.SRV
+	err     error
+	lookups []string
+}
+
+func (r *stubSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lookups = append(r.lookups, fmt.Sprintf("_%s._%s.%s", service, proto, name))
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return "", r.records, nil
+}
+
+func TestConnectWithSRVLookup(t *testing.T) {
+	s := newTestVCSim(t)
+	port, err := strconv.Atoi(s.URL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const hostname = "vcenter.example.com"
+	newConnection := func(resolver *stubSRVResolver) *vclib.VSphereConnection {
+		return &vclib.VSphereConnection{
+			Hostname:       hostname,
+			Insecure:       true,
+			Username:       "user",
+			Password:       "pass",
+			UseSRVLookup:   true,
+			Resolver:       resolver,
+			ConnectTimeout: time.Second,
+		}
+	}
+
+	resolver := &stubSRVResolver{records: []*net.SRV{{Target: s.URL.Hostname() + ".", Port: uint16(port)}}}
+	connection := newConnection(resolver)
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Logout(context.Background())
+	if got := connection.Client.URL().Host; got != s.URL.Host {
+		t.Errorf("Expected the client to connect to the SRV target %s, got %s", s.URL.Host, got)
+	}
+	if len(resolver.lookups) != 1 || resolver.lookups[0] != "_vsphere._tcp."+hostname {
+		t.Errorf("Expected a lookup of _vsphere._tcp.%s, got %v", hostname, resolver.lookups)
+	}
+
+	// A configured port takes precedence over the SRV record
+	resolver = &stubSRVResolver{records: []*net.SRV{{Target: "unused.example.com.", Port: 8443}}}
+	connection = newConnection(resolver)
+	connection.Hostname = s.URL.Hostname()
+	connection.Port = s.URL.Port()
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	connection.Logout(context.Background())
+	if len(resolver.lookups) != 0 {
+		t.Errorf("Expected no SRV lookup with a configured port, got %v", resolver.lookups)
+	}
+
+	// Without an SRV record, the default port is used
+	resolver = &stubSRVResolver{err: &net.DNSError{Err: "no such host", Name: hostname, IsNotFound: true}}
+	connection = newConnection(resolver)
+	connection.Hostname = "127.0.0.1"
+	if _, err := connection.ProbeTLS(context.Background()); err == nil || !strings.Contains(err.Error(), "127.0.0.1:"+vclib.DefaultPort) {
+		t.Errorf("Expected to connect to the default port without an SRV record, got %v", err)
+	}
+
+	// Other lookup failures are returned
+	lookupErr := &net.DNSError{Err: "server misbehaving", Name: hostname, IsTemporary: true}
+	connection = newConnection(&stubSRVResolver{err: lookupErr})
+	if err := connection.Connect(context.Background()); !errors.Is(err, lookupErr) {
+		t.Errorf("Expected the lookup failure, got %v", err)
+	}
+}
+
+func TestNewClientInvalidConnectionConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		hostname       string
+		port           string
+		url            string
+		socks5ProxyURL string
+	}{
+		{
+			name: "empty hostname",
+			port: "443",
+		},
+		{
+			name:     "non-numeric port",
+			hostname: "vcenter.example.com",
+			port:     "https",
+		},
+		{
+			name:     "port out of range",
+			hostname: "vcenter.example.com",
+			port:     "65536",
+		},
+		{
+			name: "http URL",
+			url:  "http://gw.example.com/vcenter/sdk",
+		},
+		{
+			name: "URL without host",
+			url:  "https:///vcenter/sdk",
+		},
+		{
+			name: "URL with port out of range",
+			url:  "https://gw.example.com:65536/vcenter/sdk",
+		},
+		{
+			name:           "proxy URL without socks5 scheme",
+			hostname:       "vcenter.example.com",
+			socks5ProxyURL: "http://proxy.example.com:1080",
+		},
+		{
+			name:           "proxy URL without host",
+			hostname:       "vcenter.example.com",
+			socks5ProxyURL: "socks5://",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := &vclib.VSphereConnection{
+				Hostname:       test.hostname,
+				Port:           test.port,
+				URL:            test.url,
+				SOCKS5ProxyURL: test.socks5ProxyURL,
+			}
+			if _, err := connection.NewClient(context.Background()); !errors.Is(err, vclib.ErrInvalidConnectionConfig) {
+				t.Errorf("Expected ErrInvalidConnectionConfig, got: %v", err)
+			}
+		})
+	}
+}
+
+// socks5Proxy is a minimal SOCKS5 proxy recording the addresses it connects to.
+type socks5Proxy struct {
+	username string
+	password string
+	lock     sync.Mutex
+	targets  []string
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy, which requires the given username and password
+// unless username is empty, and returns its address.
+func startSOCKS5Proxy(t *testing.T, p *socks5Proxy) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (p *socks5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	// greeting: version, number of methods, methods
+	header := read(2)
+	if header == nil || read(int(header[1])) == nil {
+		return
+	}
+	if p.username == "" {
+		_, _ = conn.Write([]byte{5, 0})
+	} else {
+		// username/password authentication, RFC 1929
+		_, _ = conn.Write([]byte{5, 2})
+		version := read(2)
+		if version == nil {
+			return
+		}
+		username := read(int(version[1]))
+		passwordLength := read(1)
+		if username == nil || passwordLength == nil {
+			return
+		}
+		password := read(int(passwordLength[0]))
+		if string(username) != p.username || string(password) != p.password {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+
+	// request: version, command, reserved, address type, address, port
+	request := read(4)
+	if request == nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		length := read(1)
+		if length == nil {
+			return
+		}
+		host = string(read(int(length[0])))
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := read(2)
+	if port == nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	p.lock.Lock()
+	p.targets = append(p.targets, target)
+	p.lock.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() { _, _ = io.Copy(upstream, conn) }()
+	_, _ = io.Copy(conn, upstream)
+}
+
+func (p *socks5Proxy) dialed() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func TestConnectThroughSOCKS5Proxy(t *testing.T) {
+	s := newTestVCSim(t)
+
+	tests := []struct {
+		name      string
+		proxy     *socks5Proxy
+		userinfo  string
+		expectErr bool
+	}{
+		{
+			name:  "proxy without authentication",
+			proxy: &socks5Proxy{},
+		},
+		{
+			name:     "proxy with authentication",
+			proxy:    &socks5Proxy{username: "proxy-user", password: "proxy-pass"},
+			userinfo: "proxy-user:proxy-pass@",
+		},
+		{
+			name:      "proxy rejecting the credentials",
+			proxy:     &socks5Proxy{username: "proxy-user", password: "proxy-pass"},
+			userinfo:  "proxy-user:wrong@",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			connection := &vclib.VSphereConnection{
+				Hostname:       s.URL.Hostname(),
+				Port:           s.URL.Port(),
+				Insecure:       true,
+				Username:       "user",
+				Password:       "pass",
+				SOCKS5ProxyURL: "socks5://" + test.userinfo + startSOCKS5Proxy(t, test.proxy),
+			}
+
+			err := connection.Connect(ctx)
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("Expected connect to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Logout(ctx)
+
+			if _, err := connection.ProbeTLS(ctx); err != nil {
+				t.Fatal(err)
+			}
+			targets := test.proxy.dialed()
+			if len(targets) < 2 {
+				t.Errorf("Expected the client and the TLS probe to dial through the proxy, got %v", targets)
+			}
+			for _, target := range targets {
+				if target != s.URL.Host {
+					t.Errorf("Expected the proxy to connect to %s, got %s", s.URL.Host, target)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClientDefaultPort(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connection := &vclib.VSphereConnection{
+		Hostname: "127.0.0.1",
+		Insecure: true,
+	}
+	_, err := connection.NewClient(ctx)
+	if errors.Is(err, vclib.ErrInvalidConnectionConfig) {
+		t.Fatalf("Expected a blank port to be valid, got: %v", err)
+	}
+	urlErr := &url.Error{}
+	if !errors.As(err, &urlErr) {
+		t.Fatalf("Expected to receive an url.Error, got: %v", err)
+	}
+	if u := mustParseUrl(t, urlErr.URL); u.Port() != vclib.DefaultPort {
+		t.Errorf("Expected the default port %s to be used, got %q", vclib.DefaultPort, u.Port())
+	}
+}
+
+func TestClientOrConnectConcurrent(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+
+	const callers = 10
+	clients := make(chan *vim25.Client, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := connection.ClientOrConnect(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			clients <- client
+		}()
+	}
+	wg.Wait()
+	close(clients)
+
+	first, err := connection.ClientOrConnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client := range clients {
+		if client != first {
+			t.Error("Expected all callers to share one client")
+		}
+	}
+}
+
+func TestConnectShareSession(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+
+	newConnection := func(share bool) *vclib.VSphereConnection {
+		return &vclib.VSphereConnection{
+			Hostname:     s.URL.Hostname(),
+			Port:         s.URL.Port(),
+			Insecure:     true,
+			Username:     "user",
+			Password:     "pass",
+			ShareSession: share,
+		}
+	}
+	isActive := func(client *vim25.Client) bool {
+		userSession, err := session.NewManager(client).UserSession(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userSession != nil
+	}
+
+	connections := []*vclib.VSphereConnection{newConnection(true), newConnection(true)}
+	var wg sync.WaitGroup
+	for _, connection := range connections {
+		wg.Add(1)
+		go func(connection *vclib.VSphereConnection) {
+			defer wg.Done()
+			if err := connection.Connect(ctx); err != nil {
+				t.Error(err)
+			}
+		}(connection)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	first, second := connections[0], connections[1]
+	client, err := first.ClientOrConnect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := second.ClientOrConnect(ctx); err != nil {
+		t.Fatal(err)
+	} else if other != client {
+		t.Fatal("Expected connections with ShareSession set to share one client")
+	}
+
+	unshared := newConnection(false)
+	if err := unshared.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer unshared.Logout(ctx)
+	if unshared.Client == client {
+		t.Error("Expected a connection without ShareSession set to have its own client")
+	}
+
+	first.Logout(ctx)
+	if !isActive(client) {
+		t.Fatal("Expected the session to stay active while a connection still shares it")
+	}
+	if err := second.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if second.Client != client {
+		t.Error("Expected the remaining connection to keep the shared client")
+	}
+
+	second.Logout(ctx)
+	if isActive(client) {
+		t.Error("Expected the last Logout to log out the shared session")
+	}
+	if !isActive(unshared.Client) {
+		t.Error("Expected the session of the unshared connection to stay active")
+	}
+}
+
+func TestConnectCancelledDuringLogin(t *testing.T) {
+	s := newTestVCSim(t)
+
+	// hang Login requests until the client gives up, pass everything else to the simulator
+	loginStarted := make(chan struct{}, 1)
+	hanging := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "<Login") {
+			loginStarted <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer hanging.Close()
+	u := mustParseUrl(t, hanging.URL)
+
+	connection := &vclib.VSphereConnection{
+		Hostname: u.Hostname(),
+		Port:     u.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- connection.Connect(ctx)
+	}()
+
+	select {
+	case <-loginStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected login to start")
+	}
+
+	// credentials can be updated while the login is in flight
+	updated := make(chan struct{})
+	go func() {
+		connection.UpdateCredentials("user", "rotated", "", "")
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected UpdateCredentials not to block on an in-flight login")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Connect to return promptly after cancellation")
+	}
+}
+
+func TestConnectWithClientCertificate(t *testing.T) {
+	s := newTestVCSim(t)
+
+	cert, err := os.ReadFile(fixtures.ServerCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := os.ReadFile(fixtures.ServerKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		username      string
+		password      string
+		clientCertPEM string
+		clientKeyPEM  string
+		expectToken   bool
+	}{
+		{
+			name:          "explicit client certificate",
+			username:      "user",
+			password:      "pass",
+			clientCertPEM: string(cert),
+			clientKeyPEM:  string(key),
+			expectToken:   true,
+		},
+		{
+			name:        "legacy PEM in username and password",
+			username:    string(cert),
+			password:    string(key),
+			expectToken: true,
+		},
+		{
+			name:     "username and password",
+			username: "user",
+			password: "pass",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := &vclib.VSphereConnection{
+				Hostname: s.URL.Hostname(),
+				Port:     s.URL.Port(),
+				Insecure: true,
+			}
+			connection.UpdateCredentials(test.username, test.password, test.clientCertPEM, test.clientKeyPEM)
+			if err := connection.Connect(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if hasToken := !connection.TokenExpiry().IsZero(); hasToken != test.expectToken {
+				t.Errorf("Expected login with SAML token %t, got %t", test.expectToken, hasToken)
+			}
+		})
+	}
+}
+
+func TestConnectTracing(t *testing.T) {
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		password  string
+		expectErr bool
+	}{
+		{
+			name:     "successful connect",
+			password: "pass",
+		},
+		{
+			name:      "failed login",
+			password:  "wrong",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+			connection := &vclib.VSphereConnection{
+				Hostname: s.URL.Hostname(),
+				Port:     s.URL.Port(),
+				Insecure: true,
+				Username: "user",
+				Password: test.password,
+			}
+			if err := connection.Connect(context.Background()); (err != nil) != test.expectErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			spans := recorder.Ended()
+			var names []string
+			for _, span := range spans {
+				names = append(names, span.Name())
+				if test.expectErr != (span.Status().Code == codes.Error) {
+					t.Errorf("Unexpected status %v for span %s", span.Status(), span.Name())
+				}
+			}
+			// spans end innermost first
+			expected := []string{"vclib.login", "vclib.NewClient", "vclib.Connect"}
+			if strings.Join(names, ",") != strings.Join(expected, ",") {
+				t.Fatalf("Expected spans %v, got %v", expected, names)
+			}
+			if spans[1].Parent().SpanID() != spans[2].SpanContext().SpanID() {
+				t.Error("Expected NewClient span to be a child of the Connect span")
+			}
+		})
+	}
+}
+
+func TestConnectLogsLoginFailure(t *testing.T) {
+	var lines []string
+	vclib.SetLogger(funcr.New(func(prefix, args string) {
+		lines = append(lines, args)
+	}, funcr.Options{}))
+	defer vclib.SetLogger(klogr.New().WithName("vclib"))
+
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "wrong",
+	}
+	if err := connection.Connect(context.Background()); !vclib.IsInvalidCredentialsError(err) {
+		t.Fatalf("Expected invalid credentials error, got: %v", err)
+	}
+
+	var found bool
+	for _, line := range lines {
+		if strings.Contains(line, `"msg"="Failed to login"`) {
+			found = true
+			for _, key := range []string{`"error"=`, fmt.Sprintf(`"server"=%q`, s.URL.Hostname())} {
+				if !strings.Contains(line, key) {
+					t.Errorf("Expected %s in login failure log: %s", key, line)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected login failure to be logged, got: %v", lines)
+	}
+}
+
+func TestConnectLogsCorrelationID(t *testing.T) {
+	var lock sync.Mutex
+	var lines []string
+	vclib.SetLogger(funcr.New(func(prefix, args string) {
+		lock.Lock()
+		defer lock.Unlock()
+		lines = append(lines, args)
+	}, funcr.Options{Verbosity: 3}))
+	defer vclib.SetLogger(klogr.New().WithName("vclib"))
+
+	s := newTestVCSim(t)
+	connection := &vclib.VSphereConnection{
+		Hostname: s.URL.Hostname(),
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	ctx := vclib.WithCorrelationID(context.Background(), "reconcile-42")
+	if id, ok := vclib.CorrelationIDFromContext(ctx); !ok || id != "reconcile-42" {
+		t.Fatalf("Expected the correlation ID in the context, got %q", id)
+	}
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	connection.Logout(ctx)
+
+	lock.Lock()
+	correlated := lines
+	lines = nil
+	lock.Unlock()
+	var found bool
+	for _, line := range correlated {
+		if strings.Contains(line, `"msg"="SessionManager.Login"`) {
+			found = true
+			if !strings.Contains(line, `"correlationID"="reconcile-42"`) {
+				t.Errorf("Expected the correlation ID in the login log: %s", line)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected the login to be logged, got: %v", correlated)
+	}
+
+	if err := connection.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	connection.Logout(context.Background())
+	lock.Lock()
+	defer lock.Unlock()
+	for _, line := range lines {
+		if strings.Contains(line, "correlationID") {
+			t.Errorf("Expected no correlation ID without one in the context: %s", line)
+		}
+	}
+}
+
+// newTestVCSim starts a vCenter simulator serving TLS, accepting any non-empty credentials.
+func newTestVCSim(t *testing.T) *simulator.Server {
+	model := simulator.VPX()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.RegisterEndpoints = true
+	s := model.Service.NewServer()
+	t.Cleanup(func() {
+		s.Close()
+		model.Remove()
+	})
+	return s
+}
+
 func verifyWrappedX509UnkownAuthorityErr(t *testing.T, err error) {
 	urlErr, ok := err.(*url.Error)
 	if !ok {
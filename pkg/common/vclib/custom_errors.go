@@ -16,7 +16,12 @@ limitations under the License.
 
 package vclib
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // Error Messages
 const (
@@ -30,6 +35,16 @@ const (
 	NoDatastoreFoundErrMsg         = "Datastore not found"
 	NoDatacenterFoundErrMsg        = "Datacenter not found"
 	NoDataStoreClustersFoundErrMsg = "No DatastoreClusters Found"
+	UnexpectedVCenterErrMsg        = "vCenter instance UUID does not match the expected instance UUID"
+	NoDatacenterConfiguredErrMsg   = "No datacenter configured for the connection"
+	InvalidConnectionConfigErrMsg  = "Invalid vCenter connection config"
+	ThumbprintMismatchErrMsg       = "vCenter certificate thumbprint does not match the configured thumbprint"
+	NoAuthMethodConfiguredErrMsg   = "No password, client certificate or bearer token configured"
+	ExtensionNotRegisteredErrMsg   = "vCenter extension is not registered"
+	CircuitOpenErrMsg              = "vCenter circuit breaker is open after consecutive failures"
+	CredentialsLockTimeoutErrMsg   = "Timed out waiting for the credentials lock"
+	RateLimitedErrMsg              = "Too many new vCenter clients, rate limited"
+	SessionManagerErrMsg           = "Failed to get a clone ticket from the session manager"
 )
 
 // Error constants
@@ -44,4 +59,120 @@ var (
 	ErrNoDatastoreFound         = errors.New(NoDatastoreFoundErrMsg)
 	ErrNoDatacenterFound        = errors.New(NoDatacenterFoundErrMsg)
 	ErrNoDataStoreClustersFound = errors.New(NoDataStoreClustersFoundErrMsg)
+	ErrUnexpectedVCenter        = errors.New(UnexpectedVCenterErrMsg)
+	ErrNoDatacenterConfigured   = errors.New(NoDatacenterConfiguredErrMsg)
+	ErrInvalidConnectionConfig  = errors.New(InvalidConnectionConfigErrMsg)
+	ErrThumbprintMismatch       = errors.New(ThumbprintMismatchErrMsg)
+	ErrNoAuthMethodConfigured   = errors.New(NoAuthMethodConfiguredErrMsg)
+	ErrExtensionNotRegistered   = errors.New(ExtensionNotRegisteredErrMsg)
+	ErrCircuitOpen              = errors.New(CircuitOpenErrMsg)
+	ErrCredentialsLockTimeout   = errors.New(CredentialsLockTimeoutErrMsg)
+	ErrRateLimited              = errors.New(RateLimitedErrMsg)
+	ErrSessionManager           = errors.New(SessionManagerErrMsg)
 )
+
+// ServerError is the error of an operation on a single vCenter
+type ServerError struct {
+	Server string
+	Err    error
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Server, e.Err)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError aggregates the errors of an operation fanned out across vCenters, so that the
+// error of one vCenter does not hide the others. It is not safe for concurrent use.
+type MultiError struct {
+	// Total is the number of vCenters the operation was fanned out to
+	Total  int
+	Errors []*ServerError
+}
+
+// NewMultiError returns an empty MultiError for an operation across total vCenters
+func NewMultiError(total int) *MultiError {
+	return &MultiError{Total: total}
+}
+
+// Add records err as an error of server. A nil err is ignored, as is an error of server
+// that already matches err with errors.Is, e.g. when it is searched in several datacenters.
+func (m *MultiError) Add(server string, err error) {
+	if err == nil {
+		return
+	}
+	for _, e := range m.Errors {
+		if e.Server == server && errors.Is(e.Err, err) {
+			return
+		}
+	}
+	m.Errors = append(m.Errors, &ServerError{Server: server, Err: err})
+}
+
+// ErrorOrNil returns m if it holds any error, or nil
+func (m *MultiError) ErrorOrNil() error {
+	if len(m.Errors) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Servers returns the vCenters with at least one error, in the order they failed
+func (m *MultiError) Servers() []string {
+	var servers []string
+	seen := make(map[string]bool)
+	for _, e := range m.Errors {
+		if !seen[e.Server] {
+			seen[e.Server] = true
+			servers = append(servers, e.Server)
+		}
+	}
+	return servers
+}
+
+// Categories returns the number of errors per category, see ClassifyError
+func (m *MultiError) Categories() map[ErrorCategory]int {
+	categories := make(map[ErrorCategory]int)
+	for _, e := range m.Errors {
+		categories[ClassifyError(e.Err)]++
+	}
+	return categories
+}
+
+// Error summarizes the failed vCenters by category, e.g.
+// "2 of 3 vCenters failed (1 Timeout, 1 InvalidCredentials): vc1: ...; vc2: ..."
+func (m *MultiError) Error() string {
+	categories := m.Categories()
+	keys := make([]ErrorCategory, 0, len(categories))
+	for category := range categories {
+		keys = append(keys, category)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if categories[keys[i]] != categories[keys[j]] {
+			return categories[keys[i]] > categories[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	summary := make([]string, 0, len(keys))
+	for _, category := range keys {
+		summary = append(summary, fmt.Sprintf("%d %s", categories[category], category))
+	}
+	errs := make([]string, 0, len(m.Errors))
+	for _, e := range m.Errors {
+		errs = append(errs, e.Error())
+	}
+	return fmt.Sprintf("%d of %d vCenters failed (%s): %s",
+		len(m.Servers()), m.Total, strings.Join(summary, ", "), strings.Join(errs, "; "))
+}
+
+// Unwrap returns the error of each vCenter, so that errors.Is and errors.As look through them
+func (m *MultiError) Unwrap() []error {
+	errs := make([]error, 0, len(m.Errors))
+	for _, e := range m.Errors {
+		errs = append(errs, e)
+	}
+	return errs
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestMultiError(t *testing.T) {
+	timeout := &url.Error{Op: "Post", URL: "https://vc1/sdk", Err: &net.DNSError{IsTimeout: true}}
+	invalidLogin := soapFault(types.InvalidLogin{})
+
+	errs := NewMultiError(5)
+	errs.Add("vc1", timeout)
+	errs.Add("vc2", fmt.Errorf("connect: %w", invalidLogin))
+	errs.Add("vc3", ErrNoDatacenterFound)
+	errs.Add("vc3", nil)
+	errs.Add("vc3", ErrNoDatacenterFound)
+	// a different error with the same message is not a repeat
+	errs.Add("vc3", errors.New(NoDatacenterFoundErrMsg))
+	errs.Add("vc4", timeout)
+
+	err := errs.ErrorOrNil()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if len(errs.Errors) != 5 {
+		t.Errorf("Expected 5 errors, got %d", len(errs.Errors))
+	}
+	expected := "4 of 5 vCenters failed (2 Unknown, 2 Timeout, 1 InvalidCredentials)"
+	if msg := err.Error(); len(msg) < len(expected) || msg[:len(expected)] != expected {
+		t.Errorf("Unexpected error message %q", msg)
+	}
+	if servers := errs.Servers(); !reflect.DeepEqual(servers, []string{"vc1", "vc2", "vc3", "vc4"}) {
+		t.Errorf("Unexpected servers %v", servers)
+	}
+	expectedCategories := map[ErrorCategory]int{
+		ErrorCategoryTimeout:            2,
+		ErrorCategoryInvalidCredentials: 1,
+		ErrorCategoryUnknown:            2,
+	}
+	if categories := errs.Categories(); !reflect.DeepEqual(categories, expectedCategories) {
+		t.Errorf("Unexpected categories %v", categories)
+	}
+
+	if !errors.Is(err, ErrNoDatacenterFound) {
+		t.Error("Expected the aggregate to wrap ErrNoDatacenterFound")
+	}
+	if !errors.Is(err, timeout) {
+		t.Error("Expected the aggregate to wrap the timeout")
+	}
+	if !IsInvalidCredentialsError(errs.Errors[1]) {
+		t.Error("Expected the error of vc2 to be classified as invalid credentials")
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Server != "vc1" {
+		t.Errorf("Expected the first ServerError to be of vc1, got %v", serverErr)
+	}
+}
+
+func TestMultiError_Empty(t *testing.T) {
+	errs := NewMultiError(2)
+	errs.Add("vc1", nil)
+	if err := errs.ErrorOrNil(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/component-base/version"
+)
+
+// EnsureExtensionRegistered returns whether the vCenter extension with the given key is
+// registered, e.g. to report a missing prerequisite of the deployment before it surfaces
+// as a permission failure. A missing extension is registered when RegisterMissingExtension
+// is set, otherwise ErrExtensionNotRegistered is returned.
+func (connection *VSphereConnection) EnsureExtensionRegistered(ctx context.Context, key string) (_ bool, err error) {
+	ctx, span := connection.startSpan(ctx, "EnsureExtensionRegistered")
+	defer func() { endSpan(span, err) }()
+
+	client, err := connection.ClientOrConnect(ctx)
+	if err != nil {
+		return false, err
+	}
+	m, err := object.GetExtensionManager(client)
+	if err != nil {
+		return false, err
+	}
+
+	extension, err := m.Find(ctx, key)
+	if err != nil {
+		loggerFor(ctx).Error(err, "Failed to find extension", "server", connection.Hostname, "key", key)
+		return false, err
+	}
+	if extension != nil {
+		return true, nil
+	}
+	if !connection.RegisterMissingExtension {
+		return false, fmt.Errorf("%w: %s", ErrExtensionNotRegistered, key)
+	}
+
+	loggerFor(ctx).Info("Registering extension", "server", connection.Hostname, "key", key)
+	name := connection.userAgentName()
+	err = m.Register(ctx, types.Extension{
+		Key:     key,
+		Version: version.Get().GitVersion,
+		Description: &types.Description{
+			Label:   name,
+			Summary: name,
+		},
+		LastHeartbeatTime: time.Now(),
+	})
+	if err != nil {
+		loggerFor(ctx).Error(err, "Failed to register extension", "server", connection.Hostname, "key", key)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+)
+
+func TestEnsureExtensionRegistered(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name                     string
+		key                      string
+		registerMissingExtension bool
+		expectedRegistered       bool
+		expectedErr              error
+	}{
+		{
+			name:               "registered extension",
+			key:                "com.vmware.govmomi.simulator",
+			expectedRegistered: true,
+		},
+		{
+			name:        "missing extension",
+			key:         "io.k8s.cloud-provider-vsphere",
+			expectedErr: vclib.ErrExtensionNotRegistered,
+		},
+		{
+			name:                     "missing extension is registered",
+			key:                      "io.k8s.cloud-provider-vsphere",
+			registerMissingExtension: true,
+			expectedRegistered:       true,
+		},
+		{
+			name:               "extension registered by the previous call",
+			key:                "io.k8s.cloud-provider-vsphere",
+			expectedRegistered: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection := &vclib.VSphereConnection{
+				Hostname:                 s.URL.Hostname(),
+				Port:                     s.URL.Port(),
+				Insecure:                 true,
+				Username:                 "user",
+				Password:                 "pass",
+				RegisterMissingExtension: test.registerMissingExtension,
+			}
+			defer connection.Logout(ctx)
+
+			registered, err := connection.EnsureExtensionRegistered(ctx, test.key)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", test.expectedErr, err)
+			}
+			if registered != test.expectedRegistered {
+				t.Errorf("Expected registered %t, got %t", test.expectedRegistered, registered)
+			}
+		})
+	}
+}
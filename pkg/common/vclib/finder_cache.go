@@ -0,0 +1,159 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// FinderCache memoizes inventory path lookups per datacenter, so that repeated finds
+// of the same managed object within TTL don't walk the inventory again.
+// Failed lookups are not cached.
+type FinderCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	lock    sync.Mutex
+	entries map[finderCacheKey]finderCacheEntry
+}
+
+type finderCacheKey struct {
+	datacenter types.ManagedObjectReference
+	kind       string
+	path       string
+}
+
+type finderCacheEntry struct {
+	ref           types.ManagedObjectReference
+	inventoryPath string
+	expires       time.Time
+}
+
+// NewFinderCache returns a FinderCache whose entries expire after ttl.
+func NewFinderCache(ttl time.Duration) *FinderCache {
+	return &FinderCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[finderCacheKey]finderCacheEntry),
+	}
+}
+
+// VirtualMachine returns the VM at vmPath in dc, see Datacenter.GetVMByPath.
+func (c *FinderCache) VirtualMachine(ctx context.Context, dc *Datacenter, vmPath string) (*VirtualMachine, error) {
+	ref, inventoryPath, err := c.find(dc, VirtualMachineType, vmPath, func(finder *find.Finder) (object.Reference, string, error) {
+		vm, err := finder.VirtualMachine(ctx, vmPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return vm, vm.InventoryPath, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	vm := object.NewVirtualMachine(dc.Client(), ref)
+	vm.InventoryPath = inventoryPath
+	return &VirtualMachine{vm, dc}, nil
+}
+
+// Datastore returns the datastore with the given name in dc.
+func (c *FinderCache) Datastore(ctx context.Context, dc *Datacenter, name string) (*Datastore, error) {
+	ref, inventoryPath, err := c.find(dc, "Datastore", name, func(finder *find.Finder) (object.Reference, string, error) {
+		ds, err := finder.Datastore(ctx, name)
+		if err != nil {
+			return nil, "", err
+		}
+		return ds, ds.InventoryPath, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ds := object.NewDatastore(dc.Client(), ref)
+	ds.InventoryPath = inventoryPath
+	return &Datastore{ds, dc}, nil
+}
+
+// Folder returns the folder at folderPath in dc, see Datacenter.GetFolderByPath.
+func (c *FinderCache) Folder(ctx context.Context, dc *Datacenter, folderPath string) (*Folder, error) {
+	ref, inventoryPath, err := c.find(dc, "Folder", folderPath, func(finder *find.Finder) (object.Reference, string, error) {
+		folder, err := finder.Folder(ctx, folderPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return folder, folder.InventoryPath, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	folder := object.NewFolder(dc.Client(), ref)
+	folder.InventoryPath = inventoryPath
+	return &Folder{folder, dc}, nil
+}
+
+// Invalidate drops all cached lookups of dc.
+func (c *FinderCache) Invalidate(dc *Datacenter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.entries {
+		if key.datacenter == dc.Reference() {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// InvalidateAll drops all cached lookups.
+func (c *FinderCache) InvalidateAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[finderCacheKey]finderCacheEntry)
+}
+
+// find returns the cached lookup of path, calling lookup with an uncached finder on a miss.
+func (c *FinderCache) find(dc *Datacenter, kind, path string,
+	lookup func(finder *find.Finder) (object.Reference, string, error)) (types.ManagedObjectReference, string, error) {
+	key := finderCacheKey{datacenter: dc.Reference(), kind: kind, path: path}
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if ok && c.now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.lock.Unlock()
+	if ok {
+		return entry.ref, entry.inventoryPath, nil
+	}
+
+	obj, inventoryPath, err := lookup(getFinder(dc))
+	if err != nil {
+		return types.ManagedObjectReference{}, "", err
+	}
+	entry = finderCacheEntry{
+		ref:           obj.Reference(),
+		inventoryPath: inventoryPath,
+		expires:       c.now().Add(c.ttl),
+	}
+
+	c.lock.Lock()
+	c.entries[key] = entry
+	c.lock.Unlock()
+	return entry.ref, entry.inventoryPath, nil
+}
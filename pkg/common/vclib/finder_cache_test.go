@@ -0,0 +1,163 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// countingRoundTripper counts the round trips made through it.
+type countingRoundTripper struct {
+	soap.RoundTripper
+	count int64
+}
+
+func (c *countingRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	atomic.AddInt64(&c.count, 1)
+	return c.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+// newFinderCacheTestDatacenter returns the default simulator datacenter, counting
+// the round trips made by its client.
+func newFinderCacheTestDatacenter(tb testing.TB) (*Datacenter, *countingRoundTripper) {
+	ctx := context.Background()
+
+	model := simulator.VPX()
+	if err := model.Create(); err != nil {
+		tb.Fatal(err)
+	}
+	s := model.Service.NewServer()
+	tb.Cleanup(func() {
+		s.Close()
+		model.Remove()
+	})
+
+	c, err := govmomi.NewClient(ctx, s.URL, true)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	counter := &countingRoundTripper{RoundTripper: c.Client.RoundTripper}
+	c.Client.RoundTripper = counter
+
+	dc, err := GetDatacenter(ctx, &VSphereConnection{Client: c.Client}, TestDefaultDatacenter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dc, counter
+}
+
+func TestFinderCache(t *testing.T) {
+	ctx := context.Background()
+	dc, counter := newFinderCacheTestDatacenter(t)
+	avm := simulator.Map.Any(VirtualMachineType).(*simulator.VirtualMachine)
+	vmPath := TestDefaultDatacenter + "/vm/" + avm.Name
+
+	expected, err := dc.GetVMByPath(ctx, vmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cache := NewFinderCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	lookup := func() int64 {
+		t.Helper()
+		before := atomic.LoadInt64(&counter.count)
+		vm, err := cache.VirtualMachine(ctx, dc, vmPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vm.Reference() != expected.Reference() {
+			t.Fatalf("Expected VM %s, got %s", expected.Reference(), vm.Reference())
+		}
+		if vm.InventoryPath != expected.InventoryPath {
+			t.Errorf("Expected inventory path %s, got %s", expected.InventoryPath, vm.InventoryPath)
+		}
+		return atomic.LoadInt64(&counter.count) - before
+	}
+
+	if calls := lookup(); calls == 0 {
+		t.Fatal("Expected the first lookup to walk the inventory")
+	}
+	if calls := lookup(); calls != 0 {
+		t.Errorf("Expected a cached lookup, got %d round trips", calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if calls := lookup(); calls == 0 {
+		t.Error("Expected the lookup to walk the inventory again after TTL expiry")
+	}
+	if calls := lookup(); calls != 0 {
+		t.Errorf("Expected the refreshed lookup to be cached, got %d round trips", calls)
+	}
+
+	cache.Invalidate(dc)
+	if calls := lookup(); calls == 0 {
+		t.Error("Expected the lookup to walk the inventory again after invalidation")
+	}
+
+	cache.InvalidateAll()
+	if calls := lookup(); calls == 0 {
+		t.Error("Expected the lookup to walk the inventory again after invalidating all")
+	}
+
+	if _, err := cache.VirtualMachine(ctx, dc, testNameNotFound); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := cache.Datastore(ctx, dc, TestDefaultDatastore); err != nil {
+		t.Error(err)
+	}
+	if _, err := cache.Folder(ctx, dc, TestDefaultDatacenter+"/vm"); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkGetVMByPath(b *testing.B) {
+	ctx := context.Background()
+	dc, counter := newFinderCacheTestDatacenter(b)
+	avm := simulator.Map.Any(VirtualMachineType).(*simulator.VirtualMachine)
+	vmPath := TestDefaultDatacenter + "/vm/" + avm.Name
+
+	b.Run("uncached", func(b *testing.B) {
+		atomic.StoreInt64(&counter.count, 0)
+		for i := 0; i < b.N; i++ {
+			if _, err := dc.GetVMByPath(ctx, vmPath); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&counter.count))/float64(b.N), "roundtrips/op")
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cache := NewFinderCache(time.Minute)
+		atomic.StoreInt64(&counter.count, 0)
+		for i := 0; i < b.N; i++ {
+			if _, err := cache.VirtualMachine(ctx, dc, vmPath); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&counter.count))/float64(b.N), "roundtrips/op")
+	})
+}
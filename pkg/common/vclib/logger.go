@@ -0,0 +1,56 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2/klogr"
+)
+
+var logger = klogr.New().WithName("vclib")
+
+// SetLogger replaces the klog backed logger of the package, e.g. to route its logs
+// into a controller-runtime logger. It should be called before any connection is made.
+func SetLogger(l logr.Logger) {
+	logger = l
+}
+
+// correlationIDKey is the context key of the correlation ID added by WithCorrelationID.
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the given correlation ID, which the logs
+// of vclib calls made with the context include as the correlationID field, e.g. to find the
+// connect and login logs of a specific reconcile.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation ID added to ctx by WithCorrelationID.
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
+
+// loggerFor returns the logger of the package, with the correlation ID of ctx if any.
+func loggerFor(ctx context.Context) logr.Logger {
+	if id, ok := CorrelationIDFromContext(ctx); ok {
+		return logger.WithValues("correlationID", id)
+	}
+	return logger
+}
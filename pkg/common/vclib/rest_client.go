@@ -0,0 +1,94 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	neturl "net/url"
+
+	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25"
+)
+
+// RESTClient connects if needed and returns a vAPI REST client of vCenter, e.g. for tags and
+// content libraries, logged in with the credentials of the connection. The client shares the
+// TLS settings of the SOAP client and is cached until a new SOAP client is created. Logout
+// logs out both.
+func (connection *VSphereConnection) RESTClient(ctx context.Context) (*rest.Client, error) {
+	client, err := connection.ClientOrConnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if connection.restClient != nil && connection.restClientOwner == client {
+		return connection.restClient, nil
+	}
+
+	rc := rest.NewClient(client)
+	if err := connection.restLogin(ctx, client, rc); err != nil {
+		loggerFor(ctx).Error(err, "Failed to login to the REST API", "server", connection.Hostname)
+		return nil, err
+	}
+	if stale := connection.restClient; stale != nil {
+		if err := stale.Logout(ctx); err != nil {
+			loggerFor(ctx).V(3).Info("Failed to logout the stale REST client", "server", connection.Hostname, "err", err)
+		}
+	}
+	connection.restClient, connection.restClientOwner = rc, client
+	return rc, nil
+}
+
+// restLogin logs rc in with a SAML token issued for the client certificate, the bearer token,
+// or the username and password, whichever is configured first.
+func (connection *VSphereConnection) restLogin(ctx context.Context, client *vim25.Client, rc *rest.Client) error {
+	signer, err := connection.Signer(ctx, client)
+	if err != nil {
+		return err
+	}
+	connection.credentialsLock.Lock()
+	username, password, token := connection.Username, connection.Password, connection.BearerToken
+	connection.credentialsLock.Unlock()
+
+	switch {
+	case signer != nil:
+		loggerFor(ctx).V(3).Info("REST login with client certificate", "server", connection.Hostname)
+		return rc.LoginByToken(rc.WithSigner(ctx, signer))
+	case token != "":
+		loggerFor(ctx).V(3).Info("REST login with bearer token", "server", connection.Hostname)
+		return rc.LoginByToken(rc.WithSigner(ctx, &sts.Signer{Token: token}))
+	}
+	loggerFor(ctx).V(3).Info("REST login", "server", connection.Hostname, "username", username)
+	return rc.Login(ctx, neturl.UserPassword(username, password))
+}
+
+// logoutREST logs out the cached REST client, if any.
+func (connection *VSphereConnection) logoutREST(ctx context.Context) {
+	clientLock.Lock()
+	rc := connection.restClient
+	connection.restClient, connection.restClientOwner = nil, nil
+	clientLock.Unlock()
+
+	if rc == nil {
+		return
+	}
+	if err := rc.Logout(ctx); err != nil {
+		loggerFor(ctx).Error(err, "REST logout failed", "server", connection.Hostname)
+	}
+}
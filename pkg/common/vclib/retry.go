@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"time"
+
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// retryRoundTripper retries failed round trips with an exponential backoff.
+type retryRoundTripper struct {
+	roundTripper soap.RoundTripper
+	// count is the maximum number of attempts, including the first one.
+	count        int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	// retryable reports whether an error other than a temporary network error is retried.
+	retryable func(err error) bool
+}
+
+// newRetryRoundTripper wraps rt with the retry settings of the connection.
+func (connection *VSphereConnection) newRetryRoundTripper(rt soap.RoundTripper) soap.RoundTripper {
+	count := connection.RoundTripperCount
+	if count == 0 {
+		count = RoundTripperDefaultCount
+	}
+	multiplier := connection.RetryMultiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	return &retryRoundTripper{
+		roundTripper: rt,
+		count:        int(count),
+		initialDelay: connection.RetryInitialDelay,
+		maxDelay:     connection.RetryMaxDelay,
+		multiplier:   multiplier,
+		retryable:    connection.RetryableFault,
+	}
+}
+
+// RoundTrip implements soap.RoundTripper.
+func (r *retryRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	delay := r.initialDelay
+	for attempt := 1; ; attempt++ {
+		err := r.roundTripper.RoundTrip(ctx, req, res)
+		if err == nil || attempt >= r.count || !r.shouldRetry(err) {
+			return err
+		}
+		logger.V(4).Info("Round trip failed, retrying", "attempt", attempt, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay = time.Duration(float64(delay) * r.multiplier)
+		if r.maxDelay > 0 && delay > r.maxDelay {
+			delay = r.maxDelay
+		}
+	}
+}
+
+func (r *retryRoundTripper) shouldRetry(err error) bool {
+	if vim25.IsTemporaryNetworkError(err) {
+		return true
+	}
+	return r.retryable != nil && r.retryable(err)
+}
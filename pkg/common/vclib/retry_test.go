@@ -0,0 +1,125 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+var errTransientFault = errors.New("transient fault")
+
+// failingRoundTripper fails the first failures round trips with err.
+type failingRoundTripper struct {
+	failures int
+	err      error
+	calls    int
+	times    []time.Time
+}
+
+func (f *failingRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	f.calls++
+	f.times = append(f.times, time.Now())
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestRetryRoundTripper(t *testing.T) {
+	temporaryErr := &net.DNSError{Err: "temporary failure", IsTemporary: true}
+
+	tests := []struct {
+		name          string
+		connection    *VSphereConnection
+		err           error
+		expectedCalls int
+		expectErr     bool
+	}{
+		{
+			name:          "temporary network error succeeds on the third attempt",
+			connection:    &VSphereConnection{},
+			err:           temporaryErr,
+			expectedCalls: 3,
+		},
+		{
+			name:          "retries exhausted",
+			connection:    &VSphereConnection{RoundTripperCount: 2},
+			err:           temporaryErr,
+			expectedCalls: 2,
+			expectErr:     true,
+		},
+		{
+			name:          "fault not retried without predicate",
+			connection:    &VSphereConnection{},
+			err:           errTransientFault,
+			expectedCalls: 1,
+			expectErr:     true,
+		},
+		{
+			name: "fault retried with predicate",
+			connection: &VSphereConnection{
+				RetryableFault: func(err error) bool { return errors.Is(err, errTransientFault) },
+			},
+			err:           errTransientFault,
+			expectedCalls: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rt := &failingRoundTripper{failures: 2, err: test.err}
+			err := test.connection.newRetryRoundTripper(rt).RoundTrip(context.Background(), nil, nil)
+			if test.expectErr != (err != nil) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if rt.calls != test.expectedCalls {
+				t.Errorf("Expected %d round trips, got %d", test.expectedCalls, rt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryRoundTripperBackoff(t *testing.T) {
+	connection := &VSphereConnection{
+		RoundTripperCount: 4,
+		RetryInitialDelay: 20 * time.Millisecond,
+		RetryMaxDelay:     50 * time.Millisecond,
+		RetryMultiplier:   4,
+	}
+	rt := &failingRoundTripper{failures: 3, err: &net.DNSError{IsTemporary: true}}
+
+	if err := connection.newRetryRoundTripper(rt).RoundTrip(context.Background(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 20ms, then 80ms capped to 50ms, then 50ms
+	minDelays := []time.Duration{20 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i, minDelay := range minDelays {
+		if delay := rt.times[i+1].Sub(rt.times[i]); delay < minDelay {
+			t.Errorf("Expected retry %d after at least %s, got %s", i+1, minDelay, delay)
+		}
+	}
+	if total := rt.times[3].Sub(rt.times[0]); total > time.Second {
+		t.Errorf("Expected the delay to be capped, retries took %s", total)
+	}
+}
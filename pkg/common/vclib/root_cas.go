@@ -0,0 +1,175 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRootCAPools is the number of CACert values whose pools are cached
+const maxRootCAPools = 32
+
+// rootCAFile is a CA certificate file as of when its pool was read
+type rootCAFile struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+// rootCAPool is a cached pool and the files it was read from, if any
+type rootCAPool struct {
+	pool  *x509.CertPool
+	files []rootCAFile
+}
+
+// rootCAPoolCache caches the pools of up to max CACert values, evicting the least recently
+// used. The pool of a list of files is read again when one of them was modified.
+type rootCAPoolCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*rootCAPool
+	// order are the keys of entries, the least recently used first
+	order []string
+}
+
+func newRootCAPoolCache(max int) *rootCAPoolCache {
+	return &rootCAPoolCache{max: max, entries: make(map[string]*rootCAPool)}
+}
+
+// get returns the pool cached for key, or nil if there is none
+func (c *rootCAPoolCache) get(key string) *rootCAPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok {
+		c.touch(key)
+	}
+	return entry
+}
+
+// put caches entry for key, evicting the least recently used entry if the cache is full
+func (c *rootCAPoolCache) put(key string, entry *rootCAPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = entry
+	c.touch(key)
+}
+
+// touch moves key to the end of order. Must be called with mu held.
+func (c *rootCAPoolCache) touch(key string) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, key)
+}
+
+// len returns the number of cached pools
+func (c *rootCAPoolCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// rootCAs returns the pool of the CA certificates in CACert, which is either inline PEM or a
+// list of PEM files, optionally prefixed with file://, separated by the OS path list separator.
+// Pools are cached by CACert, and the files are only read again once modified.
+func (connection *VSphereConnection) rootCAs() (*x509.CertPool, error) {
+	if strings.HasPrefix(strings.TrimSpace(connection.CACert), "-----BEGIN") {
+		sum := sha256.Sum256([]byte(connection.CACert))
+		key := "pem:" + hex.EncodeToString(sum[:])
+		if entry := rootCAPools.get(key); entry != nil {
+			return entry.pool, nil
+		}
+		pool, err := newRootCAPool([]byte(connection.CACert))
+		if err != nil {
+			return nil, err
+		}
+		rootCAPools.put(key, &rootCAPool{pool: pool})
+		return pool, nil
+	}
+
+	names := filepath.SplitList(strings.TrimPrefix(connection.CACert, "file://"))
+	files := make([]rootCAFile, 0, len(names))
+	for _, name := range names {
+		name = filepath.Clean(name)
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rootCAFile{name: name, modTime: info.ModTime(), size: info.Size()})
+	}
+	key := "files:" + connection.CACert
+	if entry := rootCAPools.get(key); entry != nil && sameRootCAFiles(entry.files, files) {
+		return entry.pool, nil
+	}
+
+	var pemData []byte
+	for _, file := range files {
+		data, err := os.ReadFile(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if block, _ := pem.Decode(data); block == nil {
+			return nil, fmt.Errorf("invalid certificate '%s', cannot be used as a trusted CA certificate", file.name)
+		}
+		pemData = append(append(pemData, data...), '\n')
+	}
+	pool, err := newRootCAPool(pemData)
+	if err != nil {
+		return nil, err
+	}
+	rootCAPools.put(key, &rootCAPool{pool: pool, files: files})
+	return pool, nil
+}
+
+// newRootCAPool returns a pool of the CA certificates in pemData
+func newRootCAPool(pemData []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("invalid certificate in CACert, cannot be used as a trusted CA certificate")
+	}
+	return pool, nil
+}
+
+// sameRootCAFiles returns whether the files a pool was read from are unmodified
+func sameRootCAFiles(cached, current []rootCAFile) bool {
+	if len(cached) != len(current) {
+		return false
+	}
+	for i := range cached {
+		if cached[i].name != current[i].name || !cached[i].modTime.Equal(current[i].modTime) || cached[i].size != current[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib/fixtures"
+)
+
+func TestRootCAs_ReadsModifiedFiles(t *testing.T) {
+	caPEM, err := os.ReadFile(fixtures.CaCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPEM, err := os.ReadFile(fixtures.ServerCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	connection := &VSphereConnection{CACert: "file://" + caFile}
+
+	pool, err := connection.rootCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := connection.rootCAs(); err != nil || cached != pool {
+		t.Errorf("Expected the pool of the unmodified file to be cached, got %v", err)
+	}
+
+	if err := os.WriteFile(caFile, serverPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	reread, err := connection.rootCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reread == pool {
+		t.Fatal("Expected the modified file to be read again")
+	}
+	expected := x509.NewCertPool()
+	expected.AppendCertsFromPEM(serverPEM)
+	if !reread.Equal(expected) {
+		t.Error("Expected the pool of the modified file")
+	}
+}
+
+func TestRootCAPoolCache_Bounded(t *testing.T) {
+	cache := newRootCAPoolCache(2)
+	first, second, third := &rootCAPool{}, &rootCAPool{}, &rootCAPool{}
+	cache.put("first", first)
+	cache.put("second", second)
+	// first is now the most recently used
+	if cache.get("first") != first {
+		t.Fatal("Expected first to be cached")
+	}
+	cache.put("third", third)
+
+	if n := cache.len(); n != 2 {
+		t.Errorf("Expected the cache to be bounded to 2 pools, got %d", n)
+	}
+	if cache.get("second") != nil {
+		t.Error("Expected the least recently used pool to be evicted")
+	}
+	if cache.get("first") != first || cache.get("third") != third {
+		t.Error("Expected the recently used pools to be kept")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/vmware/govmomi/session"
+)
+
+// sessionManagerResponseLimit bounds the size of a session manager response that is read
+const sessionManagerResponseLimit = 64 * 1024
+
+// sharedSessionResponse is the response of a session manager to a clone ticket request
+type sharedSessionResponse struct {
+	// Token is a clone ticket of the vCenter session shared by the session manager
+	Token string `json:"token"`
+}
+
+// GetSharedToken requests a clone ticket of the vCenter session shared by the session manager
+// at url, authenticating with the bearer token. The session manager certificate is verified
+// against CACert or the system roots, unless Insecure is set.
+func (connection *VSphereConnection) GetSharedToken(ctx context.Context, url, token string) (string, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: connection.Insecure}
+	if connection.CACert != "" {
+		rootCAs, err := connection.rootCAs()
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSessionManager, err)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSessionManager, err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, sessionManagerResponseLimit))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSessionManager, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s returned %s", ErrSessionManager, url, response.Status)
+	}
+	var shared sharedSessionResponse
+	if err := json.Unmarshal(body, &shared); err != nil {
+		return "", fmt.Errorf("%w: %s returned an invalid response: %v", ErrSessionManager, url, err)
+	}
+	if shared.Token == "" {
+		return "", fmt.Errorf("%w: %s returned no token", ErrSessionManager, url)
+	}
+	return shared.Token, nil
+}
+
+// cloneSession clones the vCenter session shared by the session manager at url into the
+// session of m.
+func (connection *VSphereConnection) cloneSession(ctx context.Context, m *session.Manager, url, token string) error {
+	ticket, err := connection.GetSharedToken(ctx, url, token)
+	if err != nil {
+		return err
+	}
+	loggerFor(ctx).V(3).Info("SessionManager.CloneSession with the ticket of the session manager", "server", connection.Hostname)
+	return m.CloneSession(ctx, ticket)
+}
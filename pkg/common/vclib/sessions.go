@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// SessionInfo describes a vCenter session.
+type SessionInfo struct {
+	Key            string
+	UserName       string
+	LoginTime      time.Time
+	LastActiveTime time.Time
+	UserAgent      string
+	// Current is whether the session is the one of the connection listing the sessions
+	Current bool
+}
+
+// ListSessions returns the sessions of the user of the connection, e.g. to find sessions
+// left behind by earlier instances of the cloud provider. vCenter only lists other
+// sessions to users with the Sessions.TerminateSession privilege.
+func (connection *VSphereConnection) ListSessions(ctx context.Context) (_ []SessionInfo, err error) {
+	ctx, span := connection.startSpan(ctx, "ListSessions")
+	defer func() { endSpan(span, err) }()
+
+	client, err := connection.ClientOrConnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return connection.listSessions(ctx, client)
+}
+
+// listSessions implements ListSessions with the given client.
+func (connection *VSphereConnection) listSessions(ctx context.Context, client *vim25.Client) ([]SessionInfo, error) {
+	var sm mo.SessionManager
+	pc := property.DefaultCollector(client)
+	err := pc.RetrieveOne(ctx, *client.ServiceContent.SessionManager, []string{"sessionList", "currentSession"}, &sm)
+	if err != nil {
+		loggerFor(ctx).Error(err, "Failed to retrieve session list", "server", connection.Hostname)
+		return nil, err
+	}
+	if sm.CurrentSession == nil {
+		return nil, nil
+	}
+
+	var sessions []SessionInfo
+	for _, s := range sm.SessionList {
+		if s.UserName != sm.CurrentSession.UserName {
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			Key:            s.Key,
+			UserName:       s.UserName,
+			LoginTime:      s.LoginTime,
+			LastActiveTime: s.LastActiveTime,
+			UserAgent:      s.UserAgent,
+			Current:        s.Key == sm.CurrentSession.Key,
+		})
+	}
+	return sessions, nil
+}
+
+// TerminateStaleSessions terminates the sessions of the user of the connection that were
+// created with the same user agent, of any build version, and were not active for longer
+// than olderThan, e.g. sessions left behind by earlier instances of the cloud provider that
+// crashed before logging out. The current session is never terminated.
+func (connection *VSphereConnection) TerminateStaleSessions(ctx context.Context, olderThan time.Duration) (err error) {
+	ctx, span := connection.startSpan(ctx, "TerminateStaleSessions")
+	defer func() { endSpan(span, err) }()
+
+	client, err := connection.ClientOrConnect(ctx)
+	if err != nil {
+		return err
+	}
+	return connection.terminateStaleSessions(ctx, client, olderThan)
+}
+
+// terminateStaleSessions implements TerminateStaleSessions with the given client.
+func (connection *VSphereConnection) terminateStaleSessions(ctx context.Context, client *vim25.Client, olderThan time.Duration) error {
+	sessions, err := connection.listSessions(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	prefix := connection.userAgentName() + "/"
+	cutoff := time.Now().Add(-olderThan)
+	var stale []string
+	for _, s := range sessions {
+		if !s.Current && strings.HasPrefix(s.UserAgent, prefix) && s.LastActiveTime.Before(cutoff) {
+			stale = append(stale, s.Key)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	loggerFor(ctx).Info("Terminating stale sessions", "server", connection.Hostname, "count", len(stale), "olderThan", olderThan)
+	return session.NewManager(client).TerminateSession(ctx, stale)
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/session"
+	"k8s.io/component-base/version"
+
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+)
+
+func TestListSessions(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+
+	connect := func(username, userAgent string) *vclib.VSphereConnection {
+		connection := &vclib.VSphereConnection{
+			Hostname:  s.URL.Hostname(),
+			Port:      s.URL.Port(),
+			Insecure:  true,
+			Username:  username,
+			Password:  "pass",
+			UserAgent: userAgent,
+		}
+		if err := connection.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { connection.Logout(ctx) })
+		return connection
+	}
+	connection := connect("user", "ccm-cluster-a")
+	other := connect("user", "")
+	connect("other-user", "ccm-cluster-a")
+
+	sessions, err := connection.ListSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected the 2 sessions of user, got %+v", sessions)
+	}
+
+	expectedUserAgents := map[bool]string{
+		true:  "ccm-cluster-a/" + version.Get().GitVersion,
+		false: "k8s-cloud-provider-vsphere/" + version.Get().GitVersion,
+	}
+	current := 0
+	for _, session := range sessions {
+		if session.Current {
+			current++
+		}
+		if session.UserName != "user" {
+			t.Errorf("Expected only sessions of user, got %+v", session)
+		}
+		if session.Key == "" || session.LoginTime.IsZero() || session.LastActiveTime.IsZero() {
+			t.Errorf("Expected key, login and last active time to be set, got %+v", session)
+		}
+		if session.UserAgent != expectedUserAgents[session.Current] {
+			t.Errorf("Expected user agent %q, got %+v", expectedUserAgents[session.Current], session)
+		}
+	}
+	if current != 1 {
+		t.Errorf("Expected one current session, got %d", current)
+	}
+
+	otherSessions, err := other.ListSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range otherSessions {
+		if session.Current && session.UserAgent != expectedUserAgents[false] {
+			t.Errorf("Expected the current session of the other connection to be its own, got %+v", session)
+		}
+	}
+}
+
+func TestTerminateStaleSessions(t *testing.T) {
+	s := newTestVCSim(t)
+	ctx := context.Background()
+
+	newConnection := func(username, userAgent string) *vclib.VSphereConnection {
+		return &vclib.VSphereConnection{
+			Hostname:  s.URL.Hostname(),
+			Port:      s.URL.Port(),
+			Insecure:  true,
+			Username:  username,
+			Password:  "pass",
+			UserAgent: userAgent,
+		}
+	}
+	connect := func(username, userAgent string) *vclib.VSphereConnection {
+		connection := newConnection(username, userAgent)
+		if err := connection.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return connection
+	}
+	isActive := func(connection *vclib.VSphereConnection) bool {
+		userSession, err := session.NewManager(connection.Client).UserSession(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userSession != nil
+	}
+
+	const staleSessionAge = 500 * time.Millisecond
+	stale := connect("user", "ccm")
+	staleOtherUserAgent := connect("user", "other-tool")
+	time.Sleep(2 * staleSessionAge)
+	fresh := connect("user", "ccm")
+
+	connection := newConnection("user", "ccm")
+	connection.StaleSessionAge = staleSessionAge
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if isActive(stale) {
+		t.Error("Expected the stale session with the same user agent to be terminated")
+	}
+	if !isActive(staleOtherUserAgent) {
+		t.Error("Expected the stale session with another user agent to survive")
+	}
+	if !isActive(fresh) {
+		t.Error("Expected the recently active session to survive")
+	}
+	if !isActive(connection) {
+		t.Error("Expected the current session to survive")
+	}
+
+	// The stale sessions are only terminated on the first Connect, or on request
+	time.Sleep(2 * staleSessionAge)
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !isActive(staleOtherUserAgent) || !isActive(connection) {
+		t.Error("Expected the sessions to survive a later Connect")
+	}
+	if err := connection.TerminateStaleSessions(ctx, staleSessionAge); err != nil {
+		t.Fatal(err)
+	}
+	if !isActive(connection) {
+		t.Error("Expected the current session to survive")
+	}
+	if isActive(fresh) {
+		t.Error("Expected the session that became stale to be terminated")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// soapDebugVerbosity is the log verbosity of the SOAP bodies logged when DebugSOAP is set.
+const soapDebugVerbosity = 8
+
+const redacted = "<redacted>"
+
+var (
+	// sensitiveElement matches the start tag and text of elements holding credentials, e.g. the
+	// password of Login or the ticket of CloneSession
+	sensitiveElement = regexp.MustCompile(`(?i)(<[\w:]*(?:password|token|ticket|secret|cookie)\w*(?:\s[^>]*)?>)[^<]*`)
+	// sensitiveMethod matches the methods whose response is a credential, e.g. AcquireCloneTicket
+	sensitiveMethod = regexp.MustCompile(`(?i)ticket|token`)
+)
+
+// debugRoundTripper logs the redacted SOAP request and response bodies of round trips.
+type debugRoundTripper struct {
+	roundTripper soap.RoundTripper
+}
+
+// newDebugRoundTripper wraps rt to log the SOAP bodies if DebugSOAP is set, or returns rt.
+func (connection *VSphereConnection) newDebugRoundTripper(rt soap.RoundTripper) soap.RoundTripper {
+	if !connection.DebugSOAP {
+		return rt
+	}
+	return &debugRoundTripper{roundTripper: rt}
+}
+
+// RoundTrip implements soap.RoundTripper.
+func (d *debugRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	log := loggerFor(ctx).V(soapDebugVerbosity)
+	if !log.Enabled() {
+		return d.roundTripper.RoundTrip(ctx, req, res)
+	}
+
+	method := soapMethod(req)
+	log.Info("SOAP request", "method", method, "body", redactSOAP(req))
+	start := time.Now()
+	err := d.roundTripper.RoundTrip(ctx, req, res)
+	if err != nil {
+		log.Info("SOAP request failed", "method", method, "duration", time.Since(start), "err", err)
+		return err
+	}
+
+	body := redacted
+	if !sensitiveMethod.MatchString(method) {
+		body = redactSOAP(res)
+	}
+	log.Info("SOAP response", "method", method, "duration", time.Since(start), "body", body)
+	return nil
+}
+
+// soapMethod returns the name of the method of the SOAP body v, e.g. Login for *methods.LoginBody.
+func soapMethod(v soap.HasFault) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return strings.TrimSuffix(t.Name(), "Body")
+}
+
+// redactSOAP returns the XML encoding of v with the text of credential elements redacted.
+func redactSOAP(v any) string {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("<failed to encode: %v>", err)
+	}
+	return sensitiveElement.ReplaceAllString(string(b), "${1}"+redacted)
+}
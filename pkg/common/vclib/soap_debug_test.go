@@ -0,0 +1,105 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/vmware/govmomi/session"
+	"k8s.io/klog/v2/klogr"
+
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+)
+
+func TestDebugSOAP(t *testing.T) {
+	const password = "s3cret-passw0rd"
+	tests := []struct {
+		name         string
+		debugSOAP    bool
+		expectBodies bool
+	}{
+		{
+			name:         "enabled",
+			debugSOAP:    true,
+			expectBodies: true,
+		},
+		{
+			name: "disabled",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var lines []string
+			vclib.SetLogger(funcr.New(func(prefix, args string) {
+				lock.Lock()
+				defer lock.Unlock()
+				lines = append(lines, args)
+			}, funcr.Options{Verbosity: 8}))
+			defer vclib.SetLogger(klogr.New().WithName("vclib"))
+
+			s := newTestVCSim(t)
+			connection := &vclib.VSphereConnection{
+				Hostname:  s.URL.Hostname(),
+				Port:      s.URL.Port(),
+				Insecure:  true,
+				Username:  "debug-user",
+				Password:  password,
+				DebugSOAP: test.debugSOAP,
+			}
+			ctx := context.Background()
+			if err := connection.Connect(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Logout(ctx)
+			ticket, err := session.NewManager(connection.Client).AcquireCloneTicket(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			var login, cloneTicket bool
+			for _, line := range lines {
+				if strings.Contains(line, password) {
+					t.Errorf("Expected the password to be redacted: %s", line)
+				}
+				if strings.Contains(line, ticket) {
+					t.Errorf("Expected the clone ticket to be redacted: %s", line)
+				}
+				if strings.Contains(line, `"msg"="SOAP request"`) && strings.Contains(line, `"method"="Login"`) {
+					login = true
+					if !strings.Contains(line, "debug-user") || !strings.Contains(line, "<password><redacted></password>") {
+						t.Errorf("Expected the user name and a redacted password in the Login request: %s", line)
+					}
+				}
+				if strings.Contains(line, `"msg"="SOAP response"`) && strings.Contains(line, `"method"="AcquireCloneTicket"`) {
+					cloneTicket = true
+				}
+			}
+			if login != test.expectBodies || cloneTicket != test.expectBodies {
+				t.Errorf("Expected the SOAP bodies to be logged: %t, got Login %t, AcquireCloneTicket %t: %v",
+					test.expectBodies, login, cloneTicket, lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+
+// startSpan starts a span for a vCenter operation of the connection. The span is a
+// no-op unless a tracer provider is registered with otel.SetTracerProvider.
+func (connection *VSphereConnection) startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "vclib."+operation, trace.WithAttributes(
+		attribute.String("vsphere.server", connection.Hostname),
+		attribute.String("vsphere.operation", operation),
+	))
+}
+
+// endSpan records the result of the operation and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("vsphere.result", "error"))
+	} else {
+		span.SetAttributes(attribute.String("vsphere.result", "success"))
+	}
+	span.End()
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package vclib
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -32,13 +34,9 @@ import (
 
 // IsNotFound return true if err is NotFoundError or DefaultNotFoundError
 func IsNotFound(err error) bool {
-	_, ok := err.(*find.NotFoundError)
-	if ok {
-		return true
-	}
-
-	_, ok = err.(*find.DefaultNotFoundError)
-	return ok
+	var notFound *find.NotFoundError
+	var defaultNotFound *find.DefaultNotFoundError
+	return errors.As(err, &notFound) || errors.As(err, &defaultNotFound)
 }
 
 func getFinder(dc *Datacenter) *find.Finder {
@@ -159,22 +157,176 @@ func IsValidUUID(uuid string) bool {
 	return r.MatchString(uuid)
 }
 
+// ErrorCategory classifies errors returned by vCenter, see ClassifyError
+type ErrorCategory int
+
+const (
+	// ErrorCategoryUnknown is any error not covered by another category, or nil
+	ErrorCategoryUnknown ErrorCategory = iota
+	// ErrorCategoryNotFound is an inventory lookup that found nothing or a ManagedObjectNotFound fault
+	ErrorCategoryNotFound
+	// ErrorCategoryInvalidCredentials is an InvalidLogin fault
+	ErrorCategoryInvalidCredentials
+	// ErrorCategoryNoPermission is a NoPermission fault
+	ErrorCategoryNoPermission
+	// ErrorCategoryTimeout is a network timeout or a Timedout fault
+	ErrorCategoryTimeout
+	// ErrorCategoryTransient is a temporary network error or a HostCommunication fault
+	ErrorCategoryTransient
+	// ErrorCategoryNoCredentials is ErrNoAuthMethodConfigured, no login was attempted
+	ErrorCategoryNoCredentials
+)
+
+var errorCategoryNames = map[ErrorCategory]string{
+	ErrorCategoryUnknown:            "Unknown",
+	ErrorCategoryNotFound:           "NotFound",
+	ErrorCategoryInvalidCredentials: "InvalidCredentials",
+	ErrorCategoryNoPermission:       "NoPermission",
+	ErrorCategoryTimeout:            "Timeout",
+	ErrorCategoryTransient:          "Transient",
+	ErrorCategoryNoCredentials:      "NoCredentials",
+}
+
+func (c ErrorCategory) String() string {
+	return errorCategoryNames[c]
+}
+
+// ClassifyError returns the category of err, looking through wrapped errors
+func ClassifyError(err error) ErrorCategory {
+	if err == nil {
+		return ErrorCategoryUnknown
+	}
+
+	switch {
+	case errors.Is(err, ErrNoAuthMethodConfigured):
+		return ErrorCategoryNoCredentials
+	case IsNotFound(err), IsManagedObjectNotFoundError(err):
+		return ErrorCategoryNotFound
+	case IsInvalidCredentialsError(err):
+		return ErrorCategoryInvalidCredentials
+	}
+	if noPermission, _ := IsNoPermissionError(err); noPermission {
+		return ErrorCategoryNoPermission
+	}
+	if IsTimeout(err) {
+		return ErrorCategoryTimeout
+	}
+	if IsTemporaryNetworkError(err) {
+		return ErrorCategoryTransient
+	}
+	return ErrorCategoryUnknown
+}
+
 // IsManagedObjectNotFoundError returns true if error is of type ManagedObjectNotFound
 func IsManagedObjectNotFoundError(err error) bool {
-	isManagedObjectNotFoundError := false
-	if soap.IsSoapFault(err) {
-		_, isManagedObjectNotFoundError = soap.ToSoapFault(err).VimFault().(types.ManagedObjectNotFound)
+	switch vimFault(err).(type) {
+	case types.ManagedObjectNotFound, *types.ManagedObjectNotFound:
+		return true
 	}
-	return isManagedObjectNotFoundError
+	return false
 }
 
 // IsInvalidCredentialsError returns true if error is of type InvalidLogin
 func IsInvalidCredentialsError(err error) bool {
-	isInvalidCredentialsError := false
-	if soap.IsSoapFault(err) {
-		_, isInvalidCredentialsError = soap.ToSoapFault(err).VimFault().(types.InvalidLogin)
+	switch vimFault(err).(type) {
+	case types.InvalidLogin, *types.InvalidLogin:
+		return true
+	}
+	return false
+}
+
+// IsNoPermissionError returns true if error is of type NoPermission, along with the IDs
+// of the privileges the fault reports as missing
+func IsNoPermissionError(err error) (bool, []string) {
+	var fault types.NoPermission
+	switch f := vimFault(err).(type) {
+	case types.NoPermission:
+		fault = f
+	case *types.NoPermission:
+		fault = *f
+	default:
+		return false, nil
+	}
+
+	var privileges []string
+	seen := make(map[string]bool)
+	add := func(privilege string) {
+		if privilege != "" && !seen[privilege] {
+			seen[privilege] = true
+			privileges = append(privileges, privilege)
+		}
+	}
+	for _, missing := range fault.MissingPrivileges {
+		for _, privilege := range missing.PrivilegeIds {
+			add(privilege)
+		}
+	}
+	// PrivilegeId is deprecated in favor of MissingPrivileges, but is the only one set before vSphere 8.0
+	add(fault.PrivilegeId)
+	return true, privileges
+}
+
+// IsDuplicateNameError returns true if err, or an error it wraps, is a DuplicateName fault.
+// The object already exists and can be adopted instead of created.
+func IsDuplicateNameError(err error) bool {
+	switch vimFault(err).(type) {
+	case types.DuplicateName, *types.DuplicateName:
+		return true
+	}
+	return false
+}
+
+// IsResourceInUseError returns true if err, or an error it wraps, is a ResourceInUse fault.
+// The resource is held by another operation, so the call can be retried later.
+func IsResourceInUseError(err error) bool {
+	switch vimFault(err).(type) {
+	case types.ResourceInUse, *types.ResourceInUse:
+		return true
 	}
-	return isInvalidCredentialsError
+	return false
+}
+
+// IsTimeout returns true if err, or an error it wraps, is a network timeout or a Timedout fault
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	switch vimFault(err).(type) {
+	case types.Timedout, *types.Timedout:
+		return true
+	}
+	return false
+}
+
+// IsTemporaryNetworkError returns true if err, or an error it wraps, is a timeout, a temporary
+// network error or a HostCommunication fault. Such errors are worth retrying.
+func IsTemporaryNetworkError(err error) bool {
+	if IsTimeout(err) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	switch vimFault(err).(type) {
+	case types.HostCommunication, *types.HostCommunication:
+		return true
+	}
+	return false
+}
+
+// vimFault returns the fault of the first soap or vim fault in the chain of err, or nil
+func vimFault(err error) types.AnyType {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if soap.IsSoapFault(err) {
+			return soap.ToSoapFault(err).VimFault()
+		}
+		if soap.IsVimFault(err) {
+			return soap.ToVimFault(err)
+		}
+	}
+	return nil
 }
 
 // VerifyVolumePathsForVM verifies if the volume paths (volPaths) are attached to VM.
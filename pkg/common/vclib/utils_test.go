@@ -18,10 +18,18 @@ package vclib
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
 	"testing"
 
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 func TestUtils(t *testing.T) {
@@ -69,3 +77,256 @@ func TestUtils(t *testing.T) {
 		t.Errorf("unexpected error: %s", err)
 	}
 }
+
+func soapFault(fault types.AnyType) error {
+	f := &soap.Fault{}
+	f.Detail.Fault = fault
+	return soap.WrapSoapFault(f)
+}
+
+func TestErrorClassifiers(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		expectTimeout   bool
+		expectTemporary bool
+	}{
+		{
+			name:            "wrapped net.Error timeout",
+			err:             fmt.Errorf("login: %w", &url.Error{Op: "Post", URL: "https://vc/sdk", Err: &net.DNSError{IsTimeout: true}}),
+			expectTimeout:   true,
+			expectTemporary: true,
+		},
+		{
+			name:            "temporary net.Error",
+			err:             &url.Error{Op: "Post", URL: "https://vc/sdk", Err: &net.DNSError{IsTemporary: true}},
+			expectTemporary: true,
+		},
+		{
+			name:            "Timedout soap fault",
+			err:             fmt.Errorf("wrapped: %w", soapFault(types.Timedout{})),
+			expectTimeout:   true,
+			expectTemporary: true,
+		},
+		{
+			name:            "HostCommunication vim fault",
+			err:             soap.WrapVimFault(&types.HostCommunication{}),
+			expectTemporary: true,
+		},
+		{
+			name: "permanent soap fault",
+			err:  soapFault(types.InvalidLogin{}),
+		},
+		{
+			name: "plain error",
+			err:  errors.New("plain error"),
+		},
+		{
+			name: "nil error",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if timeout := IsTimeout(test.err); timeout != test.expectTimeout {
+				t.Errorf("IsTimeout() = %t, expected %t", timeout, test.expectTimeout)
+			}
+			if temporary := IsTemporaryNetworkError(test.err); temporary != test.expectTemporary {
+				t.Errorf("IsTemporaryNetworkError() = %t, expected %t", temporary, test.expectTemporary)
+			}
+		})
+	}
+}
+
+func TestFaultClassifiers(t *testing.T) {
+	tests := []struct {
+		name                string
+		err                 error
+		expectDuplicateName bool
+		expectResourceInUse bool
+	}{
+		{
+			name:                "DuplicateName soap fault",
+			err:                 soapFault(types.DuplicateName{Name: "vm"}),
+			expectDuplicateName: true,
+		},
+		{
+			name:                "wrapped DuplicateName vim fault",
+			err:                 fmt.Errorf("create: %w", soap.WrapVimFault(&types.DuplicateName{Name: "vm"})),
+			expectDuplicateName: true,
+		},
+		{
+			name:                "ResourceInUse soap fault",
+			err:                 soapFault(types.ResourceInUse{Name: "disk"}),
+			expectResourceInUse: true,
+		},
+		{
+			name:                "wrapped ResourceInUse vim fault",
+			err:                 fmt.Errorf("create: %w", soap.WrapVimFault(&types.ResourceInUse{Name: "disk"})),
+			expectResourceInUse: true,
+		},
+		{
+			name: "other soap fault",
+			err:  soapFault(types.InvalidLogin{}),
+		},
+		{
+			name: "plain error",
+			err:  errors.New("plain error"),
+		},
+		{
+			name: "nil error",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if duplicate := IsDuplicateNameError(test.err); duplicate != test.expectDuplicateName {
+				t.Errorf("IsDuplicateNameError() = %t, expected %t", duplicate, test.expectDuplicateName)
+			}
+			if inUse := IsResourceInUseError(test.err); inUse != test.expectResourceInUse {
+				t.Errorf("IsResourceInUseError() = %t, expected %t", inUse, test.expectResourceInUse)
+			}
+		})
+	}
+}
+
+func TestNotFoundClassifiers(t *testing.T) {
+	tests := []struct {
+		name                        string
+		err                         error
+		expectNotFound              bool
+		expectManagedObjectNotFound bool
+		expectInvalidCredentialsErr bool
+	}{
+		{
+			name:           "finder not found",
+			err:            &find.NotFoundError{},
+			expectNotFound: true,
+		},
+		{
+			name:           "wrapped finder default not found",
+			err:            fmt.Errorf("lookup: %w", &find.DefaultNotFoundError{}),
+			expectNotFound: true,
+		},
+		{
+			name:                        "ManagedObjectNotFound soap fault",
+			err:                         soapFault(types.ManagedObjectNotFound{}),
+			expectManagedObjectNotFound: true,
+		},
+		{
+			name:                        "InvalidLogin soap fault",
+			err:                         soapFault(types.InvalidLogin{}),
+			expectInvalidCredentialsErr: true,
+		},
+		{
+			name: "no auth method configured",
+			err:  fmt.Errorf("%w for server vc", ErrNoAuthMethodConfigured),
+		},
+		{
+			name: "nil error",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if notFound := IsNotFound(test.err); notFound != test.expectNotFound {
+				t.Errorf("IsNotFound() = %t, expected %t", notFound, test.expectNotFound)
+			}
+			if notFound := IsManagedObjectNotFoundError(test.err); notFound != test.expectManagedObjectNotFound {
+				t.Errorf("IsManagedObjectNotFoundError() = %t, expected %t", notFound, test.expectManagedObjectNotFound)
+			}
+			if invalid := IsInvalidCredentialsError(test.err); invalid != test.expectInvalidCredentialsErr {
+				t.Errorf("IsInvalidCredentialsError() = %t, expected %t", invalid, test.expectInvalidCredentialsErr)
+			}
+		})
+	}
+}
+
+func TestIsNoPermissionError(t *testing.T) {
+	tests := []struct {
+		name               string
+		err                error
+		expectNoPermission bool
+		expectPrivileges   []string
+	}{
+		{
+			name: "missing privileges",
+			err: soapFault(types.NoPermission{
+				MissingPrivileges: []types.NoPermissionEntityPrivileges{
+					{
+						Entity:       types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"},
+						PrivilegeIds: []string{"Datastore.AllocateSpace", "Datastore.FileManagement"},
+					},
+					{
+						Entity:       types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+						PrivilegeIds: []string{"VirtualMachine.Config.AddExistingDisk", "Datastore.AllocateSpace"},
+					},
+				},
+			}),
+			expectNoPermission: true,
+			expectPrivileges:   []string{"Datastore.AllocateSpace", "Datastore.FileManagement", "VirtualMachine.Config.AddExistingDisk"},
+		},
+		{
+			name:               "deprecated privilege ID",
+			err:                fmt.Errorf("attach disk: %w", soapFault(types.NoPermission{PrivilegeId: "System.Read"})),
+			expectNoPermission: true,
+			expectPrivileges:   []string{"System.Read"},
+		},
+		{
+			name:               "vim fault",
+			err:                soap.WrapVimFault(&types.NoPermission{PrivilegeId: "System.View"}),
+			expectNoPermission: true,
+			expectPrivileges:   []string{"System.View"},
+		},
+		{
+			name: "other soap fault",
+			err:  soapFault(types.InvalidLogin{}),
+		},
+		{
+			name: "plain error",
+			err:  errors.New("plain error"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			noPermission, privileges := IsNoPermissionError(test.err)
+			if noPermission != test.expectNoPermission {
+				t.Errorf("IsNoPermissionError() = %t, expected %t", noPermission, test.expectNoPermission)
+			}
+			if !reflect.DeepEqual(privileges, test.expectPrivileges) {
+				t.Errorf("Expected privileges %v, got %v", test.expectPrivileges, privileges)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected ErrorCategory
+	}{
+		{"nil error", nil, ErrorCategoryUnknown},
+		{"plain error", errors.New("plain error"), ErrorCategoryUnknown},
+		{"finder not found", &find.NotFoundError{}, ErrorCategoryNotFound},
+		{"wrapped finder default not found", fmt.Errorf("lookup: %w", &find.DefaultNotFoundError{}), ErrorCategoryNotFound},
+		{"ManagedObjectNotFound soap fault", soapFault(types.ManagedObjectNotFound{}), ErrorCategoryNotFound},
+		{"InvalidLogin soap fault", soapFault(types.InvalidLogin{}), ErrorCategoryInvalidCredentials},
+		{"NoPermission vim fault", soap.WrapVimFault(&types.NoPermission{}), ErrorCategoryNoPermission},
+		{"Timedout soap fault", soapFault(types.Timedout{}), ErrorCategoryTimeout},
+		{"network timeout", &url.Error{Op: "Post", URL: "https://vc/sdk", Err: &net.DNSError{IsTimeout: true}}, ErrorCategoryTimeout},
+		{"HostCommunication soap fault", soapFault(types.HostCommunication{}), ErrorCategoryTransient},
+		{"temporary network error", &net.DNSError{IsTemporary: true}, ErrorCategoryTransient},
+		{"other soap fault", soapFault(types.InvalidArgument{}), ErrorCategoryUnknown},
+		{"no auth method configured", fmt.Errorf("%w for server vc", ErrNoAuthMethodConfigured), ErrorCategoryNoCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if category := ClassifyError(test.err); category != test.expected {
+				t.Errorf("ClassifyError() = %s, expected %s", category, test.expected)
+			}
+		})
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package vclib
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -84,6 +86,168 @@ func RegisterMetrics() {
 	prometheus.MustRegister(vsphereOperationErrorMetric)
 }
 
+var vsphereSessionsActive = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cloudprovider_vsphere_sessions_active",
+		Help: "Number of vCenter sessions held",
+	},
+	[]string{"server"},
+)
+
+var vsphereSessionsCreated = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudprovider_vsphere_sessions_created_total",
+		Help: "Number of vCenter sessions created",
+	},
+	[]string{"server"},
+)
+
+var vsphereSessionsClosed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudprovider_vsphere_sessions_closed_total",
+		Help: "Number of vCenter sessions closed by logout",
+	},
+	[]string{"server"},
+)
+
+// vsphereConnects counts Connect calls by whether the existing session was reused or a new one created.
+var vsphereConnects = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudprovider_vsphere_connects_total",
+		Help: "Number of vCenter connects by session reuse",
+	},
+	[]string{"server", "session"},
+)
+
+// vsphereConnectAttempts counts Connect and ClientOrConnect calls by result, e.g. to watch for
+// reconnect storms.
+var vsphereConnectAttempts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudprovider_vsphere_connect_attempts_total",
+		Help: "Number of vCenter connect attempts by result: success, error or rate_limited",
+	},
+	[]string{"server", "result"},
+)
+
+// vsphereInsecureFallbacks counts the connections made without certificate verification
+// because the certificate was not trusted, see TLSPolicyInsecureFallbackWithWarning.
+var vsphereInsecureFallbacks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cloudprovider_vsphere_tls_insecure_fallbacks_total",
+		Help: "Number of vCenter connections made without certificate verification after the certificate was not trusted",
+	},
+	[]string{"server"},
+)
+
+// vsphereCircuitBreakerState is the state of the circuit breaker of the connections,
+// see VSphereConnection.CircuitBreakerThreshold.
+var vsphereCircuitBreakerState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "cloudprovider_vsphere_circuit_breaker_state",
+		Help: "State of the vCenter circuit breaker: 0 closed, 1 open, 2 half-open",
+	},
+	[]string{"server"},
+)
+
+var (
+	registerSessionMetricsOnce sync.Once
+	sessionMetricsLock         sync.RWMutex
+	// sessionMetricsServers are the servers session metrics are recorded for
+	sessionMetricsServers = make(map[string]bool)
+)
+
+// RegisterSessionMetrics registers the vCenter session metrics and records them for the given
+// configured servers only, which keeps the cardinality of the server label bounded.
+// It can be called again to record the metrics for more servers. Insecure fallbacks are
+// recorded for any server, see recordInsecureFallback.
+func RegisterSessionMetrics(servers ...string) {
+	registerSessionMetrics()
+
+	sessionMetricsLock.Lock()
+	defer sessionMetricsLock.Unlock()
+	for _, server := range servers {
+		sessionMetricsServers[server] = true
+	}
+}
+
+// registerSessionMetrics registers the vCenter session metrics once
+func registerSessionMetrics() {
+	registerSessionMetricsOnce.Do(func() {
+		prometheus.MustRegister(vsphereSessionsActive)
+		prometheus.MustRegister(vsphereSessionsCreated)
+		prometheus.MustRegister(vsphereSessionsClosed)
+		prometheus.MustRegister(vsphereConnects)
+		prometheus.MustRegister(vsphereConnectAttempts)
+		prometheus.MustRegister(vsphereInsecureFallbacks)
+		prometheus.MustRegister(vsphereCircuitBreakerState)
+	})
+}
+
+func recordSessionMetrics(server string) bool {
+	sessionMetricsLock.RLock()
+	defer sessionMetricsLock.RUnlock()
+	return sessionMetricsServers[server]
+}
+
+func recordSessionCreated(server string) {
+	if recordSessionMetrics(server) {
+		vsphereSessionsCreated.WithLabelValues(server).Inc()
+		vsphereSessionsActive.WithLabelValues(server).Inc()
+	}
+}
+
+func recordSessionClosed(server string) {
+	if recordSessionMetrics(server) {
+		vsphereSessionsClosed.WithLabelValues(server).Inc()
+		vsphereSessionsActive.WithLabelValues(server).Dec()
+	}
+}
+
+// recordSessionExpired records a session that is no longer valid without being logged out
+func recordSessionExpired(server string) {
+	if recordSessionMetrics(server) {
+		vsphereSessionsActive.WithLabelValues(server).Dec()
+	}
+}
+
+func recordConnect(server string, reused bool) {
+	if !recordSessionMetrics(server) {
+		return
+	}
+	session := "new"
+	if reused {
+		session = "reused"
+	}
+	vsphereConnects.WithLabelValues(server, session).Inc()
+}
+
+func recordConnectAttempt(server string, err error) {
+	if !recordSessionMetrics(server) {
+		return
+	}
+	result := "success"
+	if errors.Is(err, ErrRateLimited) {
+		result = "rate_limited"
+	} else if err != nil {
+		result = "error"
+	}
+	vsphereConnectAttempts.WithLabelValues(server, result).Inc()
+}
+
+// recordInsecureFallback records a fallback for any server, not only those passed to
+// RegisterSessionMetrics, so that it is never silent. Only servers connected to with
+// TLSPolicyInsecureFallbackWithWarning can fall back, which bounds the server label.
+func recordInsecureFallback(server string) {
+	registerSessionMetrics()
+	vsphereInsecureFallbacks.WithLabelValues(server).Inc()
+}
+
+func recordCircuitBreakerState(server string, state circuitState) {
+	if recordSessionMetrics(server) {
+		vsphereCircuitBreakerState.WithLabelValues(server).Set(float64(state))
+	}
+}
+
 // RecordvSphereMetric records the vSphere API and Operation metrics
 func RecordvSphereMetric(actionName string, requestTime time.Time, err error) {
 	switch actionName {
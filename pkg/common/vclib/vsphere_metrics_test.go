@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vclib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmware/govmomi/simulator"
+)
+
+func TestSessionMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.RegisterEndpoints = true
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	// Only the configured server is recorded, the same vCenter reached through another
+	// hostname is not.
+	server := s.URL.Hostname()
+	unregistered := "localhost"
+	RegisterSessionMetrics(server)
+
+	newConnection := func(hostname string) *VSphereConnection {
+		return &VSphereConnection{
+			Hostname: hostname,
+			Port:     s.URL.Port(),
+			Insecure: true,
+			Username: simulator.DefaultLogin.Username(),
+			Password: func() string { p, _ := simulator.DefaultLogin.Password(); return p }(),
+		}
+	}
+
+	expect := func(step string, active, created, closed, connectsNew, connectsReused float64) {
+		t.Helper()
+		for name, tc := range map[string]struct{ got, expected float64 }{
+			"active":          {testutil.ToFloat64(vsphereSessionsActive.WithLabelValues(server)), active},
+			"created":         {testutil.ToFloat64(vsphereSessionsCreated.WithLabelValues(server)), created},
+			"closed":          {testutil.ToFloat64(vsphereSessionsClosed.WithLabelValues(server)), closed},
+			"connects new":    {testutil.ToFloat64(vsphereConnects.WithLabelValues(server, "new")), connectsNew},
+			"connects reused": {testutil.ToFloat64(vsphereConnects.WithLabelValues(server, "reused")), connectsReused},
+		} {
+			if tc.got != tc.expected {
+				t.Errorf("%s: expected %s sessions metric %v, got %v", step, name, tc.expected, tc.got)
+			}
+		}
+	}
+
+	connection := newConnection(server)
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("connect", 1, 1, 0, 1, 0)
+
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("reconnect", 1, 1, 0, 1, 1)
+
+	connection.Logout(ctx)
+	expect("logout", 0, 1, 1, 1, 1)
+
+	// The logged out session is replaced by a new one
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("connect after logout", 1, 2, 1, 2, 1)
+	connection.Logout(ctx)
+
+	other := newConnection(unregistered)
+	if err := other.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	other.Logout(ctx)
+	if n := testutil.CollectAndCount(vsphereSessionsCreated); n != 1 {
+		t.Errorf("Expected session metrics for the configured server only, got %d series", n)
+	}
+}
+
+func TestConnectAttemptMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("user", "pass")}
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	server := s.URL.Hostname()
+	RegisterSessionMetrics(server)
+	successes := vsphereConnectAttempts.WithLabelValues(server, "success")
+	failures := vsphereConnectAttempts.WithLabelValues(server, "error")
+	initialSuccesses, initialFailures := testutil.ToFloat64(successes), testutil.ToFloat64(failures)
+	expect := func(step string, expectedSuccesses, expectedFailures float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(successes) - initialSuccesses; got != expectedSuccesses {
+			t.Errorf("%s: expected %v successful connect attempts, got %v", step, expectedSuccesses, got)
+		}
+		if got := testutil.ToFloat64(failures) - initialFailures; got != expectedFailures {
+			t.Errorf("%s: expected %v failed connect attempts, got %v", step, expectedFailures, got)
+		}
+	}
+
+	connection := &VSphereConnection{
+		Hostname: server,
+		Port:     s.URL.Port(),
+		Insecure: true,
+		Username: "user",
+		Password: "pass",
+	}
+	if err := connection.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("connect", 1, 0)
+	if _, err := connection.ClientOrConnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("client or connect", 2, 0)
+	connection.Logout(ctx)
+
+	connection.UpdateCredentials("user", "wrong", "", "")
+	if err := connection.Connect(ctx); err == nil {
+		t.Fatal("Expected Connect to fail with invalid credentials")
+	}
+	expect("invalid credentials", 2, 1)
+
+	// The deadline covers the whole connect
+	connection.UpdateCredentials("user", "pass", "", "")
+	connection.ConnectDeadline = time.Nanosecond
+	if err := connection.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Connect to exceed its deadline, got %v", err)
+	}
+	expect("deadline exceeded", 2, 2)
+}
+
+func TestInsecureFallbackMetricsUnregisteredServer(t *testing.T) {
+	// Fallbacks are recorded for servers never passed to RegisterSessionMetrics
+	server := "unregistered-fallback.example.com"
+	fallbacks := vsphereInsecureFallbacks.WithLabelValues(server)
+	initial := testutil.ToFloat64(fallbacks)
+
+	recordInsecureFallback(server)
+	if got := testutil.ToFloat64(fallbacks) - initial; got != 1 {
+		t.Errorf("Expected 1 insecure fallback to be recorded, got %v", got)
+	}
+	if recordSessionMetrics(server) {
+		t.Error("Expected the session metrics not to be recorded for the server")
+	}
+}